@@ -0,0 +1,222 @@
+package godddns
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/*
+	ACL.go
+
+	This script check the source address of incoming requests against the
+	allow and deny lists of each operation, before the request is handled.
+	Entries are CIDRs (e.g. 203.0.113.0/24) or single addresses.
+
+	Deny lists are checked first: the request is refused if the address
+	matches the deny list of the operation or the default deny list. Then the
+	address must match the allow list of the operation, or the default allow
+	list if the operation has none. An empty allow list allows any address
+*/
+
+//AccessList is the addresses allowed and denied to send a type of request
+type AccessList struct {
+	Allow []string `json:",omitempty"` //CIDRs or addresses allowed, any address is allowed if empty
+	Deny  []string `json:",omitempty"` //CIDRs or addresses refused, checked before the allow list
+}
+
+//AccessControlOptions are the access lists of the requests to this router
+type AccessControlOptions struct {
+	DenyBogons bool       //Refuse unspecified, reserved, documentation and multicast source addresses. Private, loopback and link local addresses are not included
+	Default    AccessList //Checked for every operation. The allow list is only used by operations without their own
+	Connect    AccessList //Handshakes (opr=c, cs and cf)
+	HeartBeat  AccessList //Heartbeats (opr=h)
+	Sync       AccessList //Sync requests (opr=s)
+	Rotate     AccessList //Secret rotation requests (opr=r)
+	Revoke     AccessList //Revocation notices (opr=v)
+}
+
+//Addresses that never send legitimate requests. Private and link local ranges are left out as LAN clusters use them
+var bogonNetworks = mustParseCIDRs([]string{
+	"0.0.0.0/8",       //This network
+	"100.64.0.0/10",   //Carrier-grade NAT
+	"192.0.0.0/24",    //IETF protocol assignments
+	"192.0.2.0/24",    //Documentation
+	"198.18.0.0/15",   //Benchmarking
+	"198.51.100.0/24", //Documentation
+	"203.0.113.0/24",  //Documentation
+	"224.0.0.0/4",     //Multicast
+	"240.0.0.0/4",     //Reserved and broadcast
+	"::/128",          //Unspecified
+	"100::/64",        //Discard only
+	"2001:db8::/32",   //Documentation
+	"fec0::/10",       //Site local, deprecated
+	"ff00::/8",        //Multicast
+})
+
+//mustParseCIDRs parse the built-in network lists
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		network, err := parseAccessListEntry(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+//parseAccessListEntry parse a CIDR or a single address, which is treated as a network with the full mask
+func parseAccessListEntry(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("invalid access list entry: " + entry)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, errors.New("invalid access list entry: " + entry)
+	}
+	if isIPv4(ip) {
+		return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+//validate check if all entries of the access lists can be parsed
+func (o *AccessControlOptions) validate() error {
+	for _, list := range []AccessList{o.Default, o.Connect, o.HeartBeat, o.Sync, o.Rotate, o.Revoke} {
+		for _, entry := range append(append([]string{}, list.Allow...), list.Deny...) {
+			if _, err := parseAccessListEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//isEmpty check if no access list is set
+func (o *AccessControlOptions) isEmpty() bool {
+	if o.DenyBogons {
+		return false
+	}
+	for _, list := range []AccessList{o.Default, o.Connect, o.HeartBeat, o.Sync, o.Rotate, o.Revoke} {
+		if len(list.Allow) > 0 || len(list.Deny) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//getAccessList return the access list of the operation
+func (o *AccessControlOptions) getAccessList(operation string) AccessList {
+	switch operation {
+	case "connect":
+		return o.Connect
+	case "heartbeat":
+		return o.HeartBeat
+	case "sync":
+		return o.Sync
+	case "rotate":
+		return o.Rotate
+	case "revoke":
+		return o.Revoke
+	}
+	return AccessList{}
+}
+
+/*
+	matchAccessList
+
+	Return the first entry of the list matching the address. An entry that
+	cannot be parsed is returned with its error, the caller decides if it
+	should be treated as a match
+*/
+func matchAccessList(entries []string, ip net.IP) (string, error) {
+	for _, entry := range entries {
+		network, err := parseAccessListEntry(entry)
+		if err != nil {
+			return entry, err
+		}
+		if network.Contains(ip) {
+			return entry, nil
+		}
+	}
+	return "", nil
+}
+
+/*
+	checkAccessList
+
+	Check the source address of the request against the access lists of the
+	operation. Return the reason and the matching rule if the request is
+	refused, empty strings if it is allowed. Invalid deny entries refuse all
+	requests, so a typo never opens the router
+*/
+func (s *ServiceRouter) checkAccessList(operation string, remoteAddr string) (string, string) {
+	options := &AccessControlOptions{}
+	if s.Options != nil {
+		options = &s.Options.AccessControl
+	}
+	ip := net.ParseIP(trimIpPort(remoteAddr))
+	if ip == nil {
+		//Transports without addresses are fine as long as no list is set
+		if options.isEmpty() {
+			return "", ""
+		}
+		return "invalid source address", ""
+	}
+
+	if options.DenyBogons {
+		for _, network := range bogonNetworks {
+			if network.Contains(ip) {
+				return "bogon source address", network.String()
+			}
+		}
+	}
+
+	operationList := options.getAccessList(operation)
+	for _, denyList := range [][]string{options.Default.Deny, operationList.Deny} {
+		rule, err := matchAccessList(denyList, ip)
+		if err != nil {
+			return err.Error(), rule
+		}
+		if rule != "" {
+			return "denied by access list", rule
+		}
+	}
+
+	allowList := operationList.Allow
+	if len(allowList) == 0 {
+		allowList = options.Default.Allow
+	}
+	if len(allowList) == 0 {
+		return "", ""
+	}
+	rule, err := matchAccessList(allowList, ip)
+	if rule == "" || err != nil {
+		return "not in access list", ""
+	}
+	s.logger().Debug("request allowed by access list", logKeyOperation, operation, logKeyEndpoint, remoteAddr, "rule", rule)
+	return "", ""
+}
+
+//allowRequestSource reply 403 if the source address of the request is refused by the access lists
+func (s *ServiceRouter) allowRequestSource(w http.ResponseWriter, r *http.Request, operation string) bool {
+	reason, rule := s.checkAccessList(operation, r.RemoteAddr)
+	if reason == "" {
+		return true
+	}
+
+	s.metrics.inc(metricAccessDenied, "operation", operation)
+	s.logger().Warn("request denied by access list", logKeyOperation, operation, logKeyEndpoint, r.RemoteAddr, "rule", rule, logKeyError, reason)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("403 - Forbidden"))
+	return false
+}
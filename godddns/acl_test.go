@@ -0,0 +1,170 @@
+package godddns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAccessListEntry(t *testing.T) {
+	tests := []struct {
+		entry    string
+		expected string
+		valid    bool
+	}{
+		{"203.0.113.0/24", "203.0.113.0/24", true},
+		{"203.0.113.7/24", "203.0.113.0/24", true},
+		{" 198.51.100.1 ", "198.51.100.1/32", true},
+		{"2001:db8::/32", "2001:db8::/32", true},
+		{"2001:db8::1", "2001:db8::1/128", true},
+		{"::ffff:198.51.100.1", "198.51.100.1/32", true},
+		{"203.0.113.0/33", "", false},
+		{"example.com", "", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		network, err := parseAccessListEntry(test.entry)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("invalid entry %q accepted as %s", test.entry, network)
+			}
+			continue
+		}
+		if err != nil || network.String() != test.expected {
+			t.Errorf("entry %q parsed as %v, %v, expected %s", test.entry, network, err, test.expected)
+		}
+	}
+}
+
+func TestMatchAccessList(t *testing.T) {
+	entries := []string{"198.51.100.0/24", "2001:db8::/32"}
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"198.51.100.7", "198.51.100.0/24"},
+		{"::ffff:198.51.100.7", "198.51.100.0/24"},
+		{"2001:db8::7", "2001:db8::/32"},
+		{"203.0.113.7", ""},
+		{"2001:db9::7", ""},
+	}
+	for _, test := range tests {
+		rule, err := matchAccessList(entries, net.ParseIP(test.ip))
+		if err != nil || rule != test.expected {
+			t.Errorf("%s matched %q, %v, expected %q", test.ip, rule, err, test.expected)
+		}
+	}
+
+	if rule, err := matchAccessList([]string{"typo", "198.51.100.0/24"}, net.ParseIP("198.51.100.7")); err == nil || rule != "typo" {
+		t.Errorf("invalid entry not reported, matched %q", rule)
+	}
+}
+
+func TestCheckAccessList(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{
+		DeviceUUID: "thisNode",
+		Logger:     &recordLogger{},
+		AccessControl: AccessControlOptions{
+			Default:   AccessList{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.66"}},
+			HeartBeat: AccessList{Allow: []string{"198.51.100.0/24"}, Deny: []string{"198.51.100.66"}},
+		},
+	})
+	tests := []struct {
+		operation  string
+		remoteAddr string
+		allowed    bool
+	}{
+		{"connect", "10.1.2.3:40000", true},
+		{"connect", "198.51.100.7:40000", false}, //Only in the allow list of heartbeats
+		{"connect", "10.0.0.66:40000", false},
+		{"heartbeat", "198.51.100.7:40000", true},
+		{"heartbeat", "[::ffff:198.51.100.7]:40000", true},
+		{"heartbeat", "10.1.2.3:40000", false}, //The operation list replaces the default allow list
+		{"heartbeat", "198.51.100.66:40000", false},
+		{"heartbeat", "10.0.0.66:40000", false}, //The default deny list applies to every operation
+		{"sync", "10.1.2.3:40000", true},
+		{"sync", "not an address", false},
+	}
+	for _, test := range tests {
+		reason, rule := router.checkAccessList(test.operation, test.remoteAddr)
+		if allowed := reason == ""; allowed != test.allowed {
+			t.Errorf("%s from %s allowed: %t (%s %s), expected %t", test.operation, test.remoteAddr, allowed, reason, rule, test.allowed)
+		}
+	}
+}
+
+func TestCheckAccessListInvalidDenyEntry(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{
+		DeviceUUID:    "thisNode",
+		Logger:        &recordLogger{},
+		AccessControl: AccessControlOptions{Sync: AccessList{Deny: []string{"198.51.100.0/33"}}},
+	})
+	if reason, _ := router.checkAccessList("sync", "203.0.113.7:40000"); reason == "" {
+		t.Error("request allowed with an invalid deny entry")
+	}
+	if reason, _ := router.checkAccessList("heartbeat", "203.0.113.7:40000"); reason != "" {
+		t.Errorf("invalid deny entry of another operation refused the request: %s", reason)
+	}
+}
+
+func TestCheckAccessListWithoutLists(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode", Logger: &recordLogger{}})
+	for _, remoteAddr := range []string{"203.0.113.7:40000", "[2001:db8::7]:40000", "pipe"} {
+		if reason, _ := router.checkAccessList("heartbeat", remoteAddr); reason != "" {
+			t.Errorf("request from %s refused without access lists: %s", remoteAddr, reason)
+		}
+	}
+}
+
+func TestDenyBogons(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{
+		DeviceUUID:    "thisNode",
+		Logger:        &recordLogger{},
+		AccessControl: AccessControlOptions{DenyBogons: true},
+	})
+	tests := []struct {
+		remoteAddr string
+		allowed    bool
+	}{
+		{"0.0.0.0:40000", false},
+		{"100.64.1.1:40000", false},
+		{"192.0.2.1:40000", false},
+		{"203.0.113.7:40000", false},
+		{"224.0.0.1:40000", false},
+		{"255.255.255.255:40000", false},
+		{"[::]:40000", false},
+		{"[2001:db8::7]:40000", false},
+		{"[ff02::1]:40000", false},
+		{"[::ffff:203.0.113.7]:40000", false},
+		{"8.8.8.8:40000", true},
+		{"[2606:4700::1111]:40000", true},
+
+		//LAN clusters use private, loopback and link local addresses
+		{"10.0.0.1:40000", true},
+		{"192.168.1.1:40000", true},
+		{"127.0.0.1:40000", true},
+		{"169.254.1.1:40000", true},
+		{"[fd00::1]:40000", true},
+		{"[fe80::1]:40000", true},
+		{"[::1]:40000", true},
+	}
+	for _, test := range tests {
+		reason, _ := router.checkAccessList("heartbeat", test.remoteAddr)
+		if allowed := reason == ""; allowed != test.allowed {
+			t.Errorf("%s allowed: %t (%s), expected %t", test.remoteAddr, allowed, reason, test.allowed)
+		}
+	}
+}
+
+func TestAccessControlOptionsValidate(t *testing.T) {
+	valid := AccessControlOptions{
+		Default: AccessList{Allow: []string{"10.0.0.0/8", "2001:db8::1"}},
+		Revoke:  AccessList{Deny: []string{"198.51.100.66"}},
+	}
+	if err := valid.validate(); err != nil {
+		t.Errorf("valid access lists refused: %v", err)
+	}
+	invalid := AccessControlOptions{Rotate: AccessList{Deny: []string{"10.0.0.0/8", "10.0.0.256"}}}
+	if err := invalid.validate(); err == nil {
+		t.Error("invalid deny entry accepted")
+	}
+}
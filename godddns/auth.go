@@ -0,0 +1,152 @@
+package godddns
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+	Auth.go
+
+	This script handle the authentication of the nodes joining this router.
+	An Authenticator receive the full credential and the request of the
+	handshake, so it can consider the joining node UUID, its source address
+	or the TLS client certificate. The permissions returned are stored with
+	the TOTP record of the node and checked on every heartbeat, sync and
+	revocation request
+*/
+
+//Permission is the set of operations a registered node is allowed to perform on this router
+type Permission int
+
+const (
+	PermissionHeartbeat Permission = 1 << iota //Send heartbeats to this router and have its address updated
+	PermissionSync                             //Ask this router for the address of other nodes
+	PermissionRevoke                           //Issue revocations of other nodes to this router. Never granted by default, as it allows to remove any node from the cluster
+	PermissionRotate                           //Ask this router for a new TOTP secret
+
+	PermissionNone Permission = 0
+	PermissionAll             = PermissionHeartbeat | PermissionSync | PermissionRotate //The permissions granted by default, PermissionRevoke has to be granted explicitly
+)
+
+//Has return true if all the given permissions are granted
+func (p Permission) Has(permission Permission) bool {
+	return p&permission == permission
+}
+
+func (p Permission) String() string {
+	if p == PermissionNone {
+		return "none"
+	}
+	names := []string{}
+	if p.Has(PermissionHeartbeat) {
+		names = append(names, "heartbeat")
+	}
+	if p.Has(PermissionSync) {
+		names = append(names, "sync")
+	}
+	if p.Has(PermissionRevoke) {
+		names = append(names, "revoke")
+	}
+	if p.Has(PermissionRotate) {
+		names = append(names, "rotate")
+	}
+	return strings.Join(names, ",")
+}
+
+//AuthRequest is the handshake request to be authenticated
+type AuthRequest struct {
+	Credential Credential    //The UUID, username and password sent by the joining node
+	RemoteAddr string        //The source address of the handshake
+	Request    *http.Request //The handshake request, e.g. for the TLS client certificate
+
+	PasswordVerified bool //The password is verified by the challenge-response join, Credential.Password is empty
+}
+
+//AuthResult is the result of a successful authentication
+type AuthResult struct {
+	Permissions Permission //The operations the node is allowed to perform on this router
+}
+
+//Authenticator decide if a node can join this router. Return an error with the reason to reject the node
+type Authenticator interface {
+	Authenticate(request *AuthRequest) (*AuthResult, error)
+}
+
+//AuthenticatorFunc is an adapter to use an ordinary function as Authenticator
+type AuthenticatorFunc func(request *AuthRequest) (*AuthResult, error)
+
+func (f AuthenticatorFunc) Authenticate(request *AuthRequest) (*AuthResult, error) {
+	return f(request)
+}
+
+//ErrInvalidCredential is returned by the AuthFunction adapter if the username or password is incorrect
+var ErrInvalidCredential = errors.New("incorrect username or password")
+
+//authFunctionAuthenticator adapt the username and password AuthFunction to Authenticator
+type authFunctionAuthenticator struct {
+	authFunction func(string, string) bool
+}
+
+func (a *authFunctionAuthenticator) Authenticate(request *AuthRequest) (*AuthResult, error) {
+	if request.PasswordVerified {
+		return &AuthResult{Permissions: PermissionAll}, nil
+	}
+	if !a.authFunction(request.Credential.Username, request.Credential.Password) {
+		return nil, ErrInvalidCredential
+	}
+	return &AuthResult{Permissions: PermissionAll}, nil
+}
+
+//scramCredentialAuthenticator check the password join against the challenge-response verifiers
+type scramCredentialAuthenticator struct {
+	credentialFunction func(string) *ScramCredential
+}
+
+func (a *scramCredentialAuthenticator) Authenticate(request *AuthRequest) (*AuthResult, error) {
+	if request.PasswordVerified {
+		return &AuthResult{Permissions: PermissionAll}, nil
+	}
+	credential := a.credentialFunction(request.Credential.Username)
+	if credential == nil || !credential.Verify(request.Credential.Password) {
+		return nil, ErrInvalidCredential
+	}
+	return &AuthResult{Permissions: PermissionAll}, nil
+}
+
+/*
+	getAuthenticator
+
+	Return the authenticator of this router. AuthFunction is used if no
+	authenticator is set, then the verifiers of the challenge-response join.
+	Return nil if none is set
+*/
+func (s *ServiceRouter) getAuthenticator() Authenticator {
+	if s.Options.Authenticator != nil {
+		return s.Options.Authenticator
+	}
+	if s.Options.AuthFunction != nil {
+		return &authFunctionAuthenticator{authFunction: s.Options.AuthFunction}
+	}
+	if s.Options.ScramCredentialFunction != nil {
+		return &scramCredentialAuthenticator{credentialFunction: s.Options.ScramCredentialFunction}
+	}
+	return nil
+}
+
+//Inject an authenticator into an imported service router
+func (s *ServiceRouter) InjectAuthenticator(authenticator Authenticator) {
+	s.Options.Authenticator = authenticator
+}
+
+//getNodePermissions return the permissions granted to the node with given UUID, PermissionNone if not registered
+func (s *ServiceRouter) getNodePermissions(nodeUUID string) Permission {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	position := s.totpMapExists(nodeUUID)
+	if position < 0 {
+		return PermissionNone
+	}
+	return s.TOTPMap[position].Permissions
+}
@@ -0,0 +1,114 @@
+package godddns_test
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+func TestAuthenticatorPermissions(t *testing.T) {
+	granted := map[string]godddns.Permission{
+		"heartbeat": godddns.PermissionHeartbeat,
+		"sync":      godddns.PermissionSync,
+		"rotate":    godddns.PermissionRotate,
+		"all":       godddns.PermissionAll,
+	}
+	requests := map[string]*godddns.AuthRequest{}
+	requestsMux := sync.Mutex{}
+
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0)})
+	router, err := network.AddNodeWithOptions("router", "203.0.113.1", func(options *godddns.RouterOptions) {
+		options.Authenticator = godddns.AuthenticatorFunc(func(request *godddns.AuthRequest) (*godddns.AuthResult, error) {
+			requestsMux.Lock()
+			requests[request.Credential.NodeUUID] = request
+			requestsMux.Unlock()
+			permissions, ok := granted[request.Credential.NodeUUID]
+			if !ok {
+				return nil, errors.New("unknown node")
+			}
+			return &godddns.AuthResult{Permissions: permissions}, nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, uuid := range []string{"heartbeat", "sync", "rotate", "all", "unknown"} {
+		if _, err := network.AddNode(uuid, "203.0.113."+strconv.Itoa(i+2)); err != nil {
+			t.Fatal(err)
+		}
+		if err := network.Connect("router", uuid); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//The authenticator decides who may join and with which permissions
+	if err := network.Connect("unknown", "router"); err == nil {
+		t.Error("node rejected by the authenticator joined")
+	}
+	for uuid, permissions := range granted {
+		if err := network.Connect(uuid, "router"); err != nil {
+			t.Fatal(err)
+		}
+		if stored := router.Router.NodePermissions(uuid); stored != permissions {
+			t.Errorf("permissions of %s stored as %s, expected %s", uuid, stored, permissions)
+		}
+		request := requests[uuid]
+		if request == nil || request.RemoteAddr == "" || !strings.HasPrefix(request.RemoteAddr, network.GetIP(uuid).String()+":") {
+			t.Errorf("authenticator called for %s with %+v", uuid, request)
+		} else if !request.PasswordVerified || request.Credential.Password != "" {
+			t.Errorf("password of %s sent to the authenticator instead of the challenge-response join", uuid)
+		}
+	}
+
+	//Each operation is only permitted with its permission
+	for uuid, permissions := range granted {
+		node, _ := network.GetNode(uuid)
+		err := node.Router.HeartBeatToNode("router")
+		if permissions.Has(godddns.PermissionHeartbeat) != (err == nil) {
+			t.Errorf("heartbeat of %s with %s returned %v", uuid, permissions, err)
+		}
+
+		syncedIP, err := node.Router.ResolveNodeIP("unknown", "router")
+		if permissions.Has(godddns.PermissionSync) != (err == nil) {
+			t.Errorf("sync of %s with %s returned %v", uuid, permissions, err)
+		} else if err == nil && !syncedIP.Equal(network.GetIP("unknown")) {
+			t.Errorf("sync of %s returned %s", uuid, syncedIP)
+		}
+
+		remoteNode, _ := node.Router.GetNodeByUUID("router")
+		err = remoteNode.RotateSecret()
+		if permissions.Has(godddns.PermissionRotate) && err != nil {
+			t.Errorf("rotation of %s with %s refused: %v", uuid, permissions, err)
+		} else if !permissions.Has(godddns.PermissionRotate) && err != godddns.ErrRotationNotPermitted {
+			t.Errorf("rotation of %s with %s returned %v", uuid, permissions, err)
+		}
+	}
+}
+
+func TestAuthFunctionGrantsDefaultPermissions(t *testing.T) {
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0)})
+	router, err := network.AddNode("router", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.AddNode("node", "203.0.113.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.Connect("node", "router"); err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := router.Router.NodePermissions("node")
+	if permissions != godddns.PermissionAll || permissions.Has(godddns.PermissionRevoke) {
+		t.Errorf("default permissions %s, expected %s without revoke", permissions, godddns.PermissionAll)
+	}
+	if router.Router.NodePermissions("unregistered") != godddns.PermissionNone {
+		t.Error("permissions granted to an unregistered node")
+	}
+}
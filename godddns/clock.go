@@ -0,0 +1,65 @@
+package godddns
+
+import (
+	"time"
+)
+
+/*
+	Clock.go
+
+	All time related logic of the router (TOTP, last online bookkeeping, the
+	heartbeat scheduler and the delayed saves) read the time from the clock set in RouterOptions,
+	so they can be driven by a controllable clock in tests and simulations
+*/
+
+//Clock provide the current time and tickers to the router
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+//Ticker deliver ticks on its channel at every interval until stopped
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+//The default clock using the system time
+type systemClock struct{}
+
+type systemTicker struct {
+	ticker *time.Ticker
+}
+
+var defaultClock Clock = &systemClock{}
+
+func (c *systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *systemClock) NewTicker(d time.Duration) Ticker {
+	return &systemTicker{
+		ticker: time.NewTicker(d),
+	}
+}
+
+func (t *systemTicker) Chan() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t *systemTicker) Stop() {
+	t.ticker.Stop()
+}
+
+//getClock return the clock of this router, fallback to system clock if not set
+func (s *ServiceRouter) getClock() Clock {
+	if s.Options != nil && s.Options.Clock != nil {
+		return s.Options.Clock
+	}
+	return defaultClock
+}
+
+//now return the current time of this router's clock
+func (s *ServiceRouter) now() time.Time {
+	return s.getClock().Now()
+}
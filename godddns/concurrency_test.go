@@ -0,0 +1,82 @@
+package godddns_test
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+/*
+	Run with -race to check that the heartbeat cycles and the accessors
+	of the router can be used at the same time
+*/
+func TestConcurrentAccess(t *testing.T) {
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0), Seed: 1})
+	for i, uuid := range []string{"a", "b", "c"} {
+		if _, err := network.AddNode(uuid, "203.0.113."+strconv.Itoa(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := network.GetNode("a")
+	router := nodeA.Router
+
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			network.SetIP("a", "203.0.113."+strconv.Itoa(100+i))
+			network.RunCycles(1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			router.AddNode(router.NewNode(godddns.NodeOptions{NodeID: "d", Port: 8080, RESTInterface: "/godddns"}))
+			router.RemoveNode("d")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			router.SetIpChangeEventListener(func(net.IP) {})
+			router.GetDeviceIpAddr()
+			router.GetDeviceIpAddrByFamily()
+			router.NodeConnected("b")
+			router.IsOrphan()
+			for _, uuid := range router.GetNeighbourNodes() {
+				router.GetNodeIP(uuid)
+				if node, err := router.GetNodeByUUID(uuid); err == nil {
+					node.GetReflectedIP()
+					node.GetLastOnline()
+					node.GetRetryCount()
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	if err := network.CheckConvergence(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+package godddns
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	Config.go
+
+	This script handle the versioning of the exported router config.
+	Every exported config carry a Version field. Configs of older versions
+	(including the unversioned layout written before versioning is added)
+	are migrated step by step to the current version before they are
+	validated and loaded
+*/
+
+//The version of the config written by this version of go-DDDNS
+const configVersion = 2
+
+/*
+	configMigrations
+
+	configMigrations[i] migrate a config of version i to version i + 1.
+	The config is given as the decoded JSON object so fields can be renamed
+	or moved before the config is decoded into the current layout
+*/
+var configMigrations = []func(config map[string]interface{}) error{
+	migrateConfigV0ToV1,
+	migrateConfigV1ToV2,
+}
+
+//ConfigValidationError list all the problems found in a config
+type ConfigValidationError struct {
+	Problems []string
+}
+
+func (e *ConfigValidationError) Error() string {
+	return "invalid router config: " + strings.Join(e.Problems, "; ")
+}
+
+//migrateConfig upgrade the config to the current version and return the migrated JSON
+func migrateConfig(jsonConfig []byte) ([]byte, error) {
+	config := map[string]interface{}{}
+	err := json.Unmarshal(jsonConfig, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if rawVersion, ok := config["Version"]; ok && rawVersion != nil {
+		floatVersion, ok := rawVersion.(float64)
+		if !ok || floatVersion < 0 || floatVersion != float64(int(floatVersion)) {
+			return nil, fmt.Errorf("invalid config version: %v", rawVersion)
+		}
+		version = int(floatVersion)
+	}
+
+	if version > configVersion {
+		return nil, fmt.Errorf("config version %d is newer than the supported version %d", version, configVersion)
+	}
+	if version == configVersion {
+		return jsonConfig, nil
+	}
+
+	for ; version < configVersion; version++ {
+		err = configMigrations[version](config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to migrate config from version %d: %w", version, err)
+		}
+		config["Version"] = version + 1
+	}
+	return json.Marshal(config)
+}
+
+/*
+	migrateConfigV0ToV1
+
+	The unversioned config is the JSON form of the ServiceRouter struct. The
+	layout is kept in version 1, only the defaults that were not written by
+	the older versions are filled in
+*/
+func migrateConfigV0ToV1(config map[string]interface{}) error {
+	if value, ok := config["ConnectionRetryWaitTimeMin"].(float64); !ok || value == 0 {
+		config["ConnectionRetryWaitTimeMin"] = 10
+	}
+	if value, ok := config["ConnectionRetryWaitTimeMax"].(float64); !ok || value == 0 {
+		config["ConnectionRetryWaitTimeMax"] = 120
+	}
+
+	nodeMap, _ := config["NodeMap"].([]interface{})
+	for _, thisNode := range nodeMap {
+		nodeConfig, ok := thisNode.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		//Older versions did not normalize the REST interface of imported nodes
+		if restInterface, ok := nodeConfig["RESTfulInterface"].(string); ok && restInterface != "" {
+			nodeConfig["RESTfulInterface"] = filepath.ToSlash(filepath.Clean(restInterface))
+		}
+	}
+	return nil
+}
+
+/*
+	migrateConfigV1ToV2
+
+	Version 2 store the permissions of each registered node in its TOTP record
+	and add the revocation list, so older versions refuse the config instead
+	of loading it and forgetting the revoked nodes. Nodes registered before
+	permissions are added keep doing what they could do before (heartbeat,
+	sync and rotating their secret), PermissionRevoke is only granted explicitly
+*/
+func migrateConfigV1ToV2(config map[string]interface{}) error {
+	totpMap, _ := config["TOTPMap"].([]interface{})
+	for _, record := range totpMap {
+		recordConfig, ok := record.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := recordConfig["Permissions"]; !ok {
+			recordConfig["Permissions"] = int(PermissionAll)
+		}
+	}
+	return nil
+}
+
+//validate check the snapshot for problems that prevent the router from working
+func (snapshot *routerSnapshot) validate() error {
+	problems := []string{}
+
+	if snapshot.Options == nil {
+		problems = append(problems, "options is missing")
+	} else {
+		if strings.TrimSpace(snapshot.Options.DeviceUUID) == "" {
+			problems = append(problems, "device UUID is missing")
+		}
+		if snapshot.Options.SyncInterval < 0 {
+			problems = append(problems, "sync interval is negative")
+		}
+		if err := snapshot.Options.TOTP.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := snapshot.Options.AccessControl.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if _, err := parseTrustedProxies(snapshot.Options.TrustedProxies); err != nil {
+			problems = append(problems, err.Error())
+		}
+		if err := validateForwardedHeader(snapshot.Options.ForwardedHeader); err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, adminKey := range snapshot.Options.Revocation.AdminKeys {
+			if len(adminKey) != ed25519.PublicKeySize {
+				problems = append(problems, "invalid revocation admin key")
+			}
+		}
+	}
+
+	nodeUUIDs := map[string]bool{}
+	for i, thisNode := range snapshot.NodeMap {
+		nodeName := "node " + strconv.Itoa(i)
+		if thisNode == nil {
+			problems = append(problems, nodeName+" is empty")
+			continue
+		}
+		if strings.TrimSpace(thisNode.UUID) == "" {
+			problems = append(problems, nodeName+" has no UUID")
+		} else {
+			nodeName = "node " + thisNode.UUID
+			if nodeUUIDs[thisNode.UUID] {
+				problems = append(problems, "duplicate "+nodeName)
+			}
+			nodeUUIDs[thisNode.UUID] = true
+			if snapshot.Options != nil && thisNode.UUID == snapshot.Options.DeviceUUID {
+				problems = append(problems, nodeName+" has the same UUID as this device")
+			}
+		}
+		if thisNode.Port <= 0 || thisNode.Port > 65535 {
+			problems = append(problems, nodeName+" has invalid port "+strconv.Itoa(thisNode.Port))
+		}
+		if thisNode.RetryCount < 0 {
+			problems = append(problems, nodeName+" has negative retry count")
+		}
+		if !isValidPublicKey(thisNode.PublicKey) {
+			problems = append(problems, nodeName+" has invalid public key")
+		}
+		if thisNode.TOTPParameters != nil && thisNode.TOTPParameters.validate() != nil {
+			problems = append(problems, nodeName+" has unsupported TOTP parameters")
+		}
+	}
+
+	recordUUIDs := map[string]bool{}
+	for i, record := range snapshot.TOTPMap {
+		if record == nil {
+			problems = append(problems, "TOTP record "+strconv.Itoa(i)+" is empty")
+			continue
+		}
+		if strings.TrimSpace(record.RemoteUUID) == "" {
+			problems = append(problems, "TOTP record "+strconv.Itoa(i)+" has no UUID")
+			continue
+		}
+		if recordUUIDs[record.RemoteUUID] {
+			problems = append(problems, "duplicate TOTP record of node "+record.RemoteUUID)
+		}
+		if !isValidPublicKey(record.PublicKey) {
+			problems = append(problems, "TOTP record of node "+record.RemoteUUID+" has invalid public key")
+		}
+		if record.Parameters.validate() != nil || record.PreviousParameters.validate() != nil {
+			problems = append(problems, "TOTP record of node "+record.RemoteUUID+" has unsupported TOTP parameters")
+		}
+		recordUUIDs[record.RemoteUUID] = true
+	}
+
+	revokedUUIDs := map[string]bool{}
+	for i, revocation := range snapshot.Revocations {
+		if revocation == nil || strings.TrimSpace(revocation.NodeUUID) == "" {
+			problems = append(problems, "revocation "+strconv.Itoa(i)+" has no UUID")
+			continue
+		}
+		if revokedUUIDs[revocation.NodeUUID] {
+			problems = append(problems, "duplicate revocation of node "+revocation.NodeUUID)
+		}
+		if nodeUUIDs[revocation.NodeUUID] || recordUUIDs[revocation.NodeUUID] {
+			problems = append(problems, "node "+revocation.NodeUUID+" is revoked but still registered")
+		}
+		revokedUUIDs[revocation.NodeUUID] = true
+	}
+
+	if snapshot.ConnectionRetryWaitTimeMin < 0 || snapshot.ConnectionRetryWaitTimeMax < snapshot.ConnectionRetryWaitTimeMin {
+		problems = append(problems, "invalid connection retry wait time")
+	}
+
+	if len(problems) > 0 {
+		return &ConfigValidationError{Problems: problems}
+	}
+	return nil
+}
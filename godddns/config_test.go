@@ -0,0 +1,136 @@
+package godddns
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//An unversioned config as written before the config layout is versioned
+const testConfigV0 = `{
+	"NodeMap": [{
+		"UUID": "node1",
+		"IpAddr": "203.0.113.1",
+		"Port": 8080,
+		"RESTfulInterface": "godddns//api/../",
+		"SendTotpSecret": "JBSWY3DPEHPK3PXP"
+	}],
+	"TOTPMap": [{
+		"RemoteUUID": "node1",
+		"RecvTOTPSecret": "KRSXG5CTMVRXEZLU"
+	}],
+	"Options": {
+		"DeviceUUID": "thisNode",
+		"SyncInterval": 10
+	}
+}`
+
+func TestMigrateConfigFromV0(t *testing.T) {
+	router, err := NewRouterFromJSON(testConfigV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if router.ConnectionRetryWaitTimeMin != 10 || router.ConnectionRetryWaitTimeMax != 120 {
+		t.Errorf("retry wait time defaults not filled in: %d - %d", router.ConnectionRetryWaitTimeMin, router.ConnectionRetryWaitTimeMax)
+	}
+	if node := router.getNodeByUUID("node1"); node == nil || node.RESTfulInterface != "godddns" {
+		t.Errorf("REST interface of the node not normalized")
+	}
+
+	//Nodes registered before permissions existed keep doing everything they could, but never revoke
+	permissions := router.getNodePermissions("node1")
+	if permissions != PermissionAll {
+		t.Errorf("migrated permissions %s, expected %s", permissions, PermissionAll)
+	}
+	if permissions.Has(PermissionRevoke) {
+		t.Error("PermissionRevoke granted by the migration")
+	}
+}
+
+//configWithVersion return the test config with the given version and the permissions of node1 if given
+func configWithVersion(t *testing.T, version int, permissions ...Permission) string {
+	t.Helper()
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(testConfigV0), &config); err != nil {
+		t.Fatal(err)
+	}
+	config["Version"] = version
+	for _, permission := range permissions {
+		config["TOTPMap"].([]interface{})[0].(map[string]interface{})["Permissions"] = int(permission)
+	}
+	js, _ := json.Marshal(config)
+	return string(js)
+}
+
+func TestMigrateConfigPermissions(t *testing.T) {
+	//Version 1 has no permissions, the nodes keep everything but revocation
+	router, err := NewRouterFromJSON(configWithVersion(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if permissions := router.getNodePermissions("node1"); permissions != PermissionHeartbeat|PermissionSync|PermissionRotate {
+		t.Errorf("version 1 permissions migrated to %s, expected heartbeat, sync and rotate", permissions)
+	}
+
+	//Permissions stored by the current version are never changed
+	for _, stored := range []Permission{PermissionHeartbeat, PermissionSync, PermissionHeartbeat | PermissionRevoke} {
+		router, err := NewRouterFromJSON(configWithVersion(t, configVersion, stored))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if permissions := router.getNodePermissions("node1"); permissions != stored {
+			t.Errorf("stored permissions %s loaded as %s", stored, permissions)
+		}
+	}
+}
+
+func TestMigrateConfigRefusesNewerVersion(t *testing.T) {
+	_, err := NewRouterFromJSON(configWithVersion(t, configVersion+1, PermissionAll))
+	if err == nil || !strings.Contains(err.Error(), "newer than the supported version") {
+		t.Errorf("config of a newer version accepted: %v", err)
+	}
+
+	_, err = NewRouterFromJSON(strings.Replace(testConfigV0, "{", `{"Version": 1.5,`, 1))
+	if err == nil {
+		t.Error("config with invalid version accepted")
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	router, err := NewRouterFromJSON(testConfigV0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := router.ExportRouterToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(js, `"Version": `+strconv.Itoa(configVersion)) {
+		t.Errorf("exported config is not written with the current version")
+	}
+
+	imported, err := NewRouterFromJSON(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.getTotpSecret("node1") != "KRSXG5CTMVRXEZLU" || imported.getNodePermissions("node1") != PermissionAll {
+		t.Error("TOTP record changed by export and import")
+	}
+	if !imported.PublicKey().Equal(router.PublicKey()) {
+		t.Error("identity key changed by export and import")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := strings.Replace(testConfigV0, `"Port": 8080`, `"Port": 70000`, 1)
+	config = strings.Replace(config, `"DeviceUUID": "thisNode"`, `"DeviceUUID": ""`, 1)
+	_, err := NewRouterFromJSON(config)
+	validationError, ok := err.(*ConfigValidationError)
+	if !ok {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if len(validationError.Problems) != 2 {
+		t.Errorf("expected 2 problems, got %v", validationError.Problems)
+	}
+}
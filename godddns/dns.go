@@ -0,0 +1,454 @@
+package godddns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	DNS.go
+
+	This script implements an optional authoritative DNS responder that
+	answers A / AAAA queries of <uuid>.<cluster-zone> from the live node map
+	of the router, so tools and services not written in Go can resolve the
+	nodes in the cluster by name. The responder listen on both UDP and TCP
+*/
+
+type DNSServerOptions struct {
+	Zone        string   //The zone of the cluster, e.g. cluster.example.com
+	ListenAddr  string   //The address to listen on for both UDP and TCP, default ":53"
+	TTL         uint32   //TTL of the A / AAAA records in seconds, default 60
+	NegativeTTL uint32   //TTL of negative answers (SOA minimum) in seconds, default 30
+	NameServers []string //The name servers of the zone, default <DeviceUUID>.<zone>
+	Hostmaster  string   //The mailbox of the zone admin in SOA record, default hostmaster.<zone>
+}
+
+type DNSServer struct {
+	router      *ServiceRouter
+	options     DNSServerOptions
+	zone        string
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+
+	serial         uint32 //The SOA serial, increased every time the records changed
+	recordSnapshot string //The snapshot of the records when the serial was last updated
+	mux            sync.Mutex
+	closeOnce      sync.Once
+	wg             sync.WaitGroup
+}
+
+const (
+	dnsMaxUDPSize     = 512
+	dnsEDNSUDPSize    = 1232
+	dnsTCPIdleTimeout = 10 * time.Second
+)
+
+/*
+	StartDNSServer
+
+	Start the DNS responder of this router with the given options.
+	The server will be stopped when the router is closed or DNSServer.Close is called
+*/
+func (s *ServiceRouter) StartDNSServer(options DNSServerOptions) (*DNSServer, error) {
+	if strings.TrimSpace(options.Zone) == "" {
+		return nil, errors.New("dns zone is not set")
+	}
+	if options.ListenAddr == "" {
+		options.ListenAddr = ":53"
+	}
+	if options.TTL == 0 {
+		options.TTL = 60
+	}
+	if options.NegativeTTL == 0 {
+		options.NegativeTTL = 30
+	}
+
+	zone := canonicalDNSName(options.Zone)
+	if len(options.NameServers) == 0 {
+		options.NameServers = []string{s.Options.DeviceUUID + "." + zone}
+	}
+	if options.Hostmaster == "" {
+		options.Hostmaster = "hostmaster." + zone
+	}
+
+	//Make sure all the names can be encoded before the server start
+	for _, name := range append([]string{zone, options.Hostmaster}, options.NameServers...) {
+		if _, err := appendDNSName([]byte{}, name); err != nil {
+			return nil, err
+		}
+	}
+
+	udpConn, err := net.ListenPacket("udp", options.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	//Listen TCP on the same port as UDP, in case a random port (:0) is given
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	d := &DNSServer{
+		router:      s,
+		options:     options,
+		zone:        zone,
+		udpConn:     udpConn,
+		tcpListener: tcpListener,
+	}
+
+	d.wg.Add(2)
+	go d.serveUDP()
+	go d.serveTCP()
+
+	s.mux.Lock()
+	s.dnsServers = append(s.dnsServers, d)
+	s.mux.Unlock()
+
+	s.logger().Info("dns responder started", logKeyOperation, "dns", "zone", zone, logKeyEndpoint, udpConn.LocalAddr().String())
+	return d, nil
+}
+
+//Addr return the address the DNS server is listening on
+func (d *DNSServer) Addr() net.Addr {
+	return d.udpConn.LocalAddr()
+}
+
+//Close stop the DNS server
+func (d *DNSServer) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		err = d.udpConn.Close()
+		d.tcpListener.Close()
+		d.wg.Wait()
+	})
+	return err
+}
+
+func (d *DNSServer) serveUDP() {
+	defer d.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := d.udpConn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		response := d.handleQuery(buf[:n], true)
+		if response != nil {
+			d.udpConn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (d *DNSServer) serveTCP() {
+	defer d.wg.Done()
+	for {
+		conn, err := d.tcpListener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go d.handleTCPConn(conn)
+	}
+}
+
+//handleTCPConn answer the length prefixed queries on a TCP connection until it is idle
+func (d *DNSServer) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+	lengthBuf := make([]byte, 2)
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		response := d.handleQuery(query, false)
+		if response == nil {
+			return
+		}
+		if _, err := conn.Write(append(appendUint16([]byte{}, uint16(len(response))), response...)); err != nil {
+			return
+		}
+	}
+}
+
+/*
+	handleQuery
+
+	Answer a single DNS query message. Return nil if the message should be ignored
+*/
+func (d *DNSServer) handleQuery(query []byte, isUDP bool) []byte {
+	req, err := unpackDNSMessage(query)
+	if err != nil {
+		if len(query) < 12 {
+			//Not even a header. Ignore it
+			return nil
+		}
+		return d.packResponse(&dnsMessage{
+			Header: dnsHeader{
+				ID:       binary.BigEndian.Uint16(query),
+				Response: true,
+				Rcode:    dnsRcodeFormatError,
+			},
+		}, dnsMaxUDPSize, isUDP)
+	}
+	if req.Header.Response {
+		return nil
+	}
+
+	resp := &dnsMessage{
+		Header: dnsHeader{
+			ID:               req.Header.ID,
+			Response:         true,
+			Opcode:           req.Header.Opcode,
+			RecursionDesired: req.Header.RecursionDesired,
+		},
+		Questions: req.Questions,
+	}
+
+	//Check the max UDP payload size from EDNS
+	udpSize := dnsMaxUDPSize
+	for _, rr := range req.Additionals {
+		if rr.Type == dnsTypeOPT {
+			if int(rr.Class) > udpSize {
+				udpSize = int(rr.Class)
+			}
+			resp.Additionals = append(resp.Additionals, dnsRR{
+				Name:  ".",
+				Type:  dnsTypeOPT,
+				Class: dnsEDNSUDPSize,
+			})
+		}
+	}
+	if udpSize > dnsEDNSUDPSize {
+		udpSize = dnsEDNSUDPSize
+	}
+
+	if req.Header.Opcode != dnsOpcodeQuery {
+		resp.Header.Rcode = dnsRcodeNotImplemented
+		return d.packResponse(resp, udpSize, isUDP)
+	}
+	if len(req.Questions) != 1 {
+		resp.Header.Rcode = dnsRcodeFormatError
+		return d.packResponse(resp, udpSize, isUDP)
+	}
+
+	question := req.Questions[0]
+	if question.Class != dnsClassINET && question.Class != dnsClassANY {
+		resp.Header.Rcode = dnsRcodeRefused
+		return d.packResponse(resp, udpSize, isUDP)
+	}
+
+	name := canonicalDNSName(question.Name)
+	if name != d.zone && !strings.HasSuffix(name, "."+d.zone) {
+		//Not in our zone
+		resp.Header.Rcode = dnsRcodeRefused
+		return d.packResponse(resp, udpSize, isUDP)
+	}
+
+	resp.Header.Authoritative = true
+	records, nameExists := d.lookup(name, question.Type)
+	if !nameExists {
+		resp.Header.Rcode = dnsRcodeNameError
+	}
+	resp.Answers = records
+	if len(records) == 0 {
+		//NXDOMAIN or NODATA, attach the SOA for negative caching
+		soa, err := d.soaRecord()
+		if err != nil {
+			resp.Header.Rcode = dnsRcodeServerFailure
+		} else {
+			soa.TTL = d.options.NegativeTTL
+			resp.Authorities = []dnsRR{*soa}
+		}
+	}
+
+	return d.packResponse(resp, udpSize, isUDP)
+}
+
+//packResponse encode the response, set the truncated flag if it does not fit in the UDP payload
+func (d *DNSServer) packResponse(resp *dnsMessage, udpSize int, isUDP bool) []byte {
+	packed, err := resp.Pack()
+	if err != nil {
+		resp.Answers = nil
+		resp.Authorities = nil
+		resp.Header.Rcode = dnsRcodeServerFailure
+		packed, err = resp.Pack()
+		if err != nil {
+			return nil
+		}
+	}
+
+	if isUDP && len(packed) > udpSize {
+		resp.Header.Truncated = true
+		resp.Answers = nil
+		resp.Authorities = nil
+		packed, _ = resp.Pack()
+	}
+	return packed
+}
+
+/*
+	lookup
+
+	Return the records matching the given name and type, and if the name exists in the zone
+*/
+func (d *DNSServer) lookup(name string, qtype uint16) ([]dnsRR, bool) {
+	if name == d.zone {
+		records := []dnsRR{}
+		if qtype == dnsTypeSOA || qtype == dnsTypeANY {
+			soa, err := d.soaRecord()
+			if err == nil {
+				records = append(records, *soa)
+			}
+		}
+		if qtype == dnsTypeNS || qtype == dnsTypeANY {
+			for _, ns := range d.options.NameServers {
+				data, err := appendDNSName([]byte{}, ns)
+				if err != nil {
+					continue
+				}
+				records = append(records, dnsRR{
+					Name:  d.zone,
+					Type:  dnsTypeNS,
+					Class: dnsClassINET,
+					TTL:   d.options.TTL,
+					Data:  data,
+				})
+			}
+		}
+		return records, true
+	}
+
+	label := strings.TrimSuffix(name, "."+d.zone)
+	if strings.Contains(label, ".") {
+		//Only one level of sub-domain is served
+		return []dnsRR{}, false
+	}
+
+	addrs, ok := d.resolveUUID(label)
+	if !ok {
+		return []dnsRR{}, false
+	}
+
+	records := []dnsRR{}
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == dnsTypeA || qtype == dnsTypeANY {
+				records = append(records, dnsRR{
+					Name:  name,
+					Type:  dnsTypeA,
+					Class: dnsClassINET,
+					TTL:   d.options.TTL,
+					Data:  []byte(ip4),
+				})
+			}
+		} else if ip16 := ip.To16(); ip16 != nil {
+			if qtype == dnsTypeAAAA || qtype == dnsTypeANY {
+				records = append(records, dnsRR{
+					Name:  name,
+					Type:  dnsTypeAAAA,
+					Class: dnsClassINET,
+					TTL:   d.options.TTL,
+					Data:  []byte(ip16),
+				})
+			}
+		}
+	}
+	return records, true
+}
+
+//resolveUUID return the addresses of the node (or this router) with given UUID label
+func (d *DNSServer) resolveUUID(label string) ([]net.IP, bool) {
+	s := d.router
+	if strings.EqualFold(label, s.Options.DeviceUUID) {
+		addrs := []net.IP{}
+		ipv4, ipv6 := s.GetDeviceIpAddrByFamily()
+		if ipv4 != nil {
+			addrs = append(addrs, ipv4)
+		}
+		if ipv6 != nil {
+			addrs = append(addrs, ipv6)
+		}
+		if len(addrs) == 0 && !isUnspecifiedIP(s.GetDeviceIpAddr()) {
+			addrs = append(addrs, s.GetDeviceIpAddr())
+		}
+		return addrs, true
+	}
+
+	for _, node := range s.getNodes() {
+		if strings.EqualFold(label, node.UUID) {
+			ip := node.GetIpAddr()
+			if isUnspecifiedIP(ip) {
+				return []net.IP{}, true
+			}
+			return []net.IP{ip}, true
+		}
+	}
+	return nil, false
+}
+
+//soaRecord build the SOA record of the zone, the serial is bumped when the node records changed
+func (d *DNSServer) soaRecord() (*dnsRR, error) {
+	serial := d.currentSerial()
+	data, err := newSOAData(d.options.NameServers[0], d.options.Hostmaster, serial, 3600, 600, 86400, d.options.NegativeTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsRR{
+		Name:  d.zone,
+		Type:  dnsTypeSOA,
+		Class: dnsClassINET,
+		TTL:   d.options.TTL,
+		Data:  data,
+	}, nil
+}
+
+func (d *DNSServer) currentSerial() uint32 {
+	//Take a snapshot of all records served by this zone
+	entries := []string{}
+	if addrs, ok := d.resolveUUID(d.router.Options.DeviceUUID); ok {
+		for _, ip := range addrs {
+			entries = append(entries, d.router.Options.DeviceUUID+"="+ip.String())
+		}
+	}
+	for _, node := range d.router.getNodes() {
+		entries = append(entries, node.UUID+"="+node.GetIpAddr().String())
+	}
+	sort.Strings(entries)
+	snapshot := strings.Join(entries, ",")
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.serial == 0 || snapshot != d.recordSnapshot {
+		newSerial := uint32(d.router.now().Unix())
+		if newSerial <= d.serial {
+			newSerial = d.serial + 1
+		}
+		d.serial = newSerial
+		d.recordSnapshot = snapshot
+	}
+	return d.serial
+}
+
+//isUnspecifiedIP check if the ip is empty or 0.0.0.0 / ::
+func isUnspecifiedIP(ip net.IP) bool {
+	return ip == nil || ip.IsUnspecified()
+}
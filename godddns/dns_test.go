@@ -0,0 +1,179 @@
+package godddns
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+)
+
+//newTestDNSServer create a responder of the zone without listening, node1 is at 203.0.113.1
+func newTestDNSServer(t *testing.T, nameServers ...string) *DNSServer {
+	t.Helper()
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	node := router.NewNode(NodeOptions{NodeID: "node1", Port: 8080, RESTInterface: "/godddns"})
+	node.IpAddr = net.ParseIP("203.0.113.1")
+	router.AddNode(node)
+	if len(nameServers) == 0 {
+		nameServers = []string{"thisnode.cluster.example.com."}
+	}
+	return &DNSServer{
+		router: router,
+		options: DNSServerOptions{
+			TTL:         60,
+			NegativeTTL: 30,
+			NameServers: nameServers,
+			Hostmaster:  "hostmaster.cluster.example.com.",
+		},
+		zone: "cluster.example.com.",
+	}
+}
+
+//packTestQuery pack a query of the name and type
+func packTestQuery(t *testing.T, name string, qtype uint16) []byte {
+	t.Helper()
+	packed, err := (&dnsMessage{
+		Header:    dnsHeader{ID: 0x1234, Opcode: dnsOpcodeQuery},
+		Questions: []dnsQuestion{{Name: name, Type: qtype, Class: dnsClassINET}},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+//queryTestDNSServer send the query to the responder and decode its response
+func queryTestDNSServer(t *testing.T, d *DNSServer, query []byte, isUDP bool) *dnsMessage {
+	t.Helper()
+	response := d.handleQuery(query, isUDP)
+	if response == nil {
+		t.Fatal("query ignored")
+	}
+	resp, err := unpackDNSMessage(response)
+	if err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return resp
+}
+
+func TestUnpackDNSMessageMalformed(t *testing.T) {
+	header := []byte{0x12, 0x34, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0} //One question
+	tests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"short header", header[:11]},
+		{"missing question", header},
+		{"label past the end", append(append([]byte{}, header...), 5, 'n', 'o', 'd', 'e')},
+		{"missing question type", append(append([]byte{}, header...), 4, 'n', 'o', 'd', 'e', 0, 0, 1)},
+		{"reserved label type", append(append([]byte{}, header...), 0x40, 0, 0, 1, 0, 1)},
+		{"truncated pointer", append(append([]byte{}, header...), 0xC0)},
+		{"record data past the end", []byte{0x12, 0x34, 0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 203, 0}},
+	}
+	for _, test := range tests {
+		if _, err := unpackDNSMessage(test.msg); err == nil {
+			t.Errorf("%s accepted", test.name)
+		}
+	}
+}
+
+func TestReadDNSNameCompression(t *testing.T) {
+	//"node1" followed by a pointer to "example.com" at offset 0
+	msg := []byte("\x07example\x03com\x00\x05node1\xC0\x00")
+	name, offset, err := readDNSName(msg, 13)
+	if err != nil || name != "node1.example.com." || offset != len(msg) {
+		t.Errorf("compressed name read as %q at %d, %v", name, offset, err)
+	}
+
+	//Pointers to each other never end
+	loop := []byte("\x05node1\xC0\x08\xC0\x00")
+	if _, _, err := readDNSName(loop, 0); err == nil {
+		t.Error("compression loop accepted")
+	}
+	if _, _, err := readDNSName([]byte{0xC0, 0x00}, 0); err == nil {
+		t.Error("pointer to itself accepted")
+	}
+}
+
+func TestHandleQueryAnswer(t *testing.T) {
+	d := newTestDNSServer(t)
+	resp := queryTestDNSServer(t, d, packTestQuery(t, "NODE1.cluster.example.com", dnsTypeA), true)
+	if resp.Header.ID != 0x1234 || !resp.Header.Response || !resp.Header.Authoritative || resp.Header.Rcode != dnsRcodeSuccess {
+		t.Fatalf("unexpected response header %+v", resp.Header)
+	}
+	if len(resp.Answers) != 1 || !net.IP(resp.Answers[0].Data).Equal(net.ParseIP("203.0.113.1")) || resp.Answers[0].TTL != 60 {
+		t.Errorf("unexpected answers %+v", resp.Answers)
+	}
+
+	//NODATA: the name exists without records of the type
+	resp = queryTestDNSServer(t, d, packTestQuery(t, "node1.cluster.example.com", dnsTypeAAAA), true)
+	if resp.Header.Rcode != dnsRcodeSuccess || len(resp.Answers) != 0 || len(resp.Authorities) != 1 {
+		t.Errorf("NODATA answered with rcode %d, %d answers and %d authorities", resp.Header.Rcode, len(resp.Answers), len(resp.Authorities))
+	}
+}
+
+func TestHandleQueryNXDomain(t *testing.T) {
+	d := newTestDNSServer(t)
+	for _, name := range []string{"unknown.cluster.example.com", "a.node1.cluster.example.com"} {
+		resp := queryTestDNSServer(t, d, packTestQuery(t, name, dnsTypeA), true)
+		if resp.Header.Rcode != dnsRcodeNameError || len(resp.Answers) != 0 {
+			t.Errorf("%s answered with rcode %d and %d answers", name, resp.Header.Rcode, len(resp.Answers))
+		}
+		//The SOA is attached for negative caching
+		if len(resp.Authorities) != 1 || resp.Authorities[0].Type != dnsTypeSOA || resp.Authorities[0].TTL != 30 {
+			t.Errorf("%s answered without the SOA of the zone: %+v", name, resp.Authorities)
+		}
+	}
+
+	resp := queryTestDNSServer(t, d, packTestQuery(t, "node1.example.org", dnsTypeA), true)
+	if resp.Header.Rcode != dnsRcodeRefused {
+		t.Errorf("name outside the zone answered with rcode %d", resp.Header.Rcode)
+	}
+}
+
+func TestHandleQueryMalformed(t *testing.T) {
+	d := newTestDNSServer(t)
+	if response := d.handleQuery([]byte{0x12, 0x34}, true); response != nil {
+		t.Error("message without header answered")
+	}
+
+	query := packTestQuery(t, "node1.cluster.example.com", dnsTypeA)
+	resp := queryTestDNSServer(t, d, query[:len(query)-2], true)
+	if resp.Header.ID != 0x1234 || resp.Header.Rcode != dnsRcodeFormatError {
+		t.Errorf("truncated query answered with ID %x and rcode %d", resp.Header.ID, resp.Header.Rcode)
+	}
+
+	//Responses are never answered, so two responders cannot loop
+	response := append([]byte{}, query...)
+	response[2] |= 0x80
+	if d.handleQuery(response, true) != nil {
+		t.Error("response answered")
+	}
+}
+
+func TestHandleQueryTruncated(t *testing.T) {
+	nameServers := []string{}
+	for i := 0; i < 20; i++ {
+		nameServers = append(nameServers, "nameserver"+strconv.Itoa(i)+".cluster.example.com.")
+	}
+	d := newTestDNSServer(t, nameServers...)
+	query := packTestQuery(t, "cluster.example.com", dnsTypeNS)
+
+	resp := queryTestDNSServer(t, d, query, true)
+	if !resp.Header.Truncated || len(resp.Answers) != 0 {
+		t.Errorf("oversized UDP response sent with %d answers, truncated %t", len(resp.Answers), resp.Header.Truncated)
+	}
+	packed := d.handleQuery(query, true)
+	if len(packed) > dnsMaxUDPSize {
+		t.Errorf("truncated response of %d bytes", len(packed))
+	}
+
+	//The client retries over TCP, which has no size limit
+	resp = queryTestDNSServer(t, d, query, false)
+	if resp.Header.Truncated || len(resp.Answers) != len(nameServers) {
+		t.Errorf("TCP response with %d answers, truncated %t", len(resp.Answers), resp.Header.Truncated)
+	}
+	if !bytes.Contains(d.handleQuery(query, false), []byte("nameserver19")) {
+		t.Error("last name server missing from the TCP response")
+	}
+}
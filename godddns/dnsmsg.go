@@ -0,0 +1,332 @@
+package godddns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+/*
+	DNSMsg.go
+
+	A minimal DNS wire format (RFC 1035) encoder and decoder used by the
+	built-in DNS responder. Only the parts required by go-DDDNS are
+	implemented. Names are written without compression but compressed
+	names are accepted when decoding
+*/
+
+//DNS record types
+const (
+	dnsTypeA     uint16 = 1
+	dnsTypeNS    uint16 = 2
+	dnsTypeSOA   uint16 = 6
+	dnsTypeAAAA  uint16 = 28
+	dnsTypeOPT   uint16 = 41
+	dnsTypeTSIG  uint16 = 250
+	dnsTypeANY   uint16 = 255
+	dnsClassINET uint16 = 1
+	dnsClassNONE uint16 = 254
+	dnsClassANY  uint16 = 255
+)
+
+//DNS opcodes and response codes
+const (
+	dnsOpcodeQuery  = 0
+	dnsOpcodeUpdate = 5
+
+	dnsRcodeSuccess        = 0
+	dnsRcodeFormatError    = 1
+	dnsRcodeServerFailure  = 2
+	dnsRcodeNameError      = 3
+	dnsRcodeNotImplemented = 4
+	dnsRcodeRefused        = 5
+	dnsRcodeNotAuth        = 9
+)
+
+var errDNSMessageTruncated = errors.New("dns message truncated")
+
+type dnsHeader struct {
+	ID                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              int
+}
+
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte //The encoded RDATA of this record
+}
+
+type dnsMessage struct {
+	Header      dnsHeader
+	Questions   []dnsQuestion
+	Answers     []dnsRR
+	Authorities []dnsRR
+	Additionals []dnsRR
+}
+
+//canonicalDNSName lower case the name and make sure it is fully qualified
+func canonicalDNSName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !strings.HasSuffix(name, ".") {
+		name = name + "."
+	}
+	return name
+}
+
+/*
+	Encoding
+*/
+
+func (h *dnsHeader) flags() uint16 {
+	var flags uint16
+	if h.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(h.Opcode&0xF) << 11
+	if h.Authoritative {
+		flags |= 1 << 10
+	}
+	if h.Truncated {
+		flags |= 1 << 9
+	}
+	if h.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	flags |= uint16(h.Rcode & 0xF)
+	return flags
+}
+
+//appendDNSName write the name in uncompressed wire format
+func appendDNSName(b []byte, name string) ([]byte, error) {
+	name = canonicalDNSName(name)
+	if name == "." {
+		return append(b, 0), nil
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.New("invalid dns label in name: " + name)
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0), nil
+}
+
+func appendDNSRR(b []byte, rr *dnsRR) ([]byte, error) {
+	b, err := appendDNSName(b, rr.Name)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint16(b, rr.Type)
+	b = appendUint16(b, rr.Class)
+	b = appendUint32(b, rr.TTL)
+	if len(rr.Data) > 0xFFFF {
+		return nil, errors.New("dns record data too long")
+	}
+	b = appendUint16(b, uint16(len(rr.Data)))
+	return append(b, rr.Data...), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+//Pack encode the message into wire format
+func (m *dnsMessage) Pack() ([]byte, error) {
+	b := make([]byte, 0, 512)
+	b = appendUint16(b, m.Header.ID)
+	b = appendUint16(b, m.Header.flags())
+	b = appendUint16(b, uint16(len(m.Questions)))
+	b = appendUint16(b, uint16(len(m.Answers)))
+	b = appendUint16(b, uint16(len(m.Authorities)))
+	b = appendUint16(b, uint16(len(m.Additionals)))
+
+	var err error
+	for _, q := range m.Questions {
+		b, err = appendDNSName(b, q.Name)
+		if err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+
+	for _, section := range [][]dnsRR{m.Answers, m.Authorities, m.Additionals} {
+		for i := range section {
+			b, err = appendDNSRR(b, &section[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+//newSOAData encode the RDATA of a SOA record
+func newSOAData(mname string, rname string, serial uint32, refresh uint32, retry uint32, expire uint32, minimum uint32) ([]byte, error) {
+	b, err := appendDNSName([]byte{}, mname)
+	if err != nil {
+		return nil, err
+	}
+	b, err = appendDNSName(b, rname)
+	if err != nil {
+		return nil, err
+	}
+	b = appendUint32(b, serial)
+	b = appendUint32(b, refresh)
+	b = appendUint32(b, retry)
+	b = appendUint32(b, expire)
+	b = appendUint32(b, minimum)
+	return b, nil
+}
+
+/*
+	Decoding
+*/
+
+//readDNSName read a possibly compressed name starting at offset, return the name and the offset after it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	labels := []string{}
+	nextOffset := -1
+	jumps := 0
+	for {
+		if offset >= len(msg) {
+			return "", 0, errDNSMessageTruncated
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			offset++
+			if nextOffset < 0 {
+				nextOffset = offset
+			}
+			return canonicalDNSName(strings.Join(labels, ".")), nextOffset, nil
+		case length&0xC0 == 0xC0:
+			//Compression pointer
+			if offset+1 >= len(msg) {
+				return "", 0, errDNSMessageTruncated
+			}
+			jumps++
+			if jumps > 64 {
+				return "", 0, errors.New("dns name compression loop")
+			}
+			if nextOffset < 0 {
+				nextOffset = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+		case length&0xC0 != 0:
+			return "", 0, errors.New("unsupported dns label type")
+		default:
+			offset++
+			if offset+length > len(msg) {
+				return "", 0, errDNSMessageTruncated
+			}
+			labels = append(labels, string(msg[offset:offset+length]))
+			offset += length
+		}
+	}
+}
+
+func readDNSRR(msg []byte, offset int) (*dnsRR, int, error) {
+	name, offset, err := readDNSName(msg, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset+10 > len(msg) {
+		return nil, 0, errDNSMessageTruncated
+	}
+	rr := dnsRR{
+		Name:  name,
+		Type:  binary.BigEndian.Uint16(msg[offset:]),
+		Class: binary.BigEndian.Uint16(msg[offset+2:]),
+		TTL:   binary.BigEndian.Uint32(msg[offset+4:]),
+	}
+	dataLength := int(binary.BigEndian.Uint16(msg[offset+8:]))
+	offset += 10
+	if offset+dataLength > len(msg) {
+		return nil, 0, errDNSMessageTruncated
+	}
+	rr.Data = msg[offset : offset+dataLength]
+	return &rr, offset + dataLength, nil
+}
+
+//unpackDNSMessage decode a message in wire format
+func unpackDNSMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errDNSMessageTruncated
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m := dnsMessage{
+		Header: dnsHeader{
+			ID:                 binary.BigEndian.Uint16(msg[0:]),
+			Response:           flags&(1<<15) != 0,
+			Opcode:             int(flags>>11) & 0xF,
+			Authoritative:      flags&(1<<10) != 0,
+			Truncated:          flags&(1<<9) != 0,
+			RecursionDesired:   flags&(1<<8) != 0,
+			RecursionAvailable: flags&(1<<7) != 0,
+			Rcode:              int(flags & 0xF),
+		},
+	}
+	questionCount := int(binary.BigEndian.Uint16(msg[4:]))
+	sectionCounts := []int{
+		int(binary.BigEndian.Uint16(msg[6:])),
+		int(binary.BigEndian.Uint16(msg[8:])),
+		int(binary.BigEndian.Uint16(msg[10:])),
+	}
+
+	offset := 12
+	for i := 0; i < questionCount; i++ {
+		name, nextOffset, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if nextOffset+4 > len(msg) {
+			return nil, errDNSMessageTruncated
+		}
+		m.Questions = append(m.Questions, dnsQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[nextOffset:]),
+			Class: binary.BigEndian.Uint16(msg[nextOffset+2:]),
+		})
+		offset = nextOffset + 4
+	}
+
+	sections := []*[]dnsRR{&m.Answers, &m.Authorities, &m.Additionals}
+	for i, section := range sections {
+		for j := 0; j < sectionCounts[i]; j++ {
+			rr, nextOffset, err := readDNSRR(msg, offset)
+			if err != nil {
+				return nil, err
+			}
+			*section = append(*section, *rr)
+			offset = nextOffset
+		}
+	}
+
+	return &m, nil
+}
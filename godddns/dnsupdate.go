@@ -0,0 +1,531 @@
+package godddns
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	DNSUpdate.go
+
+	This script push the address of this router (and optionally all its
+	peers) to an external authoritative DNS server with RFC 2136 UPDATE
+	messages signed with TSIG (RFC 8945). Updates are sent after a
+	heartbeat cycle whenever the published addresses have changed
+*/
+
+type DNSUpdateOptions struct {
+	Server        string        //The address of the authoritative DNS server, e.g. ns1.example.com:53
+	Zone          string        //The zone to be updated
+	RecordName    string        //The record name of this router, default <DeviceUUID>.<zone>
+	TTL           uint32        //TTL of the published records, default 60
+	IncludePeers  bool          //Also publish the address of all peers as <uuid>.<zone>
+	TSIGKeyName   string        //The name of the TSIG key, leave empty to send unsigned updates
+	TSIGSecret    string        //The base64 encoded TSIG secret
+	TSIGAlgorithm string        //hmac-sha256 (default), hmac-sha512, hmac-sha1 or hmac-md5
+	Timeout       time.Duration //Timeout of each update, default 5 seconds
+}
+
+type DNSUpdatePublisher struct {
+	router       *ServiceRouter
+	options      DNSUpdateOptions
+	zone         string
+	tsigSecret   []byte
+	lastSnapshot string //The records published last time
+	mux          sync.Mutex
+}
+
+//The TSIG algorithm names and their hash functions
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-md5.sig-alg.reg.int.": md5.New,
+	"hmac-sha1.":                sha1.New,
+	"hmac-sha256.":              sha256.New,
+	"hmac-sha512.":              sha512.New,
+}
+
+const tsigFudge = 300
+
+/*
+	AddDNSUpdatePublisher
+
+	Register a publisher that keep the records on the given DNS server in sync
+	with this router. The first update is sent on the next heartbeat cycle
+*/
+func (s *ServiceRouter) AddDNSUpdatePublisher(options DNSUpdateOptions) (*DNSUpdatePublisher, error) {
+	if strings.TrimSpace(options.Server) == "" {
+		return nil, errors.New("dns server address is not set")
+	}
+	if strings.TrimSpace(options.Zone) == "" {
+		return nil, errors.New("dns zone is not set")
+	}
+	if _, _, err := net.SplitHostPort(options.Server); err != nil {
+		options.Server = net.JoinHostPort(strings.Trim(options.Server, "[]"), "53")
+	}
+	if options.TTL == 0 {
+		options.TTL = 60
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+
+	zone := canonicalDNSName(options.Zone)
+	if options.RecordName == "" {
+		options.RecordName = s.Options.DeviceUUID + "." + zone
+	}
+	options.RecordName = canonicalDNSName(options.RecordName)
+	if !strings.HasSuffix(options.RecordName, "."+zone) && options.RecordName != zone {
+		return nil, errors.New("record name " + options.RecordName + " is not in zone " + zone)
+	}
+
+	publisher := &DNSUpdatePublisher{
+		router:  s,
+		options: options,
+		zone:    zone,
+	}
+
+	if options.TSIGKeyName != "" {
+		if options.TSIGAlgorithm == "" {
+			options.TSIGAlgorithm = "hmac-sha256"
+		}
+		algorithm := canonicalDNSName(options.TSIGAlgorithm)
+		if algorithm == "hmac-md5." {
+			algorithm = "hmac-md5.sig-alg.reg.int."
+		}
+		if _, ok := tsigAlgorithms[algorithm]; !ok {
+			return nil, errors.New("unsupported TSIG algorithm: " + options.TSIGAlgorithm)
+		}
+		secret, err := base64.StdEncoding.DecodeString(options.TSIGSecret)
+		if err != nil {
+			return nil, errors.New("invalid TSIG secret: " + err.Error())
+		}
+		publisher.options.TSIGAlgorithm = algorithm
+		publisher.options.TSIGKeyName = canonicalDNSName(options.TSIGKeyName)
+		publisher.tsigSecret = secret
+	}
+
+	s.mux.Lock()
+	s.dnsUpdatePublishers = append(s.dnsUpdatePublishers, publisher)
+	s.mux.Unlock()
+	return publisher, nil
+}
+
+//RemoveDNSUpdatePublisher stop sending updates with the given publisher
+func (s *ServiceRouter) RemoveDNSUpdatePublisher(publisher *DNSUpdatePublisher) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	remainingPublishers := []*DNSUpdatePublisher{}
+	for _, thisPublisher := range s.dnsUpdatePublishers {
+		if thisPublisher != publisher {
+			remainingPublishers = append(remainingPublishers, thisPublisher)
+		}
+	}
+	s.dnsUpdatePublishers = remainingPublishers
+}
+
+//publishDNSUpdates send updates with all publishers whose records has changed
+func (s *ServiceRouter) publishDNSUpdates() {
+	s.mux.RLock()
+	publishers := s.dnsUpdatePublishers
+	s.mux.RUnlock()
+
+	for _, publisher := range publishers {
+		err := publisher.publish(false)
+		if err != nil {
+			s.logger().Warn("unable to publish dns update", logKeyOperation, "dnsupdate", logKeyEndpoint, publisher.options.Server, logKeyError, err)
+		}
+	}
+}
+
+//Publish send the update to the DNS server immediately, regardless of changes
+func (p *DNSUpdatePublisher) Publish() error {
+	return p.publish(true)
+}
+
+func (p *DNSUpdatePublisher) publish(force bool) error {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	//Collect the records to publish
+	records := map[string][]net.IP{}
+	ipv4, ipv6 := p.router.GetDeviceIpAddrByFamily()
+	for _, ip := range []net.IP{ipv4, ipv6} {
+		if !isUnspecifiedIP(ip) {
+			records[p.options.RecordName] = append(records[p.options.RecordName], ip)
+		}
+	}
+
+	if p.options.IncludePeers {
+		for _, node := range p.router.getNodes() {
+			ip := node.GetIpAddr()
+			if !isUnspecifiedIP(ip) {
+				name := canonicalDNSName(node.UUID + "." + p.zone)
+				records[name] = append(records[name], ip)
+			}
+		}
+	}
+
+	if len(records) == 0 {
+		//Nothing to publish yet
+		return nil
+	}
+
+	names := []string{}
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshot := []string{}
+	for _, name := range names {
+		for _, ip := range records[name] {
+			snapshot = append(snapshot, name+"="+ip.String())
+		}
+	}
+	snapshotString := strings.Join(snapshot, ",")
+	if !force && snapshotString == p.lastSnapshot {
+		return nil
+	}
+
+	//Build the update message
+	msg := dnsMessage{
+		Header: dnsHeader{
+			ID:     randomDNSMessageID(),
+			Opcode: dnsOpcodeUpdate,
+		},
+		Questions: []dnsQuestion{
+			{
+				Name:  p.zone,
+				Type:  dnsTypeSOA,
+				Class: dnsClassINET,
+			},
+		},
+	}
+
+	for _, name := range names {
+		//Replace the whole A and AAAA RRset of this name
+		for _, rrType := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			msg.Authorities = append(msg.Authorities, dnsRR{
+				Name:  name,
+				Type:  rrType,
+				Class: dnsClassANY,
+			})
+		}
+		for _, ip := range records[name] {
+			rr := dnsRR{
+				Name:  name,
+				Type:  dnsTypeAAAA,
+				Class: dnsClassINET,
+				TTL:   p.options.TTL,
+				Data:  []byte(ip.To16()),
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				rr.Type = dnsTypeA
+				rr.Data = []byte(ip4)
+			}
+			msg.Authorities = append(msg.Authorities, rr)
+		}
+	}
+
+	err := p.exchange(&msg)
+	if err != nil {
+		return err
+	}
+
+	p.router.logger().Info("dns update published", logKeyOperation, "dnsupdate", logKeyEndpoint, p.options.Server, "records", snapshotString)
+	p.lastSnapshot = snapshotString
+	return nil
+}
+
+/*
+	exchange
+
+	Sign and send the update message over UDP, retry with TCP if the
+	response is truncated. Return error if the server rejected the update
+*/
+func (p *DNSUpdatePublisher) exchange(msg *dnsMessage) error {
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	var requestMAC []byte
+	if p.tsigSecret != nil {
+		packed, requestMAC, err = p.signMessage(packed, msg.Header.ID, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	response, err := p.send("udp", packed)
+	if err == nil {
+		if resp, parseErr := unpackDNSMessage(response); parseErr == nil && resp.Header.Truncated {
+			response, err = p.send("tcp", packed)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := unpackDNSMessage(response)
+	if err != nil {
+		return err
+	}
+	if resp.Header.ID != msg.Header.ID || !resp.Header.Response {
+		return errors.New("unexpected response from dns server")
+	}
+
+	if p.tsigSecret != nil {
+		err = p.verifyResponse(response, requestMAC)
+		if err != nil {
+			return err
+		}
+	}
+
+	if resp.Header.Rcode != dnsRcodeSuccess {
+		return fmt.Errorf("dns update rejected with rcode %d", resp.Header.Rcode)
+	}
+	return nil
+}
+
+//send the packed message to the server and return the raw response
+func (p *DNSUpdatePublisher) send(network string, packed []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, p.options.Server, p.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(p.options.Timeout))
+
+	if network == "tcp" {
+		_, err = conn.Write(append(appendUint16([]byte{}, uint16(len(packed))), packed...))
+		if err != nil {
+			return nil, err
+		}
+		lengthBuf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+			return nil, err
+		}
+		response := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+		return response, nil
+	}
+
+	_, err = conn.Write(packed)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+/*
+	TSIG signing and verification
+*/
+
+//signMessage append a TSIG record to the packed message, return the signed message and its MAC
+func (p *DNSUpdatePublisher) signMessage(packed []byte, originalID uint16, requestMAC []byte) ([]byte, []byte, error) {
+	timeSigned := uint64(p.router.now().Unix())
+	mac, err := p.computeTSIGMAC(packed, requestMAC, timeSigned, tsigFudge, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	algorithm, err := appendDNSName([]byte{}, p.options.TSIGAlgorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+	rdata := append(algorithm, byte(timeSigned>>40), byte(timeSigned>>32), byte(timeSigned>>24), byte(timeSigned>>16), byte(timeSigned>>8), byte(timeSigned))
+	rdata = appendUint16(rdata, tsigFudge)
+	rdata = appendUint16(rdata, uint16(len(mac)))
+	rdata = append(rdata, mac...)
+	rdata = appendUint16(rdata, originalID)
+	rdata = appendUint16(rdata, 0) //Error
+	rdata = appendUint16(rdata, 0) //Other length
+
+	signed, err := appendDNSRR(append([]byte{}, packed...), &dnsRR{
+		Name:  p.options.TSIGKeyName,
+		Type:  dnsTypeTSIG,
+		Class: dnsClassANY,
+		TTL:   0,
+		Data:  rdata,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//Increase the additional record count for the TSIG record
+	binary.BigEndian.PutUint16(signed[10:], binary.BigEndian.Uint16(signed[10:])+1)
+	return signed, mac, nil
+}
+
+//computeTSIGMAC calculate the MAC of the message (without TSIG record) and the TSIG variables
+func (p *DNSUpdatePublisher) computeTSIGMAC(packed []byte, requestMAC []byte, timeSigned uint64, fudge uint16, tsigError uint16, otherData []byte) ([]byte, error) {
+	keyName, err := appendDNSName([]byte{}, p.options.TSIGKeyName)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := appendDNSName([]byte{}, p.options.TSIGAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hmac.New(tsigAlgorithms[p.options.TSIGAlgorithm], p.tsigSecret)
+	if requestMAC != nil {
+		h.Write(appendUint16([]byte{}, uint16(len(requestMAC))))
+		h.Write(requestMAC)
+	}
+	h.Write(packed)
+	h.Write(keyName)
+	h.Write(appendUint16([]byte{}, dnsClassANY))
+	h.Write(appendUint32([]byte{}, 0))
+	h.Write(algorithm)
+	h.Write([]byte{byte(timeSigned >> 40), byte(timeSigned >> 32), byte(timeSigned >> 24), byte(timeSigned >> 16), byte(timeSigned >> 8), byte(timeSigned)})
+	h.Write(appendUint16([]byte{}, fudge))
+	h.Write(appendUint16([]byte{}, tsigError))
+	h.Write(appendUint16([]byte{}, uint16(len(otherData))))
+	h.Write(otherData)
+	return h.Sum(nil), nil
+}
+
+//verifyResponse check the TSIG record of the response signed by the server
+func (p *DNSUpdatePublisher) verifyResponse(response []byte, requestMAC []byte) error {
+	unsigned, tsig, err := splitTSIGRecord(response)
+	if err != nil {
+		return err
+	}
+	if tsig == nil {
+		resp, err := unpackDNSMessage(response)
+		if err == nil && resp.Header.Rcode == dnsRcodeNotAuth {
+			return errors.New("dns server rejected the TSIG signature")
+		} else if err == nil && resp.Header.Rcode != dnsRcodeSuccess {
+			return fmt.Errorf("dns update rejected with rcode %d", resp.Header.Rcode)
+		}
+		return errors.New("dns server response is not signed")
+	}
+
+	//Parse the TSIG RDATA
+	algorithm, offset, err := readDNSName(tsig.Data, 0)
+	if err != nil {
+		return err
+	}
+	if offset+10 > len(tsig.Data) {
+		return errDNSMessageTruncated
+	}
+	timeSigned := uint64(binary.BigEndian.Uint16(tsig.Data[offset:]))<<32 | uint64(binary.BigEndian.Uint32(tsig.Data[offset+2:]))
+	fudge := binary.BigEndian.Uint16(tsig.Data[offset+6:])
+	macSize := int(binary.BigEndian.Uint16(tsig.Data[offset+8:]))
+	offset += 10
+	if offset+macSize+6 > len(tsig.Data) {
+		return errDNSMessageTruncated
+	}
+	mac := tsig.Data[offset : offset+macSize]
+	offset += macSize
+	tsigError := binary.BigEndian.Uint16(tsig.Data[offset+2:])
+	otherLength := int(binary.BigEndian.Uint16(tsig.Data[offset+4:]))
+	offset += 6
+	if offset+otherLength > len(tsig.Data) {
+		return errDNSMessageTruncated
+	}
+	otherData := tsig.Data[offset : offset+otherLength]
+
+	if tsigError != 0 {
+		return fmt.Errorf("dns server returned TSIG error %d", tsigError)
+	}
+	if algorithm != p.options.TSIGAlgorithm || canonicalDNSName(tsig.Name) != p.options.TSIGKeyName {
+		return errors.New("dns server signed the response with another key")
+	}
+
+	expectedMAC, err := p.computeTSIGMAC(unsigned, requestMAC, timeSigned, fudge, tsigError, otherData)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expectedMAC) {
+		return errors.New("invalid TSIG signature in dns server response")
+	}
+
+	now := uint64(p.router.now().Unix())
+	if now > timeSigned+uint64(fudge) || timeSigned > now+uint64(fudge) {
+		return errors.New("TSIG signature of dns server response expired")
+	}
+	return nil
+}
+
+/*
+	splitTSIGRecord
+
+	Return the message without its TSIG record (with the additional count and
+	message ID restored) and the TSIG record. The TSIG record is nil if the
+	message is not signed
+*/
+func splitTSIGRecord(msg []byte) ([]byte, *dnsRR, error) {
+	m, err := unpackDNSMessage(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(m.Additionals) == 0 || m.Additionals[len(m.Additionals)-1].Type != dnsTypeTSIG {
+		return msg, nil, nil
+	}
+
+	//Walk through the message to find where the last record starts
+	offset := 12
+	for i := 0; i < len(m.Questions); i++ {
+		_, nextOffset, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		offset = nextOffset + 4
+	}
+	recordCount := len(m.Answers) + len(m.Authorities) + len(m.Additionals)
+	for i := 0; i < recordCount-1; i++ {
+		_, nextOffset, err := readDNSRR(msg, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		offset = nextOffset
+	}
+
+	tsig := m.Additionals[len(m.Additionals)-1]
+	unsigned := append([]byte{}, msg[:offset]...)
+	binary.BigEndian.PutUint16(unsigned[10:], uint16(len(m.Additionals)-1))
+
+	//Restore the original ID the message was signed with
+	originalIDOffset := 0
+	if _, nameEnd, err := readDNSName(tsig.Data, 0); err == nil && nameEnd+10 <= len(tsig.Data) {
+		macSize := int(binary.BigEndian.Uint16(tsig.Data[nameEnd+8:]))
+		originalIDOffset = nameEnd + 10 + macSize
+	}
+	if originalIDOffset > 0 && originalIDOffset+2 <= len(tsig.Data) {
+		copy(unsigned[0:2], tsig.Data[originalIDOffset:originalIDOffset+2])
+	}
+	return unsigned, &tsig, nil
+}
+
+//randomDNSMessageID return a random ID for the DNS message
+func randomDNSMessageID() uint16 {
+	buf := make([]byte, 2)
+	if _, err := rand.Read(buf); err != nil {
+		return uint16(time.Now().UnixNano())
+	}
+	return binary.BigEndian.Uint16(buf)
+}
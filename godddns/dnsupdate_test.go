@@ -0,0 +1,203 @@
+package godddns
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTSIGSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+//newTestPublisher create a publisher signing with the given TSIG secret
+func newTestPublisher(t *testing.T, secret string) *DNSUpdatePublisher {
+	t.Helper()
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	publisher, err := router.AddDNSUpdatePublisher(DNSUpdateOptions{
+		Server:      "ns1.example.com",
+		Zone:        "example.com",
+		TSIGKeyName: "Update-Key",
+		TSIGSecret:  secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publisher
+}
+
+//signTestResponseAt sign the message like the server would at the given time
+func signTestResponseAt(t *testing.T, p *DNSUpdatePublisher, packed []byte, requestMAC []byte, timeSigned time.Time) []byte {
+	t.Helper()
+	signed, _, err := p.signMessage(packed, binary.BigEndian.Uint16(packed), requestMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Replace the time and MAC of the TSIG record, which is the last part of the message
+	unixTime := uint64(timeSigned.Unix())
+	mac, err := p.computeTSIGMAC(packed, requestMAC, unixTime, tsigFudge, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsigData := signed[len(signed)-len(mac)-16:]
+	copy(tsigData, []byte{byte(unixTime >> 40), byte(unixTime >> 32), byte(unixTime >> 24), byte(unixTime >> 16), byte(unixTime >> 8), byte(unixTime)})
+	copy(tsigData[10:], mac)
+	return signed
+}
+
+//packTestUpdate pack an update message of the zone, as a response if the server is replying
+func packTestUpdate(t *testing.T, id uint16, response bool, rcode int) []byte {
+	t.Helper()
+	msg := &dnsMessage{
+		Header:    dnsHeader{ID: id, Response: response, Opcode: dnsOpcodeUpdate, Rcode: rcode},
+		Questions: []dnsQuestion{{Name: "example.com.", Type: dnsTypeSOA, Class: dnsClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return packed
+}
+
+func TestAddDNSUpdatePublisherOptions(t *testing.T) {
+	publisher := newTestPublisher(t, testTSIGSecret)
+	if publisher.options.Server != "ns1.example.com:53" {
+		t.Errorf("server %s, expected the default port", publisher.options.Server)
+	}
+	if publisher.options.RecordName != "thisnode.example.com." {
+		t.Errorf("record name %s, expected thisnode.example.com.", publisher.options.RecordName)
+	}
+	if publisher.options.TSIGAlgorithm != "hmac-sha256." || publisher.options.TSIGKeyName != "update-key." {
+		t.Errorf("TSIG key %s %s not canonicalized", publisher.options.TSIGKeyName, publisher.options.TSIGAlgorithm)
+	}
+
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	invalid := []DNSUpdateOptions{
+		{Zone: "example.com"},
+		{Server: "ns1.example.com"},
+		{Server: "ns1.example.com", Zone: "example.com", RecordName: "host.example.org"},
+		{Server: "ns1.example.com", Zone: "example.com", TSIGKeyName: "key", TSIGSecret: testTSIGSecret, TSIGAlgorithm: "hmac-sha3"},
+		{Server: "ns1.example.com", Zone: "example.com", TSIGKeyName: "key", TSIGSecret: "not base64!"},
+	}
+	for _, options := range invalid {
+		if _, err := router.AddDNSUpdatePublisher(options); err == nil {
+			t.Errorf("invalid options accepted: %+v", options)
+		}
+	}
+}
+
+func TestSignMessage(t *testing.T) {
+	publisher := newTestPublisher(t, testTSIGSecret)
+	packed := packTestUpdate(t, 0x1234, false, dnsRcodeSuccess)
+	signed, mac, err := publisher.signMessage(packed, 0x1234, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, tsig, err := splitTSIGRecord(signed)
+	if err != nil || tsig == nil {
+		t.Fatalf("TSIG record not found in the signed message: %v", err)
+	}
+	if !bytes.Equal(unsigned, packed) {
+		t.Error("message without the TSIG record differs from the original message")
+	}
+	if tsig.Name != "update-key." || tsig.Class != dnsClassANY || tsig.TTL != 0 {
+		t.Errorf("TSIG record %s class %d TTL %d", tsig.Name, tsig.Class, tsig.TTL)
+	}
+
+	//The MAC covers the message and the TSIG variables of RFC 8945 section 4.3.3
+	secret, _ := base64.StdEncoding.DecodeString(testTSIGSecret)
+	algorithm := "\x0bhmac-sha256\x00"
+	if !bytes.HasPrefix(tsig.Data, []byte(algorithm)) {
+		t.Fatalf("TSIG record %x does not start with the algorithm", tsig.Data)
+	}
+	timeSigned := tsig.Data[len(algorithm) : len(algorithm)+6]
+	if now := time.Now().Unix(); int64(binary.BigEndian.Uint32(timeSigned[2:])) < now-1 || timeSigned[0] != 0 || timeSigned[1] != 0 {
+		t.Errorf("signed at %x, expected %d", timeSigned, now)
+	}
+	variables := []byte("\x0aupdate-key\x00\x00\xff\x00\x00\x00\x00" + algorithm)
+	variables = append(variables, timeSigned...)
+	variables = append(variables, byte(tsigFudge>>8), byte(tsigFudge&0xFF), 0, 0, 0, 0)
+	h := hmac.New(sha256.New, secret)
+	h.Write(packed)
+	h.Write(variables)
+	if !hmac.Equal(mac, h.Sum(nil)) {
+		t.Error("MAC does not match the RFC 8945 computation")
+	}
+	if !bytes.Contains(tsig.Data, mac) {
+		t.Error("MAC not written in the TSIG record")
+	}
+}
+
+func TestVerifyResponse(t *testing.T) {
+	publisher := newTestPublisher(t, testTSIGSecret)
+	_, requestMAC, err := publisher.signMessage(packTestUpdate(t, 0x1234, false, dnsRcodeSuccess), 0x1234, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The server signs its response with the MAC of the request prepended
+	response, _, err := publisher.signMessage(packTestUpdate(t, 0x1234, true, dnsRcodeSuccess), 0x1234, requestMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.verifyResponse(response, requestMAC); err != nil {
+		t.Errorf("signed response refused: %v", err)
+	}
+
+	tampered := append([]byte{}, response...)
+	tampered[3] = dnsRcodeRefused
+	if err := publisher.verifyResponse(tampered, requestMAC); err == nil {
+		t.Error("tampered response accepted")
+	}
+	if err := publisher.verifyResponse(response, []byte("another request")); err == nil {
+		t.Error("response to another request accepted")
+	}
+
+	otherKey := newTestPublisher(t, base64.StdEncoding.EncodeToString([]byte("another secret")))
+	if err := otherKey.verifyResponse(response, requestMAC); err == nil {
+		t.Error("response signed with another secret accepted")
+	}
+}
+
+func TestVerifyResponseTimeSigned(t *testing.T) {
+	publisher := newTestPublisher(t, testTSIGSecret)
+	packed := packTestUpdate(t, 0x1234, true, dnsRcodeSuccess)
+	fudge := time.Duration(tsigFudge) * time.Second
+
+	//Clocks of the server and the router may differ by the fudge in both directions
+	for _, offset := range []time.Duration{-fudge + time.Minute, fudge - time.Minute} {
+		response := signTestResponseAt(t, publisher, packed, nil, time.Now().Add(offset))
+		if err := publisher.verifyResponse(response, nil); err != nil {
+			t.Errorf("response signed %v away refused: %v", offset, err)
+		}
+	}
+	for _, offset := range []time.Duration{-fudge - time.Minute, fudge + time.Minute} {
+		response := signTestResponseAt(t, publisher, packed, nil, time.Now().Add(offset))
+		if err := publisher.verifyResponse(response, nil); err == nil || !strings.Contains(err.Error(), "expired") {
+			t.Errorf("response signed %v away accepted: %v", offset, err)
+		}
+	}
+}
+
+func TestVerifyUnsignedResponse(t *testing.T) {
+	publisher := newTestPublisher(t, testTSIGSecret)
+	tests := []struct {
+		rcode    int
+		expected string
+	}{
+		{dnsRcodeSuccess, "not signed"},
+		{dnsRcodeNotAuth, "rejected the TSIG signature"},
+		{dnsRcodeRefused, "rcode 5"},
+	}
+	for _, test := range tests {
+		err := publisher.verifyResponse(packTestUpdate(t, 0x1234, true, test.rcode), nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("unsigned response with rcode %d returned %v, expected %q", test.rcode, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package godddns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+	Events.go
+
+	This script provide a subscription API for the node lifecycle and
+	address change events of the router, so applications can react to
+	cluster changes without polling the node map
+
+	cancel := thisNode.Subscribe(func(e godddns.Event) {
+		if e.Type == godddns.EventNodeIpChanged {
+			fmt.Println(e.NodeUUID, "moved to", e.IpAddr)
+		}
+	})
+	defer cancel()
+*/
+
+type EventType int
+
+const (
+	EventIpChanged         EventType = iota //The voted address of this router changed
+	EventNodeIpChanged                      //The address of a node changed
+	EventNodeOnline                         //A heartbeat to a node succeeded after it was offline or never reached
+	EventNodeOffline                        //A heartbeat to an online node failed
+	EventNodeSyncMode                       //A node cannot be reached by heartbeat and its address is resolved with sync requests
+	EventOrphanModeEntered                  //This router cannot reach any node
+	EventOrphanModeLeft                     //This router can reach a node again after being in orphan mode
+	EventHandshakeAccepted                  //A node connected to this router with valid credentials
+	EventHandshakeRejected                  //A node failed to connect to this router
+	EventReRegistration                     //A node declined the TOTP of this router and a new handshake was performed
+	EventSecretRotated                      //The TOTP secret shared with a node was replaced
+	EventRateLimited                        //A request was refused as its address or node UUID is locked out or sending too many handshakes
+	EventLockout                            //An address or node UUID is locked out after too many failed attempts
+	EventNodeRevoked                        //A node is revoked on this router or by a notice from another node
+)
+
+var eventTypeNames = map[EventType]string{
+	EventIpChanged:         "ip-changed",
+	EventNodeIpChanged:     "node-ip-changed",
+	EventNodeOnline:        "node-online",
+	EventNodeOffline:       "node-offline",
+	EventNodeSyncMode:      "node-sync-mode",
+	EventOrphanModeEntered: "orphan-mode-entered",
+	EventOrphanModeLeft:    "orphan-mode-left",
+	EventHandshakeAccepted: "handshake-accepted",
+	EventHandshakeRejected: "handshake-rejected",
+	EventReRegistration:    "re-registration",
+	EventSecretRotated:     "secret-rotated",
+	EventRateLimited:       "rate-limited",
+	EventLockout:           "lockout",
+	EventNodeRevoked:       "node-revoked",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Type           EventType //The type of this event
+	Time           time.Time //The time this event happened
+	NodeUUID       string    //The UUID of the remote node, empty for events of this router
+	IpAddr         net.IP    //The new address for ip change events
+	PreviousIpAddr net.IP    //The previous address for ip change events
+	RemoteAddr     string    //The source address of the request for handshake, rate limit, lockout and revocation events
+	Err            error     //The reason of rejected handshakes, failed heartbeats, failed re-registrations and lockouts
+}
+
+type eventSubscription struct {
+	handler func(Event)
+}
+
+/*
+	Subscribe
+
+	Register a handler that is called for every event of this router. Handlers
+	are called in the order they are registered, on the routine that generated
+	the event (e.g. the heartbeat routine), so they should return quickly.
+	Call the returned function to unsubscribe
+*/
+func (s *ServiceRouter) Subscribe(handler func(Event)) func() {
+	subscription := &eventSubscription{handler: handler}
+	s.eventMux.Lock()
+	s.eventSubscriptions = append(s.eventSubscriptions, subscription)
+	s.eventMux.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.eventMux.Lock()
+			defer s.eventMux.Unlock()
+			newSubscriptions := []*eventSubscription{}
+			for _, thisSubscription := range s.eventSubscriptions {
+				if thisSubscription != subscription {
+					newSubscriptions = append(newSubscriptions, thisSubscription)
+				}
+			}
+			s.eventSubscriptions = newSubscriptions
+		})
+	}
+}
+
+/*
+	SubscribeChan
+
+	Return a channel that receive every event of this router. Events are dropped
+	if the channel buffer is full, so the receiver never block the router.
+	Call the returned function to unsubscribe and close the channel
+*/
+func (s *ServiceRouter) SubscribeChan(bufferSize int) (<-chan Event, func()) {
+	eventChan := make(chan Event, bufferSize)
+	var chanMux sync.Mutex
+	closed := false
+	cancel := s.Subscribe(func(e Event) {
+		chanMux.Lock()
+		defer chanMux.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case eventChan <- e:
+		default:
+			s.logger().Warn("event channel is full, dropping event", "event", e.Type.String(), logKeyRemote, e.NodeUUID)
+		}
+	})
+
+	return eventChan, func() {
+		cancel()
+		chanMux.Lock()
+		defer chanMux.Unlock()
+		if !closed {
+			closed = true
+			close(eventChan)
+		}
+	}
+}
+
+//emitEvent send the event to all subscribers. Must not be called while holding the router or node lock
+func (s *ServiceRouter) emitEvent(e Event) {
+	if e.Time.IsZero() {
+		e.Time = s.now()
+	}
+
+	s.eventMux.Lock()
+	subscriptions := make([]*eventSubscription, len(s.eventSubscriptions))
+	copy(subscriptions, s.eventSubscriptions)
+	s.eventMux.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.handler(e)
+	}
+}
+
+//setNodeOnline update the online state of the node and emit an event if it changed
+func (s *ServiceRouter) setNodeOnline(node *Node, online bool, reason error) {
+	node.mux.Lock()
+	changed := node.online != online
+	node.online = online
+	if online {
+		node.syncMode = false
+	}
+	node.mux.Unlock()
+
+	if !changed {
+		return
+	}
+	if online {
+		s.emitEvent(Event{Type: EventNodeOnline, NodeUUID: node.UUID})
+	} else {
+		s.emitEvent(Event{Type: EventNodeOffline, NodeUUID: node.UUID, Err: reason})
+	}
+}
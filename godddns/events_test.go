@@ -0,0 +1,79 @@
+package godddns
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	received := []string{}
+	cancelFirst := router.Subscribe(func(e Event) {
+		received = append(received, "first "+e.Type.String())
+	})
+	cancelSecond := router.Subscribe(func(e Event) {
+		received = append(received, "second "+e.Type.String())
+		if e.Time.IsZero() {
+			t.Error("event sent without time")
+		}
+	})
+
+	router.emitEvent(Event{Type: EventNodeOnline, NodeUUID: "node1"})
+	cancelFirst()
+	cancelFirst() //Cancelling twice does not remove other subscriptions
+	router.emitEvent(Event{Type: EventNodeOffline, NodeUUID: "node1"})
+	cancelSecond()
+	router.emitEvent(Event{Type: EventIpChanged})
+
+	expected := []string{"first node-online", "second node-online", "second node-offline"}
+	if len(received) != len(expected) {
+		t.Fatalf("received %q, expected %q", received, expected)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("received %q, expected %q", received, expected)
+			break
+		}
+	}
+}
+
+func TestSubscribeChan(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	events, cancel := router.SubscribeChan(1)
+	node := router.NewNode(NodeOptions{NodeID: "node1", Port: 8080, RESTInterface: "/godddns"})
+
+	//Only changes of the online state are sent
+	router.setNodeOnline(node, true, nil)
+	router.setNodeOnline(node, true, nil)
+	e := <-events
+	if e.Type != EventNodeOnline || e.NodeUUID != "node1" {
+		t.Errorf("received %s of %s, expected node-online of node1", e.Type, e.NodeUUID)
+	}
+
+	//Events are dropped instead of blocking the router when the buffer is full
+	reason := errors.New("connection refused")
+	router.setNodeOnline(node, false, reason)
+	router.emitEvent(Event{Type: EventIpChanged})
+	e = <-events
+	if e.Type != EventNodeOffline || e.Err != reason {
+		t.Errorf("received %s with %v, expected node-offline with the heartbeat error", e.Type, e.Err)
+	}
+
+	cancel()
+	cancel()
+	router.emitEvent(Event{Type: EventIpChanged})
+	if _, ok := <-events; ok {
+		t.Error("event received after the subscription is cancelled")
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	for eventType := EventIpChanged; eventType <= EventNodeRevoked; eventType++ {
+		if eventType.String() == "unknown" {
+			t.Errorf("event type %d has no name", eventType)
+		}
+	}
+	if EventType(-1).String() != "unknown" {
+		t.Error("invalid event type named")
+	}
+}
@@ -0,0 +1,76 @@
+package godddns
+
+import (
+	"errors"
+	"net"
+)
+
+/*
+	Export_test.go
+
+	Expose the internals needed by the tests of the godddns_test package,
+	which run the routers on the simulated network
+*/
+
+var ErrRotationNotPermitted = errRotationNotPermitted
+
+//NodePermissions return the permissions granted to the node on this router
+func (s *ServiceRouter) NodePermissions(nodeUUID string) Permission {
+	return s.getNodePermissions(nodeUUID)
+}
+
+//ResolveNodeIP ask the node askingUUID for the address of lostUUID, like a sync of a lost node
+func (s *ServiceRouter) ResolveNodeIP(lostUUID string, askingUUID string) (net.IP, error) {
+	askingNode := s.getNodeByUUID(askingUUID)
+	if askingNode == nil {
+		return nil, errors.New("node with given UUID not found")
+	}
+	return s.resolveNodeIpFromAskingNode(&Node{UUID: lostUUID}, askingNode)
+}
+
+//ChallengeJoined return true if the node has completed a challenge-response join
+func (n *Node) ChallengeJoined() bool {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.challengeJoin
+}
+
+//NodeSecret return the TOTP secret received from the node
+func (s *ServiceRouter) NodeSecret(nodeUUID string) string {
+	return s.getTotpSecret(nodeUUID)
+}
+
+//AcceptsToken return true if the token is accepted from the node, with its current or previous secret
+func (s *ServiceRouter) AcceptsToken(nodeUUID string, token string) bool {
+	return s.verifyNodeTOTP(nodeUUID, token) != ""
+}
+
+//RotateSecretIfDue rotate the secret of the node with given UUID if it is due, like after a heartbeat
+func (s *ServiceRouter) RotateSecretIfDue(nodeUUID string) error {
+	node := s.getNodeByUUID(nodeUUID)
+	if node == nil {
+		return errors.New("node with given UUID not found")
+	}
+	s.rotateSecretIfDue(node)
+	return nil
+}
+
+//TokenOf return the current token of the secret with the TOTP parameters of the node
+func (n *Node) TokenOf(secret string) string {
+	n.mux.RLock()
+	parameters := n.totpParameters
+	n.mux.RUnlock()
+	return n.parent.generateTOTP(secret, parameters)
+}
+
+//SecretIssueTime return the time the send secret was issued or last asked to rotate
+func (n *Node) SecretIssueTime() int64 {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.secretIssueTime
+}
+
+//VerifyRevocationNotice check the notice as if it is forwarded by the node with given UUID
+func (s *ServiceRouter) VerifyRevocationNotice(notice RevocationNotice, senderUUID string) error {
+	return s.verifyRevocationNotice(&notice, senderUUID)
+}
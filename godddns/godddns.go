@@ -1,12 +1,13 @@
 package godddns
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,15 +19,23 @@ type Node struct {
 	ReflectedIP        string //The IP address reflected by the other node
 	ReflectedPrivateIP string //The IP address reflected by local nodes, should be LAN address
 	RequireHTTPS       bool   //The connection to the node must pass through HTTPS
+	PasswordJoin       bool   //Join the node by sending the password (opr=c) instead of the challenge-response join, only over HTTPS
 	SendTotpSecret     string //The TOTPSecret for sending message
 
-	lastOnline    int64          //Last time this node is connectable
-	lastSync      int64          //Last time this device tries to conenct this node
-	retryCount    int64          //The number of retries done on this node
-	retryUsername string         //The username for retry
-	retryPassword string         //The password for retry
-	publicKey     []byte         //The public key of this node
-	parent        *ServiceRouter `json:"-"` //The service router that this node belongs to
+	totpParameters  TOTPParameters //The parameters of the TOTP for sending message, set by the node that issued the secret
+	secretIssueTime int64          //The time the TOTPSecret for sending message is received
+	lastOnline      int64          //Last time this node is connectable
+	lastSync        int64          //Last time this device tries to conenct this node
+	retryCount      int64          //The number of retries done on this node
+	retryUsername   string         //The username for retry
+	retryPassword   string         //The password for retry
+	publicKey       []byte         //The public key of this node
+	challengeJoin   bool           //If this node supports the challenge-response join, the password is never sent to it again
+	requireReplyMAC bool           //If this node has replied with a MAC, plain replies of older versions are refused from now on
+	online          bool           //If the last heartbeat to this node succeeded
+	syncMode        bool           //If this node address is resolved with sync requests
+	parent          *ServiceRouter `json:"-"` //The service router that this node belongs to
+	mux             sync.RWMutex   //Protect the address, reflection and retry states of this node
 }
 
 //New Node Options
@@ -35,32 +44,85 @@ type NodeOptions struct {
 	Port          int    //The connection port for this node
 	RESTInterface string //The RESTFUL request interface
 	RequireHTTPS  bool   //Use HTTPS for this node
+	PasswordJoin  bool   //The node only supports the password join (e.g. an older version), requires RequireHTTPS
 }
 
 type TOTPRecord struct {
-	RemoteUUID     string //The remote node ID where this TOTP was sent to
-	RecvTOTPSecret string //The TOTP secret assigned to this node
+	RemoteUUID     string         //The remote node ID where this TOTP was sent to
+	RecvTOTPSecret string         //The TOTP secret assigned to this node
+	Permissions    Permission     //The operations this node is allowed to perform on this router
+	PublicKey      []byte         //The public key sent by this node when it joined, nil if not exchanged
+	Parameters     TOTPParameters //The parameters of the TOTP generated from the secret
+
+	PreviousTOTPSecret   string         `json:",omitempty"` //The secret before the last rotation, still accepted until it expires
+	PreviousParameters   TOTPParameters //The parameters of the TOTP generated from the previous secret
+	PreviousSecretExpire int64          `json:",omitempty"` //The time the previous secret is no longer accepted
+	RequireNonce         bool           `json:",omitempty"` //The node has sent packets with nonce, packets without nonce are refused
 }
 
 type RouterOptions struct {
-	DeviceUUID   string                    //The UUID of this device
-	AuthFunction func(string, string) bool `json:"-"` //Check if the authentication is correct based on username and password
-	SyncInterval int64                     //Sync interval in seconds
-	Verbal       bool                      //Enable verbal output
+	DeviceUUID              string                        //The UUID of this device
+	AuthFunction            func(string, string) bool     `json:"-"` //Check if the authentication is correct based on username and password
+	Authenticator           Authenticator                 `json:"-"` //Check the handshake with its full request, AuthFunction is used if not set
+	ScramCredentialFunction func(string) *ScramCredential `json:"-"` //Return the verifier of the username for the challenge-response join, nil if not found
+	RequireChallengeJoin    bool                          //Refuse the password join (opr=c) and never fall back to it when joining other nodes
+	SyncInterval            int64                         //Sync interval in seconds
+	Verbal                  bool                          //Enable debug and info output of the default logger
+	Transport               Transport                     `json:"-"` //The transport for sending packets to other nodes, use HTTP if not set
+	Clock                   Clock                         `json:"-"` //The clock for TOTP and heartbeat timing, use system time if not set
+	Logger                  Logger                        `json:"-"` //The leveled logger (e.g. *slog.Logger), use the standard log package if not set
+	Store                   Store                         `json:"-"` //The storage backend the router state is saved to automatically, not saved if not set
+	SecretCipher            *SecretCipher                 `json:"-"` //The cipher to encrypt the secrets in the saved state, saved in plain text without the retry credentials if not set
+	SaveDelay               time.Duration                 //The delay before changes are saved to the store, default 1 second
+	TOTP                    TOTPOptions                   //The parameters of the issued TOTP secrets and their rotation schedule
+	RateLimit               RateLimitOptions              //The limits of failed attempts and handshakes before requests are refused
+	AccessControl           AccessControlOptions          //The source addresses allowed and denied for each type of request
+	TrustedProxies          []string                      //CIDRs or addresses of the reverse proxies whose forwarding header is honored, use SetTrustedProxies to change them after the router is created
+	ForwardedHeader         string                        //The forwarding header set by the trusted proxies: X-Forwarded-For (default) or Forwarded
+	Revocation              RevocationOptions             //The administrator keys trusted to endorse the routers issuing revocations
 }
 
+//ServiceRouter is a go-DDDNS node. The exported fields are guarded by the router lock once the router is running,
+//use the accessors (AddNode, RemoveNode, GetNodeByUUID, GetDeviceIpAddr, SetIpChangeEventListener...) instead of reading or changing them directly
 type ServiceRouter struct {
 	NodeMap                    []*Node
 	TOTPMap                    []*TOTPRecord
 	Options                    *RouterOptions
-	DeviceIpAddr               net.IP
+	DeviceIpAddr               net.IP //The IP address of this router, IPv4 is preferred if the router is dual-stack
+	DeviceIpv4Addr             net.IP //The IPv4 address of this router, nil if no node reflected an IPv4 address
+	DeviceIpv6Addr             net.IP //The IPv6 address of this router, nil if no node reflected an IPv6 address
 	LastIpUpdateTime           int64
 	LastSyncTime               int64
 	ConnectionRetryWaitTimeMin int
 	ConnectionRetryWaitTimeMax int
-	IpChangeEventListener      func(net.IP) `json:"-"`
+	IpChangeEventListener      func(net.IP) `json:"-"` //Called when the address of this router changed, use SetIpChangeEventListener to change it while the router is running
 
 	heartBeatTickerChannel chan bool
+	orphanMode             bool                     //If this router cannot reach any node
+	dnsServers             []*DNSServer             //The DNS responders started by this router
+	recordFiles            []*recordFile            //The record files kept in sync with the cluster
+	dnsUpdatePublishers    []*DNSUpdatePublisher    //The RFC 2136 publishers of this router
+	metrics                routerMetrics            //The heartbeat, sync and handshake statistic of this router
+	eventSubscriptions     []*eventSubscription     //The subscribers of the router events
+	eventMux               sync.Mutex               //Protect the event subscriptions
+	scramSessions          map[string]*scramSession //The challenge-response handshakes waiting for the client proof
+	scramMockKey           []byte                   //The key to derive the fake salt of unknown usernames
+	scramMux               sync.Mutex               //Protect the challenge-response handshakes
+	identityKey            ed25519.PrivateKey       //The private key of this router, generated on first use
+	identityMux            sync.Mutex               //Protect the identity key
+	replayCaches           map[string]*replayCache  //The nonces recently accepted from each node
+	replayMux              sync.Mutex               //Protect the replay caches
+	rateLimiter            rateLimiter              //The failed attempts and handshake allowance of each address and node UUID
+	rateLimitMux           sync.Mutex               //Protect the rate limiter
+	revocations            []*Revocation            //The nodes revoked on this router and the delivery of their notices
+	revocationRemovals     map[string]int64         //Node UUID => the time its revocation is removed, older notices of the node are refused
+	trustedProxies         []*net.IPNet             //The parsed trusted proxies of the options
+	savePending            bool                     //If a save to the store is scheduled
+	saveQuit               chan bool                //Closed to cancel the scheduled save
+	saveStopped            bool                     //If the router is closed and changes are no longer saved
+	saveMux                sync.Mutex               //Serialize the saves to the store
+	heartBeatCycleMux      sync.Mutex               //Make sure only one heartbeat cycle is running at a time
+	mux                    sync.RWMutex             //Protect the node map, TOTP map, revocation list and device ip address states
 }
 
 var (
@@ -68,31 +130,95 @@ var (
 )
 
 func NewServiceRouter(options RouterOptions) *ServiceRouter {
-	return &ServiceRouter{
+	clock := options.Clock
+	if clock == nil {
+		clock = defaultClock
+	}
+
+	newRouter := &ServiceRouter{
 		NodeMap:                    []*Node{},
 		TOTPMap:                    []*TOTPRecord{},
 		Options:                    &options,
 		DeviceIpAddr:               nil,
-		LastIpUpdateTime:           time.Now().Unix(),
+		LastIpUpdateTime:           clock.Now().Unix(),
 		LastSyncTime:               0,
 		ConnectionRetryWaitTimeMin: 10,
 		ConnectionRetryWaitTimeMax: 120,
 		IpChangeEventListener:      nil,
 	}
+	newRouter.loadTrustedProxies()
+	newRouter.checkStoreCipher()
+	return newRouter
+}
+
+//The operation name of each request type for logs and metrics
+var operationNames = map[string]string{
+	"c":  "connect",
+	"cs": "connect",
+	"cf": "connect",
+	"h":  "heartbeat",
+	"s":  "sync",
+	"r":  "rotate",
+	"v":  "revoke",
 }
 
 //Create a basic request router
 func (s *ServiceRouter) HandleConnections(w http.ResponseWriter, r *http.Request) {
 	oprType := r.URL.Query().Get("opr")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("405 - Method Not Allowed"))
+		return
+	}
+
+	//Use the address of the client instead of the reverse proxy in front of this router
+	if clientAddr := s.resolveClientAddr(r); clientAddr != r.RemoteAddr {
+		r = r.WithContext(r.Context())
+		r.RemoteAddr = clientAddr
+	}
+
+	//Check the source address against the access lists before anything else
+	operation, knownOperation := operationNames[oprType]
+	if !knownOperation {
+		operation = "unknown"
+	}
+	if !s.allowRequestSource(w, r, operation) {
+		return
+	}
+
+	//Packets are small, refuse large bodies before they are parsed
+	r.Body = http.MaxBytesReader(w, r.Body, s.getRateLimitOptions().MaxRequestBodySize)
+
+	//Refuse addresses that are locked out or sending too many handshakes
+	if knownOperation {
+		isHandshake := operation == "connect"
+		if !s.checkRequestRate(w, r, operation, isHandshake) {
+			return
+		}
+	}
+
 	if oprType == "c" {
 		//Connection Request
 		s.handleConnectionEstablishResponse(w, r)
+	} else if oprType == "cs" {
+		//Challenge-response Connection Request
+		s.handleChallengeStart(w, r)
+	} else if oprType == "cf" {
+		//Challenge-response Connection Proof
+		s.handleChallengeFinish(w, r)
 	} else if oprType == "h" {
 		//Heartbeat Request
 		s.handleHeartBeatRequest(w, r)
 	} else if oprType == "s" {
 		//Sync Request
 		s.handleSyncRequestByLostNode(w, r)
+	} else if oprType == "r" {
+		//TOTP Secret Rotation Request
+		s.handleRotationRequest(w, r)
+	} else if oprType == "v" {
+		//Node Revocation Notice
+		s.handleRevocationRequest(w, r)
 	} else {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("400 - Bad Request"))
@@ -107,6 +233,7 @@ func (s *ServiceRouter) NewNode(options NodeOptions) *Node {
 		Port:             options.Port,
 		RESTfulInterface: filepath.ToSlash(filepath.Clean(options.RESTInterface)),
 		RequireHTTPS:     options.RequireHTTPS,
+		PasswordJoin:     options.PasswordJoin,
 		SendTotpSecret:   "",
 
 		lastOnline: 0,
@@ -118,16 +245,27 @@ func (s *ServiceRouter) NewNode(options NodeOptions) *Node {
 
 //Add the node to this router
 func (s *ServiceRouter) AddNode(node *Node) error {
-	if s.NodeRegistered(node.UUID) {
+	s.mux.Lock()
+	if s.nodeRegistered(node.UUID) {
+		s.mux.Unlock()
 		return errors.New("node already registered")
 	}
+	if s.revocationExists(node.UUID) >= 0 {
+		s.mux.Unlock()
+		return errors.New("node is revoked")
+	}
 	s.NodeMap = append(s.NodeMap, node)
+	s.mux.Unlock()
+
+	s.scheduleSave()
 	return nil
 }
 
-//Remove the node with given UUID
+//Remove the node with given UUID from this router only, use RevokeNode to remove it from the whole cluster
 func (s *ServiceRouter) RemoveNode(nodeUUID string) error {
-	if !s.NodeRegistered(nodeUUID) {
+	s.mux.Lock()
+	if !s.nodeRegistered(nodeUUID) {
+		s.mux.Unlock()
 		return errors.New("node with given UUID not exists")
 	}
 	newNodeMap := []*Node{}
@@ -147,27 +285,30 @@ func (s *ServiceRouter) RemoveNode(nodeUUID string) error {
 
 	s.NodeMap = newNodeMap
 	s.TOTPMap = newTotpMap
+	s.mux.Unlock()
+
+	s.metrics.removeNode(nodeUUID)
+	s.scheduleSave()
 	return nil
 }
 
-//Add the node to this router
+//Check if the node with given UUID is registered on this router
 func (s *ServiceRouter) NodeRegistered(nodeUUID string) bool {
-	nodeUUID = strings.TrimSpace(nodeUUID)
-	for _, node := range s.NodeMap {
-		if strings.TrimSpace(node.UUID) == nodeUUID {
-			return true
-		}
-	}
-	return false
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.nodeRegistered(nodeUUID)
 }
 
 func (s *ServiceRouter) NodeConnected(nodeUUID string) bool {
-	targetNode := s.getNodeByUUID(nodeUUID)
-	if targetNode == nil {
-		return false
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, node := range s.NodeMap {
+		if node.UUID == nodeUUID {
+			return s.totpMapExists(node.UUID) >= 0
+		}
 	}
 
-	return s.totpMapExists(targetNode.UUID) >= 0
+	return false
 }
 
 func (s *ServiceRouter) GetNodeByUUID(nodeUUID string) (*Node, error) {
@@ -179,32 +320,113 @@ func (s *ServiceRouter) GetNodeByUUID(nodeUUID string) (*Node, error) {
 	}
 }
 
+//GetNodeIP return the IP address of the node with given UUID, return nil if not found
 func (s *ServiceRouter) GetNodeIP(nodeUUID string) net.IP {
 	targetNode := s.getNodeByUUID(nodeUUID)
-	return targetNode.IpAddr
+	if targetNode == nil {
+		return nil
+	}
+	return targetNode.GetIpAddr()
 }
 
 func (s *ServiceRouter) GetNeighbourNodes() []string {
 	nodeUUIDs := []string{}
-	for _, node := range s.NodeMap {
+	for _, node := range s.getNodes() {
 		nodeUUIDs = append(nodeUUIDs, node.UUID)
 	}
 
 	return nodeUUIDs
 }
 
+//GetDeviceIpAddr return the IP address of this router as voted by the other nodes
+func (s *ServiceRouter) GetDeviceIpAddr() net.IP {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.DeviceIpAddr
+}
+
+//GetDeviceIpAddrByFamily return the IPv4 and IPv6 address of this router as voted by the other nodes
+func (s *ServiceRouter) GetDeviceIpAddrByFamily() (net.IP, net.IP) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.DeviceIpv4Addr, s.DeviceIpv6Addr
+}
+
+//SetIpChangeEventListener set the function called when the address of this router changed, nil to remove it
+func (s *ServiceRouter) SetIpChangeEventListener(listener func(net.IP)) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.IpChangeEventListener = listener
+}
+
+//IsOrphan return true if this router cannot reach any node in the cluster
+func (s *ServiceRouter) IsOrphan() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.orphanMode
+}
+
 func (s *ServiceRouter) Close() {
 	//Stop Heartbeat
 	s.StopHeartBeat()
 
+	//Write the latest state to the store before the connections are ended
+	s.stopSaving()
+
 	//Disconnect all nodes
-	for _, node := range s.NodeMap {
+	for _, node := range s.getNodes() {
 		node.EndConnection()
 	}
+
+	//Stop the DNS responders
+	s.mux.Lock()
+	dnsServers := s.dnsServers
+	s.dnsServers = []*DNSServer{}
+	s.mux.Unlock()
+	for _, dnsServer := range dnsServers {
+		dnsServer.Close()
+	}
 }
 
+//PrettyPrintTOTPMap print the UUID of the nodes registered on this router. The TOTP secrets are redacted
 func (s *ServiceRouter) PrettyPrintTOTPMap() {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	for _, totpR := range s.TOTPMap {
-		fmt.Println(totpR.RemoteUUID + ": " + totpR.RecvTOTPSecret)
+		fmt.Println(totpR.RemoteUUID + ": " + redactSecret(totpR.RecvTOTPSecret))
 	}
 }
+
+/*
+	Node state accessors
+
+	The following functions are safe to be called while the heartbeat routine is running
+*/
+
+//GetIpAddr return the IP address of this node
+func (n *Node) GetIpAddr() net.IP {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.IpAddr
+}
+
+//GetReflectedIP return the public and private IP address of the parent router as reflected by this node
+func (n *Node) GetReflectedIP() (string, string) {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.ReflectedIP, n.ReflectedPrivateIP
+}
+
+//GetLastOnline return the last time (unix timestamp) this node is connectable
+func (n *Node) GetLastOnline() int64 {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.lastOnline
+}
+
+//GetRetryCount return the number of failed heartbeats since this node last online
+func (n *Node) GetRetryCount() int64 {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.retryCount
+}
@@ -1,18 +1,13 @@
 package godddns
 
 import (
-	"bytes"
+	"crypto/hmac"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"time"
-
-	"github.com/xlzd/gotp"
 )
 
 /*
@@ -23,34 +18,55 @@ import (
 */
 
 type HeartBeatPacket struct {
-	NodeUUID string
-	TOTP     string
-	IPADDR   string
+	NodeUUID  string
+	TOTP      string
+	IPADDR    string
+	Nonce     string `json:",omitempty"` //Random value the reply is bound to, each nonce is accepted once
+	Timestamp int64  `json:",omitempty"` //The time the packet is sent
+	MAC       []byte `json:",omitempty"` //Keyed with the TOTP secret of the sending node
+	Signature []byte `json:",omitempty"` //Signed with the identity key of the sending node
+}
+
+//Reply to a heartbeat with nonce, authenticated by the replying router
+type HeartBeatResponse struct {
+	ReflectionIP string //The address of the sending node as seen by the replying router
+	MAC          []byte //Keyed with the TOTP secret the heartbeat is sent with
+	Signature    []byte //Signed with the identity key of the replying router
+}
+
+//signedMessage return the message signed in the heartbeat sent to the router with given UUID
+func (p *HeartBeatPacket) signedMessage(routerUUID string) []byte {
+	return signedMessage("heartbeat", p.NodeUUID, routerUUID, p.TOTP, p.IPADDR, p.Nonce, strconv.FormatInt(p.Timestamp, 10))
+}
+
+//signedMessage return the message signed in the reply of the router with given UUID to the heartbeat
+func (r *HeartBeatResponse) signedMessage(routerUUID string, packet *HeartBeatPacket) []byte {
+	return signedMessage("heartbeat-response", routerUUID, packet.NodeUUID, packet.Nonce, r.ReflectionIP)
 }
 
 func (s *ServiceRouter) StartHeartBeat() {
-	beatingInterval := s.Options.SyncInterval
-	if beatingInterval <= 0 {
-		//Use default value 10 seconds
-		beatingInterval = 10
-	}
+	beatingInterval := s.getSyncInterval()
 
 	//Check if there is a previous heart beat routine running. Kill it if true
-	if s.heartBeatTickerChannel != nil {
-		s.heartBeatTickerChannel <- true
-	}
+	s.StopHeartBeat()
 
 	//Execute the initiation heart beat cycle
 	s.ExecuteHeartBeatCycle()
 
 	//Create a heart beat ticker of given interval
-	ticker := time.NewTicker(time.Duration(beatingInterval) * time.Second)
+	ticker := s.getClock().NewTicker(time.Duration(beatingInterval) * time.Second)
 	quit := make(chan bool)
+	s.mux.Lock()
+	if s.heartBeatTickerChannel != nil {
+		//Another heartbeat routine started in between. Replace it with this one
+		close(s.heartBeatTickerChannel)
+	}
 	s.heartBeatTickerChannel = quit
+	s.mux.Unlock()
 	go func() {
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.Chan():
 				s.ExecuteHeartBeatCycle()
 			case <-quit:
 				ticker.Stop()
@@ -61,8 +77,11 @@ func (s *ServiceRouter) StartHeartBeat() {
 }
 
 func (s *ServiceRouter) StopHeartBeat() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
 	if s.heartBeatTickerChannel != nil {
-		s.heartBeatTickerChannel <- true
+		close(s.heartBeatTickerChannel)
+		s.heartBeatTickerChannel = nil
 	}
 }
 
@@ -77,32 +96,60 @@ func (s *ServiceRouter) handleHeartBeatRequest(w http.ResponseWriter, r *http.Re
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !s.checkNodeLockout(w, r, "heartbeat", payload.NodeUUID) {
+		return
+	}
 
 	//Validate the TOTP
-	targetTotpSecret := ""
-	for _, thisTOTPRecord := range s.TOTPMap {
-		if thisTOTPRecord.RemoteUUID == payload.NodeUUID {
-			targetTotpSecret = thisTOTPRecord.RecvTOTPSecret
-		}
-	}
+	targetTotpSecret := s.getTotpSecret(payload.NodeUUID)
 
 	if targetTotpSecret == "" {
 		//No record found, target UUID did not register on this node
+		s.recordAuthFailure(r, "heartbeat", payload.NodeUUID)
+		s.metrics.inc(metricTOTPFailures, "operation", "heartbeat")
 		http.Error(w, "node TOTP not registered", http.StatusUnauthorized)
-		log.Println(s.Options.DeviceUUID + " TOTP Map Dump: ")
-		s.PrettyPrintTOTPMap()
+		s.logger().Warn("heartbeat rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "heartbeat", logKeyEndpoint, r.RemoteAddr, logKeyError, "node TOTP not registered")
 		return
 	}
 
-	targetTotpResolver := gotp.NewDefaultTOTP(targetTotpSecret)
-	isValidTotp := targetTotpResolver.Verify(payload.TOTP, int(time.Now().Unix()))
+	//The previous secret is still accepted for a while after rotation
+	matchedTotpSecret := s.verifyNodeTOTP(payload.NodeUUID, payload.TOTP)
 
-	if !isValidTotp {
+	if matchedTotpSecret == "" {
 		//Response to invalid TOTP
+		s.recordAuthFailure(r, "heartbeat", payload.NodeUUID)
+		s.metrics.inc(metricTOTPFailures, "operation", "heartbeat")
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("400 - Invalid TOTP"))
-		log.Println(s.Options.DeviceUUID + " TOTP Map Dump: ")
-		s.PrettyPrintTOTPMap()
+		s.logger().Warn("heartbeat rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "heartbeat", logKeyEndpoint, r.RemoteAddr, logKeyError, "invalid TOTP")
+		return
+	}
+
+	//Check the signature if the node has sent its public key
+	err = s.verifyNodeSignature(payload.NodeUUID, payload.signedMessage(s.Options.DeviceUUID), payload.Signature)
+	if err != nil {
+		s.recordNodeFailure(r, "heartbeat", payload.NodeUUID)
+		s.metrics.inc(metricSignatureFailures, "operation", "heartbeat")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		s.logger().Warn("heartbeat rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "heartbeat", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	//Make sure the packet is recent and not seen before
+	status, err := s.checkPacketFreshness(payload.NodeUUID, matchedTotpSecret, payload.signedMessage(s.Options.DeviceUUID), payload.Nonce, payload.Timestamp, payload.MAC, payload.TOTP, r.RemoteAddr)
+	if err != nil {
+		s.metrics.inc(metricReplayedPackets, "operation", "heartbeat")
+		http.Error(w, err.Error(), status)
+		s.logger().Warn("heartbeat rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "heartbeat", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	s.recordAuthSuccess(r, payload.NodeUUID)
+
+	//Check if the node is allowed to send heartbeat
+	if !s.getNodePermissions(payload.NodeUUID).Has(PermissionHeartbeat) {
+		http.Error(w, "heartbeat not permitted", http.StatusForbidden)
+		s.logger().Warn("heartbeat rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "heartbeat", logKeyEndpoint, r.RemoteAddr, logKeyError, "heartbeat not permitted")
 		return
 	}
 
@@ -112,10 +159,63 @@ func (s *ServiceRouter) handleHeartBeatRequest(w http.ResponseWriter, r *http.Re
 		http.Error(w, "node UUID not registered", http.StatusUnauthorized)
 		return
 	}
-	targetNodeRegistry.IpAddr = net.ParseIP(trimIpPort(r.RemoteAddr))
+	newIpAddr := net.ParseIP(trimIpPort(r.RemoteAddr))
+	targetNodeRegistry.mux.Lock()
+	previousIpAddr := targetNodeRegistry.IpAddr
+	nodeIpChanged := !newIpAddr.Equal(previousIpAddr)
+	targetNodeRegistry.IpAddr = newIpAddr
+	targetNodeRegistry.mux.Unlock()
+	if nodeIpChanged {
+		s.metrics.inc(metricNodeIpChanges, "node", payload.NodeUUID)
+		s.emitEvent(Event{Type: EventNodeIpChanged, NodeUUID: payload.NodeUUID, IpAddr: newIpAddr, PreviousIpAddr: previousIpAddr})
+		s.scheduleSave()
+	}
 
 	//Reply the IP address of the requesting node from this node's perspective
-	w.Write([]byte(r.RemoteAddr))
+	if payload.Nonce == "" {
+		//Sent by older versions that do not verify the reply
+		w.Write([]byte(r.RemoteAddr))
+		return
+	}
+	response := HeartBeatResponse{
+		ReflectionIP: r.RemoteAddr,
+	}
+	response.MAC = packetMAC(matchedTotpSecret, response.signedMessage(s.Options.DeviceUUID, &payload))
+	response.Signature = s.sign(response.signedMessage(s.Options.DeviceUUID, &payload))
+	result, _ := json.Marshal(response)
+	w.Write(result)
+}
+
+/*
+	parseHeartBeatResponse
+
+	Return the reflected address in the reply of the node. The reply must carry
+	a MAC keyed with the TOTP secret the heartbeat is sent with and bound to the
+	nonce of the heartbeat, and be signed by the node if its public key is
+	known, so the reflection cannot be forged on the way. The plain reply of
+	older versions is only accepted from nodes that never sent a MAC
+*/
+func parseHeartBeatResponse(node *Node, packet *HeartBeatPacket, totpSecret string, body []byte) (string, error) {
+	response := HeartBeatResponse{}
+	err := json.Unmarshal(body, &response)
+	if err != nil || len(response.MAC) == 0 {
+		if node.requiresReplyMAC() {
+			return "", errors.New("heartbeat response is not authenticated")
+		}
+		//Older versions reply the reflected address in plain text
+		return string(body), nil
+	}
+	if !hmac.Equal(response.MAC, packetMAC(totpSecret, response.signedMessage(node.UUID, packet))) {
+		return "", errors.New("heartbeat response is not authenticated")
+	}
+	if publicKey := node.GetPublicKey(); len(publicKey) > 0 {
+		err = verifySignature(publicKey, response.signedMessage(node.UUID, packet), response.Signature)
+		if err != nil {
+			return "", err
+		}
+	}
+	node.setReplyMACRequired()
+	return response.ReflectionIP, nil
 }
 
 /*
@@ -123,13 +223,23 @@ func (s *ServiceRouter) handleHeartBeatRequest(w http.ResponseWriter, r *http.Re
 	the current node's public / private IP address
 */
 func (s *ServiceRouter) ExecuteHeartBeatCycle() {
+	s.heartBeatCycleMux.Lock()
+	defer s.heartBeatCycleMux.Unlock()
+
 	//Execute heartbeat on all connected nodes
-	for _, node := range s.NodeMap {
+	for _, node := range s.getNodes() {
 		s.heartBeatToNode(node)
 	}
 
+	//Forward the revocations the other nodes have not received yet
+	s.deliverRevocations()
+
+	//Drop the rate limiter entries of addresses that are no longer seen
+	s.pruneRateLimiter()
+
 	//Vote the correct ip address from what other nodes told us
 	pubip, priip := s.VoteRouterIPAddr()
+	ipv4, ipv6 := s.VoteRouterIPAddrByFamily()
 
 	//Use its public IP as this node IP, if public ip is not found (aka LAN cluster)
 	//use private IP address instead
@@ -140,16 +250,35 @@ func (s *ServiceRouter) ExecuteHeartBeatCycle() {
 		newIp = priip
 	}
 
-	if newIp.String() != "" && newIp.String() != s.DeviceIpAddr.String() {
+	s.mux.Lock()
+	previousIp := s.DeviceIpAddr
+	ipChanged := newIp.String() != "" && newIp.String() != s.DeviceIpAddr.String()
+	if ipChanged {
 		//IP has changed.
-		s.LastIpUpdateTime = time.Now().Unix()
-		if s.IpChangeEventListener != nil {
+		s.LastIpUpdateTime = s.now().Unix()
+	}
+	s.LastSyncTime = s.now().Unix()
+	s.DeviceIpAddr = newIp
+	s.DeviceIpv4Addr = ipv4
+	s.DeviceIpv6Addr = ipv6
+	ipChangeEventListener := s.IpChangeEventListener
+	s.mux.Unlock()
+
+	if ipChanged {
+		s.metrics.inc(metricIpChanges)
+		s.emitEvent(Event{Type: EventIpChanged, IpAddr: newIp, PreviousIpAddr: previousIp})
+		s.scheduleSave()
+		if ipChangeEventListener != nil {
 			//An event listener has bind to this router. Notify it as well.
-			s.IpChangeEventListener(newIp)
+			ipChangeEventListener(newIp)
 		}
 	}
-	s.LastSyncTime = time.Now().Unix()
-	s.DeviceIpAddr = newIp
+
+	//Push the new addresses to the external DNS servers
+	s.publishDNSUpdates()
+
+	//Rewrite the record files if any address in the cluster changed
+	s.updateRecordFiles(false)
 }
 
 //HeartBeatToNode execute a one-time heartbeat update to given node with matching UUID
@@ -163,67 +292,102 @@ func (s *ServiceRouter) HeartBeatToNode(nodeUUID string) error {
 }
 
 //VoteRouterIPAddr will check all the IP addresses return from the network of nodes
-//and decide what is the current router public and private IP address
+//and decide what is the current router public and private IP address.
+//IPv4 results are preferred, IPv6 results are returned only if no IPv4 address is reflected
 func (s *ServiceRouter) VoteRouterIPAddr() (net.IP, net.IP) {
-	privateIps := map[string]int{}
-	publicIps := map[string]int{}
-	//Create the key value pairs
-	for _, node := range s.NodeMap {
-		if node.ReflectedIP != "" {
-			publicIps[node.ReflectedIP] = 0
-		}
+	votes := s.voteReflectedIPs()
 
-		if node.ReflectedPrivateIP != "" {
-			privateIps[node.ReflectedPrivateIP] = 0
-		}
+	rpub := votes.publicIpv4
+	if rpub == nil {
+		rpub = votes.publicIpv6
+	}
+	if rpub == nil {
+		rpub = net.ParseIP("0.0.0.0")
+	}
+
+	rpri := votes.privateIpv4
+	if rpri == nil {
+		rpri = votes.privateIpv6
+	}
+	if rpri == nil {
+		rpri = net.ParseIP("0.0.0.0")
 	}
+	return rpub, rpri
+}
+
+//VoteRouterIPAddrByFamily will check all the IP addresses return from the network of nodes
+//and decide what is the current router IPv4 and IPv6 address. Public addresses are preferred
+//over private ones in each family. Return nil for the family that no node has reflected.
+func (s *ServiceRouter) VoteRouterIPAddrByFamily() (net.IP, net.IP) {
+	votes := s.voteReflectedIPs()
+
+	ipv4 := votes.publicIpv4
+	if ipv4 == nil {
+		ipv4 = votes.privateIpv4
+	}
+
+	ipv6 := votes.publicIpv6
+	if ipv6 == nil {
+		ipv6 = votes.privateIpv6
+	}
+	return ipv4, ipv6
+}
+
+//The vote results of the reflected IPs grouped by address family
+type ipVoteResult struct {
+	publicIpv4  net.IP
+	privateIpv4 net.IP
+	publicIpv6  net.IP
+	privateIpv6 net.IP
+}
+
+func (s *ServiceRouter) voteReflectedIPs() *ipVoteResult {
+	publicIpv4s := map[string]int{}
+	privateIpv4s := map[string]int{}
+	publicIpv6s := map[string]int{}
+	privateIpv6s := map[string]int{}
 
 	//Count the number of pairs in the node map
-	publicIpMaxCount := 0
-	privateIpMaxCount := 0
-	for _, node := range s.NodeMap {
-		if node.ReflectedIP != "" {
-			publicIps[node.ReflectedIP]++
-			if publicIps[node.ReflectedIP] > publicIpMaxCount {
-				publicIpMaxCount = publicIps[node.ReflectedIP]
+	for _, node := range s.getNodes() {
+		reflectedIP, reflectedPrivateIP := node.GetReflectedIP()
+		if ip := net.ParseIP(reflectedIP); ip != nil {
+			if isIPv4(ip) {
+				publicIpv4s[ip.String()]++
+			} else {
+				publicIpv6s[ip.String()]++
 			}
 		}
 
-		if node.ReflectedPrivateIP != "" {
-			privateIps[node.ReflectedPrivateIP]++
-			if privateIps[node.ReflectedPrivateIP] > privateIpMaxCount {
-				privateIpMaxCount = privateIps[node.ReflectedPrivateIP]
+		if ip := net.ParseIP(reflectedPrivateIP); ip != nil {
+			if isIPv4(ip) {
+				privateIpv4s[ip.String()]++
+			} else {
+				privateIpv6s[ip.String()]++
 			}
 		}
 	}
 
-	//Extract the vote results for public and private ips
-	votePublicIpResult := "0.0.0.0"
-	votePrivateIpResult := "0.0.0.0"
-	for ip, count := range publicIps {
-		if count == publicIpMaxCount {
-			votePublicIpResult = ip
-			break
-		}
+	return &ipVoteResult{
+		publicIpv4:  pickMostVotedIP(publicIpv4s),
+		privateIpv4: pickMostVotedIP(privateIpv4s),
+		publicIpv6:  pickMostVotedIP(publicIpv6s),
+		privateIpv6: pickMostVotedIP(privateIpv6s),
 	}
+}
 
-	for pip, count := range privateIps {
-		if count == privateIpMaxCount {
-			votePrivateIpResult = pip
-			break
+//pickMostVotedIP return the ip with most votes, ties are broken by the smaller string
+//so every vote on the same set of reflections gives the same result. Return nil if there are no votes
+func pickMostVotedIP(votes map[string]int) net.IP {
+	voteResult := ""
+	maxCount := 0
+	for ip, count := range votes {
+		if count > maxCount || (count == maxCount && ip < voteResult) {
+			voteResult = ip
+			maxCount = count
 		}
 	}
 
-	//Prase the IP to return correct datatypes
-	rpub := net.ParseIP(votePublicIpResult)
-	if rpub == nil {
-		rpub = net.ParseIP("0.0.0.0")
-	}
-	rpri := net.ParseIP(votePrivateIpResult)
-	if rpri == nil {
-		rpri = net.ParseIP("0.0.0.0")
-	}
-	return rpub, rpri
+	return net.ParseIP(voteResult)
 }
 
 /*
@@ -231,91 +395,126 @@ func (s *ServiceRouter) VoteRouterIPAddr() (net.IP, net.IP) {
 	DDDNS implementation. Updates will be written directly to the node object pointed by the poitner
 */
 func (s *ServiceRouter) heartBeatToNode(node *Node) error {
-	if node.retryCount >= heartBeatRetryCount {
+	node.mux.RLock()
+	retryCount := node.retryCount
+	nodeIpAddr := node.IpAddr
+	sendTotpSecret := node.SendTotpSecret
+	totpParameters := node.totpParameters
+	node.mux.RUnlock()
+
+	if retryCount >= heartBeatRetryCount {
 		//Enter sync mode
+		node.mux.Lock()
+		enteredSyncMode := !node.syncMode
+		node.syncMode = true
+		node.mux.Unlock()
+		if enteredSyncMode {
+			s.emitEvent(Event{Type: EventNodeSyncMode, NodeUUID: node.UUID})
+		}
 		return s.syncNodeAddress(node)
 	}
 
 	//Assemble the target node heartbeat endpoint
-	reqEndpoint := node.IpAddr.String() + ":" + strconv.Itoa(node.Port) + "/" + node.RESTfulInterface + "?opr=h"
-	reqEndpoint = filepath.ToSlash(filepath.Clean(reqEndpoint))
+	endpoint := node.getEndpoint(nodeIpAddr.String())
 
-	//Append protocol type
-	if node.RequireHTTPS {
-		reqEndpoint = "https://" + reqEndpoint
-	} else {
-		reqEndpoint = "http://" + reqEndpoint
-	}
-
-	if s.Options.Verbal {
-		log.Println("Heartbeat request sending to: ", reqEndpoint, " at ip address: ", node.IpAddr.String())
-	}
+	s.logger().Debug("sending heartbeat", logKeyRemote, node.UUID, logKeyOperation, "heartbeat", logKeyEndpoint, endpoint.URL("h"))
 
 	//Generate a TOTP for this node
-	totp := gotp.NewDefaultTOTP(node.SendTotpSecret)
-	token := totp.Now()
+	token := s.generateTOTP(sendTotpSecret, totpParameters)
 
 	//POST this node's IP address to the target node
-	postBody, _ := json.Marshal(map[string]string{
-		"NodeUUID": s.Options.DeviceUUID,
-		"TOTP":     token,
-		"IPADDR":   s.DeviceIpAddr.String(),
-	})
-	responseBody := bytes.NewBuffer(postBody)
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	packet := HeartBeatPacket{
+		NodeUUID:  s.Options.DeviceUUID,
+		TOTP:      token,
+		IPADDR:    s.GetDeviceIpAddr().String(),
+		Nonce:     nonce,
+		Timestamp: s.now().Unix(),
+	}
+	packet.MAC = packetMAC(sendTotpSecret, packet.signedMessage(node.UUID))
+	packet.Signature = s.sign(packet.signedMessage(node.UUID))
+	postBody, _ := json.Marshal(packet)
 
 	//Record last sync time
-	node.lastSync = time.Now().Unix()
-
-	//Create a POST request to the target node heartbeat endpoint
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
-	resp, err := client.Post(reqEndpoint, "application/json", responseBody)
+	syncTime := s.now().Unix()
+	node.mux.Lock()
+	node.lastSync = syncTime
+	node.mux.Unlock()
+
+	//Send the heartbeat to the target node
+	resp, err := s.getTransport().HeartBeat(endpoint, postBody)
+	s.metrics.inc(metricHeartbeatsSent, "node", node.UUID)
 	if err != nil {
 		//Post failed, clear all the IP fields
+		s.metrics.inc(metricHeartbeatsFailed, "node", node.UUID)
+		node.mux.Lock()
 		node.ReflectedIP = ""
 		node.ReflectedPrivateIP = ""
-		if s.Options.Verbal {
-			log.Println(err.Error())
-		}
 		node.retryCount++
+		node.mux.Unlock()
+		s.logger().Debug("heartbeat failed", logKeyRemote, node.UUID, logKeyOperation, "heartbeat", logKeyEndpoint, endpoint.URL("h"), logKeyError, err)
+		s.setNodeOnline(node, false, err)
 		return err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-
+	body := resp.Body
 	if resp.StatusCode != http.StatusOK {
+		s.metrics.inc(metricHeartbeatsFailed, "node", node.UUID)
 		if resp.StatusCode == http.StatusUnauthorized {
 			//Do a reconnection
-			log.Println(node.UUID+" requesting new registration from "+s.Options.DeviceUUID+": ", string(body), " with status code: ", resp.StatusCode)
-			node.StartConnection(node.IpAddr.String(), node.retryUsername, node.retryPassword)
+			s.logger().Warn("heartbeat unauthorized, registering again", logKeyRemote, node.UUID, logKeyOperation, "heartbeat", logKeyEndpoint, endpoint.URL("h"), logKeyStatus, resp.StatusCode, logKeyError, string(body))
+			node.mux.RLock()
+			retryUsername := node.retryUsername
+			retryPassword := node.retryPassword
+			node.mux.RUnlock()
+			if retryUsername == "" && retryPassword == "" {
+				//e.g. the router is restored from a config exported without encryption
+				err = errors.New("no retry credentials for this node")
+				s.logger().Error("unable to register again", logKeyRemote, node.UUID, logKeyOperation, "connect", logKeyError, err)
+				s.emitEvent(Event{Type: EventReRegistration, NodeUUID: node.UUID, Err: err})
+				return err
+			}
+			_, err = node.StartConnection(nodeIpAddr.String(), retryUsername, retryPassword)
+			s.emitEvent(Event{Type: EventReRegistration, NodeUUID: node.UUID, Err: err})
 			return nil
 		} else {
 			//Unable to reflect IP
-			if s.Options.Verbal {
-				log.Println(node.UUID+" declined heartbeat request from "+s.Options.DeviceUUID+": ", string(body), " with status code: ", resp.StatusCode)
-				log.Println(s.Options.DeviceUUID + " TOTP Map Dump: ")
-				s.PrettyPrintTOTPMap()
-			}
+			s.logger().Warn("heartbeat declined", logKeyRemote, node.UUID, logKeyOperation, "heartbeat", logKeyEndpoint, endpoint.URL("h"), logKeyStatus, resp.StatusCode, logKeyError, string(body))
+			node.mux.Lock()
 			node.ReflectedPrivateIP = ""
 			node.ReflectedIP = ""
-			return errors.New("heartbeat declined by remote node")
+			node.mux.Unlock()
+			err = errors.New("heartbeat declined by remote node")
+			s.setNodeOnline(node, false, err)
+			return err
 		}
 
 	}
 
 	//The returned body should contain this node's ip address as seen by the other node
-	if s.Options.Verbal {
-		log.Println(node.UUID+" reflected IP to "+s.Options.DeviceUUID, string(body), " Error: ", err)
+	reflectedIp, err := parseHeartBeatResponse(node, &packet, sendTotpSecret, body) //This node IP as seens by the requested node
+	if err != nil {
+		//The reply cannot be trusted, treat the node as unreachable
+		s.metrics.inc(metricHeartbeatsFailed, "node", node.UUID)
+		s.metrics.inc(metricSignatureFailures, "operation", "heartbeat_response")
+		node.mux.Lock()
+		node.ReflectedIP = ""
+		node.ReflectedPrivateIP = ""
+		node.retryCount++
+		node.mux.Unlock()
+		s.logger().Warn("heartbeat response rejected", logKeyRemote, node.UUID, logKeyOperation, "heartbeat", logKeyEndpoint, endpoint.URL("h"), logKeyError, err)
+		s.setNodeOnline(node, false, err)
+		return err
 	}
+	s.logger().Debug("heartbeat reflected", logKeyRemote, node.UUID, logKeyOperation, "heartbeat", logKeyEndpoint, endpoint.URL("h"), "reflectedIP", reflectedIp)
 
-	reflectedIp := string(body) //This node IP as seens by the requested node
 	reflectedIp = trimIpPort(reflectedIp)
 
 	//Update node information
+	node.mux.Lock()
 	node.lastOnline = node.lastSync
 	node.retryCount = 0
 
@@ -326,6 +525,17 @@ func (s *ServiceRouter) heartBeatToNode(node *Node) error {
 		node.ReflectedPrivateIP = ""
 		node.ReflectedIP = reflectedIp
 	}
+	node.mux.Unlock()
+
+	s.setNodeOnline(node, true, nil)
+
+	//At least one node is reachable
+	if s.setOrphanMode(false) {
+		s.logger().Info("node reachable, leaving orphan mode", logKeyRemote, node.UUID, logKeyOperation, "heartbeat")
+		s.emitEvent(Event{Type: EventOrphanModeLeft, NodeUUID: node.UUID})
+	}
 
+	//Replace the secret if it has been used long enough
+	s.rotateSecretIfDue(node)
 	return nil
 }
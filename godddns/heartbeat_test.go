@@ -0,0 +1,95 @@
+package godddns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testReplySecret = "JBSWY3DPEHPK3PXP"
+
+//newReplyNode create the router replying to this node, and the node of the replying router with its public key if known
+func newReplyNode(knownKey bool) (*ServiceRouter, *Node) {
+	replier := NewServiceRouter(RouterOptions{DeviceUUID: "node1"})
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	node := router.NewNode(NodeOptions{NodeID: "node1", Port: 8080, RESTInterface: "/godddns"})
+	if knownKey {
+		node.publicKey = replier.PublicKey()
+	}
+	return replier, node
+}
+
+//signHeartBeatResponse return the reply of the router to the heartbeat, with its MAC and signature changed if given
+func signHeartBeatResponse(t *testing.T, replier *ServiceRouter, packet *HeartBeatPacket, change func(*HeartBeatResponse)) []byte {
+	t.Helper()
+	response := HeartBeatResponse{ReflectionIP: "203.0.113.10:49152"}
+	response.MAC = packetMAC(testReplySecret, response.signedMessage(replier.Options.DeviceUUID, packet))
+	response.Signature = replier.sign(response.signedMessage(replier.Options.DeviceUUID, packet))
+	if change != nil {
+		change(&response)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseHeartBeatResponse(t *testing.T) {
+	packet := &HeartBeatPacket{NodeUUID: "thisNode", Nonce: "nonce"}
+	replier, node := newReplyNode(true)
+	forger := NewServiceRouter(RouterOptions{DeviceUUID: "node1"})
+
+	reflectedIP, err := parseHeartBeatResponse(node, packet, testReplySecret, signHeartBeatResponse(t, replier, packet, nil))
+	if err != nil || reflectedIP != "203.0.113.10:49152" {
+		t.Errorf("authenticated reply parsed as %s, %v", reflectedIP, err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*HeartBeatResponse)
+	}{
+		{"bad MAC", func(r *HeartBeatResponse) { r.MAC = packetMAC("KRSXG5CTMVRXEZLU", r.signedMessage("node1", packet)) }},
+		{"changed address", func(r *HeartBeatResponse) { r.ReflectionIP = "198.51.100.1:49152" }},
+		{"forged signature", func(r *HeartBeatResponse) { r.Signature = forger.sign(r.signedMessage("node1", packet)) }},
+		{"missing signature", func(r *HeartBeatResponse) { r.Signature = nil }},
+	}
+	for _, test := range tests {
+		if _, err := parseHeartBeatResponse(node, packet, testReplySecret, signHeartBeatResponse(t, replier, packet, test.change)); err == nil {
+			t.Errorf("reply with %s accepted", test.name)
+		}
+	}
+
+	//Another heartbeat cannot be answered with this reply
+	if _, err := parseHeartBeatResponse(node, &HeartBeatPacket{NodeUUID: "thisNode", Nonce: "other"}, testReplySecret, signHeartBeatResponse(t, replier, packet, nil)); err == nil {
+		t.Error("reply to another heartbeat accepted")
+	}
+}
+
+func TestParseLegacyHeartBeatResponse(t *testing.T) {
+	packet := &HeartBeatPacket{NodeUUID: "thisNode", Nonce: "nonce"}
+	legacyReply := []byte("203.0.113.10:49152")
+
+	//Older versions without key reply in plain text
+	replier, node := newReplyNode(false)
+	reflectedIP, err := parseHeartBeatResponse(node, packet, testReplySecret, legacyReply)
+	if err != nil || reflectedIP != "203.0.113.10:49152" {
+		t.Errorf("plain reply of an older version parsed as %s, %v", reflectedIP, err)
+	}
+
+	//Once the node replied with a MAC, plain replies are forged
+	if _, err := parseHeartBeatResponse(node, packet, testReplySecret, signHeartBeatResponse(t, replier, packet, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if !node.requireReplyMAC {
+		t.Error("reply with a MAC not remembered")
+	}
+	if _, err := parseHeartBeatResponse(node, packet, testReplySecret, legacyReply); err == nil {
+		t.Error("plain reply accepted after a reply with a MAC")
+	}
+
+	//Nodes that joined with a public key always reply with a MAC
+	_, node = newReplyNode(true)
+	if _, err := parseHeartBeatResponse(node, packet, testReplySecret, legacyReply); err == nil {
+		t.Error("plain reply accepted from a node with a public key")
+	}
+}
@@ -0,0 +1,147 @@
+package godddns
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+/*
+	Identity.go
+
+	This script handle the Ed25519 identity of the router. Every router owns a
+	key pair that is generated on first use and saved with the router state.
+	Public keys are exchanged during the handshake, and heartbeat and sync
+	packets are signed with the private key, so a node is authenticated by
+	its key and keeps the same identity when its TOTP secret is issued again.
+
+	Nodes joined before keys are exchanged (or running older versions) do not
+	send a key, and their packets are checked with the TOTP only
+*/
+
+//getIdentityKey return the private key of this router, a new key is generated on first use
+func (s *ServiceRouter) getIdentityKey() ed25519.PrivateKey {
+	s.identityMux.Lock()
+	defer s.identityMux.Unlock()
+	if s.identityKey == nil {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			//The system random source is broken, nothing else in the router can work either
+			panic(err)
+		}
+		s.identityKey = privateKey
+	}
+	return s.identityKey
+}
+
+//setIdentityKey restore the private key of this router from its seed
+func (s *ServiceRouter) setIdentityKey(seed []byte) error {
+	if len(seed) != ed25519.SeedSize {
+		return errors.New("invalid identity key")
+	}
+	s.identityMux.Lock()
+	defer s.identityMux.Unlock()
+	s.identityKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+//PublicKey return the public key of this router, which is sent to the nodes it joins
+func (s *ServiceRouter) PublicKey() ed25519.PublicKey {
+	return s.getIdentityKey().Public().(ed25519.PublicKey)
+}
+
+//PublicKeyFingerprint return the SHA-256 fingerprint of the public key, for comparing keys out of band
+func PublicKeyFingerprint(publicKey []byte) string {
+	if len(publicKey) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256(publicKey)
+	return hex.EncodeToString(hash[:])
+}
+
+//The number of random bytes in a nonce
+const nonceLength = 18
+
+//newNonce return a random nonce for binding a reply to its request
+func newNonce() (string, error) {
+	nonce := make([]byte, nonceLength)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+//sign create the signature of the message with the private key of this router
+func (s *ServiceRouter) sign(message []byte) []byte {
+	return ed25519.Sign(s.getIdentityKey(), message)
+}
+
+/*
+	signedMessage
+
+	Build the message to be signed for the given operation. Fields are JSON
+	encoded so the boundary between fields is not ambiguous, and the operation
+	is included so a signature cannot be reused for another packet type
+*/
+func signedMessage(operation string, fields ...string) []byte {
+	message, _ := json.Marshal(append([]string{"go-DDDNS/" + operation}, fields...))
+	return message
+}
+
+//isValidPublicKey check if the key is empty (not exchanged) or a valid Ed25519 public key
+func isValidPublicKey(publicKey []byte) bool {
+	return len(publicKey) == 0 || len(publicKey) == ed25519.PublicKeySize
+}
+
+//getNodePublicKey return the public key sent by the node with given UUID when it joined this router, nil if not exchanged
+func (s *ServiceRouter) getNodePublicKey(nodeUUID string) []byte {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	position := s.totpMapExists(nodeUUID)
+	if position < 0 {
+		return nil
+	}
+	return s.TOTPMap[position].PublicKey
+}
+
+/*
+	verifyNodeSignature
+
+	Check the signature of a packet sent by the node with given UUID. Nodes
+	that did not send a public key when joining are not required to sign
+*/
+func (s *ServiceRouter) verifyNodeSignature(nodeUUID string, message []byte, signature []byte) error {
+	publicKey := s.getNodePublicKey(nodeUUID)
+	if len(publicKey) == 0 {
+		return nil
+	}
+	return verifySignature(publicKey, message, signature)
+}
+
+//verifySignature check the signature of the message with the given public key
+func verifySignature(publicKey []byte, message []byte, signature []byte) error {
+	if len(signature) == 0 {
+		return errors.New("packet is not signed")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), message, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+//GetPublicKey return the public key of this node received during the handshake, nil if not exchanged
+func (n *Node) GetPublicKey() ed25519.PublicKey {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	if len(n.publicKey) == 0 {
+		return nil
+	}
+	publicKey := make([]byte, len(n.publicKey))
+	copy(publicKey, n.publicKey)
+	return publicKey
+}
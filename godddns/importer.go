@@ -1,9 +1,13 @@
 package godddns
 
 import (
+	"crypto/cipher"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
-	"log"
+	"net"
+	"strings"
 )
 
 /*
@@ -13,37 +17,118 @@ import (
 
 */
 
+//The exported form of a service router
+type routerSnapshot struct {
+	Version                    int //The version of the config layout
+	NodeMap                    []*nodeSnapshot
+	TOTPMap                    []*TOTPRecord
+	Options                    *RouterOptions
+	DeviceIpAddr               net.IP
+	DeviceIpv4Addr             net.IP
+	DeviceIpv6Addr             net.IP
+	LastIpUpdateTime           int64
+	LastSyncTime               int64
+	ConnectionRetryWaitTimeMin int
+	ConnectionRetryWaitTimeMax int
+	Revocations                []*Revocation           `json:",omitempty"` //The nodes revoked on this router
+	RevocationRemovals         map[string]int64        `json:",omitempty"` //The time each revocation is removed on this router
+	IdentityKey                string                  `json:",omitempty"` //Base64 encoded seed of the identity key
+	Encryption                 *secretEncryptionHeader `json:",omitempty"` //Set if the secrets are encrypted
+}
+
+//The exported form of a node
+type nodeSnapshot struct {
+	UUID               string
+	IpAddr             net.IP
+	Port               int
+	RESTfulInterface   string
+	ReflectedIP        string
+	ReflectedPrivateIP string
+	RequireHTTPS       bool
+	PasswordJoin       bool `json:",omitempty"` //The node is joined by sending the password
+	SendTotpSecret     string
+	TOTPParameters     *TOTPParameters `json:",omitempty"` //The parameters of the TOTP, not set if they are the defaults
+	SecretIssueTime    int64           `json:",omitempty"` //The time the TOTP secret is received
+	PublicKey          []byte          `json:",omitempty"` //The public key received during the handshake
+	ChallengeJoin      bool            `json:",omitempty"` //If the node supports the challenge-response join
+	RequireReplyMAC    bool            `json:",omitempty"` //If the node has replied with a MAC
+	RetryUsername      string          `json:",omitempty"` //Only exported if the secrets are encrypted
+	RetryPassword      string          `json:",omitempty"` //Only exported if the secrets are encrypted
+	LastOnline         int64
+	LastSync           int64
+	RetryCount         int64
+}
+
 //NewRouterFromJSON create a new router object from JSON string
 //Notes that the newly created service router is still has its auth function missing
 //the authentication function has to be injected after the router is returned
 func NewRouterFromJSON(jsonConfig string) (*ServiceRouter, error) {
-	newRouter := ServiceRouter{}
-	err := json.Unmarshal([]byte(jsonConfig), &newRouter)
+	return NewRouterFromEncryptedJSON(jsonConfig, nil)
+}
+
+//NewRouterFromJSONFile create a new router from file contianing json string
+func NewRouterFromJSONFile(filename string) (*ServiceRouter, error) {
+	return NewRouterFromEncryptedJSONFile(filename, nil)
+}
+
+/*
+	NewRouterFromEncryptedJSON
+
+	Create a new router object from JSON string exported by ExportRouterToEncryptedJSON.
+	Configs with plain secrets are also accepted, so an existing config can be
+	loaded and exported again with encryption
+*/
+func NewRouterFromEncryptedJSON(jsonConfig string, secretCipher *SecretCipher) (*ServiceRouter, error) {
+	//Upgrade configs written by older versions
+	migratedConfig, err := migrateConfig([]byte(jsonConfig))
 	if err != nil {
 		return nil, err
 	}
 
-	//Fill the parent object for all nodes
-	for _, registerNodes := range newRouter.NodeMap {
-		registerNodes.parent = &newRouter
+	snapshot := routerSnapshot{}
+	err = json.Unmarshal(migratedConfig, &snapshot)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(newRouter.NodeMap) == 0 && newRouter.Options.Verbal {
-		log.Println(newRouter.Options.DeviceUUID + " config has no 0 registered node!!!")
+	err = snapshot.validate()
+	if err != nil {
+		return nil, err
 	}
 
-	newRouter.IpChangeEventListener = nil
+	var aead cipher.AEAD
+	if snapshot.Encryption != nil {
+		if secretCipher == nil {
+			return nil, errors.New("config contains encrypted secrets, a passphrase or key is required")
+		}
+		aead, err = secretCipher.newOpener(snapshot.Encryption)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &newRouter, nil
+	newRouter, err := snapshot.restore(aead)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(newRouter.NodeMap) == 0 {
+		newRouter.logger().Warn("imported config has no registered node")
+	}
+	if snapshot.Encryption == nil && secretCipher != nil {
+		newRouter.logger().Warn("imported config secrets are not encrypted, export the router again to encrypt them")
+	}
+
+	return newRouter, nil
 }
 
-//NewRouterFromJSONFile create a new router from file contianing json string
-func NewRouterFromJSONFile(filename string) (*ServiceRouter, error) {
+//NewRouterFromEncryptedJSONFile create a new router from file containing json string exported with encrypted secrets
+func NewRouterFromEncryptedJSONFile(filename string, secretCipher *SecretCipher) (*ServiceRouter, error) {
 	fileContent, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return NewRouterFromJSON(string(fileContent))
+	return NewRouterFromEncryptedJSON(string(fileContent), secretCipher)
 }
 
 //Inject an auth function into an imported service router
@@ -51,8 +136,286 @@ func (s *ServiceRouter) InjectAuthFunction(authFunction func(string, string) boo
 	s.Options.AuthFunction = authFunction
 }
 
-//Export a service router to JSON string
+/*
+	ExportRouterToJSON
+
+	Export a service router to JSON string. The retry credentials of the nodes
+	are never written in plain text, so they are left out with a warning, and
+	the router loaded from the config cannot register again by itself. Use
+	ExportRouterToEncryptedJSON to keep them
+*/
 func (s *ServiceRouter) ExportRouterToJSON() (string, error) {
-	js, err := json.MarshalIndent(s, "", " ")
+	if droppedNodes := s.getNodesWithRetryCredentials(); len(droppedNodes) > 0 {
+		s.logger().Warn("exporting without a cipher, the retry credentials are not exported and these nodes cannot register again after a restore", logKeyOperation, "export", "nodes", strings.Join(droppedNodes, ","))
+	}
+	return s.exportRouter(nil)
+}
+
+//getNodesWithRetryCredentials return the UUIDs of the nodes with retry credentials set
+func (s *ServiceRouter) getNodesWithRetryCredentials() []string {
+	nodeUUIDs := []string{}
+	for _, node := range s.getNodes() {
+		node.mux.RLock()
+		if node.retryUsername != "" || node.retryPassword != "" {
+			nodeUUIDs = append(nodeUUIDs, node.UUID)
+		}
+		node.mux.RUnlock()
+	}
+	return nodeUUIDs
+}
+
+//ExportRouterToEncryptedJSON export a service router to JSON string with all secrets encrypted by the cipher
+func (s *ServiceRouter) ExportRouterToEncryptedJSON(secretCipher *SecretCipher) (string, error) {
+	if secretCipher == nil {
+		return "", errors.New("cipher is not set")
+	}
+	return s.exportRouter(secretCipher)
+}
+
+func (s *ServiceRouter) exportRouter(secretCipher *SecretCipher) (string, error) {
+	var header *secretEncryptionHeader
+	var aead cipher.AEAD
+	if secretCipher != nil {
+		var err error
+		header, aead, err = secretCipher.newSealer()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	snapshot, err := s.snapshot(aead)
+	if err != nil {
+		return "", err
+	}
+	snapshot.Encryption = header
+
+	js, err := json.MarshalIndent(snapshot, "", " ")
 	return string(js), err
 }
+
+//snapshot copy the exportable states of the router, secrets are encrypted if aead is not nil
+func (s *ServiceRouter) snapshot(aead cipher.AEAD) (*routerSnapshot, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	//Lock all the nodes so their states will not change during export
+	for _, node := range s.NodeMap {
+		node.mux.RLock()
+		defer node.mux.RUnlock()
+	}
+
+	sealSecret := func(secret string, context string) (string, error) {
+		if aead == nil {
+			return secret, nil
+		}
+		return encryptSecret(aead, secret, context)
+	}
+
+	snapshot := routerSnapshot{
+		Version:                    configVersion,
+		NodeMap:                    []*nodeSnapshot{},
+		TOTPMap:                    []*TOTPRecord{},
+		Options:                    s.Options,
+		DeviceIpAddr:               s.DeviceIpAddr,
+		DeviceIpv4Addr:             s.DeviceIpv4Addr,
+		DeviceIpv6Addr:             s.DeviceIpv6Addr,
+		LastIpUpdateTime:           s.LastIpUpdateTime,
+		LastSyncTime:               s.LastSyncTime,
+		ConnectionRetryWaitTimeMin: s.ConnectionRetryWaitTimeMin,
+		ConnectionRetryWaitTimeMax: s.ConnectionRetryWaitTimeMax,
+	}
+
+	for _, revocation := range s.revocations {
+		snapshot.Revocations = append(snapshot.Revocations, &Revocation{
+			RevocationNotice: revocation.RevocationNotice,
+			ReceivedFrom:     revocation.ReceivedFrom,
+			Pending:          append([]string{}, revocation.Pending...),
+		})
+	}
+	if len(s.revocationRemovals) > 0 {
+		snapshot.RevocationRemovals = map[string]int64{}
+		for nodeUUID, removeTime := range s.revocationRemovals {
+			snapshot.RevocationRemovals[nodeUUID] = removeTime
+		}
+	}
+
+	identityKey, err := sealSecret(base64.StdEncoding.EncodeToString(s.getIdentityKey().Seed()), "IdentityKey/"+s.Options.DeviceUUID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.IdentityKey = identityKey
+
+	for _, node := range s.NodeMap {
+		sendTotpSecret, err := sealSecret(node.SendTotpSecret, "SendTotpSecret/"+node.UUID)
+		if err != nil {
+			return nil, err
+		}
+
+		//The retry credentials are the account on the remote node. Never write them in plain text
+		retryUsername := ""
+		retryPassword := ""
+		if aead != nil {
+			retryUsername, err = sealSecret(node.retryUsername, "RetryUsername/"+node.UUID)
+			if err != nil {
+				return nil, err
+			}
+			retryPassword, err = sealSecret(node.retryPassword, "RetryPassword/"+node.UUID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		snapshot.NodeMap = append(snapshot.NodeMap, &nodeSnapshot{
+			UUID:               node.UUID,
+			IpAddr:             node.IpAddr,
+			Port:               node.Port,
+			RESTfulInterface:   node.RESTfulInterface,
+			ReflectedIP:        node.ReflectedIP,
+			ReflectedPrivateIP: node.ReflectedPrivateIP,
+			RequireHTTPS:       node.RequireHTTPS,
+			PasswordJoin:       node.PasswordJoin,
+			SendTotpSecret:     sendTotpSecret,
+			TOTPParameters:     node.totpParameters.wireParameters(),
+			SecretIssueTime:    node.secretIssueTime,
+			PublicKey:          node.publicKey,
+			ChallengeJoin:      node.challengeJoin,
+			RequireReplyMAC:    node.requireReplyMAC,
+			RetryUsername:      retryUsername,
+			RetryPassword:      retryPassword,
+			LastOnline:         node.lastOnline,
+			LastSync:           node.lastSync,
+			RetryCount:         node.retryCount,
+		})
+	}
+
+	for _, record := range s.TOTPMap {
+		recvTotpSecret, err := sealSecret(record.RecvTOTPSecret, "RecvTOTPSecret/"+record.RemoteUUID)
+		if err != nil {
+			return nil, err
+		}
+		previousTotpSecret := ""
+		if record.PreviousTOTPSecret != "" {
+			previousTotpSecret, err = sealSecret(record.PreviousTOTPSecret, "PreviousTOTPSecret/"+record.RemoteUUID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		snapshot.TOTPMap = append(snapshot.TOTPMap, &TOTPRecord{
+			RemoteUUID:     record.RemoteUUID,
+			RecvTOTPSecret: recvTotpSecret,
+			Permissions:    record.Permissions,
+			PublicKey:      record.PublicKey,
+			Parameters:     record.Parameters,
+
+			PreviousTOTPSecret:   previousTotpSecret,
+			PreviousParameters:   record.PreviousParameters,
+			PreviousSecretExpire: record.PreviousSecretExpire,
+			RequireNonce:         record.RequireNonce,
+		})
+	}
+
+	return &snapshot, nil
+}
+
+//restore create a service router from the snapshot, encrypted secrets are decrypted with aead
+func (snapshot *routerSnapshot) restore(aead cipher.AEAD) (*ServiceRouter, error) {
+	newRouter := ServiceRouter{
+		NodeMap:                    []*Node{},
+		TOTPMap:                    []*TOTPRecord{},
+		Options:                    snapshot.Options,
+		DeviceIpAddr:               snapshot.DeviceIpAddr,
+		DeviceIpv4Addr:             snapshot.DeviceIpv4Addr,
+		DeviceIpv6Addr:             snapshot.DeviceIpv6Addr,
+		LastIpUpdateTime:           snapshot.LastIpUpdateTime,
+		LastSyncTime:               snapshot.LastSyncTime,
+		ConnectionRetryWaitTimeMin: snapshot.ConnectionRetryWaitTimeMin,
+		ConnectionRetryWaitTimeMax: snapshot.ConnectionRetryWaitTimeMax,
+		IpChangeEventListener:      nil,
+		revocations:                snapshot.Revocations,
+		revocationRemovals:         snapshot.RevocationRemovals,
+	}
+
+	if snapshot.IdentityKey != "" {
+		encodedSeed, err := decryptSecret(aead, snapshot.IdentityKey, "IdentityKey/"+snapshot.Options.DeviceUUID)
+		if err != nil {
+			return nil, err
+		}
+		seed, err := base64.StdEncoding.DecodeString(encodedSeed)
+		if err != nil {
+			return nil, errors.New("invalid identity key")
+		}
+		err = newRouter.setIdentityKey(seed)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, thisNode := range snapshot.NodeMap {
+		sendTotpSecret, err := decryptSecret(aead, thisNode.SendTotpSecret, "SendTotpSecret/"+thisNode.UUID)
+		if err != nil {
+			return nil, err
+		}
+		totpParameters := TOTPParameters{}
+		if thisNode.TOTPParameters != nil {
+			totpParameters = *thisNode.TOTPParameters
+		}
+		retryUsername, err := decryptSecret(aead, thisNode.RetryUsername, "RetryUsername/"+thisNode.UUID)
+		if err != nil {
+			return nil, err
+		}
+		retryPassword, err := decryptSecret(aead, thisNode.RetryPassword, "RetryPassword/"+thisNode.UUID)
+		if err != nil {
+			return nil, err
+		}
+		//Fill the parent object for all nodes
+		newRouter.NodeMap = append(newRouter.NodeMap, &Node{
+			UUID:               thisNode.UUID,
+			IpAddr:             thisNode.IpAddr,
+			Port:               thisNode.Port,
+			RESTfulInterface:   thisNode.RESTfulInterface,
+			ReflectedIP:        thisNode.ReflectedIP,
+			ReflectedPrivateIP: thisNode.ReflectedPrivateIP,
+			RequireHTTPS:       thisNode.RequireHTTPS,
+			PasswordJoin:       thisNode.PasswordJoin,
+			SendTotpSecret:     sendTotpSecret,
+
+			totpParameters:  totpParameters.normalize(),
+			secretIssueTime: thisNode.SecretIssueTime,
+			publicKey:       thisNode.PublicKey,
+			challengeJoin:   thisNode.ChallengeJoin,
+			requireReplyMAC: thisNode.RequireReplyMAC,
+			lastOnline:      thisNode.LastOnline,
+			lastSync:        thisNode.LastSync,
+			retryCount:      thisNode.RetryCount,
+			retryUsername:   retryUsername,
+			retryPassword:   retryPassword,
+			parent:          &newRouter,
+		})
+	}
+
+	for _, record := range snapshot.TOTPMap {
+		recvTotpSecret, err := decryptSecret(aead, record.RecvTOTPSecret, "RecvTOTPSecret/"+record.RemoteUUID)
+		if err != nil {
+			return nil, err
+		}
+		previousTotpSecret, err := decryptSecret(aead, record.PreviousTOTPSecret, "PreviousTOTPSecret/"+record.RemoteUUID)
+		if err != nil {
+			return nil, err
+		}
+		newRouter.TOTPMap = append(newRouter.TOTPMap, &TOTPRecord{
+			RemoteUUID:     record.RemoteUUID,
+			RecvTOTPSecret: recvTotpSecret,
+			Permissions:    record.Permissions,
+			PublicKey:      record.PublicKey,
+			Parameters:     record.Parameters.normalize(),
+
+			PreviousTOTPSecret:   previousTotpSecret,
+			PreviousParameters:   record.PreviousParameters.normalize(),
+			PreviousSecretExpire: record.PreviousSecretExpire,
+			RequireNonce:         record.RequireNonce,
+		})
+	}
+
+	newRouter.loadTrustedProxies()
+	return &newRouter, nil
+}
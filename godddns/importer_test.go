@@ -0,0 +1,112 @@
+package godddns
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+//recordLogger keep the warnings written by the router
+type recordLogger struct {
+	warnings []string
+	mux      sync.Mutex
+}
+
+func (l *recordLogger) Debug(msg string, args ...interface{}) {}
+func (l *recordLogger) Info(msg string, args ...interface{})  {}
+func (l *recordLogger) Error(msg string, args ...interface{}) {}
+
+func (l *recordLogger) Warn(msg string, args ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.warnings = append(l.warnings, strings.TrimSpace(msg+" "+formatLogArgs(args)))
+}
+
+func (l *recordLogger) getWarnings() []string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return append([]string{}, l.warnings...)
+}
+
+func TestExportRetryCredentialsRoundTrip(t *testing.T) {
+	router := newSecretsRouter()
+	logger := &recordLogger{}
+	router.Options.Logger = logger
+	secretCipher, _ := NewKeyCipher([]byte("0123456789abcdef0123456789abcdef"))
+
+	js, err := router.ExportRouterToEncryptedJSON(secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.getWarnings()) != 0 {
+		t.Errorf("encrypted export warned %q", logger.getWarnings())
+	}
+	restored, err := NewRouterFromEncryptedJSON(js, secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uuid := range []string{"node1", "node2"} {
+		node, err := restored.GetNodeByUUID(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.retryUsername != "user" || node.retryPassword != "password of "+uuid {
+			t.Errorf("retry credentials of %s restored as %s and %s", uuid, node.retryUsername, node.retryPassword)
+		}
+	}
+
+	//A second export of the restored router keeps the credentials again
+	js, err = restored.ExportRouterToEncryptedJSON(secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err = NewRouterFromEncryptedJSON(js, secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.getNodesWithRetryCredentials()) != 2 {
+		t.Errorf("retry credentials of %q restored after two exports, expected node1 and node2", restored.getNodesWithRetryCredentials())
+	}
+}
+
+func TestExportWithoutCipherDropsRetryCredentials(t *testing.T) {
+	router := newSecretsRouter()
+	logger := &recordLogger{}
+	router.Options.Logger = logger
+	node, _ := router.GetNodeByUUID("node2")
+	node.retryUsername = ""
+	node.retryPassword = ""
+
+	js, err := router.ExportRouterToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(js, "password of node1") {
+		t.Error("retry password exported in plain text")
+	}
+	warnings := logger.getWarnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "nodes=node1") {
+		t.Errorf("export warned %q, expected one warning naming node1", warnings)
+	}
+
+	restored, err := NewRouterFromJSON(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes := restored.getNodesWithRetryCredentials(); len(nodes) != 0 {
+		t.Errorf("retry credentials of %q restored from a plain export", nodes)
+	}
+	if restored.getTotpSecret("node1") != "RECVNODE1SECRET" {
+		t.Error("TOTP secrets dropped with the retry credentials")
+	}
+
+	//Nothing to drop, nothing to warn about
+	logger = &recordLogger{}
+	restored.Options.Logger = logger
+	if _, err := restored.ExportRouterToJSON(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.getWarnings()) != 0 {
+		t.Errorf("export without retry credentials warned %q", logger.getWarnings())
+	}
+}
@@ -0,0 +1,159 @@
+package godddns
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+/*
+	Logger.go
+
+	This script define the leveled logger used by the service router.
+	The interface is compatible with *slog.Logger, so a structured logger
+	can be passed in RouterOptions directly
+
+	thisNode := godddns.NewServiceRouter(godddns.RouterOptions{
+		DeviceUUID: "thisNode",
+		Logger:     slog.Default(),
+	})
+
+	Every log entry carry key value pairs (e.g. "remote", "node2"). The
+	following keys are used consistently across the router
+
+	local     The UUID of this router (added to every entry)
+	remote    The UUID of the remote node
+	operation The protocol operation (connect, heartbeat, sync, dns, dnsupdate, recordfile)
+	endpoint  The URL or address of the remote endpoint
+	status    The status code returned by the remote node
+	error     The error of the operation
+*/
+
+//Logger is a leveled logger with key value pair arguments
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+//Log keys shared by all log entries
+const (
+	logKeyLocal     = "local"
+	logKeyRemote    = "remote"
+	logKeyOperation = "operation"
+	logKeyEndpoint  = "endpoint"
+	logKeyStatus    = "status"
+	logKeyError     = "error"
+)
+
+/*
+	stdLogger
+
+	The default logger writing to the standard log package. Debug and Info
+	entries are only written if verbal output is enabled, warnings and errors
+	are always written
+*/
+type stdLogger struct {
+	verbal bool
+}
+
+//NewStdLogger return a logger that write to the standard log package. If verbal is false, Debug and Info entries are discarded
+func NewStdLogger(verbal bool) Logger {
+	return &stdLogger{verbal: verbal}
+}
+
+func (l *stdLogger) Debug(msg string, args ...interface{}) {
+	if l.verbal {
+		l.output("DEBUG", msg, args)
+	}
+}
+
+func (l *stdLogger) Info(msg string, args ...interface{}) {
+	if l.verbal {
+		l.output("INFO", msg, args)
+	}
+}
+
+func (l *stdLogger) Warn(msg string, args ...interface{}) {
+	l.output("WARN", msg, args)
+}
+
+func (l *stdLogger) Error(msg string, args ...interface{}) {
+	l.output("ERROR", msg, args)
+}
+
+func (l *stdLogger) output(level string, msg string, args []interface{}) {
+	log.Println("[" + level + "] " + msg + formatLogArgs(args))
+}
+
+//formatLogArgs render the key value pairs as " key=value key=value", values with spaces are quoted
+func formatLogArgs(args []interface{}) string {
+	var sb strings.Builder
+	for i := 0; i < len(args); i += 2 {
+		key := "!BADKEY"
+		var value interface{}
+		if i+1 < len(args) {
+			key = fmt.Sprint(args[i])
+			value = args[i+1]
+		} else {
+			value = args[i]
+		}
+
+		valueString := fmt.Sprint(value)
+		if err, ok := value.(error); ok && err != nil {
+			valueString = err.Error()
+		}
+		if valueString == "" || strings.ContainsAny(valueString, " \t\n\"=") {
+			valueString = strconv.Quote(valueString)
+		}
+		sb.WriteString(" " + key + "=" + valueString)
+	}
+	return sb.String()
+}
+
+/*
+	routerLogger
+
+	Wrap the logger of the router and add the UUID of the router to every entry
+*/
+type routerLogger struct {
+	logger Logger
+	local  string
+}
+
+func (l *routerLogger) Debug(msg string, args ...interface{}) {
+	l.logger.Debug(msg, l.withLocal(args)...)
+}
+
+func (l *routerLogger) Info(msg string, args ...interface{}) {
+	l.logger.Info(msg, l.withLocal(args)...)
+}
+
+func (l *routerLogger) Warn(msg string, args ...interface{}) {
+	l.logger.Warn(msg, l.withLocal(args)...)
+}
+
+func (l *routerLogger) Error(msg string, args ...interface{}) {
+	l.logger.Error(msg, l.withLocal(args)...)
+}
+
+func (l *routerLogger) withLocal(args []interface{}) []interface{} {
+	return append([]interface{}{logKeyLocal, l.local}, args...)
+}
+
+//logger return the logger of this router, use the standard logger if no logger is set
+func (s *ServiceRouter) logger() Logger {
+	if s.Options == nil {
+		return NewStdLogger(false)
+	}
+	logger := s.Options.Logger
+	if logger == nil {
+		logger = NewStdLogger(s.Options.Verbal)
+	}
+	return &routerLogger{
+		logger: logger,
+		local:  s.Options.DeviceUUID,
+	}
+}
@@ -0,0 +1,254 @@
+package godddns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	Metrics.go
+
+	This script collect the heartbeat, sync and handshake statistic of
+	the router and expose them in the Prometheus text exposition format,
+	so a node that silently falls out of the mesh can be alerted on.
+
+	http.Handle("/metrics", router.MetricsHandler())
+*/
+
+//Counter names
+const (
+	metricHeartbeatsSent       = "godddns_heartbeats_sent_total"
+	metricHeartbeatsFailed     = "godddns_heartbeats_failed_total"
+	metricSyncIssued           = "godddns_sync_requests_issued_total"
+	metricSyncFailed           = "godddns_sync_requests_failed_total"
+	metricSyncServed           = "godddns_sync_requests_served_total"
+	metricHandshakes           = "godddns_handshakes_total"
+	metricTOTPFailures         = "godddns_totp_validation_failures_total"
+	metricSignatureFailures    = "godddns_signature_validation_failures_total"
+	metricReplayedPackets      = "godddns_replayed_packets_total"
+	metricSecretRotations      = "godddns_secret_rotations_total"
+	metricRevocations          = "godddns_revocations_total"
+	metricRevocationDeliveries = "godddns_revocation_deliveries_total"
+	metricRateLimited          = "godddns_rate_limited_requests_total"
+	metricLockouts             = "godddns_lockouts_total"
+	metricAccessDenied         = "godddns_access_denied_total"
+	metricIpChanges            = "godddns_ip_changes_total"
+	metricNodeIpChanges        = "godddns_node_ip_changes_total"
+	metricOrphanModeEntered    = "godddns_orphan_mode_entered_total"
+)
+
+type metricDefinition struct {
+	Name     string
+	Help     string
+	Labelled bool //If the metric has labels. Metrics without labels are reported as 0 before the first event
+}
+
+//The counters exported by the router, in the order they are written
+var counterDefinitions = []metricDefinition{
+	{metricHeartbeatsSent, "Number of heartbeats sent to each node.", true},
+	{metricHeartbeatsFailed, "Number of heartbeats to each node that failed or were declined.", true},
+	{metricSyncIssued, "Number of sync requests sent to other nodes to resolve a lost node.", false},
+	{metricSyncFailed, "Number of sync requests sent to other nodes that failed.", false},
+	{metricSyncServed, "Number of sync requests from other nodes answered by this router.", false},
+	{metricHandshakes, "Number of handshakes by direction and result.", true},
+	{metricTOTPFailures, "Number of requests rejected due to an unknown or invalid TOTP by operation.", true},
+	{metricSignatureFailures, "Number of requests rejected due to a missing or invalid signature by operation.", true},
+	{metricReplayedPackets, "Number of requests rejected due to a replayed nonce, an invalid MAC or an expired time by operation.", true},
+	{metricSecretRotations, "Number of TOTP secret rotations by direction and result.", true},
+	{metricRevocations, "Number of node revocations issued on this router or received from other nodes by source and result.", true},
+	{metricRevocationDeliveries, "Number of revocation notices forwarded to other nodes by result.", true},
+	{metricRateLimited, "Number of requests refused by the rate limiter by operation and reason.", true},
+	{metricLockouts, "Number of lockouts after too many failed attempts by scope.", true},
+	{metricAccessDenied, "Number of requests refused by the access lists by operation.", true},
+	{metricIpChanges, "Number of times the voted address of this router changed.", false},
+	{metricNodeIpChanges, "Number of times the address of each node changed.", true},
+	{metricOrphanModeEntered, "Number of times this router entered orphan mode.", false},
+}
+
+type routerMetrics struct {
+	counters map[string]map[string]uint64 //Metric name => label string => value
+	mux      sync.Mutex
+}
+
+//inc increase the counter with given name and label pairs (key, value, key, value...) by one
+func (m *routerMetrics) inc(name string, labels ...string) {
+	labelString := formatMetricLabels(labels...)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.counters == nil {
+		m.counters = map[string]map[string]uint64{}
+	}
+	if m.counters[name] == nil {
+		m.counters[name] = map[string]uint64{}
+	}
+	m.counters[name][labelString]++
+}
+
+//removeNode drop the per node series of the node with given UUID
+func (m *routerMetrics) removeNode(nodeUUID string) {
+	nodeLabel := formatMetricLabels("node", nodeUUID)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	for _, series := range m.counters {
+		delete(series, nodeLabel)
+	}
+}
+
+//snapshot return a copy of the counters
+func (m *routerMetrics) snapshot() map[string]map[string]uint64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	result := map[string]map[string]uint64{}
+	for name, series := range m.counters {
+		result[name] = map[string]uint64{}
+		for labelString, value := range series {
+			result[name][labelString] = value
+		}
+	}
+	return result
+}
+
+/*
+	MetricsHandler
+
+	Return a http handler that serve the metrics of this router in
+	Prometheus text format
+*/
+func (s *ServiceRouter) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WriteMetrics(w)
+	})
+}
+
+//WriteMetrics write the metrics of this router in Prometheus text format to the writer
+func (s *ServiceRouter) WriteMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	//Counters
+	counters := s.metrics.snapshot()
+	for _, definition := range counterDefinitions {
+		writeMetricHeader(bw, definition.Name, definition.Help, "counter")
+		series := counters[definition.Name]
+		if len(series) == 0 && !definition.Labelled {
+			fmt.Fprintf(bw, "%s 0\n", definition.Name)
+			continue
+		}
+		labelStrings := []string{}
+		for labelString := range series {
+			labelStrings = append(labelStrings, labelString)
+		}
+		sort.Strings(labelStrings)
+		for _, labelString := range labelStrings {
+			fmt.Fprintf(bw, "%s%s %d\n", definition.Name, labelString, series[labelString])
+		}
+	}
+
+	//Gauges of the router
+	nodes := s.getNodes()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].UUID < nodes[j].UUID
+	})
+
+	writeMetricHeader(bw, "godddns_nodes", "Number of nodes registered on this router.", "gauge")
+	fmt.Fprintf(bw, "godddns_nodes %d\n", len(nodes))
+
+	writeMetricHeader(bw, "godddns_orphan_mode", "1 if this router cannot reach any node and is in orphan mode.", "gauge")
+	fmt.Fprintf(bw, "godddns_orphan_mode %d\n", boolToMetric(s.IsOrphan()))
+
+	writeMetricHeader(bw, "godddns_vote_disagreement", "Number of nodes that reflected an address different from the voted address of this router.", "gauge")
+	fmt.Fprintf(bw, "godddns_vote_disagreement %d\n", s.countVoteDisagreement())
+
+	//Gauges of each node
+	now := s.now().Unix()
+	writeMetricHeader(bw, "godddns_node_last_online_age_seconds", "Seconds since the last successful heartbeat to each node. Not reported for nodes that were never online.", "gauge")
+	for _, node := range nodes {
+		lastOnline := node.GetLastOnline()
+		if lastOnline > 0 {
+			fmt.Fprintf(bw, "godddns_node_last_online_age_seconds%s %d\n", formatMetricLabels("node", node.UUID), now-lastOnline)
+		}
+	}
+
+	writeMetricHeader(bw, "godddns_node_retry_count", "Number of failed heartbeats to each node since it was last online.", "gauge")
+	for _, node := range nodes {
+		fmt.Fprintf(bw, "godddns_node_retry_count%s %d\n", formatMetricLabels("node", node.UUID), node.GetRetryCount())
+	}
+
+	writeMetricHeader(bw, "godddns_node_connected", "1 if the node has completed the handshake with this router.", "gauge")
+	for _, node := range nodes {
+		fmt.Fprintf(bw, "godddns_node_connected%s %d\n", formatMetricLabels("node", node.UUID), boolToMetric(s.NodeConnected(node.UUID)))
+	}
+
+	return bw.Flush()
+}
+
+/*
+	countVoteDisagreement
+
+	Count the reflections that do not match the winning vote of their category
+	(public / private, IPv4 / IPv6). A non zero value means the nodes do not
+	agree on the address of this router, e.g. during an address change or when
+	some nodes are behind a different NAT
+*/
+func (s *ServiceRouter) countVoteDisagreement() int {
+	votes := s.voteReflectedIPs()
+	disagreement := 0
+	for _, node := range s.getNodes() {
+		reflectedIP, reflectedPrivateIP := node.GetReflectedIP()
+		if ip := net.ParseIP(reflectedIP); ip != nil {
+			voted := votes.publicIpv6
+			if isIPv4(ip) {
+				voted = votes.publicIpv4
+			}
+			if !ip.Equal(voted) {
+				disagreement++
+			}
+		}
+		if ip := net.ParseIP(reflectedPrivateIP); ip != nil {
+			voted := votes.privateIpv6
+			if isIPv4(ip) {
+				voted = votes.privateIpv4
+			}
+			if !ip.Equal(voted) {
+				disagreement++
+			}
+		}
+	}
+	return disagreement
+}
+
+func writeMetricHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+}
+
+//formatMetricLabels render the label pairs (key, value, key, value...) as {key="value",...}
+func formatMetricLabels(labels ...string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"=\""+escapeMetricLabel(labels[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeMetricLabel(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
+
+func boolToMetric(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
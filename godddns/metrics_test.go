@@ -0,0 +1,96 @@
+package godddns
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFormatMetricLabels(t *testing.T) {
+	tests := []struct {
+		labels   []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{"node"}, ""},
+		{[]string{"node", "node1"}, `{node="node1"}`},
+		{[]string{"direction", "outgoing", "result", "success"}, `{direction="outgoing",result="success"}`},
+		{[]string{"node", "a\"b\\c\nd"}, `{node="a\"b\\c\nd"}`},
+	}
+	for _, test := range tests {
+		if result := formatMetricLabels(test.labels...); result != test.expected {
+			t.Errorf("labels %q formatted as %s, expected %s", test.labels, result, test.expected)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	for _, uuid := range []string{"node2", "node1"} {
+		router.AddNode(router.NewNode(NodeOptions{NodeID: uuid, Port: 8080, RESTInterface: "/godddns"}))
+	}
+	router.metrics.inc(metricHeartbeatsSent, "node", "node1")
+	router.metrics.inc(metricHeartbeatsSent, "node", "node1")
+	router.metrics.inc(metricHeartbeatsSent, "node", "node2")
+	router.metrics.inc(metricHandshakes, "direction", "incoming", "result", "rejected")
+
+	recorder := httptest.NewRecorder()
+	router.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("metrics served as %s", contentType)
+	}
+	output := recorder.Body.String()
+	for _, line := range []string{
+		"# HELP godddns_heartbeats_sent_total Number of heartbeats sent to each node.\n# TYPE godddns_heartbeats_sent_total counter\n",
+		"godddns_heartbeats_sent_total{node=\"node1\"} 2\ngodddns_heartbeats_sent_total{node=\"node2\"} 1\n",
+		"godddns_handshakes_total{direction=\"incoming\",result=\"rejected\"} 1\n",
+		"godddns_ip_changes_total 0\n", //Counters without labels are reported before the first increase
+		"# TYPE godddns_nodes gauge\ngodddns_nodes 2\n",
+		"godddns_orphan_mode 0\n",
+		"godddns_node_retry_count{node=\"node1\"} 0\ngodddns_node_retry_count{node=\"node2\"} 0\n",
+		"godddns_node_connected{node=\"node1\"} 0\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("metrics output does not contain %q", line)
+		}
+	}
+	if strings.Contains(output, "godddns_heartbeats_failed_total{") {
+		t.Error("labelled counter reported before the first increase")
+	}
+	if strings.Contains(output, "godddns_node_last_online_age_seconds{") {
+		t.Error("last online age reported for nodes that were never online")
+	}
+
+	//Every sample belongs to a declared metric
+	declared := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "# TYPE ") {
+			declared[fields[2]] = true
+		} else if !strings.HasPrefix(line, "#") && !declared[strings.SplitN(fields[0], "{", 2)[0]] {
+			t.Errorf("sample %q without TYPE line", line)
+		}
+	}
+}
+
+func TestMetricsRemoveNode(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	router.AddNode(router.NewNode(NodeOptions{NodeID: "node1", Port: 8080, RESTInterface: "/godddns"}))
+	router.metrics.inc(metricHeartbeatsSent, "node", "node1")
+	router.metrics.inc(metricIpChanges)
+	if err := router.RemoveNode("node1"); err != nil {
+		t.Fatal(err)
+	}
+
+	output := bytes.Buffer{}
+	if err := router.WriteMetrics(&output); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output.String(), "node1") {
+		t.Error("series of the removed node still reported")
+	}
+	if !strings.Contains(output.String(), "godddns_ip_changes_total 1\n") {
+		t.Error("series of the router removed with the node")
+	}
+}
@@ -4,12 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"log"
 	"net"
-	"net/http"
-	"path/filepath"
-	"strconv"
 )
 
 /*
@@ -19,46 +14,70 @@ import (
 */
 func (n *Node) StartConnection(initIPAddr string, username string, password string) (string, error) {
 	//Check if the service router was correctly set-up
-	if n.parent.Options.AuthFunction == nil {
-		return "", errors.New("this service router does not contain a valid auth function")
+	if n.parent.getAuthenticator() == nil {
+		return "", errors.New("this service router does not contain a valid auth function or authenticator")
 	}
 
 	//Use this ip address as its initial IP address
-	n.IpAddr = net.ParseIP(initIPAddr)
-
-	postBody, _ := json.Marshal(map[string]string{
-		"NodeUUID": n.parent.Options.DeviceUUID,
-		"Username": username,
-		"Password": password,
-	})
-	responseBody := bytes.NewBuffer(postBody)
-	protocol := "http://"
-	if n.RequireHTTPS {
-		protocol = "https://"
+	n.mux.Lock()
+	n.IpAddr = net.ParseIP(trimIpPort(initIPAddr))
+	n.mux.Unlock()
+
+	//Prove the password with the challenge-response join. The password is only sent to nodes set to the password join
+	endpoint := n.getEndpoint(initIPAddr)
+	oprType := "cs"
+	var payload *TOTPPayload
+	var rejectReason string
+	var err error
+	if n.PasswordJoin {
+		oprType = "c"
+		err = n.checkPasswordJoin(endpoint)
+		if err == nil {
+			payload, rejectReason, err = n.passwordConnect(endpoint, username, password)
+		}
+	} else {
+		payload, rejectReason, err = n.challengeConnect(endpoint, username, password)
+		if err == errChallengeJoinUnsupported {
+			//Never fall back to sending the password, the reply may come from an attacker on the path
+			err = errors.New("challenge-response join is not supported by the remote node, set PasswordJoin on the node to send the password over HTTPS")
+		}
 	}
-
-	reqEndpoint := initIPAddr + ":" + strconv.Itoa(n.Port) + "/" + n.RESTfulInterface + "?opr=c"
-	reqEndpoint = protocol + filepath.ToSlash(filepath.Clean(reqEndpoint))
-
-	resp, err := http.Post(reqEndpoint, "application/json", responseBody)
 	if err != nil {
-		return "", err
+		n.parent.metrics.inc(metricHandshakes, "direction", "outgoing", "result", "failure")
+		n.parent.logger().Warn("handshake failed", logKeyRemote, n.UUID, logKeyOperation, "connect", logKeyEndpoint, endpoint.URL(oprType), logKeyError, err)
+		return rejectReason, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	//The public key of a node must not change once it is known
+	n.mux.RLock()
+	pinnedKey := n.publicKey
+	n.mux.RUnlock()
+	if len(pinnedKey) > 0 && !bytes.Equal(pinnedKey, payload.PublicKey) {
+		err = errors.New("public key of the remote node changed, remove and add the node again to accept the new key")
+		n.parent.metrics.inc(metricHandshakes, "direction", "outgoing", "result", "failure")
+		n.parent.logger().Error("handshake rejected", logKeyRemote, n.UUID, logKeyOperation, "connect", logKeyEndpoint, endpoint.URL(oprType), "fingerprint", PublicKeyFingerprint(payload.PublicKey), logKeyError, err)
 		return "", err
 	}
 
-	payload := TOTPPayload{}
-	err = json.Unmarshal(body, &payload)
-	resp.Body.Close()
+	//Make sure tokens can be generated from the issued secret
+	parameters := TOTPParameters{}
+	if payload.Parameters != nil {
+		parameters = *payload.Parameters
+	}
+	if !isValidTOTPSecret(payload.TOTPSecret) {
+		err = errors.New("invalid TOTP secret")
+	} else if err = parameters.validate(); err != nil {
+		err = errors.New("unsupported TOTP parameters: " + err.Error())
+	}
 	if err != nil {
-		return string(body), err
+		n.parent.metrics.inc(metricHandshakes, "direction", "outgoing", "result", "failure")
+		n.parent.logger().Warn("handshake failed", logKeyRemote, n.UUID, logKeyOperation, "connect", logKeyEndpoint, endpoint.URL(oprType), logKeyError, err)
+		return "", err
 	}
 
 	reflectedIP := trimIpPort(payload.ReflectionIP)
 
+	n.mux.Lock()
 	if n.ReflectedIP == "" {
 		//Initialization
 		n.ReflectedIP = reflectedIP
@@ -71,16 +90,74 @@ func (n *Node) StartConnection(initIPAddr string, username string, password stri
 	}
 
 	n.SendTotpSecret = payload.TOTPSecret
-	if n.parent.Options.Verbal {
-		log.Println(n.parent.Options.DeviceUUID, " received payload for handshake: ", payload)
+	n.totpParameters = parameters.normalize()
+	n.secretIssueTime = n.parent.now().Unix()
+	if len(payload.PublicKey) > 0 {
+		n.publicKey = payload.PublicKey
 	}
-
 	n.retryUsername = username
 	n.retryPassword = password
+	if oprType == "cs" {
+		n.challengeJoin = true
+	}
+	n.mux.Unlock()
+	n.parent.metrics.inc(metricHandshakes, "direction", "outgoing", "result", "success")
+	n.parent.scheduleSave()
+
+	n.parent.logger().Info("handshake completed", logKeyRemote, n.UUID, logKeyOperation, "connect", logKeyEndpoint, endpoint.URL(oprType), "reflectedIP", reflectedIP)
 
 	return payload.TOTPSecret, nil
 }
 
+/*
+	checkPasswordJoin
+
+	Check if the password can be sent to the node. The password join is
+	refused if it is disabled on this router, if the node supported the
+	challenge-response join before or if the connection is not encrypted
+*/
+func (n *Node) checkPasswordJoin(endpoint *Endpoint) error {
+	if n.parent.Options.RequireChallengeJoin {
+		return errors.New("password join is disabled by RequireChallengeJoin")
+	}
+	n.mux.RLock()
+	challengeJoined := n.challengeJoin
+	n.mux.RUnlock()
+	if challengeJoined {
+		return errors.New("remote node supported the challenge-response join before, refusing to send the password")
+	}
+	if !endpoint.RequireHTTPS {
+		return errors.New("password join requires HTTPS, refusing to send the password in plain text")
+	}
+	return nil
+}
+
+//passwordConnect join the remote node by sending the username and password (opr=c). The second return value is the rejection reason of the remote node
+func (n *Node) passwordConnect(endpoint *Endpoint, username string, password string) (*TOTPPayload, string, error) {
+	postBody, _ := json.Marshal(Credential{
+		NodeUUID:  n.parent.Options.DeviceUUID,
+		Username:  username,
+		Password:  password,
+		PublicKey: n.parent.PublicKey(),
+	})
+
+	resp, err := n.parent.getTransport().Connect(endpoint, postBody)
+	if err != nil {
+		return nil, "", err
+	}
+
+	payload := TOTPPayload{}
+	err = json.Unmarshal(resp.Body, &payload)
+	if err != nil {
+		n.parent.logger().Debug("handshake rejected", logKeyRemote, n.UUID, logKeyOperation, "connect", logKeyStatus, resp.StatusCode, logKeyError, string(resp.Body))
+		return nil, string(resp.Body), err
+	}
+	if !isValidPublicKey(payload.PublicKey) {
+		return nil, "", errors.New("invalid public key")
+	}
+	return &payload, "", nil
+}
+
 /*
 	EndConnection
 
@@ -88,8 +165,11 @@ func (n *Node) StartConnection(initIPAddr string, username string, password stri
 */
 
 func (n *Node) EndConnection() error {
+	n.parent.mux.Lock()
+
 	//Check if node is connected
 	if n.parent.totpMapExists(n.UUID) < 0 {
+		n.parent.mux.Unlock()
 		return errors.New("node is not conennected")
 	}
 
@@ -100,8 +180,10 @@ func (n *Node) EndConnection() error {
 		}
 	}
 	n.parent.TOTPMap = newTotpMap
-	if n.parent.Options.Verbal {
-		log.Println("Node " + n.UUID + " disconnected")
-	}
+	n.parent.mux.Unlock()
+	n.parent.removeReplayCache(n.UUID)
+
+	n.parent.logger().Info("node disconnected", logKeyRemote, n.UUID)
+	n.parent.scheduleSave()
 	return nil
 }
@@ -0,0 +1,418 @@
+package godddns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Proxy.go
+
+	This script find the address of the client when the router is behind a
+	reverse proxy or load balancer, so the reflected address is the client's
+	instead of the proxy's.
+
+	For HTTP proxies (e.g. nginx), the header set in ForwardedHeader is honored
+	if the request comes from a trusted proxy: X-Forwarded-For by default, or
+	Forwarded (RFC 7239). Only one of them is read, as proxies that append to
+	one pass the other from the client unchanged. The addresses are read from
+	the right, skipping the trusted proxies, so a client cannot forge its
+	address by sending the header itself.
+
+	For TCP proxies (e.g. HAProxy), wrap the listener with NewProxyProtocolListener
+	to read the PROXY protocol v1 or v2 header sent by the trusted proxies
+
+	listener, _ := net.Listen("tcp", ":8080")
+	listener, _ = godddns.NewProxyProtocolListener(listener, []string{"10.0.0.2"})
+	http.Serve(listener, http.HandlerFunc(router.HandleConnections))
+*/
+
+const (
+	proxyHeaderTimeout = 5 * time.Second //Time for a trusted proxy to send the PROXY protocol header
+	proxyV1MaxLength   = 107             //The longest PROXY protocol v1 header, including CRLF
+)
+
+//The first 12 bytes of a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+//The forwarding headers that can be honored
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+//validateForwardedHeader check if the header can be honored, empty means X-Forwarded-For
+func validateForwardedHeader(header string) error {
+	switch http.CanonicalHeaderKey(header) {
+	case "", HeaderXForwardedFor, HeaderForwarded:
+		return nil
+	}
+	return errors.New("unsupported forwarded header: " + header)
+}
+
+//parseTrustedProxies parse the CIDRs or addresses of the trusted proxies
+func parseTrustedProxies(trustedProxies []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range trustedProxies {
+		network, err := parseAccessListEntry(entry)
+		if err != nil {
+			return nil, errors.New("invalid trusted proxy: " + entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+//isTrustedProxy check if the address belongs to one of the networks
+func isTrustedProxy(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//parseForwardedAddress parse an address in the forwarding headers, return the address in ip or ip:port format and the ip
+func parseForwardedAddress(value string) (string, net.IP) {
+	value = strings.Trim(strings.TrimSpace(value), "\"")
+	host, port, err := net.SplitHostPort(value)
+	if err == nil {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return "", nil
+		}
+		return net.JoinHostPort(ip.String(), port), ip
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+	if ip == nil {
+		return "", nil
+	}
+	return ip.String(), ip
+}
+
+//forwardedFor return the for= addresses in the Forwarded headers, from the first proxy to the last
+func forwardedFor(header http.Header) []string {
+	addresses := []string{}
+	for _, line := range header.Values("Forwarded") {
+		for _, element := range strings.Split(line, ",") {
+			forValue := ""
+			for _, pair := range strings.Split(element, ";") {
+				keyValue := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(keyValue) == 2 && strings.EqualFold(keyValue[0], "for") {
+					forValue = keyValue[1]
+				}
+			}
+			addresses = append(addresses, forValue)
+		}
+	}
+	return addresses
+}
+
+//xForwardedFor return the addresses in the X-Forwarded-For headers, from the client to the last proxy
+func xForwardedFor(header http.Header) []string {
+	addresses := []string{}
+	for _, line := range header.Values("X-Forwarded-For") {
+		addresses = append(addresses, strings.Split(line, ",")...)
+	}
+	return addresses
+}
+
+/*
+	resolveClientAddr
+
+	Return the address of the client that sent the request. If the request
+	comes from a trusted proxy, the forwarding header is read from the last
+	hop backward until an address that is not a trusted proxy is found. An
+	address that cannot be parsed (e.g. "unknown") stops the search, and the
+	last trusted hop is used
+*/
+func (s *ServiceRouter) resolveClientAddr(r *http.Request) string {
+	s.mux.RLock()
+	trustedProxies := s.trustedProxies
+	forwardedHeader := s.Options.ForwardedHeader
+	s.mux.RUnlock()
+	if len(trustedProxies) == 0 || !isTrustedProxy(trustedProxies, net.ParseIP(trimIpPort(r.RemoteAddr))) {
+		return r.RemoteAddr
+	}
+
+	var hops []string
+	if http.CanonicalHeaderKey(forwardedHeader) == HeaderForwarded {
+		hops = forwardedFor(r.Header)
+	} else {
+		hops = xForwardedFor(r.Header)
+	}
+	clientAddr := r.RemoteAddr
+	for i := len(hops) - 1; i >= 0; i-- {
+		address, ip := parseForwardedAddress(hops[i])
+		if ip == nil {
+			break
+		}
+		clientAddr = address
+		if !isTrustedProxy(trustedProxies, ip) {
+			break
+		}
+	}
+
+	if clientAddr != r.RemoteAddr {
+		s.logger().Debug("client address resolved from forwarding headers", logKeyEndpoint, clientAddr, "proxy", r.RemoteAddr)
+	}
+	return clientAddr
+}
+
+//loadTrustedProxies parse the trusted proxies in the options once, they are ignored if any entry is invalid
+func (s *ServiceRouter) loadTrustedProxies() {
+	if s.Options == nil {
+		return
+	}
+	trustedProxies, err := parseTrustedProxies(s.Options.TrustedProxies)
+	if err == nil {
+		err = validateForwardedHeader(s.Options.ForwardedHeader)
+	}
+	if err != nil {
+		s.logger().Error("forwarding headers ignored", logKeyError, err)
+		trustedProxies = nil
+	}
+	s.mux.Lock()
+	s.trustedProxies = trustedProxies
+	s.mux.Unlock()
+}
+
+//SetTrustedProxies replace the trusted proxies and the forwarding header honored from them
+func (s *ServiceRouter) SetTrustedProxies(trustedProxies []string, forwardedHeader string) error {
+	networks, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return err
+	}
+	if err = validateForwardedHeader(forwardedHeader); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	s.Options.TrustedProxies = trustedProxies
+	s.Options.ForwardedHeader = forwardedHeader
+	s.trustedProxies = networks
+	s.mux.Unlock()
+	return nil
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+	trustedProxies []*net.IPNet
+}
+
+/*
+	NewProxyProtocolListener
+
+	Wrap the listener so the PROXY protocol v1 and v2 headers sent by the trusted
+	proxies are removed from the connection, and RemoteAddr return the address
+	of the client. Connections from other addresses are not changed, and so are
+	connections from trusted proxies that do not send a header
+*/
+func NewProxyProtocolListener(listener net.Listener, trustedProxies []string) (net.Listener, error) {
+	networks, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolListener{
+		Listener:       listener,
+		trustedProxies: networks,
+	}, nil
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !isTrustedProxy(l.trustedProxies, tcpAddr.IP) {
+		return conn, nil
+	}
+
+	//The header is read on first use, so a slow proxy does not block the other connections
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReaderSize(conn, 256),
+	}, nil
+}
+
+//proxyProtocolConn is a connection from a trusted proxy that may start with a PROXY protocol header
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	remoteAddr net.Addr //The address of the client in the header, nil if not sent
+	headerErr  error    //Set if the header is invalid, the connection cannot be used
+	headerOnce sync.Once
+
+	readDeadline time.Time //The read deadline set by the user of the connection, e.g. the ReadTimeout of http.Server
+	deadlineMux  sync.Mutex
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.headerOnce.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.headerOnce.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.deadlineMux.Lock()
+	defer c.deadlineMux.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMux.Lock()
+	defer c.deadlineMux.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+/*
+	readHeader
+
+	Read and remove the PROXY protocol header, if any, from the start of the
+	connection. The header must arrive within the header timeout, or the read
+	deadline set by the user of the connection if sooner, which is restored
+	once the header is read
+*/
+func (c *proxyProtocolConn) readHeader() {
+	c.deadlineMux.Lock()
+	headerDeadline := time.Now().Add(proxyHeaderTimeout)
+	if !c.readDeadline.IsZero() && c.readDeadline.Before(headerDeadline) {
+		headerDeadline = c.readDeadline
+	}
+	c.Conn.SetReadDeadline(headerDeadline)
+	c.deadlineMux.Unlock()
+	defer func() {
+		c.deadlineMux.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineMux.Unlock()
+	}()
+
+	firstByte, err := c.reader.Peek(1)
+	if err != nil {
+		c.headerErr = err
+		return
+	}
+	switch firstByte[0] {
+	case 'P':
+		prefix, err := c.reader.Peek(6)
+		if err == nil && string(prefix) == "PROXY " {
+			c.remoteAddr, c.headerErr = readProxyV1Header(c.reader)
+		}
+	case '\r':
+		signature, err := c.reader.Peek(len(proxyV2Signature))
+		if err == nil && bytes.Equal(signature, proxyV2Signature) {
+			c.remoteAddr, c.headerErr = readProxyV2Header(c.reader)
+		}
+	}
+}
+
+/*
+	readProxyV1Header
+
+	Read the text header, e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+	Return nil address for "PROXY UNKNOWN", which is sent for health checks
+*/
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY protocol header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol header")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid PROXY protocol header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+/*
+	readProxyV2Header
+
+	Read the binary header: the signature, version and command, address family
+	and protocol, length of the addresses, then the addresses. Return nil address
+	for the LOCAL command (e.g. health checks) and unsupported address families
+*/
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	command := header[12] & 0x0F
+	family := header[13] >> 4
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+
+	if command == 0 {
+		//LOCAL, the connection is made by the proxy itself
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, errors.New("unsupported PROXY protocol command")
+	}
+	switch family {
+	case 1:
+		//IPv4: source address, destination address, source port, destination port
+		if len(addresses) < 12 {
+			return nil, errors.New("invalid PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 2:
+		//IPv6
+		if len(addresses) < 36 {
+			return nil, errors.New("invalid PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	}
+	return nil, nil
+}
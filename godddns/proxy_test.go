@@ -0,0 +1,255 @@
+package godddns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//newProxyRequest create a request from the given address with the forwarding headers
+func newProxyRequest(remoteAddr string, headers map[string]string) *http.Request {
+	r, _ := http.NewRequest("POST", "/godddns?opr=h", nil)
+	r.RemoteAddr = remoteAddr
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+func TestResolveClientAddrXForwardedFor(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{
+		DeviceUUID:     "thisNode",
+		Logger:         &recordLogger{},
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+	tests := []struct {
+		remoteAddr string
+		header     string
+		expected   string
+	}{
+		{"10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.1:1234", "198.51.100.7, 10.0.0.2", "198.51.100.7"},
+		{"10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"}, //The client forged the first entry
+		{"10.0.0.1:1234", "[2001:db8::7]:4711", "[2001:db8::7]:4711"},
+		{"10.0.0.1:1234", "198.51.100.7, unknown", "10.0.0.1:1234"},
+		{"10.0.0.1:1234", "", "10.0.0.1:1234"},
+		{"198.51.100.1:1234", "203.0.113.9", "198.51.100.1:1234"}, //Not a trusted proxy
+	}
+	for _, test := range tests {
+		r := newProxyRequest(test.remoteAddr, map[string]string{"X-Forwarded-For": test.header})
+		if result := router.resolveClientAddr(r); result != test.expected {
+			t.Errorf("X-Forwarded-For %q from %s resolved to %s, expected %s", test.header, test.remoteAddr, result, test.expected)
+		}
+	}
+}
+
+func TestResolveClientAddrForwarded(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{
+		DeviceUUID:      "thisNode",
+		Logger:          &recordLogger{},
+		TrustedProxies:  []string{"10.0.0.0/8"},
+		ForwardedHeader: HeaderForwarded,
+	})
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"for=198.51.100.7", "198.51.100.7"},
+		{"for=198.51.100.7;proto=https;by=10.0.0.1", "198.51.100.7"},
+		{"for=203.0.113.9, for=198.51.100.7", "198.51.100.7"},
+		{"for=198.51.100.7, for=10.0.0.2", "198.51.100.7"},
+		{`for="[2001:db8::7]:4711"`, "[2001:db8::7]:4711"},
+		{"For=198.51.100.7", "198.51.100.7"},
+		{"for=_hidden", "10.0.0.1:1234"},
+	}
+	for _, test := range tests {
+		r := newProxyRequest("10.0.0.1:1234", map[string]string{"Forwarded": test.header})
+		if result := router.resolveClientAddr(r); result != test.expected {
+			t.Errorf("Forwarded %q resolved to %s, expected %s", test.header, result, test.expected)
+		}
+	}
+
+	//The other header is passed from the client unchanged, so it is never read
+	r := newProxyRequest("10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.9"})
+	if result := router.resolveClientAddr(r); result != "10.0.0.1:1234" {
+		t.Errorf("X-Forwarded-For honored with Forwarded configured, resolved to %s", result)
+	}
+}
+
+func TestSetTrustedProxies(t *testing.T) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode", Logger: &recordLogger{}})
+	r := newProxyRequest("10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7"})
+	if result := router.resolveClientAddr(r); result != "10.0.0.1:1234" {
+		t.Errorf("forwarding header honored without trusted proxies, resolved to %s", result)
+	}
+
+	if err := router.SetTrustedProxies([]string{"10.0.0.1"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if result := router.resolveClientAddr(r); result != "198.51.100.7" {
+		t.Errorf("trusted proxy set at runtime not honored, resolved to %s", result)
+	}
+
+	if err := router.SetTrustedProxies([]string{"not an address"}, ""); err == nil {
+		t.Error("invalid trusted proxy accepted")
+	}
+	if err := router.SetTrustedProxies([]string{"10.0.0.1"}, "X-Real-IP"); err == nil {
+		t.Error("unsupported forwarded header accepted")
+	}
+}
+
+func TestReadProxyV1Header(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected string
+		valid    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", false},
+	}
+	for _, test := range tests {
+		addr, err := readProxyV1Header(bufio.NewReader(bytes.NewBufferString(test.header)))
+		if !test.valid {
+			if err == nil {
+				t.Errorf("invalid header %q accepted", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("header %q refused: %v", test.header, err)
+			continue
+		}
+		if (addr == nil && test.expected != "") || (addr != nil && addr.String() != test.expected) {
+			t.Errorf("header %q read as %v, expected %q", test.header, addr, test.expected)
+		}
+	}
+}
+
+//proxyV2Header build a PROXY protocol v2 header with the given command, family and addresses
+func proxyV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x01, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyV2Header(t *testing.T) {
+	ipv4 := append(append([]byte{}, net.ParseIP("192.0.2.1").To4()...), net.ParseIP("198.51.100.1").To4()...)
+	ipv4 = append(ipv4, 0xDC, 0x04, 0x01, 0xBB) //Ports 56324 and 443
+	addr, err := readProxyV2Header(bufio.NewReader(bytes.NewReader(proxyV2Header(1, 1, ipv4))))
+	if err != nil || addr.String() != "192.0.2.1:56324" {
+		t.Errorf("IPv4 header read as %v, %v", addr, err)
+	}
+
+	ipv6 := append(append([]byte{}, net.ParseIP("2001:db8::1")...), net.ParseIP("2001:db8::2")...)
+	ipv6 = append(ipv6, 0xDC, 0x04, 0x01, 0xBB)
+	addr, err = readProxyV2Header(bufio.NewReader(bytes.NewReader(proxyV2Header(1, 2, ipv6))))
+	if err != nil || addr.String() != "[2001:db8::1]:56324" {
+		t.Errorf("IPv6 header read as %v, %v", addr, err)
+	}
+
+	//Health checks of the proxy itself
+	addr, err = readProxyV2Header(bufio.NewReader(bytes.NewReader(proxyV2Header(0, 0, nil))))
+	if err != nil || addr != nil {
+		t.Errorf("LOCAL header read as %v, %v", addr, err)
+	}
+
+	if _, err = readProxyV2Header(bufio.NewReader(bytes.NewReader(proxyV2Header(1, 1, ipv4[:8])))); err == nil {
+		t.Error("truncated IPv4 addresses accepted")
+	}
+	if _, err = readProxyV2Header(bufio.NewReader(bytes.NewReader(proxyV2Header(2, 1, ipv4)))); err == nil {
+		t.Error("unsupported command accepted")
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("unable to listen on loopback: ", err)
+	}
+	defer listener.Close()
+	proxyListener, err := NewProxyProtocolListener(listener, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, header := range []string{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", ""} {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(header + "hello"))
+		client.Close()
+
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedAddr := "192.0.2.1:56324"
+		if header == "" {
+			//Connections without header keep the address of the proxy
+			expectedAddr = client.LocalAddr().String()
+		}
+		if conn.RemoteAddr().String() != expectedAddr {
+			t.Errorf("remote address %s, expected %s", conn.RemoteAddr(), expectedAddr)
+		}
+		body, err := ioutil.ReadAll(conn)
+		if err != nil || string(body) != "hello" {
+			t.Errorf("body after the header read as %q, %v", body, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolKeepsReadDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("unable to listen on loopback: ", err)
+	}
+	defer listener.Close()
+	proxyListener, err := NewProxyProtocolListener(listener, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The first connection sends the header and stalls, the second sends nothing
+	for _, header := range []string{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", ""} {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		client.Write([]byte(header))
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		//Like http.Server with ReadTimeout, the deadline is set before the header is read
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		result := make(chan error, 1)
+		go func() {
+			conn.RemoteAddr()
+			_, err := conn.Read(make([]byte, 16))
+			result <- err
+		}()
+		select {
+		case err := <-result:
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				t.Errorf("read with header %q returned %v, expected a timeout", header, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("read deadline lost after reading header %q", header)
+		}
+	}
+}
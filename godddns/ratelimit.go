@@ -0,0 +1,405 @@
+package godddns
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+	RateLimit.go
+
+	This script protect the router from password spraying and TOTP guessing.
+	Failed handshakes and packets with an invalid TOTP or signature are counted
+	for the source address. Failures of a node that proved its identity with a
+	valid TOTP, such as an invalid signature, are also counted for its UUID.
+	Once either reach the limit within the failure window, further requests
+	are refused with 429 until the lockout ends. The lockout is doubled every time
+	it is triggered again, up to the maximum lockout.
+
+	Handshakes are expensive for both sides, so each source address is also
+	limited to a number of handshake requests per minute. IPv6 addresses are
+	grouped by their /64 prefix, which is usually assigned to a single host.
+
+	Failures before the TOTP is verified are never counted for the claimed
+	UUID, so other hosts claiming the UUID of a node cannot lock it out. A node
+	with a locked UUID can still reach the router from the address it last
+	sent a heartbeat from
+
+	The limiter tracks a fixed number of addresses and node UUIDs. Once full,
+	the least recently seen entry that is not locked out is dropped for each
+	new one, and the idle entries are removed on every heartbeat cycle instead
+	of on the request path
+*/
+
+const (
+	defaultMaxFailures         = 5
+	defaultFailureWindow       = 300   //Seconds the failures are counted in
+	defaultLockoutDuration     = 60    //Seconds of the first lockout
+	defaultMaxLockoutDuration  = 3600  //Seconds of the longest lockout
+	defaultHandshakesPerMinute = 10    //Handshake requests per minute from one source address
+	defaultHandshakeBurst      = 5     //Handshake requests from one source address allowed at once
+	defaultMaxRequestBodySize  = 65536 //Bytes of a request body, far larger than any packet
+	rateLimiterMaxEntries      = 10000 //Addresses or node UUIDs tracked at most, the least recently seen that is not locked out is dropped for a new one
+)
+
+//errRateLimited is returned to requests refused by the rate limiter
+var errRateLimited = errors.New("too many requests")
+
+//RateLimitOptions are the limits of requests to this router
+type RateLimitOptions struct {
+	MaxFailures         int   //Failed attempts from one address or for one node UUID before lockout, default 5, negative to disable
+	FailureWindow       int64 //Seconds the failed attempts are counted in, default 300
+	LockoutDuration     int64 //Seconds of the first lockout, doubled on every lockout after, default 60
+	MaxLockoutDuration  int64 //Seconds of the longest lockout, default 3600
+	HandshakesPerMinute int   //Handshake requests per minute from one address, default 10, negative to disable
+	HandshakeBurst      int   //Handshake requests allowed at once from one address, default 5
+	MaxRequestBodySize  int64 //Bytes of a request body, default 64 KiB
+}
+
+//The failures and handshake allowance of a source address or node UUID
+type rateLimitEntry struct {
+	key         string  //The source address or node UUID of the entry
+	failures    int     //Failed attempts in the current window
+	windowStart int64   //The time the first failure of the current window happened
+	lockouts    uint    //Number of lockouts in a row, for the exponential lockout
+	lockedUntil int64   //Requests are refused until this time
+	lastFailure int64   //The time of the last failed attempt
+	tokens      float64 //Handshake requests allowed now
+	lastRefill  int64   //The time in nanoseconds the tokens were last refilled
+}
+
+type rateLimiter struct {
+	addresses rateLimitTable //Source address => entry
+	nodes     rateLimitTable //Claimed node UUID => entry
+}
+
+//rateLimitTable is the entries of the rate limiter, ordered from the most to the least recently seen
+type rateLimitTable struct {
+	entries map[string]*list.Element //Key => element of the entry in order
+	order   *list.List               //The entries, most recently seen first
+}
+
+//getRateLimitOptions return the rate limit options of this router with the defaults filled in
+func (s *ServiceRouter) getRateLimitOptions() RateLimitOptions {
+	options := RateLimitOptions{}
+	if s.Options != nil {
+		options = s.Options.RateLimit
+	}
+	if options.MaxFailures == 0 {
+		options.MaxFailures = defaultMaxFailures
+	}
+	if options.FailureWindow <= 0 {
+		options.FailureWindow = defaultFailureWindow
+	}
+	if options.LockoutDuration <= 0 {
+		options.LockoutDuration = defaultLockoutDuration
+	}
+	if options.MaxLockoutDuration <= 0 {
+		options.MaxLockoutDuration = defaultMaxLockoutDuration
+	}
+	if options.MaxLockoutDuration < options.LockoutDuration {
+		options.MaxLockoutDuration = options.LockoutDuration
+	}
+	if options.HandshakesPerMinute == 0 {
+		options.HandshakesPerMinute = defaultHandshakesPerMinute
+	}
+	if options.HandshakeBurst <= 0 {
+		options.HandshakeBurst = defaultHandshakeBurst
+	}
+	if options.MaxRequestBodySize <= 0 {
+		options.MaxRequestBodySize = defaultMaxRequestBodySize
+	}
+	return options
+}
+
+//rateLimitAddress return the key of the source address of the request, IPv6 addresses are grouped by /64
+func rateLimitAddress(remoteAddr string) string {
+	ip := net.ParseIP(trimIpPort(remoteAddr))
+	if ip == nil {
+		return trimIpPort(remoteAddr)
+	}
+	if isIPv4(ip) {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+//find return the entry of the key, nil if not found. The caller must hold the limiter lock
+func (t *rateLimitTable) find(key string) *rateLimitEntry {
+	element, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	return element.Value.(*rateLimitEntry)
+}
+
+/*
+	get
+
+	Return the entry of the key and mark it as the most recently seen. A new
+	entry is created if not found, dropping the least recently seen entry that
+	is not locked out if the table is full. If every entry is locked out, the
+	new entry is returned without being tracked. The caller must hold the
+	limiter lock
+*/
+func (t *rateLimitTable) get(key string, now int64) *rateLimitEntry {
+	if t.entries == nil {
+		t.entries = map[string]*list.Element{}
+		t.order = list.New()
+	}
+	if element, ok := t.entries[key]; ok {
+		t.order.MoveToFront(element)
+		return element.Value.(*rateLimitEntry)
+	}
+
+	entry := &rateLimitEntry{key: key, tokens: -1}
+	if t.order.Len() >= rateLimiterMaxEntries && !t.evict(now) {
+		return entry
+	}
+	t.entries[key] = t.order.PushFront(entry)
+	return entry
+}
+
+/*
+	evict
+
+	Drop the least recently seen entry that is not locked out, so a flood of
+	new addresses cannot lift a lockout. The locked entries passed over are
+	moved to the front, to be checked again last. Return false if every entry
+	is locked out. The caller must hold the limiter lock
+*/
+func (t *rateLimitTable) evict(now int64) bool {
+	for i := t.order.Len(); i > 0; i-- {
+		oldest := t.order.Back()
+		entry := oldest.Value.(*rateLimitEntry)
+		if entry.lockedFor(now) == 0 {
+			t.order.Remove(oldest)
+			delete(t.entries, entry.key)
+			return true
+		}
+		t.order.MoveToFront(oldest)
+	}
+	return false
+}
+
+//prune remove the entries that no longer affect any request. The caller must hold the limiter lock
+func (t *rateLimitTable) prune(options RateLimitOptions, now time.Time) {
+	if t.order == nil {
+		return
+	}
+	for element := t.order.Back(); element != nil; {
+		previous := element.Prev()
+		entry := element.Value.(*rateLimitEntry)
+		idle := entry.lockedUntil < now.Unix() && entry.lastFailure < now.Unix()-options.MaxLockoutDuration
+		refilled := entry.lastRefill < now.Add(-time.Minute).UnixNano()
+		if idle && refilled {
+			t.order.Remove(element)
+			delete(t.entries, entry.key)
+		}
+		element = previous
+	}
+}
+
+//pruneRateLimiter remove the idle entries of the rate limiter, called on every heartbeat cycle
+func (s *ServiceRouter) pruneRateLimiter() {
+	options := s.getRateLimitOptions()
+	now := s.now()
+	s.rateLimitMux.Lock()
+	defer s.rateLimitMux.Unlock()
+	s.rateLimiter.addresses.prune(options, now)
+	s.rateLimiter.nodes.prune(options, now)
+}
+
+//lockedFor return the seconds left of the lockout of the entry, 0 if not locked
+func (e *rateLimitEntry) lockedFor(now int64) int64 {
+	if e.lockedUntil > now {
+		return e.lockedUntil - now
+	}
+	return 0
+}
+
+/*
+	checkRequestRate
+
+	Refuse the request if its source address is locked out, or if it is a
+	handshake (opr=c, cs or cf) and the address has used up its allowance.
+	Called before the request body is parsed
+*/
+func (s *ServiceRouter) checkRequestRate(w http.ResponseWriter, r *http.Request, operation string, handshake bool) bool {
+	options := s.getRateLimitOptions()
+	address := rateLimitAddress(r.RemoteAddr)
+	now := s.now()
+
+	s.rateLimitMux.Lock()
+	entry := s.rateLimiter.addresses.get(address, now.Unix())
+	retryAfter := int64(0)
+	reason := ""
+	if locked := entry.lockedFor(now.Unix()); locked > 0 {
+		retryAfter = locked
+		reason = "lockout"
+	} else if handshake && options.HandshakesPerMinute > 0 {
+		//Refill the allowance at the rate of handshakes per minute
+		rate := float64(options.HandshakesPerMinute) / float64(time.Minute)
+		if entry.tokens < 0 {
+			entry.tokens = float64(options.HandshakeBurst)
+		} else {
+			entry.tokens += float64(now.UnixNano()-entry.lastRefill) * rate
+			if entry.tokens > float64(options.HandshakeBurst) {
+				entry.tokens = float64(options.HandshakeBurst)
+			}
+		}
+		entry.lastRefill = now.UnixNano()
+		if entry.tokens < 1 {
+			retryAfter = int64((1-entry.tokens)/rate/float64(time.Second)) + 1
+			reason = "rate"
+		} else {
+			entry.tokens--
+		}
+	}
+	s.rateLimitMux.Unlock()
+
+	if reason == "" {
+		return true
+	}
+	s.rejectRateLimited(w, r, operation, "", reason, retryAfter)
+	return false
+}
+
+/*
+	checkNodeLockout
+
+	Refuse the request if the node UUID it claims is locked out, unless it is
+	sent from the address the node last sent a heartbeat from
+*/
+func (s *ServiceRouter) checkNodeLockout(w http.ResponseWriter, r *http.Request, operation string, nodeUUID string) bool {
+	s.rateLimitMux.Lock()
+	retryAfter := int64(0)
+	if entry := s.rateLimiter.nodes.find(nodeUUID); entry != nil {
+		retryAfter = entry.lockedFor(s.now().Unix())
+	}
+	s.rateLimitMux.Unlock()
+	if retryAfter == 0 {
+		return true
+	}
+
+	if node := s.getNodeByUUID(nodeUUID); node != nil {
+		nodeIpAddr := node.GetIpAddr()
+		if nodeIpAddr != nil && nodeIpAddr.Equal(net.ParseIP(trimIpPort(r.RemoteAddr))) {
+			return true
+		}
+	}
+	s.rejectRateLimited(w, r, operation, nodeUUID, "lockout", retryAfter)
+	return false
+}
+
+//rejectRateLimited reply 429 to the request refused by the rate limiter
+func (s *ServiceRouter) rejectRateLimited(w http.ResponseWriter, r *http.Request, operation string, nodeUUID string, reason string, retryAfter int64) {
+	s.metrics.inc(metricRateLimited, "operation", operation, "reason", reason)
+	s.logger().Debug("request rate limited", logKeyRemote, nodeUUID, logKeyOperation, operation, logKeyEndpoint, r.RemoteAddr, "reason", reason, "retryAfter", retryAfter)
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	http.Error(w, errRateLimited.Error(), http.StatusTooManyRequests)
+	s.emitEvent(Event{Type: EventRateLimited, NodeUUID: nodeUUID, RemoteAddr: r.RemoteAddr, Err: errRateLimited})
+}
+
+/*
+	recordAuthFailure
+
+	Count a failed handshake or a packet with an invalid TOTP against the
+	source address, and lock it out once the limit is reached. The claimed
+	node UUID is only logged, as anyone can claim it
+*/
+func (s *ServiceRouter) recordAuthFailure(r *http.Request, operation string, nodeUUID string) {
+	s.countAuthFailure(r, operation, nodeUUID, false)
+}
+
+/*
+	recordNodeFailure
+
+	Count a failure of a node that proved its identity with a valid TOTP, such
+	as an invalid signature, against the source address and the node UUID
+*/
+func (s *ServiceRouter) recordNodeFailure(r *http.Request, operation string, nodeUUID string) {
+	s.countAuthFailure(r, operation, nodeUUID, true)
+}
+
+//countAuthFailure count the failure against the source address, and the node UUID if identified, and lock them out once the limit is reached
+func (s *ServiceRouter) countAuthFailure(r *http.Request, operation string, nodeUUID string, identified bool) {
+	options := s.getRateLimitOptions()
+	if options.MaxFailures < 0 {
+		return
+	}
+
+	type lockout struct {
+		scope    string
+		key      string
+		duration int64
+	}
+	lockouts := []lockout{}
+	now := s.now().Unix()
+
+	s.rateLimitMux.Lock()
+	keys := []lockout{{scope: "address", key: rateLimitAddress(r.RemoteAddr)}}
+	if identified && nodeUUID != "" {
+		keys = append(keys, lockout{scope: "node", key: nodeUUID})
+	}
+	for _, thisKey := range keys {
+		entries := &s.rateLimiter.addresses
+		if thisKey.scope == "node" {
+			entries = &s.rateLimiter.nodes
+		}
+		entry := entries.get(thisKey.key, now)
+
+		//Start over after a quiet period
+		if entry.lastFailure < now-options.MaxLockoutDuration {
+			entry.lockouts = 0
+		}
+		if entry.windowStart < now-options.FailureWindow {
+			entry.failures = 0
+			entry.windowStart = now
+		}
+		entry.failures++
+		entry.lastFailure = now
+
+		if entry.failures >= options.MaxFailures {
+			duration := options.LockoutDuration
+			for i := uint(0); i < entry.lockouts && duration < options.MaxLockoutDuration; i++ {
+				duration *= 2
+			}
+			if duration > options.MaxLockoutDuration {
+				duration = options.MaxLockoutDuration
+			}
+			entry.lockouts++
+			entry.lockedUntil = now + duration
+			entry.failures = 0
+			thisKey.duration = duration
+			lockouts = append(lockouts, thisKey)
+		}
+	}
+	s.rateLimitMux.Unlock()
+
+	for _, thisLockout := range lockouts {
+		s.metrics.inc(metricLockouts, "scope", thisLockout.scope)
+		s.logger().Warn("too many failed attempts, locked out", logKeyRemote, nodeUUID, logKeyOperation, operation, logKeyEndpoint, r.RemoteAddr, "scope", thisLockout.scope, "duration", thisLockout.duration)
+		event := Event{Type: EventLockout, RemoteAddr: r.RemoteAddr, Err: errors.New("locked out for " + strconv.FormatInt(thisLockout.duration, 10) + " seconds")}
+		if thisLockout.scope == "node" {
+			event.NodeUUID = nodeUUID
+		}
+		s.emitEvent(event)
+	}
+}
+
+//recordAuthSuccess clear the failed attempts of the source address and node UUID after a successful authentication
+func (s *ServiceRouter) recordAuthSuccess(r *http.Request, nodeUUID string) {
+	s.rateLimitMux.Lock()
+	defer s.rateLimitMux.Unlock()
+	if entry := s.rateLimiter.addresses.find(rateLimitAddress(r.RemoteAddr)); entry != nil {
+		entry.failures = 0
+	}
+	if entry := s.rateLimiter.nodes.find(nodeUUID); entry != nil {
+		entry.failures = 0
+	}
+}
@@ -0,0 +1,117 @@
+package godddns_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+//newRateLimitNetwork connect the node a to the router r, which count the failures with the default limits
+func newRateLimitNetwork(t *testing.T) (*simulator.Network, *godddns.ServiceRouter) {
+	t.Helper()
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0)})
+	router, err := network.AddNodeWithOptions("r", "203.0.113.1", func(options *godddns.RouterOptions) {
+		options.Logger = &warnLogger{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.AddNode("a", "203.0.113.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	return network, router.Router
+}
+
+//sendInvalidHeartbeat send a heartbeat claiming the node UUID with an invalid TOTP from the address, and return the status code of the reply
+func sendInvalidHeartbeat(router *godddns.ServiceRouter, nodeUUID string, ipAddr string) int {
+	payload, _ := json.Marshal(godddns.HeartBeatPacket{NodeUUID: nodeUUID, TOTP: "000000"})
+	return router.HandlePacket("h", ipAddr+":40000", payload).StatusCode
+}
+
+func TestLockoutEscalation(t *testing.T) {
+	network, router := newRateLimitNetwork(t)
+	lockOut := func() {
+		t.Helper()
+		for i := 0; i < 5; i++ {
+			if status := sendInvalidHeartbeat(router, "a", "198.51.100.1"); status != http.StatusBadRequest {
+				t.Fatalf("failure %d replied with %d, expected %d", i+1, status, http.StatusBadRequest)
+			}
+		}
+		if status := sendInvalidHeartbeat(router, "a", "198.51.100.1"); status != http.StatusTooManyRequests {
+			t.Fatalf("request after 5 failures replied with %d, expected %d", status, http.StatusTooManyRequests)
+		}
+	}
+
+	//Other addresses are not affected by the lockout
+	lockOut()
+	if status := sendInvalidHeartbeat(router, "a", "198.51.100.2"); status != http.StatusBadRequest {
+		t.Errorf("request of another address replied with %d", status)
+	}
+
+	//The lockout is lifted after 60 seconds, and the second one lasts twice as long
+	network.Clock.Advance(60 * time.Second)
+	lockOut()
+	network.Clock.Advance(60 * time.Second)
+	if status := sendInvalidHeartbeat(router, "a", "198.51.100.1"); status != http.StatusTooManyRequests {
+		t.Errorf("request within the second lockout replied with %d", status)
+	}
+	network.Clock.Advance(60 * time.Second)
+	if status := sendInvalidHeartbeat(router, "a", "198.51.100.1"); status != http.StatusBadRequest {
+		t.Errorf("request after the second lockout replied with %d", status)
+	}
+}
+
+func TestSpoofedUUIDDoesNotLockOutNode(t *testing.T) {
+	network, router := newRateLimitNetwork(t)
+
+	//Hosts claiming the UUID of the node only lock out their own address
+	for host := 1; host <= 5; host++ {
+		for i := 0; i < 5; i++ {
+			sendInvalidHeartbeat(router, "a", "198.51.100."+strconv.Itoa(host))
+		}
+		if status := sendInvalidHeartbeat(router, "a", "198.51.100."+strconv.Itoa(host)); status != http.StatusTooManyRequests {
+			t.Fatalf("address claiming the UUID not locked out, replied with %d", status)
+		}
+	}
+
+	//The node is not bound to the address of its last heartbeat here, as it has moved
+	if err := network.SetIP("a", "203.0.113.99"); err != nil {
+		t.Fatal(err)
+	}
+	nodeA, _ := network.GetNode("a")
+	if err := nodeA.Router.HeartBeatToNode("r"); err != nil {
+		t.Errorf("heartbeat of the node refused after the spoofed failures: %v", err)
+	}
+}
+
+func TestLockedEntriesNotEvicted(t *testing.T) {
+	_, router := newRateLimitNetwork(t)
+	for i := 0; i < 5; i++ {
+		sendInvalidHeartbeat(router, "a", "198.51.100.1")
+	}
+	for i := 0; i < 4; i++ {
+		sendInvalidHeartbeat(router, "a", "198.51.100.2")
+	}
+
+	//Fill the limiter with more addresses than it tracks
+	for i := 0; i < 10000; i++ {
+		sendInvalidHeartbeat(router, "a", "10."+strconv.Itoa(i/65536)+"."+strconv.Itoa(i/256%256)+"."+strconv.Itoa(i%256))
+	}
+
+	if status := sendInvalidHeartbeat(router, "a", "198.51.100.1"); status != http.StatusTooManyRequests {
+		t.Errorf("lockout lifted by new addresses, replied with %d", status)
+	}
+	//The failures of the address that is not locked out are dropped for the new addresses
+	sendInvalidHeartbeat(router, "a", "198.51.100.2")
+	if status := sendInvalidHeartbeat(router, "a", "198.51.100.2"); status != http.StatusBadRequest {
+		t.Errorf("least recently seen address not dropped, replied with %d", status)
+	}
+}
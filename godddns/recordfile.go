@@ -0,0 +1,340 @@
+package godddns
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+	RecordFile.go
+
+	This script render the router's view of the cluster into standard
+	record files (hosts, BIND zone, dnsmasq and CoreDNS hosts file).
+	The records are written inside a managed block so hand-written entries
+	in the same file are preserved. Files are rewritten atomically after a
+	heartbeat cycle whenever an address in the cluster has changed
+*/
+
+type RecordFileFormat int
+
+const (
+	RecordFileHosts        RecordFileFormat = iota //An /etc/hosts fragment
+	RecordFileBINDZone                             //A BIND style zone file
+	RecordFileDnsmasq                              //A dnsmasq config with address= lines
+	RecordFileCoreDNSHosts                         //A hosts file for the CoreDNS hosts plugin
+)
+
+type RecordFileOptions struct {
+	Path        string           //The path of the file to write
+	Format      RecordFileFormat //The format of the file
+	Zone        string           //The domain suffix of node names (<uuid>.<zone>). Required for BIND zone file
+	TTL         uint32           //TTL of the records in BIND zone file, default 60
+	OmitSOA     bool             //Do not write SOA and NS records in BIND zone file (e.g. they are maintained by hand)
+	NameServers []string         //The name servers in BIND zone file, default <DeviceUUID>.<zone>
+	Hostmaster  string           //The mailbox of the zone admin in BIND zone file, default hostmaster.<zone>
+}
+
+type recordFile struct {
+	options      RecordFileOptions
+	lastSnapshot string //The records written to the file last time
+	lastSerial   uint32 //The last SOA serial written to a BIND zone file
+	mux          sync.Mutex
+}
+
+//A single address record of a node in the cluster
+type addressRecord struct {
+	UUID string
+	IP   net.IP
+}
+
+/*
+	AddRecordFile
+
+	Register a record file to be kept in sync with the cluster and write it immediately
+*/
+func (s *ServiceRouter) AddRecordFile(options RecordFileOptions) error {
+	if strings.TrimSpace(options.Path) == "" {
+		return errors.New("record file path is empty")
+	}
+	if options.Format == RecordFileBINDZone && strings.TrimSpace(options.Zone) == "" {
+		return errors.New("zone is required for BIND zone file")
+	}
+	if options.TTL == 0 {
+		options.TTL = 60
+	}
+	if options.Zone != "" {
+		zone := canonicalDNSName(options.Zone)
+		if len(options.NameServers) == 0 {
+			options.NameServers = []string{s.Options.DeviceUUID + "." + zone}
+		}
+		if options.Hostmaster == "" {
+			options.Hostmaster = "hostmaster." + zone
+		}
+	}
+
+	newRecordFile := &recordFile{
+		options: options,
+	}
+
+	s.mux.Lock()
+	for _, thisFile := range s.recordFiles {
+		if thisFile.options.Path == options.Path {
+			s.mux.Unlock()
+			return errors.New("record file already registered")
+		}
+	}
+	s.recordFiles = append(s.recordFiles, newRecordFile)
+	s.mux.Unlock()
+
+	return newRecordFile.write(s, s.getAddressRecords(), true)
+}
+
+//RemoveRecordFile stop updating the record file with given path. The file itself is kept as is
+func (s *ServiceRouter) RemoveRecordFile(path string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	newRecordFiles := []*recordFile{}
+	for _, thisFile := range s.recordFiles {
+		if thisFile.options.Path != path {
+			newRecordFiles = append(newRecordFiles, thisFile)
+		}
+	}
+	if len(newRecordFiles) == len(s.recordFiles) {
+		return errors.New("record file not registered")
+	}
+	s.recordFiles = newRecordFiles
+	return nil
+}
+
+//WriteRecordFiles rewrite all the registered record files regardless of changes
+func (s *ServiceRouter) WriteRecordFiles() error {
+	return s.updateRecordFiles(true)
+}
+
+//updateRecordFiles rewrite the record files whose records has changed since last write
+func (s *ServiceRouter) updateRecordFiles(force bool) error {
+	s.mux.RLock()
+	recordFiles := s.recordFiles
+	s.mux.RUnlock()
+	if len(recordFiles) == 0 {
+		return nil
+	}
+
+	records := s.getAddressRecords()
+	var lastErr error
+	for _, thisFile := range recordFiles {
+		err := thisFile.write(s, records, force)
+		if err != nil {
+			s.logger().Warn("unable to write record file", logKeyOperation, "recordfile", "path", thisFile.options.Path, logKeyError, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+//getAddressRecords return the address records of this router and all its nodes, sorted by UUID
+func (s *ServiceRouter) getAddressRecords() []*addressRecord {
+	records := []*addressRecord{}
+	ipv4, ipv6 := s.GetDeviceIpAddrByFamily()
+	if ipv4 == nil && ipv6 == nil && !isUnspecifiedIP(s.GetDeviceIpAddr()) {
+		ipv4 = s.GetDeviceIpAddr()
+	}
+	for _, ip := range []net.IP{ipv4, ipv6} {
+		if !isUnspecifiedIP(ip) {
+			records = append(records, &addressRecord{UUID: s.Options.DeviceUUID, IP: ip})
+		}
+	}
+
+	for _, node := range s.getNodes() {
+		ip := node.GetIpAddr()
+		if !isUnspecifiedIP(ip) {
+			records = append(records, &addressRecord{UUID: node.UUID, IP: ip})
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].UUID < records[j].UUID
+	})
+	return records
+}
+
+/*
+	Record file rendering
+*/
+
+func (f *recordFile) write(s *ServiceRouter, records []*addressRecord, force bool) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	snapshot := []string{}
+	for _, record := range records {
+		snapshot = append(snapshot, record.UUID+"="+record.IP.String())
+	}
+	snapshotString := strings.Join(snapshot, ",")
+	if !force && snapshotString == f.lastSnapshot {
+		//Nothing changed
+		return nil
+	}
+
+	//Read the current file to preserve the hand-written entries
+	existingContent := ""
+	fileMode := os.FileMode(0644)
+	if fileInfo, err := os.Stat(f.options.Path); err == nil {
+		fileMode = fileInfo.Mode().Perm()
+		content, err := ioutil.ReadFile(f.options.Path)
+		if err != nil {
+			return err
+		}
+		existingContent = string(content)
+	}
+
+	if f.options.Format == RecordFileBINDZone {
+		serial := uint32(s.now().Unix())
+		if serial <= f.lastSerial {
+			serial = f.lastSerial + 1
+		}
+		f.lastSerial = serial
+	}
+
+	commentPrefix := "#"
+	if f.options.Format == RecordFileBINDZone {
+		commentPrefix = ";"
+	}
+	beginMarker := commentPrefix + " BEGIN go-DDDNS " + s.Options.DeviceUUID
+	endMarker := commentPrefix + " END go-DDDNS " + s.Options.DeviceUUID
+	block := beginMarker + "\n" + f.render(records) + endMarker + "\n"
+
+	newContent, err := replaceManagedBlock(existingContent, beginMarker, endMarker, block)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(f.options.Path, []byte(newContent), fileMode)
+	if err != nil {
+		return err
+	}
+	f.lastSnapshot = snapshotString
+	return nil
+}
+
+//render the records in the format of this file, each line ends with a new line
+func (f *recordFile) render(records []*addressRecord) string {
+	zone := ""
+	if f.options.Zone != "" {
+		zone = canonicalDNSName(f.options.Zone)
+	}
+	fqdn := func(uuid string) string {
+		if zone == "" {
+			return uuid
+		}
+		return strings.ToLower(uuid) + "." + zone
+	}
+
+	var sb strings.Builder
+	switch f.options.Format {
+	case RecordFileHosts:
+		for _, record := range records {
+			if zone == "" {
+				fmt.Fprintf(&sb, "%s\t%s\n", record.IP.String(), record.UUID)
+			} else {
+				fmt.Fprintf(&sb, "%s\t%s %s\n", record.IP.String(), strings.TrimSuffix(fqdn(record.UUID), "."), record.UUID)
+			}
+		}
+	case RecordFileCoreDNSHosts:
+		//The CoreDNS hosts plugin serve the names under the zones it is configured with, use fully qualified names
+		for _, record := range records {
+			fmt.Fprintf(&sb, "%s\t%s\n", record.IP.String(), fqdn(record.UUID))
+		}
+	case RecordFileDnsmasq:
+		for _, record := range records {
+			fmt.Fprintf(&sb, "address=/%s/%s\n", strings.TrimSuffix(fqdn(record.UUID), "."), record.IP.String())
+		}
+	case RecordFileBINDZone:
+		ttl := f.options.TTL
+		if !f.options.OmitSOA {
+			fmt.Fprintf(&sb, "%s\t%d\tIN\tSOA\t%s %s %d 3600 600 86400 %d\n", zone, ttl, canonicalDNSName(f.options.NameServers[0]), canonicalDNSName(f.options.Hostmaster), f.lastSerial, ttl)
+			for _, ns := range f.options.NameServers {
+				fmt.Fprintf(&sb, "%s\t%d\tIN\tNS\t%s\n", zone, ttl, canonicalDNSName(ns))
+			}
+		}
+		for _, record := range records {
+			recordType := "AAAA"
+			if isIPv4(record.IP) {
+				recordType = "A"
+			}
+			fmt.Fprintf(&sb, "%s\t%d\tIN\t%s\t%s\n", fqdn(record.UUID), ttl, recordType, record.IP.String())
+		}
+	}
+	return sb.String()
+}
+
+/*
+	replaceManagedBlock
+
+	Replace the block between the begin and end marker lines with the given block.
+	If the block does not exists, it is appended to the end of the content
+*/
+func replaceManagedBlock(content string, beginMarker string, endMarker string, block string) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+	beginLine := -1
+	endLine := -1
+	for i, line := range lines {
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == beginMarker && beginLine < 0 {
+			beginLine = i
+		} else if trimmedLine == endMarker && beginLine >= 0 {
+			endLine = i
+			break
+		}
+	}
+
+	if beginLine >= 0 && endLine < 0 {
+		return "", errors.New("managed block is not closed, expecting " + endMarker)
+	}
+
+	if beginLine < 0 {
+		//Append the block to the end of file
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return content + block, nil
+	}
+
+	return strings.Join(lines[:beginLine], "") + block + strings.Join(lines[endLine+1:], ""), nil
+}
+
+//writeFileAtomic write the content to a temp file in the same folder and rename it to the target path
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpFilename := tmpFile.Name()
+
+	_, err = tmpFile.Write(content)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFilename, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package godddns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaceManagedBlock(t *testing.T) {
+	block := "# BEGIN go-DDDNS a\n203.0.113.1\ta\n# END go-DDDNS a\n"
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"", block},
+		{"127.0.0.1\tlocalhost", "127.0.0.1\tlocalhost\n" + block},
+		{"127.0.0.1\tlocalhost\n", "127.0.0.1\tlocalhost\n" + block},
+		{
+			"127.0.0.1\tlocalhost\n# BEGIN go-DDDNS a\n198.51.100.1\ta\n# END go-DDDNS a\n::1\tlocalhost\n",
+			"127.0.0.1\tlocalhost\n" + block + "::1\tlocalhost\n",
+		},
+		{
+			//Markers indented by hand are still found
+			"  # BEGIN go-DDDNS a  \n198.51.100.1\ta\n\t# END go-DDDNS a\n",
+			block,
+		},
+		{
+			//Blocks of other routers are left untouched
+			"# BEGIN go-DDDNS b\n198.51.100.2\tb\n# END go-DDDNS b\n",
+			"# BEGIN go-DDDNS b\n198.51.100.2\tb\n# END go-DDDNS b\n" + block,
+		},
+	}
+	for _, test := range tests {
+		result, err := replaceManagedBlock(test.content, "# BEGIN go-DDDNS a", "# END go-DDDNS a", block)
+		if err != nil || result != test.expected {
+			t.Errorf("block in %q replaced as %q, %v, expected %q", test.content, result, err, test.expected)
+		}
+	}
+
+	if _, err := replaceManagedBlock("# BEGIN go-DDDNS a\n198.51.100.1\ta\n", "# BEGIN go-DDDNS a", "# END go-DDDNS a", block); err == nil {
+		t.Error("unclosed managed block replaced")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(filename, []byte("old content\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(filename, []byte("new content\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil || string(content) != "new content\n" {
+		t.Errorf("file content %q, %v", content, err)
+	}
+	if fileInfo, err := os.Stat(filename); err != nil || fileInfo.Mode().Perm() != 0640 {
+		t.Errorf("file mode %v, %v, expected 0640", fileInfo.Mode().Perm(), err)
+	}
+
+	//The temp file is renamed over the target, nothing is left behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files in the folder after the write, expected 1", len(files))
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "hosts"), []byte("content"), 0644); err == nil {
+		t.Error("write to a missing folder succeeded")
+	}
+}
+
+//newRecordFileRouter create a router at 203.0.113.10 with node1 at 203.0.113.1
+func newRecordFileRouter() (*ServiceRouter, *Node) {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	router.DeviceIpAddr = net.ParseIP("203.0.113.10")
+	node := router.NewNode(NodeOptions{NodeID: "node1", Port: 8080, RESTInterface: "/godddns"})
+	node.IpAddr = net.ParseIP("203.0.113.1")
+	router.AddNode(node)
+	return router, node
+}
+
+func TestAddRecordFileKeepsHandWrittenEntries(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hosts")
+	handWritten := "127.0.0.1\tlocalhost\n192.168.1.1\trouter\n"
+	if err := ioutil.WriteFile(filename, []byte(handWritten), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	router, node := newRecordFileRouter()
+	if err := router.AddRecordFile(RecordFileOptions{Path: filename, Format: RecordFileHosts, Zone: "cluster.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := handWritten + "# BEGIN go-DDDNS thisNode\n" +
+		"203.0.113.1\tnode1.cluster.example.com node1\n" +
+		"203.0.113.10\tthisnode.cluster.example.com thisNode\n" +
+		"# END go-DDDNS thisNode\n"
+	if content, _ := ioutil.ReadFile(filename); string(content) != expected {
+		t.Errorf("hosts file written as %q, expected %q", content, expected)
+	}
+
+	//Only the managed block is rewritten when an address changes
+	node.IpAddr = net.ParseIP("203.0.113.101")
+	if err := router.updateRecordFiles(false); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(filename)
+	if !strings.HasPrefix(string(content), handWritten) || !strings.Contains(string(content), "203.0.113.101\tnode1") || strings.Count(string(content), "BEGIN go-DDDNS") != 1 {
+		t.Errorf("hosts file rewritten as %q", content)
+	}
+	if fileInfo, _ := os.Stat(filename); fileInfo.Mode().Perm() != 0600 {
+		t.Errorf("file mode changed to %v", fileInfo.Mode().Perm())
+	}
+}
+
+func TestAddRecordFileBINDZone(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cluster.zone")
+	if err := ioutil.WriteFile(filename, []byte("$ORIGIN cluster.example.com.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	router, _ := newRecordFileRouter()
+	if err := router.AddRecordFile(RecordFileOptions{Path: filename, Format: RecordFileBINDZone}); err == nil {
+		t.Error("zone file accepted without zone")
+	}
+	if err := router.AddRecordFile(RecordFileOptions{Path: filename, Format: RecordFileBINDZone, Zone: "cluster.example.com", TTL: 30}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(filename)
+	for _, line := range []string{
+		"$ORIGIN cluster.example.com.\n; BEGIN go-DDDNS thisNode\n",
+		"cluster.example.com.\t30\tIN\tNS\tthisnode.cluster.example.com.\n",
+		"node1.cluster.example.com.\t30\tIN\tA\t203.0.113.1\n",
+		"; END go-DDDNS thisNode\n",
+	} {
+		if !strings.Contains(string(content), line) {
+			t.Errorf("zone file %q does not contain %q", content, line)
+		}
+	}
+}
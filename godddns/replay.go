@@ -0,0 +1,241 @@
+package godddns
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sort"
+)
+
+/*
+	Replay.go
+
+	This script stop captured heartbeat and sync packets from being replayed.
+	Every packet carry a random nonce, the time it is sent and a MAC keyed with
+	the TOTP secret of the sender. The router accepts a packet only if it is
+	recent and its nonce has not been seen from the same node before.
+
+	The nonces seen from each node are kept until the packet would be too old
+	to be accepted anyway. If a node sends more packets than the cache holds,
+	the oldest nonces are dropped and packets older than them are refused.
+
+	Older versions send packets without nonce. Once a node has sent a nonce,
+	or has joined with a public key, its packets without nonce are refused.
+	For the other nodes, a TOTP token sent again from another address than
+	the one that used it first is logged, as it may be a captured packet.
+	In the same way, the plain replies of older versions are accepted until
+	the node has replied with a MAC or is known to have a public key
+*/
+
+const (
+	replayWindow           = 90   //Seconds a packet is accepted before or after the time it is sent
+	replayCacheSizePerNode = 1024 //The maximum number of nonces kept for each node
+)
+
+//errPacketReplayed is returned if the nonce of the packet has been seen, or may have been dropped from the cache
+var errPacketReplayed = errors.New("packet replayed or expired")
+
+//replayCache is the nonces recently accepted from a node
+type replayCache struct {
+	nonces map[string]int64           //Nonce => the time the packet is sent
+	floor  int64                      //Packets sent at or before this time are refused, as their nonces may be dropped
+	tokens map[string]*legacyTokenUse //TOTP token => the first use of the token in packets without nonce
+}
+
+//legacyTokenUse is the first use of a TOTP token in a packet without nonce
+type legacyTokenUse struct {
+	address string //The address the token is first sent from
+	expire  int64  //The time the token can no longer be valid
+}
+
+//packetMAC return the MAC of the message keyed with the TOTP secret shared by both nodes
+func packetMAC(totpSecret string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(totpSecret))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+/*
+	checkPacketFreshness
+
+	Verify the MAC and the time of a packet and remember its nonce. Packets
+	without nonce are only accepted from nodes running older versions, and
+	their TOTP token only from the address it is first sent from. Must be
+	called after the packet is authenticated, so the cache cannot be filled
+	by other parties
+*/
+func (s *ServiceRouter) checkPacketFreshness(nodeUUID string, totpSecret string, message []byte, nonce string, timestamp int64, mac []byte, token string, remoteAddr string) (int, error) {
+	if nonce == "" {
+		if s.nodeRequiresNonce(nodeUUID) {
+			return http.StatusBadRequest, errors.New("packet has no nonce")
+		}
+		return s.checkLegacyToken(nodeUUID, token, remoteAddr)
+	}
+
+	if !hmac.Equal(mac, packetMAC(totpSecret, message)) {
+		return http.StatusUnauthorized, errors.New("invalid packet MAC")
+	}
+
+	now := s.now().Unix()
+	if timestamp < now-replayWindow || timestamp > now+replayWindow {
+		return http.StatusBadRequest, errors.New("packet time is out of the accepted window")
+	}
+
+	s.replayMux.Lock()
+	if s.replayCaches == nil {
+		s.replayCaches = map[string]*replayCache{}
+	}
+	cache, ok := s.replayCaches[nodeUUID]
+	if !ok {
+		cache = &replayCache{nonces: map[string]int64{}}
+		s.replayCaches[nodeUUID] = cache
+	}
+
+	if timestamp <= cache.floor {
+		s.replayMux.Unlock()
+		return http.StatusBadRequest, errPacketReplayed
+	}
+	if _, seen := cache.nonces[nonce]; seen {
+		s.replayMux.Unlock()
+		return http.StatusBadRequest, errPacketReplayed
+	}
+	cache.add(nonce, timestamp, now)
+	s.replayMux.Unlock()
+
+	s.setNonceRequired(nodeUUID)
+	return http.StatusOK, nil
+}
+
+//nodeRequiresNonce check if packets without nonce are refused from the node, i.e. it runs a version that sends them
+func (s *ServiceRouter) nodeRequiresNonce(nodeUUID string) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	position := s.totpMapExists(nodeUUID)
+	if position < 0 {
+		return false
+	}
+	record := s.TOTPMap[position]
+	return record.RequireNonce || len(record.PublicKey) > 0
+}
+
+//setNonceRequired refuse packets without nonce from the node from now on
+func (s *ServiceRouter) setNonceRequired(nodeUUID string) {
+	s.mux.Lock()
+	position := s.totpMapExists(nodeUUID)
+	changed := position >= 0 && !s.TOTPMap[position].RequireNonce
+	if changed {
+		s.TOTPMap[position].RequireNonce = true
+	}
+	s.mux.Unlock()
+
+	if changed {
+		s.scheduleSave()
+	}
+}
+
+//requiresReplyMAC check if plain replies are refused from the node, i.e. it runs a version that authenticates them
+func (n *Node) requiresReplyMAC() bool {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return n.requireReplyMAC || len(n.publicKey) > 0
+}
+
+//setReplyMACRequired refuse plain replies from the node from now on
+func (n *Node) setReplyMACRequired() {
+	n.mux.Lock()
+	changed := !n.requireReplyMAC
+	n.requireReplyMAC = true
+	n.mux.Unlock()
+
+	if changed {
+		n.parent.scheduleSave()
+	}
+}
+
+/*
+	checkLegacyToken
+
+	Remember the first address each TOTP token of a packet without nonce is
+	sent from. Older versions send the same token again within its period,
+	also after their address changed, so the token is still accepted from
+	another address but logged, as it may be a captured packet sent from
+	elsewhere
+*/
+func (s *ServiceRouter) checkLegacyToken(nodeUUID string, token string, remoteAddr string) (int, error) {
+	s.mux.RLock()
+	period := int64(defaultTOTPPeriod)
+	if position := s.totpMapExists(nodeUUID); position >= 0 {
+		period = int64(s.TOTPMap[position].Parameters.normalize().Period)
+	}
+	s.mux.RUnlock()
+
+	now := s.now().Unix()
+	address := trimIpPort(remoteAddr)
+
+	s.replayMux.Lock()
+	defer s.replayMux.Unlock()
+	if s.replayCaches == nil {
+		s.replayCaches = map[string]*replayCache{}
+	}
+	cache, ok := s.replayCaches[nodeUUID]
+	if !ok {
+		cache = &replayCache{nonces: map[string]int64{}}
+		s.replayCaches[nodeUUID] = cache
+	}
+	if cache.tokens == nil {
+		cache.tokens = map[string]*legacyTokenUse{}
+	}
+	for key, use := range cache.tokens {
+		if use.expire < now {
+			delete(cache.tokens, key)
+		}
+	}
+
+	if use, seen := cache.tokens[token]; seen {
+		if use.address != address {
+			s.logger().Warn("token of a packet without nonce sent again from another address", logKeyRemote, nodeUUID, logKeyEndpoint, remoteAddr, "firstAddress", use.address)
+		}
+		return http.StatusOK, nil
+	}
+	//The token is valid within its period, plus the clock difference of the nodes
+	cache.tokens[token] = &legacyTokenUse{
+		address: address,
+		expire:  now + 2*period + replayWindow,
+	}
+	return http.StatusOK, nil
+}
+
+//add remember the nonce, dropping the expired nonces and the oldest ones if the cache is full
+func (c *replayCache) add(nonce string, timestamp int64, now int64) {
+	for key, sentTime := range c.nonces {
+		if sentTime < now-replayWindow {
+			delete(c.nonces, key)
+		}
+	}
+
+	if len(c.nonces) >= replayCacheSizePerNode {
+		sentTimes := make([]int64, 0, len(c.nonces))
+		for _, sentTime := range c.nonces {
+			sentTimes = append(sentTimes, sentTime)
+		}
+		sort.Slice(sentTimes, func(i, j int) bool { return sentTimes[i] < sentTimes[j] })
+
+		//Drop the oldest quarter, packets sent before them are refused from now on
+		c.floor = sentTimes[len(sentTimes)/4]
+		for key, sentTime := range c.nonces {
+			if sentTime <= c.floor {
+				delete(c.nonces, key)
+			}
+		}
+	}
+
+	c.nonces[nonce] = timestamp
+}
+
+//removeReplayCache drop the nonces of the node with given UUID
+func (s *ServiceRouter) removeReplayCache(nodeUUID string) {
+	s.replayMux.Lock()
+	defer s.replayMux.Unlock()
+	delete(s.replayCaches, nodeUUID)
+}
@@ -0,0 +1,149 @@
+package godddns
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testTotpSecret = "JBSWY3DPEHPK3PXP"
+
+//newReplayRouter create a router with a TOTP record of node1
+func newReplayRouter() (*ServiceRouter, *recordLogger) {
+	logger := &recordLogger{}
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode", Logger: logger})
+	router.TOTPMap = []*TOTPRecord{{RemoteUUID: "node1", RecvTOTPSecret: testTotpSecret, Permissions: PermissionAll}}
+	return router, logger
+}
+
+//checkNoncePacket check a packet of node1 with nonce, MAC keyed with the shared secret
+func checkNoncePacket(router *ServiceRouter, nonce string, timestamp int64) (int, error) {
+	message := []byte("heartbeat/" + nonce + "/" + strconv.FormatInt(timestamp, 10))
+	return router.checkPacketFreshness("node1", testTotpSecret, message, nonce, timestamp, packetMAC(testTotpSecret, message), "123456", "203.0.113.1:40000")
+}
+
+func TestReplayedNonceRefused(t *testing.T) {
+	router, _ := newReplayRouter()
+	now := router.now().Unix()
+	if _, err := checkNoncePacket(router, "nonce1", now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkNoncePacket(router, "nonce1", now); err != errPacketReplayed {
+		t.Errorf("replayed nonce accepted: %v", err)
+	}
+	if _, err := checkNoncePacket(router, "nonce2", now); err != nil {
+		t.Errorf("new nonce refused: %v", err)
+	}
+}
+
+func TestPacketTimeWindow(t *testing.T) {
+	router, _ := newReplayRouter()
+	now := router.now().Unix()
+	if status, err := checkNoncePacket(router, "old", now-replayWindow-1); err == nil || status != http.StatusBadRequest {
+		t.Errorf("packet sent before the window accepted: %d %v", status, err)
+	}
+	if _, err := checkNoncePacket(router, "future", now+replayWindow+1); err == nil {
+		t.Error("packet sent after the window accepted")
+	}
+	if _, err := checkNoncePacket(router, "late", now-replayWindow+1); err != nil {
+		t.Errorf("packet within the window refused: %v", err)
+	}
+}
+
+func TestPacketMACVerified(t *testing.T) {
+	router, _ := newReplayRouter()
+	now := router.now().Unix()
+	message := []byte("heartbeat")
+	status, err := router.checkPacketFreshness("node1", testTotpSecret, message, "nonce", now, packetMAC("KRSXG5CTMVRXEZLU", message), "123456", "203.0.113.1:40000")
+	if err == nil || status != http.StatusUnauthorized {
+		t.Errorf("packet with MAC of another secret accepted: %d %v", status, err)
+	}
+}
+
+func TestNonceRequiredAfterFirstNonce(t *testing.T) {
+	router, _ := newReplayRouter()
+
+	//Older versions send packets without nonce
+	if _, err := router.checkPacketFreshness("node1", testTotpSecret, nil, "", 0, nil, "123456", "203.0.113.1:40000"); err != nil {
+		t.Fatalf("legacy packet refused: %v", err)
+	}
+
+	//Once the node has sent a nonce, the nonce cannot be stripped
+	if _, err := checkNoncePacket(router, "nonce1", router.now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if !router.TOTPMap[0].RequireNonce {
+		t.Error("nonce requirement not recorded in the TOTP record")
+	}
+	if _, err := router.checkPacketFreshness("node1", testTotpSecret, nil, "", 0, nil, "654321", "203.0.113.1:40000"); err == nil {
+		t.Error("packet without nonce accepted after the node sent a nonce")
+	}
+}
+
+func TestNonceRequiredWithPublicKey(t *testing.T) {
+	router, _ := newReplayRouter()
+	router.TOTPMap[0].PublicKey = router.PublicKey()
+	if _, err := router.checkPacketFreshness("node1", testTotpSecret, nil, "", 0, nil, "123456", "203.0.113.1:40000"); err == nil {
+		t.Error("packet without nonce accepted from a node that joined with a public key")
+	}
+}
+
+func TestLegacyTokenFromAnotherAddress(t *testing.T) {
+	router, logger := newReplayRouter()
+	checkLegacy := func(token string, remoteAddr string) error {
+		_, err := router.checkPacketFreshness("node1", testTotpSecret, nil, "", 0, nil, token, remoteAddr)
+		return err
+	}
+
+	if err := checkLegacy("123456", "203.0.113.1:40000"); err != nil {
+		t.Fatal(err)
+	}
+	//Older versions send the same token again within its period
+	if err := checkLegacy("123456", "203.0.113.1:40001"); err != nil {
+		t.Errorf("token sent again from the same address refused: %v", err)
+	}
+	if len(logger.getWarnings()) != 0 {
+		t.Errorf("token sent again from the same address warned %q", logger.getWarnings())
+	}
+
+	//The address of an older version may change while its token is valid, which is accepted but logged
+	if err := checkLegacy("123456", "198.51.100.1:40000"); err != nil {
+		t.Errorf("token sent again from a new address refused: %v", err)
+	}
+	warnings := logger.getWarnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "firstAddress=203.0.113.1") {
+		t.Errorf("token from another address warned %q, expected one warning with the first address", warnings)
+	}
+
+	//The token is forgotten once it can no longer be valid
+	router.replayCaches["node1"].tokens["123456"].expire = router.now().Unix() - 1
+	if err := checkLegacy("123456", "192.0.2.1:40000"); err != nil {
+		t.Fatal(err)
+	}
+	if use := router.replayCaches["node1"].tokens["123456"]; use == nil || use.address != "192.0.2.1" {
+		t.Error("expired token still bound to its first address")
+	}
+	if len(logger.getWarnings()) != 1 {
+		t.Errorf("expired token warned %q", logger.getWarnings()[1:])
+	}
+}
+
+func TestReplayCacheFull(t *testing.T) {
+	router, _ := newReplayRouter()
+	now := router.now().Unix()
+	for i := 0; i < replayCacheSizePerNode+1; i++ {
+		if _, err := checkNoncePacket(router, "nonce"+strconv.Itoa(i), now-int64(replayCacheSizePerNode)/20+int64(i)/20); err != nil {
+			t.Fatalf("nonce %d refused: %v", i, err)
+		}
+	}
+	cache := router.replayCaches["node1"]
+	if len(cache.nonces) > replayCacheSizePerNode {
+		t.Errorf("replay cache holds %d nonces, more than %d", len(cache.nonces), replayCacheSizePerNode)
+	}
+
+	//Packets as old as the dropped nonces are refused, as they cannot be checked anymore
+	if _, err := checkNoncePacket(router, "unseen", cache.floor); err != errPacketReplayed {
+		t.Errorf("packet older than the dropped nonces accepted: %v", err)
+	}
+}
@@ -0,0 +1,538 @@
+package godddns
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	Revocation.go
+
+	This script revoke a compromised node on every router of the cluster (opr=v).
+	The administrator revokes the node on any router, which signs a revocation
+	notice with its identity key. The notice is forwarded to the connected nodes,
+	which delete the TOTP record of the revoked node, refuse its handshakes and
+	forward the notice to their own nodes, until every router has it.
+
+	Each hop is authenticated like a heartbeat, and the notice must be signed by
+	a router trusted to issue revocations: a node with PermissionRevoke on the
+	receiving router, or a router whose identity key is endorsed by one of the
+	administrator keys in the options. Notices from any other issuer are refused,
+	so a compromised node cannot revoke the others. Nodes that cannot be reached
+	are tried again on every heartbeat cycle
+
+	Notices are only accepted for the maximum notice age after they are issued.
+	Once a revocation is removed, the notices of the node issued before are
+	refused, so a captured notice cannot revoke the node again
+
+	adminKey, _ := ed25519.GenerateKey(nil) //Kept offline by the administrator
+	endorsement := godddns.EndorseRevocationIssuer(adminKey, "node1", router.PublicKey())
+*/
+
+const (
+	defaultMaxNoticeAge = 30 * 86400 //Seconds a revocation notice is accepted after it is issued
+)
+
+var (
+	errRevocationUnsupported = errors.New("remote node does not support revocation") //The remote node runs an older version without revocation
+	errRevocationRefused     = errors.New("revocation refused by remote node")       //The remote node will never accept the notice from this router, e.g. no permission
+)
+
+//RevocationOptions are the administrator keys trusted to endorse the routers issuing revocations, and the age of the notices accepted
+type RevocationOptions struct {
+	AdminKeys    [][]byte `json:",omitempty"` //Ed25519 public keys of the administrators
+	Endorsement  []byte   `json:",omitempty"` //The endorsement of this router by an administrator, sent with the revocations issued by this router
+	MaxNoticeAge int64    `json:",omitempty"` //Seconds a revocation notice is accepted after it is issued, default 30 days
+}
+
+//RevocationNotice is the statement of the issuing router that a node is no longer trusted
+type RevocationNotice struct {
+	NodeUUID    string //The UUID of the revoked node
+	IssuerUUID  string //The UUID of the router the node is revoked on
+	Reason      string `json:",omitempty"` //The reason given by the administrator
+	IssueTime   int64  //The time the node is revoked
+	IssuerKey   []byte `json:",omitempty"` //The identity key of the issuing router
+	Endorsement []byte `json:",omitempty"` //The endorsement of the issuing router by an administrator
+	Signature   []byte `json:",omitempty"` //Signed with the identity key of the issuing router
+}
+
+//Revocation is a node revoked on this router and the delivery state of its notice
+type Revocation struct {
+	RevocationNotice
+	ReceivedFrom string   `json:",omitempty"` //The node the notice is received from, empty if issued by this router
+	Pending      []string `json:",omitempty"` //The nodes the notice is not yet delivered to
+}
+
+//Sent to forward a revocation notice to a connected node
+type RevocationRequest struct {
+	NodeUUID  string
+	TOTP      string
+	Nonce     string //Random value, each nonce is accepted once
+	Timestamp int64  //The time the packet is sent
+	MAC       []byte //Keyed with the TOTP secret of the sending node
+	Signature []byte `json:",omitempty"` //Signed with the identity key of the sending node
+	Notice    RevocationNotice
+}
+
+//signedMessage return the message signed by the issuing router
+func (n *RevocationNotice) signedMessage() []byte {
+	return signedMessage("revocation", n.NodeUUID, n.IssuerUUID, n.Reason, strconv.FormatInt(n.IssueTime, 10), base64.StdEncoding.EncodeToString(n.IssuerKey))
+}
+
+//endorsementMessage return the message signed by the administrator to endorse the router
+func endorsementMessage(routerUUID string, routerPublicKey []byte) []byte {
+	return signedMessage("revocation-issuer", routerUUID, base64.StdEncoding.EncodeToString(routerPublicKey))
+}
+
+/*
+	EndorseRevocationIssuer
+
+	Sign the UUID and identity key of a router with the administrator key, so
+	the routers with the administrator public key in their options accept the
+	revocations issued by it. Set the result in RevocationOptions.Endorsement
+	of the endorsed router
+*/
+func EndorseRevocationIssuer(adminKey ed25519.PrivateKey, routerUUID string, routerPublicKey ed25519.PublicKey) []byte {
+	return ed25519.Sign(adminKey, endorsementMessage(routerUUID, routerPublicKey))
+}
+
+//getMaxNoticeAge return the seconds a revocation notice is accepted after it is issued
+func (s *ServiceRouter) getMaxNoticeAge() int64 {
+	if s.Options.Revocation.MaxNoticeAge <= 0 {
+		return defaultMaxNoticeAge
+	}
+	return s.Options.Revocation.MaxNoticeAge
+}
+
+//verifyEndorsement check if the router is endorsed by one of the administrator keys
+func (s *ServiceRouter) verifyEndorsement(routerUUID string, routerPublicKey []byte, endorsement []byte) error {
+	if len(endorsement) == 0 || len(routerPublicKey) != ed25519.PublicKeySize {
+		return errors.New("revocation issuer is not endorsed")
+	}
+	for _, adminKey := range s.Options.Revocation.AdminKeys {
+		if len(adminKey) == ed25519.PublicKeySize && ed25519.Verify(ed25519.PublicKey(adminKey), endorsementMessage(routerUUID, routerPublicKey), endorsement) {
+			return nil
+		}
+	}
+	return errors.New("revocation issuer is not endorsed")
+}
+
+//signedMessage return the message signed in the revocation request sent to the router with given UUID
+func (p *RevocationRequest) signedMessage(routerUUID string) []byte {
+	return signedMessage("revoke", p.NodeUUID, routerUUID, p.TOTP, p.Nonce, strconv.FormatInt(p.Timestamp, 10),
+		p.Notice.NodeUUID, p.Notice.IssuerUUID, p.Notice.Reason, strconv.FormatInt(p.Notice.IssueTime, 10), base64.StdEncoding.EncodeToString(p.Notice.Signature))
+}
+
+//handleRevocationRequest accept a revocation notice forwarded by a connected node
+func (s *ServiceRouter) handleRevocationRequest(w http.ResponseWriter, r *http.Request) {
+	var payload RevocationRequest
+
+	//Try to parse it into the required structure
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkNodeLockout(w, r, "revoke", payload.NodeUUID) {
+		return
+	}
+
+	//Validate the TOTP
+	matchedTotpSecret := s.verifyNodeTOTP(payload.NodeUUID, payload.TOTP)
+	if matchedTotpSecret == "" {
+		s.recordAuthFailure(r, "revoke", payload.NodeUUID)
+		s.metrics.inc(metricTOTPFailures, "operation", "revoke")
+		s.metrics.inc(metricRevocations, "source", "remote", "result", "rejected")
+		http.Error(w, "invalid TOTP", http.StatusUnauthorized)
+		s.logger().Warn("revocation rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", logKeyEndpoint, r.RemoteAddr, logKeyError, "invalid TOTP")
+		return
+	}
+
+	//Check the signature if the node has sent its public key
+	err = s.verifyNodeSignature(payload.NodeUUID, payload.signedMessage(s.Options.DeviceUUID), payload.Signature)
+	if err != nil {
+		s.recordNodeFailure(r, "revoke", payload.NodeUUID)
+		s.metrics.inc(metricSignatureFailures, "operation", "revoke")
+		s.metrics.inc(metricRevocations, "source", "remote", "result", "rejected")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		s.logger().Warn("revocation rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	//Make sure the packet is recent and not seen before
+	if payload.Nonce == "" {
+		err = errors.New("packet has no nonce")
+	}
+	status := http.StatusBadRequest
+	if err == nil {
+		status, err = s.checkPacketFreshness(payload.NodeUUID, matchedTotpSecret, payload.signedMessage(s.Options.DeviceUUID), payload.Nonce, payload.Timestamp, payload.MAC, payload.TOTP, r.RemoteAddr)
+	}
+	if err != nil {
+		s.metrics.inc(metricReplayedPackets, "operation", "revoke")
+		s.metrics.inc(metricRevocations, "source", "remote", "result", "rejected")
+		http.Error(w, err.Error(), status)
+		s.logger().Warn("revocation rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	s.recordAuthSuccess(r, payload.NodeUUID)
+
+	//Check if the notice is issued by a router trusted to revoke nodes
+	err = s.verifyRevocationNotice(&payload.Notice, payload.NodeUUID)
+	if err != nil {
+		s.metrics.inc(metricRevocations, "source", "remote", "result", "rejected")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		s.logger().Warn("revocation rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", logKeyEndpoint, r.RemoteAddr, "node", payload.Notice.NodeUUID, logKeyError, err)
+		return
+	}
+
+	if payload.Notice.NodeUUID == s.Options.DeviceUUID {
+		//Acknowledged so the notice is not sent again, the other routers refuse this router from now on
+		s.logger().Error("this router is revoked", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", "issuer", payload.Notice.IssuerUUID, "reason", payload.Notice.Reason)
+		w.Write([]byte("OK"))
+		return
+	}
+
+	accepted := s.applyRevocation(payload.Notice, payload.NodeUUID)
+	w.Write([]byte("OK"))
+	if !accepted {
+		//Already revoked, the notice is not forwarded again so it stops spreading
+		s.logger().Debug("node already revoked", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", "node", payload.Notice.NodeUUID)
+		return
+	}
+
+	s.logger().Warn("node revoked", logKeyRemote, payload.NodeUUID, logKeyOperation, "revoke", logKeyEndpoint, r.RemoteAddr, "node", payload.Notice.NodeUUID, "issuer", payload.Notice.IssuerUUID, "reason", payload.Notice.Reason)
+	s.metrics.inc(metricRevocations, "source", "remote", "result", "accepted")
+	s.emitEvent(Event{Type: EventNodeRevoked, NodeUUID: payload.Notice.NodeUUID, RemoteAddr: r.RemoteAddr})
+	s.scheduleSave()
+}
+
+/*
+	verifyRevocationNotice
+
+	Check the notice forwarded by the node with given UUID. The notice must be
+	signed by this router, by a node with PermissionRevoke on this router, or
+	by a router endorsed by an administrator key. A node cannot forward its
+	own revocation, and notices issued by revoked nodes are refused, so are
+	notices older than the maximum notice age or issued before the revocation
+	of the node was removed on this router
+*/
+func (s *ServiceRouter) verifyRevocationNotice(notice *RevocationNotice, senderUUID string) error {
+	if strings.TrimSpace(notice.NodeUUID) == "" || strings.TrimSpace(notice.IssuerUUID) == "" {
+		return errors.New("invalid revocation notice")
+	}
+	if notice.NodeUUID == senderUUID {
+		return errors.New("revocation forwarded by the revoked node")
+	}
+	if notice.NodeUUID == notice.IssuerUUID {
+		return errors.New("revocation issued by the revoked node")
+	}
+	if s.IsNodeRevoked(notice.IssuerUUID) {
+		return errors.New("revocation issued by a revoked node")
+	}
+
+	now := s.now().Unix()
+	if notice.IssueTime > now+replayWindow {
+		return errors.New("revocation issued in the future")
+	}
+	if notice.IssueTime < now-s.getMaxNoticeAge() {
+		return errors.New("revocation notice expired")
+	}
+	s.mux.RLock()
+	removeTime, removed := s.revocationRemovals[notice.NodeUUID]
+	s.mux.RUnlock()
+	if removed && notice.IssueTime <= removeTime {
+		return errors.New("revocation issued before it was removed")
+	}
+
+	var publicKey []byte
+	if notice.IssuerUUID == s.Options.DeviceUUID {
+		publicKey = s.PublicKey()
+	} else if s.getNodePermissions(notice.IssuerUUID).Has(PermissionRevoke) && len(s.getNodePublicKey(notice.IssuerUUID)) > 0 {
+		publicKey = s.getNodePublicKey(notice.IssuerUUID)
+	} else {
+		err := s.verifyEndorsement(notice.IssuerUUID, notice.IssuerKey, notice.Endorsement)
+		if err != nil {
+			return err
+		}
+		publicKey = notice.IssuerKey
+	}
+	return verifySignature(publicKey, notice.signedMessage(), notice.Signature)
+}
+
+/*
+	applyRevocation
+
+	Remove the revoked node from the node map and TOTP map and add the notice
+	to the revocation list, to be forwarded to every node except the one it
+	is received from and the issuing router. Return false if the node is
+	already revoked
+*/
+func (s *ServiceRouter) applyRevocation(notice RevocationNotice, receivedFrom string) bool {
+	s.mux.Lock()
+	if s.revocationExists(notice.NodeUUID) >= 0 {
+		s.mux.Unlock()
+		return false
+	}
+
+	newNodeMap := []*Node{}
+	newTotpMap := []*TOTPRecord{}
+	pending := []string{}
+	for _, thisNode := range s.NodeMap {
+		if thisNode.UUID == notice.NodeUUID {
+			continue
+		}
+		newNodeMap = append(newNodeMap, thisNode)
+		if thisNode.UUID != receivedFrom && thisNode.UUID != notice.IssuerUUID {
+			pending = append(pending, thisNode.UUID)
+		}
+	}
+	for _, thisRecord := range s.TOTPMap {
+		if thisRecord.RemoteUUID != notice.NodeUUID {
+			newTotpMap = append(newTotpMap, thisRecord)
+		}
+	}
+
+	s.NodeMap = newNodeMap
+	s.TOTPMap = newTotpMap
+	s.revocations = append(s.revocations, &Revocation{
+		RevocationNotice: notice,
+		ReceivedFrom:     receivedFrom,
+		Pending:          pending,
+	})
+	s.mux.Unlock()
+
+	s.removeReplayCache(notice.NodeUUID)
+	s.metrics.removeNode(notice.NodeUUID)
+	return true
+}
+
+/*
+	RevokeNode
+
+	Revoke the node with given UUID on the whole cluster. The node is removed
+	from this router, its handshakes are refused, and the signed notice is sent
+	to the connected nodes right away. Nodes that cannot be reached are tried
+	again on every heartbeat cycle. Other routers only accept the notice if
+	this router has PermissionRevoke on them or is endorsed by an administrator
+*/
+func (s *ServiceRouter) RevokeNode(nodeUUID string, reason string) error {
+	if strings.TrimSpace(nodeUUID) == "" {
+		return errors.New("node UUID is empty")
+	}
+	if nodeUUID == s.Options.DeviceUUID {
+		return errors.New("node UUID is the same as this router")
+	}
+
+	notice := RevocationNotice{
+		NodeUUID:    nodeUUID,
+		IssuerUUID:  s.Options.DeviceUUID,
+		Reason:      reason,
+		IssueTime:   s.now().Unix(),
+		IssuerKey:   s.PublicKey(),
+		Endorsement: s.Options.Revocation.Endorsement,
+	}
+	if len(notice.Endorsement) > 0 && len(s.Options.Revocation.AdminKeys) > 0 {
+		if err := s.verifyEndorsement(notice.IssuerUUID, notice.IssuerKey, notice.Endorsement); err != nil {
+			return errors.New("endorsement of this router is invalid")
+		}
+	}
+	notice.Signature = s.sign(notice.signedMessage())
+	if !s.applyRevocation(notice, "") {
+		return errors.New("node already revoked")
+	}
+
+	s.logger().Warn("node revoked", logKeyOperation, "revoke", "node", nodeUUID, "reason", reason)
+	s.metrics.inc(metricRevocations, "source", "local", "result", "accepted")
+	s.emitEvent(Event{Type: EventNodeRevoked, NodeUUID: nodeUUID})
+	s.scheduleSave()
+
+	s.deliverRevocations()
+	return nil
+}
+
+/*
+	RemoveRevocation
+
+	Remove the node with given UUID from the revocation list of this router,
+	so it can join this router again. The other routers are not notified and
+	keep refusing the node until it is removed from their list as well.
+	The notices of the node issued before are refused from now on
+*/
+func (s *ServiceRouter) RemoveRevocation(nodeUUID string) error {
+	s.mux.Lock()
+	position := s.revocationExists(nodeUUID)
+	if position < 0 {
+		s.mux.Unlock()
+		return errors.New("node is not revoked")
+	}
+	s.revocations = append(s.revocations[:position], s.revocations[position+1:]...)
+
+	//Removals older than the maximum notice age are not needed, as the notices issued before are expired
+	now := s.now().Unix()
+	if s.revocationRemovals == nil {
+		s.revocationRemovals = map[string]int64{}
+	}
+	for removedUUID, removeTime := range s.revocationRemovals {
+		if removeTime < now-s.getMaxNoticeAge() {
+			delete(s.revocationRemovals, removedUUID)
+		}
+	}
+	s.revocationRemovals[nodeUUID] = now
+	s.mux.Unlock()
+
+	s.logger().Info("revocation removed", logKeyOperation, "revoke", "node", nodeUUID)
+	s.scheduleSave()
+	return nil
+}
+
+//IsNodeRevoked check if the node with given UUID is revoked on this router
+func (s *ServiceRouter) IsNodeRevoked(nodeUUID string) bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.revocationExists(nodeUUID) >= 0
+}
+
+//GetRevocations return the notices of the nodes revoked on this router
+func (s *ServiceRouter) GetRevocations() []RevocationNotice {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	notices := []RevocationNotice{}
+	for _, revocation := range s.revocations {
+		notices = append(notices, revocation.RevocationNotice)
+	}
+	return notices
+}
+
+//revocationExists return the position of the revocation of the node in the revocation list, -1 if not revoked. The caller must hold the router lock
+func (s *ServiceRouter) revocationExists(nodeUUID string) int {
+	for i, revocation := range s.revocations {
+		if revocation.NodeUUID == nodeUUID {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+	deliverRevocations
+
+	Forward the revocation notices to the nodes that have not received them.
+	A node is dropped from the pending list once it accepts or refuses the
+	notice, is removed from this router, or runs an older version without
+	revocation
+*/
+func (s *ServiceRouter) deliverRevocations() {
+	s.mux.RLock()
+	deliveries := []Revocation{}
+	for _, revocation := range s.revocations {
+		if len(revocation.Pending) > 0 {
+			deliveries = append(deliveries, Revocation{
+				RevocationNotice: revocation.RevocationNotice,
+				Pending:          append([]string{}, revocation.Pending...),
+			})
+		}
+	}
+	s.mux.RUnlock()
+
+	changed := false
+	for _, delivery := range deliveries {
+		for _, nodeUUID := range delivery.Pending {
+			node := s.getNodeByUUID(nodeUUID)
+			if node != nil {
+				err := node.sendRevocation(&delivery.RevocationNotice)
+				if err == errRevocationUnsupported || errors.Is(err, errRevocationRefused) {
+					s.metrics.inc(metricRevocationDeliveries, "result", "refused")
+					s.logger().Warn("revocation not accepted by node", logKeyRemote, nodeUUID, logKeyOperation, "revoke", "node", delivery.NodeUUID, logKeyError, err)
+				} else if err != nil {
+					//Tried again on the next heartbeat cycle
+					s.metrics.inc(metricRevocationDeliveries, "result", "failure")
+					s.logger().Debug("revocation delivery failed", logKeyRemote, nodeUUID, logKeyOperation, "revoke", "node", delivery.NodeUUID, logKeyError, err)
+					continue
+				} else {
+					s.metrics.inc(metricRevocationDeliveries, "result", "success")
+					s.logger().Info("revocation delivered", logKeyRemote, nodeUUID, logKeyOperation, "revoke", "node", delivery.NodeUUID)
+				}
+			}
+			if s.removePendingRevocation(delivery.NodeUUID, nodeUUID) {
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		s.scheduleSave()
+	}
+}
+
+//removePendingRevocation drop the node from the pending list of the revocation, return true if it was pending
+func (s *ServiceRouter) removePendingRevocation(revokedUUID string, nodeUUID string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	position := s.revocationExists(revokedUUID)
+	if position < 0 {
+		return false
+	}
+	revocation := s.revocations[position]
+	for i, pendingUUID := range revocation.Pending {
+		if pendingUUID == nodeUUID {
+			revocation.Pending = append(revocation.Pending[:i:i], revocation.Pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//sendRevocation forward the revocation notice to this node (opr=v)
+func (n *Node) sendRevocation(notice *RevocationNotice) error {
+	s := n.parent
+	if _, ok := s.getTransport().(OperationTransport); !ok {
+		return errRevocationUnsupported
+	}
+
+	n.mux.RLock()
+	nodeIpAddr := n.IpAddr
+	sendTotpSecret := n.SendTotpSecret
+	totpParameters := n.totpParameters
+	n.mux.RUnlock()
+	if sendTotpSecret == "" {
+		return errors.New("node is not connected")
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return err
+	}
+	packet := RevocationRequest{
+		NodeUUID:  s.Options.DeviceUUID,
+		TOTP:      s.generateTOTP(sendTotpSecret, totpParameters),
+		Nonce:     nonce,
+		Timestamp: s.now().Unix(),
+		Notice:    *notice,
+	}
+	packet.MAC = packetMAC(sendTotpSecret, packet.signedMessage(n.UUID))
+	packet.Signature = s.sign(packet.signedMessage(n.UUID))
+	postBody, _ := json.Marshal(packet)
+
+	resp, err := s.sendOperation(n.getEndpoint(nodeIpAddr.String()), "v", postBody)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusBadRequest && string(resp.Body) == "400 - Bad Request" {
+		//Remote node does not know opr=v
+		return errRevocationUnsupported
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %s", errRevocationRefused, strings.TrimSpace(string(resp.Body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(string(resp.Body))
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package godddns_test
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+/*
+	newRevocationNetwork
+
+	Create the router r trusting the administrator key, with the nodes revoker
+	(PermissionRevoke on r), endorsed (endorsed by the administrator) and plain
+	(neither) joined to it
+*/
+func newRevocationNetwork(t *testing.T) *simulator.Network {
+	t.Helper()
+	adminPublicKey, adminKey, _ := ed25519.GenerateKey(nil)
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0)})
+	_, err := network.AddNodeWithOptions("r", "203.0.113.1", func(options *godddns.RouterOptions) {
+		options.Logger = &warnLogger{}
+		options.Revocation.AdminKeys = [][]byte{adminPublicKey}
+		options.Authenticator = godddns.AuthenticatorFunc(func(request *godddns.AuthRequest) (*godddns.AuthResult, error) {
+			if request.Credential.NodeUUID == "revoker" {
+				return &godddns.AuthResult{Permissions: godddns.PermissionAll | godddns.PermissionRevoke}, nil
+			}
+			return &godddns.AuthResult{Permissions: godddns.PermissionAll}, nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, uuid := range []string{"revoker", "endorsed", "plain"} {
+		node, err := network.AddNodeWithOptions(uuid, "203.0.113."+string(rune('2'+i)), func(options *godddns.RouterOptions) {
+			options.Logger = &warnLogger{}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uuid == "endorsed" {
+			node.Router.Options.Revocation.Endorsement = godddns.EndorseRevocationIssuer(adminKey, uuid, node.Router.PublicKey())
+		}
+		if err := network.Connect(uuid, "r"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return network
+}
+
+//issueNotice revoke the node on the issuing router and return the signed notice
+func issueNotice(t *testing.T, network *simulator.Network, issuerUUID string, nodeUUID string) godddns.RevocationNotice {
+	t.Helper()
+	issuer, _ := network.GetNode(issuerUUID)
+	if err := issuer.Router.RevokeNode(nodeUUID, "host compromised"); err != nil {
+		t.Fatal(err)
+	}
+	for _, notice := range issuer.Router.GetRevocations() {
+		if notice.NodeUUID == nodeUUID {
+			return notice
+		}
+	}
+	t.Fatalf("notice of %s not issued", nodeUUID)
+	return godddns.RevocationNotice{}
+}
+
+func TestRevocationIssuers(t *testing.T) {
+	network := newRevocationNetwork(t)
+	router, _ := network.GetNode("r")
+
+	tests := []struct {
+		issuer   string
+		accepted bool
+	}{
+		{"r", true},        //Issued by the router itself
+		{"revoker", true},  //PermissionRevoke with the key of its handshake
+		{"endorsed", true}, //Endorsed by an administrator key
+		{"plain", false},   //Neither permitted nor endorsed
+		{"unknown", false}, //Not registered on the router
+	}
+	if _, err := network.AddNode("unknown", "203.0.113.9"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		notice := issueNotice(t, network, test.issuer, "victim-of-"+test.issuer)
+		err := router.Router.VerifyRevocationNotice(notice, "plain")
+		if test.accepted && err != nil {
+			t.Errorf("notice issued by %s refused: %v", test.issuer, err)
+		} else if !test.accepted && err == nil {
+			t.Errorf("notice issued by %s accepted", test.issuer)
+		}
+	}
+
+	//The signature covers the issuer, a notice cannot be passed off as issued by a trusted router
+	for _, issuer := range []string{"r", "revoker", "endorsed"} {
+		notice := issueNotice(t, network, "plain", "forged-by-"+issuer)
+		notice.IssuerUUID = issuer
+		if err := router.Router.VerifyRevocationNotice(notice, "plain"); err == nil {
+			t.Errorf("notice of plain accepted as issued by %s", issuer)
+		}
+	}
+
+	//The endorsement is bound to the key of the endorsed router
+	notice := issueNotice(t, network, "endorsed", "victim-of-stolen-endorsement")
+	plain, _ := network.GetNode("plain")
+	notice.IssuerKey = plain.Router.PublicKey()
+	if err := router.Router.VerifyRevocationNotice(notice, "plain"); err == nil {
+		t.Error("endorsement accepted for another key")
+	}
+}
+
+func TestRevocationReplayedAfterRemoval(t *testing.T) {
+	network := newRevocationNetwork(t)
+	router, _ := network.GetNode("r")
+	revoker, _ := network.GetNode("revoker")
+
+	notice := issueNotice(t, network, "revoker", "victim")
+	if !router.Router.IsNodeRevoked("victim") {
+		t.Fatal("notice not delivered to the router")
+	}
+	if err := router.Router.RemoveRevocation("victim"); err != nil {
+		t.Fatal(err)
+	}
+
+	//The notice is still signed by a trusted issuer, but issued before the removal
+	if err := router.Router.VerifyRevocationNotice(notice, "revoker"); err == nil || !strings.Contains(err.Error(), "removed") {
+		t.Errorf("notice replayed after the removal returned %v", err)
+	}
+
+	//A revocation issued after the removal is accepted again
+	network.Clock.Advance(time.Second)
+	if err := revoker.Router.RemoveRevocation("victim"); err != nil {
+		t.Fatal(err)
+	}
+	issueNotice(t, network, "revoker", "victim")
+	if !router.Router.IsNodeRevoked("victim") {
+		t.Error("revocation issued after the removal refused")
+	}
+
+	//The removal is kept with the router state
+	js, err := router.Router.ExportRouterToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := godddns.NewRouterFromJSON(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Options.Clock = network.Clock
+	if err := restored.VerifyRevocationNotice(notice, "revoker"); err == nil || !strings.Contains(err.Error(), "removed") {
+		t.Errorf("notice replayed on the restored router returned %v", err)
+	}
+}
+
+func TestRevocationNoticeAge(t *testing.T) {
+	network := newRevocationNetwork(t)
+	router, _ := network.GetNode("r")
+	router.Router.Options.Revocation.MaxNoticeAge = 3600
+
+	notice := issueNotice(t, network, "endorsed", "victim")
+	if err := router.Router.VerifyRevocationNotice(notice, "plain"); err != nil {
+		t.Fatalf("fresh notice refused: %v", err)
+	}
+	network.Clock.Advance(3601 * time.Second)
+	if err := router.Router.VerifyRevocationNotice(notice, "plain"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("notice after the maximum notice age returned %v", err)
+	}
+
+	notice.IssueTime = network.Clock.Now().Add(time.Hour).Unix()
+	if err := router.Router.VerifyRevocationNotice(notice, "plain"); err == nil || !strings.Contains(err.Error(), "future") {
+		t.Errorf("notice issued in the future returned %v", err)
+	}
+}
@@ -0,0 +1,371 @@
+package godddns
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+/*
+	Rotation.go
+
+	This script rotate the TOTP secrets shared between connected nodes (opr=r).
+	The node holding a secret asks the node that issued it for a new one,
+	authenticated with the current secret like a heartbeat. The new secret is
+	encrypted with a key derived from the current secret and the request nonce.
+
+	The issuing node keeps accepting the previous secret until the overlap
+	window ends, so heartbeats sent before the reply arrived are not rejected.
+	If the reply is lost, the node asks again with the previous secret and the
+	issuing node replaces the new secret without extending the window
+*/
+
+var (
+	errRotationUnsupported  = errors.New("remote node does not support secret rotation") //The remote node runs an older version without secret rotation
+	errRotationNotPermitted = errors.New("secret rotation not permitted by remote node") //This router does not have PermissionRotate on the remote node
+)
+
+//Sent by the node holding the secret
+type RotationRequest struct {
+	NodeUUID  string
+	TOTP      string
+	Nonce     string //Random value the reply is bound to, each nonce is accepted once
+	Timestamp int64  //The time the packet is sent
+	MAC       []byte //Keyed with the TOTP secret of the sending node
+	Signature []byte `json:",omitempty"` //Signed with the identity key of the sending node
+}
+
+//Reply of the issuing node with the new secret
+type RotationResponse struct {
+	TOTPSecret string          //Encrypted with the key derived from the current secret
+	Parameters *TOTPParameters `json:",omitempty"` //The parameters of the TOTP, not set if they are the defaults
+	Signature  []byte          `json:",omitempty"` //Signed with the identity key of the issuing node
+}
+
+//signedMessage return the message signed in the rotation request sent to the router with given UUID
+func (p *RotationRequest) signedMessage(routerUUID string) []byte {
+	return signedMessage("rotate", p.NodeUUID, routerUUID, p.TOTP, p.Nonce, strconv.FormatInt(p.Timestamp, 10))
+}
+
+//signedMessage return the message signed in the reply of the router with given UUID to the rotation request
+func (r *RotationResponse) signedMessage(routerUUID string, packet *RotationRequest) []byte {
+	parameters := ""
+	if r.Parameters != nil {
+		parameters = r.Parameters.String()
+	}
+	return signedMessage("rotate-response", routerUUID, packet.NodeUUID, packet.Nonce, r.TOTPSecret, parameters)
+}
+
+//rotationAEAD return the cipher of the new secret, keyed with the secret used to authenticate the request
+func rotationAEAD(totpSecret string, nonce string) (cipher.AEAD, error) {
+	return newSecretAEAD(scramHMAC([]byte(totpSecret), "Rotation Key"+nonce))
+}
+
+//rotationSecretContext is the context authenticated with the encrypted TOTP secret
+func rotationSecretContext(nodeUUID string, nonce string, parameters *TOTPParameters) string {
+	context := "TOTPSecret/" + nodeUUID + "/" + nonce
+	if parameters != nil {
+		context += "/" + parameters.String()
+	}
+	return context
+}
+
+//handleRotationRequest issue a new TOTP secret to the node that holds the current one
+func (s *ServiceRouter) handleRotationRequest(w http.ResponseWriter, r *http.Request) {
+	var payload RotationRequest
+
+	//Try to parse it into the required structure
+	err := json.NewDecoder(r.Body).Decode(&payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkNodeLockout(w, r, "rotate", payload.NodeUUID) {
+		return
+	}
+
+	//Validate the TOTP, the previous secret is accepted if the last reply was lost
+	matchedTotpSecret := s.verifyNodeTOTP(payload.NodeUUID, payload.TOTP)
+	if matchedTotpSecret == "" {
+		s.recordAuthFailure(r, "rotate", payload.NodeUUID)
+		s.metrics.inc(metricTOTPFailures, "operation", "rotate")
+		s.metrics.inc(metricSecretRotations, "direction", "incoming", "result", "failure")
+		http.Error(w, "invalid TOTP", http.StatusUnauthorized)
+		s.logger().Warn("rotation request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "rotate", logKeyEndpoint, r.RemoteAddr, logKeyError, "invalid TOTP")
+		return
+	}
+
+	//Check the signature if the node has sent its public key
+	err = s.verifyNodeSignature(payload.NodeUUID, payload.signedMessage(s.Options.DeviceUUID), payload.Signature)
+	if err != nil {
+		s.recordNodeFailure(r, "rotate", payload.NodeUUID)
+		s.metrics.inc(metricSignatureFailures, "operation", "rotate")
+		s.metrics.inc(metricSecretRotations, "direction", "incoming", "result", "failure")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		s.logger().Warn("rotation request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "rotate", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	//Make sure the packet is recent and not seen before. Nonce is required as the new secret is bound to it
+	if payload.Nonce == "" {
+		err = errors.New("packet has no nonce")
+	}
+	status := http.StatusBadRequest
+	if err == nil {
+		status, err = s.checkPacketFreshness(payload.NodeUUID, matchedTotpSecret, payload.signedMessage(s.Options.DeviceUUID), payload.Nonce, payload.Timestamp, payload.MAC, payload.TOTP, r.RemoteAddr)
+	}
+	if err != nil {
+		s.metrics.inc(metricReplayedPackets, "operation", "rotate")
+		s.metrics.inc(metricSecretRotations, "direction", "incoming", "result", "failure")
+		http.Error(w, err.Error(), status)
+		s.logger().Warn("rotation request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "rotate", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	s.recordAuthSuccess(r, payload.NodeUUID)
+
+	//Check if the node is allowed to replace its secret
+	if !s.getNodePermissions(payload.NodeUUID).Has(PermissionRotate) {
+		s.metrics.inc(metricSecretRotations, "direction", "incoming", "result", "failure")
+		http.Error(w, "rotation not permitted", http.StatusForbidden)
+		s.logger().Warn("rotation request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "rotate", logKeyEndpoint, r.RemoteAddr, logKeyError, "rotation not permitted")
+		return
+	}
+
+	totpSecret, parameters, err := s.rotateTOTPSecret(payload.NodeUUID, matchedTotpSecret)
+	if err != nil {
+		s.metrics.inc(metricSecretRotations, "direction", "incoming", "result", "failure")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		s.logger().Error("unable to rotate secret", logKeyRemote, payload.NodeUUID, logKeyOperation, "rotate", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	//Encrypt the new secret with the key derived from the secret the node holds
+	aead, err := rotationAEAD(matchedTotpSecret, payload.Nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := RotationResponse{
+		Parameters: parameters.wireParameters(),
+	}
+	response.TOTPSecret, err = encryptSecret(aead, totpSecret, rotationSecretContext(payload.NodeUUID, payload.Nonce, response.Parameters))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Signature = s.sign(response.signedMessage(s.Options.DeviceUUID, &payload))
+	result, _ := json.Marshal(response)
+
+	s.logger().Info("secret rotated", logKeyRemote, payload.NodeUUID, logKeyOperation, "rotate", logKeyEndpoint, r.RemoteAddr)
+	s.metrics.inc(metricSecretRotations, "direction", "incoming", "result", "success")
+	w.Write(result)
+	s.emitEvent(Event{Type: EventSecretRotated, NodeUUID: payload.NodeUUID, RemoteAddr: r.RemoteAddr})
+	s.scheduleSave()
+}
+
+/*
+	rotateTOTPSecret
+
+	Replace the secret in the TOTP record of the node. The current secret is
+	kept as the previous one until the overlap window ends, unless the request
+	was authenticated with the previous secret, i.e. the last reply was lost
+*/
+func (s *ServiceRouter) rotateTOTPSecret(nodeUUID string, matchedTotpSecret string) (string, TOTPParameters, error) {
+	totpSecret, err := s.newTOTPSecret()
+	if err != nil {
+		return "", TOTPParameters{}, err
+	}
+	parameters := s.getTOTPOptions().parameters()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	position := s.totpMapExists(nodeUUID)
+	if position < 0 {
+		return "", TOTPParameters{}, errors.New("node TOTP not registered")
+	}
+	record := s.TOTPMap[position]
+	if record.RecvTOTPSecret == matchedTotpSecret {
+		record.PreviousTOTPSecret = record.RecvTOTPSecret
+		record.PreviousParameters = record.Parameters
+		record.PreviousSecretExpire = s.now().Unix() + s.getRotationOverlap()
+	}
+	record.RecvTOTPSecret = totpSecret
+	record.Parameters = parameters
+	return totpSecret, parameters, nil
+}
+
+/*
+	RotateSecret
+
+	Ask this node for a new TOTP secret to replace the one received when
+	joining it. The node keeps accepting the current secret for a while, so
+	heartbeats that are on the way are not rejected
+*/
+func (n *Node) RotateSecret() error {
+	s := n.parent
+	if _, ok := s.getTransport().(OperationTransport); !ok {
+		return errRotationUnsupported
+	}
+
+	n.mux.RLock()
+	nodeIpAddr := n.IpAddr
+	sendTotpSecret := n.SendTotpSecret
+	totpParameters := n.totpParameters
+	n.mux.RUnlock()
+	if sendTotpSecret == "" {
+		return errors.New("node is not connected")
+	}
+
+	endpoint := n.getEndpoint(nodeIpAddr.String())
+	totpSecret, parameters, err := n.requestRotation(endpoint, sendTotpSecret, totpParameters)
+	if err == errRotationUnsupported {
+		return err
+	}
+	if err != nil {
+		s.metrics.inc(metricSecretRotations, "direction", "outgoing", "result", "failure")
+		s.logger().Warn("secret rotation failed", logKeyRemote, n.UUID, logKeyOperation, "rotate", logKeyEndpoint, endpoint.URL("r"), logKeyError, err)
+		return err
+	}
+
+	n.mux.Lock()
+	if n.SendTotpSecret != sendTotpSecret {
+		//Replaced by a handshake in the meantime, which is newer than this secret
+		n.mux.Unlock()
+		return errors.New("secret changed during rotation")
+	}
+	n.SendTotpSecret = totpSecret
+	n.totpParameters = parameters
+	n.secretIssueTime = s.now().Unix()
+	n.mux.Unlock()
+
+	s.logger().Info("secret rotated", logKeyRemote, n.UUID, logKeyOperation, "rotate", logKeyEndpoint, endpoint.URL("r"))
+	s.metrics.inc(metricSecretRotations, "direction", "outgoing", "result", "success")
+	s.emitEvent(Event{Type: EventSecretRotated, NodeUUID: n.UUID})
+	s.scheduleSave()
+	return nil
+}
+
+//requestRotation send the rotation request (opr=r) and return the new secret and its parameters
+func (n *Node) requestRotation(endpoint *Endpoint, sendTotpSecret string, totpParameters TOTPParameters) (string, TOTPParameters, error) {
+	s := n.parent
+	nonce, err := newNonce()
+	if err != nil {
+		return "", TOTPParameters{}, err
+	}
+	packet := RotationRequest{
+		NodeUUID:  s.Options.DeviceUUID,
+		TOTP:      s.generateTOTP(sendTotpSecret, totpParameters),
+		Nonce:     nonce,
+		Timestamp: s.now().Unix(),
+	}
+	packet.MAC = packetMAC(sendTotpSecret, packet.signedMessage(n.UUID))
+	packet.Signature = s.sign(packet.signedMessage(n.UUID))
+	postBody, _ := json.Marshal(packet)
+
+	resp, err := s.sendOperation(endpoint, "r", postBody)
+	if err != nil {
+		return "", TOTPParameters{}, err
+	}
+	if resp.StatusCode == http.StatusBadRequest && string(resp.Body) == "400 - Bad Request" {
+		//Remote node does not know opr=r
+		return "", TOTPParameters{}, errRotationUnsupported
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return "", TOTPParameters{}, errRotationNotPermitted
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", TOTPParameters{}, errors.New(string(resp.Body))
+	}
+
+	response := RotationResponse{}
+	err = json.Unmarshal(resp.Body, &response)
+	if err != nil {
+		return "", TOTPParameters{}, errors.New("invalid rotation response")
+	}
+	if publicKey := n.GetPublicKey(); len(publicKey) > 0 {
+		err = verifySignature(publicKey, response.signedMessage(n.UUID, &packet), response.Signature)
+		if err != nil {
+			s.metrics.inc(metricSignatureFailures, "operation", "rotate_response")
+			return "", TOTPParameters{}, err
+		}
+	}
+
+	//The secret cannot be decrypted or altered without the current secret
+	aead, err := rotationAEAD(sendTotpSecret, nonce)
+	if err != nil {
+		return "", TOTPParameters{}, err
+	}
+	if !isEncryptedSecret(response.TOTPSecret) {
+		return "", TOTPParameters{}, errors.New("TOTP secret is not encrypted")
+	}
+	totpSecret, err := decryptSecret(aead, response.TOTPSecret, rotationSecretContext(s.Options.DeviceUUID, nonce, response.Parameters))
+	if err != nil {
+		return "", TOTPParameters{}, err
+	}
+
+	parameters := TOTPParameters{}
+	if response.Parameters != nil {
+		parameters = *response.Parameters
+	}
+	if !isValidTOTPSecret(totpSecret) {
+		return "", TOTPParameters{}, errors.New("invalid TOTP secret")
+	}
+	if err = parameters.validate(); err != nil {
+		return "", TOTPParameters{}, errors.New("unsupported TOTP parameters: " + err.Error())
+	}
+	return totpSecret, parameters.normalize(), nil
+}
+
+/*
+	RotateSecrets
+
+	Ask every connected node for a new TOTP secret. All nodes are tried, the
+	error of the first node that failed is returned
+*/
+func (s *ServiceRouter) RotateSecrets() error {
+	var firstErr error
+	for _, node := range s.getNodes() {
+		node.mux.RLock()
+		connected := node.SendTotpSecret != ""
+		node.mux.RUnlock()
+		if !connected {
+			continue
+		}
+		err := node.RotateSecret()
+		if err != nil && firstErr == nil {
+			firstErr = errors.New("unable to rotate secret of node " + node.UUID + ": " + err.Error())
+		}
+	}
+	return firstErr
+}
+
+/*
+	rotateSecretIfDue
+
+	Rotate the secret of the node once it is older than the rotation interval.
+	Nodes running older versions or not permitting the rotation keep their
+	secret, and are asked again after another interval
+*/
+func (s *ServiceRouter) rotateSecretIfDue(node *Node) {
+	interval := s.getRotationInterval()
+	if interval == 0 {
+		return
+	}
+	node.mux.RLock()
+	secretIssueTime := node.secretIssueTime
+	node.mux.RUnlock()
+	if s.now().Unix()-secretIssueTime < interval {
+		return
+	}
+
+	err := node.RotateSecret()
+	if err == errRotationUnsupported || err == errRotationNotPermitted {
+		s.logger().Debug("secret rotation not available", logKeyRemote, node.UUID, logKeyOperation, "rotate", logKeyError, err)
+		node.mux.Lock()
+		node.secretIssueTime = s.now().Unix()
+		node.mux.Unlock()
+	}
+}
@@ -0,0 +1,115 @@
+package godddns_test
+
+import (
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+//newRotationNetwork connect the routers a and b to each other, as heartbeats are only accepted from registered nodes
+func newRotationNetwork(t *testing.T, configureA func(options *godddns.RouterOptions), configureB func(options *godddns.RouterOptions)) (*simulator.Network, *godddns.ServiceRouter, *godddns.ServiceRouter) {
+	t.Helper()
+	noConfig := func(options *godddns.RouterOptions) {}
+	if configureA == nil {
+		configureA = noConfig
+	}
+	if configureB == nil {
+		configureB = noConfig
+	}
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0)})
+	nodeA, err := network.AddNodeWithOptions("a", "203.0.113.1", configureA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeB, err := network.AddNodeWithOptions("b", "203.0.113.2", configureB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	return network, nodeA.Router, nodeB.Router
+}
+
+func TestRotateSecret(t *testing.T) {
+	network, routerA, routerB := newRotationNetwork(t, nil, func(options *godddns.RouterOptions) {
+		options.TOTP.RotationOverlap = 120
+	})
+	node, _ := routerA.GetNodeByUUID("b")
+	previousSecret := node.SendTotpSecret
+	previousToken := node.TokenOf(previousSecret)
+
+	if err := node.RotateSecret(); err != nil {
+		t.Fatal(err)
+	}
+	if node.SendTotpSecret == previousSecret {
+		t.Fatal("secret not replaced")
+	}
+	if routerB.NodeSecret("a") != node.SendTotpSecret {
+		t.Fatal("new secret not stored by the issuing router")
+	}
+	if err := routerA.HeartBeatToNode("b"); err != nil {
+		t.Errorf("heartbeat with the new secret refused: %v", err)
+	}
+
+	//Heartbeats sent before the reply arrived are accepted until the overlap ends
+	if !routerB.AcceptsToken("a", previousToken) {
+		t.Error("previous secret refused within the overlap window")
+	}
+	network.Clock.Advance(120 * time.Second)
+	if routerB.AcceptsToken("a", node.TokenOf(previousSecret)) {
+		t.Error("previous secret accepted after the overlap window")
+	}
+}
+
+func TestRotateSecretsOnSchedule(t *testing.T) {
+	network, routerA, _ := newRotationNetwork(t, func(options *godddns.RouterOptions) {
+		options.TOTP.RotationInterval = 3600
+	}, nil)
+	node, _ := routerA.GetNodeByUUID("b")
+	joinedSecret := node.SendTotpSecret
+
+	if err := routerA.HeartBeatToNode("b"); err != nil {
+		t.Fatal(err)
+	}
+	if node.SendTotpSecret != joinedSecret {
+		t.Fatal("secret rotated before the rotation interval")
+	}
+	network.Clock.Advance(3600 * time.Second)
+	if err := routerA.HeartBeatToNode("b"); err != nil {
+		t.Fatal(err)
+	}
+	if node.SendTotpSecret == joinedSecret {
+		t.Fatal("secret not rotated after the rotation interval")
+	}
+}
+
+func TestRotationNotPermitted(t *testing.T) {
+	network, routerA, routerB := newRotationNetwork(t, func(options *godddns.RouterOptions) {
+		options.TOTP.RotationInterval = 3600
+	}, func(options *godddns.RouterOptions) {
+		options.Authenticator = godddns.AuthenticatorFunc(func(request *godddns.AuthRequest) (*godddns.AuthResult, error) {
+			return &godddns.AuthResult{Permissions: godddns.PermissionHeartbeat}, nil
+		})
+	})
+	node, _ := routerA.GetNodeByUUID("b")
+	joinedSecret := node.SendTotpSecret
+
+	if err := node.RotateSecret(); err != godddns.ErrRotationNotPermitted {
+		t.Fatalf("rotation without PermissionRotate returned %v", err)
+	}
+	if node.SendTotpSecret != joinedSecret || routerB.NodeSecret("a") != joinedSecret {
+		t.Error("secret replaced without PermissionRotate")
+	}
+
+	//The node is asked again after another interval instead of on every heartbeat
+	network.Clock.Advance(3600 * time.Second)
+	if err := routerA.RotateSecretIfDue("b"); err != nil {
+		t.Fatal(err)
+	}
+	if issueTime := node.SecretIssueTime(); issueTime != network.Clock.Now().Unix() {
+		t.Errorf("rotation schedule not postponed, secret issued at %d", issueTime)
+	}
+}
@@ -0,0 +1,511 @@
+package godddns
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+	Scram.go
+
+	This script handle the challenge-response join (opr=cs and opr=cf). It
+	follows SCRAM-SHA-256 (RFC 5802 and RFC 7677): the router only keeps a salted
+	verifier of each account, and the joining node proves that it knows the
+	password without sending it. The router proves that it holds the verifier
+	in return, and the TOTP secret is encrypted with a key derived from the
+	exchange, so a passive observer can neither read the password nor the secret.
+
+	1. Joining node -> router (opr=cs): UUID, username, client nonce and public key
+	2. Router -> joining node: nonce, salt and iterations of the account and public key
+	3. Joining node -> router (opr=cf): nonce and client proof
+	4. Router -> joining node: server signature and the encrypted TOTP secret
+
+	Routers without ScramCredentialFunction reply 501. The joining node never
+	falls back to the password join (opr=c) by itself, as the reply can be
+	forged; the password is only sent over HTTPS to nodes with PasswordJoin set
+*/
+
+const (
+	scramDefaultIterations = 4096
+	scramMinIterations     = 4096    //The joining node reject weaker challenges
+	scramMaxIterations     = 1000000 //The joining node reject challenges that are too expensive to answer
+	scramSessionTimeout    = 30      //Seconds for the joining node to answer the challenge
+	scramMaxSessions       = 1024
+)
+
+//errChallengeJoinUnsupported is returned if the transport or the remote node does not support the challenge-response join
+var errChallengeJoinUnsupported = errors.New("challenge-response join is not supported")
+
+//ScramCredential is the salted verifier of an account. The password cannot be recovered from it
+type ScramCredential struct {
+	Salt       []byte //The salt of the password
+	Iterations int    //The PBKDF2 iterations of the password
+	StoredKey  []byte //H(HMAC(SaltedPassword, "Client Key")), verify the client proof
+	ServerKey  []byte //HMAC(SaltedPassword, "Server Key"), sign the reply of the router
+}
+
+//The handshake pending for the client proof
+type scramSession struct {
+	nodeUUID    string
+	username    string
+	clientNonce string
+	publicKey   []byte //The public key of the joining node
+	credential  *ScramCredential
+	expire      int64
+}
+
+//Sent by the joining node to start the challenge-response join
+type scramStartRequest struct {
+	NodeUUID    string
+	Username    string
+	ClientNonce string
+	PublicKey   []byte `json:",omitempty"`
+}
+
+//Reply of the router to the start request
+type scramChallenge struct {
+	Nonce      string //The client nonce followed by the router nonce
+	Salt       []byte
+	Iterations int
+	PublicKey  []byte `json:",omitempty"` //The public key of the router
+}
+
+//Sent by the joining node with the proof of the password
+type scramFinishRequest struct {
+	NodeUUID    string
+	Nonce       string
+	ClientProof []byte
+}
+
+//Reply of the router if the proof is correct
+type scramFinishResponse struct {
+	ServerSignature []byte //Prove that the router holds the verifier of the account
+	TOTPSecret      string //Encrypted with the session key
+	ReflectionIP    string
+	Parameters      *TOTPParameters `json:",omitempty"` //The parameters of the TOTP, not set if they are the defaults
+}
+
+/*
+	NewScramCredential
+
+	Create the verifier of a password with a random salt. Store the verifier
+	instead of the password and return it from ScramCredentialFunction
+*/
+func NewScramCredential(password string) (*ScramCredential, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	_, storedKey, serverKey := scramKeys(password, salt, scramDefaultIterations)
+	return &ScramCredential{
+		Salt:       salt,
+		Iterations: scramDefaultIterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	}, nil
+}
+
+//Verify check if the password matches this verifier
+func (c *ScramCredential) Verify(password string) bool {
+	if c.Iterations <= 0 {
+		return false
+	}
+	_, storedKey, _ := scramKeys(password, c.Salt, c.Iterations)
+	return hmac.Equal(storedKey, c.StoredKey)
+}
+
+//scramKeys derive the client key, stored key and server key from the password
+func scramKeys(password string, salt []byte, iterations int) ([]byte, []byte, []byte) {
+	saltedPassword := pbkdf2SHA256([]byte(password), salt, iterations, sha256.Size)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(saltedPassword, "Server Key")
+	return clientKey, storedKey[:], serverKey
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func scramXOR(a []byte, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+	return result
+}
+
+/*
+	scramAuthMessage
+
+	The message signed by both sides. It binds the proof to the account, the
+	joining node, the router being joined, the public keys of both sides and
+	the nonces of this handshake. Fields are JSON encoded so usernames
+	containing separators are not ambiguous
+*/
+func scramAuthMessage(username string, nodeUUID string, routerUUID string, clientNonce string, nodePublicKey []byte, challenge *scramChallenge) string {
+	message, _ := json.Marshal([]interface{}{
+		"go-DDDNS-SCRAM-SHA-256",
+		username,
+		nodeUUID,
+		routerUUID,
+		clientNonce,
+		challenge.Nonce,
+		base64.StdEncoding.EncodeToString(challenge.Salt),
+		challenge.Iterations,
+		base64.StdEncoding.EncodeToString(nodePublicKey),
+		base64.StdEncoding.EncodeToString(challenge.PublicKey),
+	})
+	return string(message)
+}
+
+//scramSecretContext is the context authenticated with the encrypted TOTP secret, the parameters are included if they are not the defaults
+func scramSecretContext(nodeUUID string, reflectionIP string, parameters *TOTPParameters) string {
+	context := "TOTPSecret/" + nodeUUID + "/" + reflectionIP
+	if parameters != nil {
+		context += "/" + parameters.String()
+	}
+	return context
+}
+
+/*
+	handleChallengeStart
+
+	Reply the salt and iterations of the account with a new nonce (opr=cs).
+	Unknown accounts get a fake but stable challenge, so the reply does not
+	tell if the username exists
+*/
+func (s *ServiceRouter) handleChallengeStart(w http.ResponseWriter, r *http.Request) {
+	if s.Options.ScramCredentialFunction == nil {
+		http.Error(w, errChallengeJoinUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	var request scramStartRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || strings.TrimSpace(request.NodeUUID) == "" || request.ClientNonce == "" || !isValidPublicKey(request.PublicKey) {
+		http.Error(w, "invalid challenge request", http.StatusBadRequest)
+		return
+	}
+	if !s.checkNodeLockout(w, r, "connect", request.NodeUUID) {
+		return
+	}
+
+	credential := s.Options.ScramCredentialFunction(request.Username)
+	if credential == nil || credential.Iterations <= 0 {
+		credential, err = s.mockScramCredential(request.Username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	routerNonce, err := newNonce()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	challenge := scramChallenge{
+		Nonce:      request.ClientNonce + routerNonce,
+		Salt:       credential.Salt,
+		Iterations: credential.Iterations,
+		PublicKey:  s.PublicKey(),
+	}
+
+	err = s.addScramSession(challenge.Nonce, &scramSession{
+		nodeUUID:    request.NodeUUID,
+		username:    request.Username,
+		clientNonce: request.ClientNonce,
+		publicKey:   request.PublicKey,
+		credential:  credential,
+		expire:      s.now().Unix() + scramSessionTimeout,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	s.logger().Debug("challenge issued", logKeyRemote, request.NodeUUID, logKeyOperation, "connect", logKeyEndpoint, r.RemoteAddr)
+	result, _ := json.Marshal(challenge)
+	w.Write(result)
+}
+
+/*
+	handleChallengeFinish
+
+	Verify the client proof (opr=cf). If the proof is correct, the handshake
+	is passed to the authenticator with PasswordVerified set, and the TOTP
+	secret is returned encrypted with the session key
+*/
+func (s *ServiceRouter) handleChallengeFinish(w http.ResponseWriter, r *http.Request) {
+	var request scramFinishRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, RemoteAddr: r.RemoteAddr, Err: err})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.checkNodeLockout(w, r, "connect", request.NodeUUID) {
+		return
+	}
+
+	//Each challenge can only be answered once
+	session := s.takeScramSession(request.Nonce)
+	if session == nil || session.nodeUUID != request.NodeUUID {
+		err = errors.New("challenge expired or not found")
+		s.recordAuthFailure(r, "connect", request.NodeUUID)
+		s.logger().Warn("handshake rejected", logKeyRemote, request.NodeUUID, logKeyOperation, "connect", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, NodeUUID: request.NodeUUID, RemoteAddr: r.RemoteAddr, Err: err})
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	challenge := &scramChallenge{
+		Nonce:      request.Nonce,
+		Salt:       session.credential.Salt,
+		Iterations: session.credential.Iterations,
+		PublicKey:  s.PublicKey(),
+	}
+	authMessage := scramAuthMessage(session.username, session.nodeUUID, s.Options.DeviceUUID, session.clientNonce, session.publicKey, challenge)
+
+	//Recover the client key from the proof and check it against the stored key
+	proofValid := false
+	if len(request.ClientProof) == sha256.Size {
+		clientSignature := scramHMAC(session.credential.StoredKey, authMessage)
+		clientKey := scramXOR(request.ClientProof, clientSignature)
+		storedKey := sha256.Sum256(clientKey)
+		proofValid = hmac.Equal(storedKey[:], session.credential.StoredKey)
+	}
+
+	authResult := &AuthResult{}
+	if proofValid {
+		authResult, err = s.authenticate(&AuthRequest{
+			Credential: Credential{
+				NodeUUID:  session.nodeUUID,
+				Username:  session.username,
+				PublicKey: session.publicKey,
+			},
+			RemoteAddr:       r.RemoteAddr,
+			Request:          r,
+			PasswordVerified: true,
+		})
+	} else {
+		err = ErrInvalidCredential
+	}
+	if err != nil {
+		s.recordAuthFailure(r, "connect", session.nodeUUID)
+		s.logger().Warn("handshake rejected", logKeyRemote, session.nodeUUID, logKeyOperation, "connect", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, NodeUUID: session.nodeUUID, RemoteAddr: r.RemoteAddr, Err: err})
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	s.recordAuthSuccess(r, session.nodeUUID)
+
+	//Encrypt the TOTP secret with the session key
+	aead, err := newSecretAEAD(scramHMAC(session.credential.StoredKey, "Session Key"+authMessage))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	totpSecret, parameters, err := s.issueTOTPSecret(session.nodeUUID, authResult.Permissions, session.publicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wireParameters := parameters.wireParameters()
+	encryptedSecret, err := encryptSecret(aead, totpSecret, scramSecretContext(session.nodeUUID, r.RemoteAddr, wireParameters))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, _ := json.Marshal(scramFinishResponse{
+		ServerSignature: scramHMAC(session.credential.ServerKey, authMessage),
+		TOTPSecret:      encryptedSecret,
+		ReflectionIP:    r.RemoteAddr,
+		Parameters:      wireParameters,
+	})
+
+	s.logger().Info("handshake accepted", logKeyRemote, session.nodeUUID, logKeyOperation, "connect", "permissions", authResult.Permissions.String(), "method", "challenge")
+
+	s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "success")
+	w.Write(result)
+	s.emitEvent(Event{Type: EventHandshakeAccepted, NodeUUID: session.nodeUUID, RemoteAddr: r.RemoteAddr})
+	s.scheduleSave()
+}
+
+//addScramSession store the pending handshake, expired handshakes are removed first
+func (s *ServiceRouter) addScramSession(nonce string, session *scramSession) error {
+	s.scramMux.Lock()
+	defer s.scramMux.Unlock()
+	if s.scramSessions == nil {
+		s.scramSessions = map[string]*scramSession{}
+	}
+
+	now := s.now().Unix()
+	for key, thisSession := range s.scramSessions {
+		if thisSession.expire < now {
+			delete(s.scramSessions, key)
+		}
+	}
+	if len(s.scramSessions) >= scramMaxSessions {
+		return errors.New("too many pending handshakes")
+	}
+
+	s.scramSessions[nonce] = session
+	return nil
+}
+
+//takeScramSession remove and return the pending handshake, nil if not found or expired
+func (s *ServiceRouter) takeScramSession(nonce string) *scramSession {
+	s.scramMux.Lock()
+	defer s.scramMux.Unlock()
+	session, ok := s.scramSessions[nonce]
+	if !ok {
+		return nil
+	}
+	delete(s.scramSessions, nonce)
+	if session.expire < s.now().Unix() {
+		return nil
+	}
+	return session
+}
+
+//mockScramCredential create an unusable credential with a salt derived from the username
+func (s *ServiceRouter) mockScramCredential(username string) (*ScramCredential, error) {
+	s.scramMux.Lock()
+	if s.scramMockKey == nil {
+		s.scramMockKey = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, s.scramMockKey); err != nil {
+			s.scramMux.Unlock()
+			s.scramMockKey = nil
+			return nil, err
+		}
+	}
+	mockKey := s.scramMockKey
+	s.scramMux.Unlock()
+
+	//The stored key is random so no proof can match
+	storedKey := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rand.Reader, storedKey); err != nil {
+		return nil, err
+	}
+	return &ScramCredential{
+		Salt:       scramHMAC(mockKey, username)[:16],
+		Iterations: scramDefaultIterations,
+		StoredKey:  storedKey,
+		ServerKey:  storedKey,
+	}, nil
+}
+
+/*
+	challengeConnect
+
+	Join the remote node with the challenge-response handshake. Return
+	errChallengeJoinUnsupported if the transport or the remote node only
+	support the password join. The second return value is the rejection
+	reason of the remote node
+*/
+func (n *Node) challengeConnect(endpoint *Endpoint, username string, password string) (*TOTPPayload, string, error) {
+	if _, ok := n.parent.getTransport().(OperationTransport); !ok {
+		return nil, "", errChallengeJoinUnsupported
+	}
+
+	clientNonce, err := newNonce()
+	if err != nil {
+		return nil, "", err
+	}
+
+	nodePublicKey := n.parent.PublicKey()
+	startBody, _ := json.Marshal(scramStartRequest{
+		NodeUUID:    n.parent.Options.DeviceUUID,
+		Username:    username,
+		ClientNonce: clientNonce,
+		PublicKey:   nodePublicKey,
+	})
+	resp, err := n.parent.sendOperation(endpoint, "cs", startBody)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusNotImplemented {
+		//Remote node does not have a verifier
+		return nil, "", errChallengeJoinUnsupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, string(resp.Body), fmt.Errorf("challenge rejected with status %d: %s", resp.StatusCode, strings.TrimSpace(string(resp.Body)))
+	}
+
+	challenge := scramChallenge{}
+	err = json.Unmarshal(resp.Body, &challenge)
+	if err != nil {
+		return nil, string(resp.Body), err
+	}
+	if !strings.HasPrefix(challenge.Nonce, clientNonce) || len(challenge.Nonce) == len(clientNonce) {
+		return nil, "", errors.New("challenge nonce does not match")
+	}
+	if challenge.Iterations < scramMinIterations || challenge.Iterations > scramMaxIterations {
+		return nil, "", fmt.Errorf("challenge iterations %d out of range", challenge.Iterations)
+	}
+	if !isValidPublicKey(challenge.PublicKey) {
+		return nil, "", errors.New("invalid public key")
+	}
+
+	clientKey, storedKey, serverKey := scramKeys(password, challenge.Salt, challenge.Iterations)
+	authMessage := scramAuthMessage(username, n.parent.Options.DeviceUUID, n.UUID, clientNonce, nodePublicKey, &challenge)
+	finishBody, _ := json.Marshal(scramFinishRequest{
+		NodeUUID:    n.parent.Options.DeviceUUID,
+		Nonce:       challenge.Nonce,
+		ClientProof: scramXOR(clientKey, scramHMAC(storedKey, authMessage)),
+	})
+	resp, err = n.parent.sendOperation(endpoint, "cf", finishBody)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, string(resp.Body), fmt.Errorf("handshake rejected with status %d: %s", resp.StatusCode, strings.TrimSpace(string(resp.Body)))
+	}
+
+	finish := scramFinishResponse{}
+	err = json.Unmarshal(resp.Body, &finish)
+	if err != nil {
+		return nil, string(resp.Body), err
+	}
+
+	//Make sure the reply comes from a router that holds the verifier
+	if !hmac.Equal(finish.ServerSignature, scramHMAC(serverKey, authMessage)) {
+		return nil, "", errors.New("invalid server signature")
+	}
+
+	aead, err := newSecretAEAD(scramHMAC(storedKey, "Session Key"+authMessage))
+	if err != nil {
+		return nil, "", err
+	}
+	if !isEncryptedSecret(finish.TOTPSecret) {
+		return nil, "", errors.New("TOTP secret is not encrypted")
+	}
+	totpSecret, err := decryptSecret(aead, finish.TOTPSecret, scramSecretContext(n.parent.Options.DeviceUUID, finish.ReflectionIP, finish.Parameters))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &TOTPPayload{
+		TOTPSecret:   totpSecret,
+		ReflectionIP: finish.ReflectionIP,
+		PublicKey:    challenge.PublicKey,
+		Parameters:   finish.Parameters,
+	}, "", nil
+}
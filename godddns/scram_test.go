@@ -0,0 +1,211 @@
+package godddns_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+const (
+	testUsername = "user"
+	testPassword = "password"
+)
+
+//newJoinNetwork create a network with router a and router b, which count the password joins it receives
+func newJoinNetwork(t *testing.T, verifier bool, passwordJoins *int) (*simulator.Network, *simulator.SimNode, *simulator.SimNode) {
+	t.Helper()
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0), Username: testUsername, Password: testPassword})
+	routerA, err := network.AddNode("a", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerB, err := network.AddNodeWithOptions("b", "203.0.113.2", func(options *godddns.RouterOptions) {
+		if !verifier {
+			//Routers without verifiers only support the password join
+			options.ScramCredentialFunction = nil
+		}
+		options.AuthFunction = func(username string, password string) bool {
+			*passwordJoins++
+			return username == testUsername && password == testPassword
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network, routerA, routerB
+}
+
+//addJoinNode add router b to router a with the given join options
+func addJoinNode(t *testing.T, routerA *simulator.SimNode, routerB *simulator.SimNode, passwordJoin bool, requireHTTPS bool) *godddns.Node {
+	t.Helper()
+	node := routerA.Router.NewNode(godddns.NodeOptions{NodeID: "b", Port: routerB.Port, RESTInterface: "/godddns", PasswordJoin: passwordJoin, RequireHTTPS: requireHTTPS})
+	if err := routerA.Router.AddNode(node); err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestScramCredentialVerify(t *testing.T) {
+	credential, err := godddns.NewScramCredential(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !credential.Verify(testPassword) {
+		t.Error("correct password not verified")
+	}
+	if credential.Verify("wrong") {
+		t.Error("wrong password verified")
+	}
+
+	//The same password gives different verifiers, so they cannot be compared across routers
+	other, _ := godddns.NewScramCredential(testPassword)
+	if string(other.StoredKey) == string(credential.StoredKey) {
+		t.Error("verifiers of the same password are equal")
+	}
+}
+
+func TestChallengeJoin(t *testing.T) {
+	passwordJoins := 0
+	network, routerA, routerB := newJoinNetwork(t, true, &passwordJoins)
+	if err := network.Connect("b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.Connect("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	node, _ := routerA.Router.GetNodeByUUID("b")
+	if passwordJoins != 0 {
+		t.Error("password sent although the challenge-response join is supported")
+	}
+	if !node.ChallengeJoined() {
+		t.Error("challenge-response join not remembered for the node")
+	}
+	if permissions := routerB.Router.NodePermissions("a"); permissions != godddns.PermissionAll {
+		t.Errorf("joined node granted %s, expected %s", permissions, godddns.PermissionAll)
+	}
+	if !node.GetPublicKey().Equal(routerB.Router.PublicKey()) {
+		t.Error("public key of the joined router not received")
+	}
+
+	//The issued secret is usable right away, without registering again
+	events, cancel := routerA.Router.SubscribeChan(16)
+	defer cancel()
+	if err := routerA.Router.HeartBeatToNode("b"); err != nil {
+		t.Errorf("heartbeat after the challenge-response join failed: %v", err)
+	}
+	for len(events) > 0 {
+		if e := <-events; e.Type == godddns.EventReRegistration {
+			t.Error("heartbeat with the issued secret refused")
+		}
+	}
+	if reflectedIP, _ := node.GetReflectedIP(); reflectedIP != "203.0.113.1" {
+		t.Errorf("reflected address %s, expected 203.0.113.1", reflectedIP)
+	}
+}
+
+func TestChallengeJoinWrongPassword(t *testing.T) {
+	passwordJoins := 0
+	_, routerA, routerB := newJoinNetwork(t, true, &passwordJoins)
+	node := addJoinNode(t, routerA, routerB, false, false)
+	if _, err := node.StartConnection("203.0.113.2", testUsername, "wrong"); err == nil {
+		t.Fatal("join with wrong password accepted")
+	}
+	if _, err := node.StartConnection("203.0.113.2", "unknown", testPassword); err == nil {
+		t.Fatal("join with unknown username accepted")
+	}
+	if routerB.Router.NodePermissions("a") != godddns.PermissionNone {
+		t.Error("TOTP secret issued to a node with wrong credential")
+	}
+}
+
+func TestPasswordJoinNotByDefault(t *testing.T) {
+	//The reply of a router without verifier can also be forged by a man-in-the-middle
+	passwordJoins := 0
+	network, _, _ := newJoinNetwork(t, false, &passwordJoins)
+	err := network.Connect("a", "b")
+	if err == nil || !strings.Contains(err.Error(), "set PasswordJoin") {
+		t.Errorf("join without the challenge-response join returned %v", err)
+	}
+	if passwordJoins != 0 {
+		t.Error("password sent without PasswordJoin set on the node")
+	}
+}
+
+func TestPasswordJoin(t *testing.T) {
+	passwordJoins := 0
+	_, routerA, routerB := newJoinNetwork(t, false, &passwordJoins)
+
+	//The password is never sent in plain text
+	node := addJoinNode(t, routerA, routerB, true, false)
+	if _, err := node.StartConnection("203.0.113.2", testUsername, testPassword); err == nil || !strings.Contains(err.Error(), "requires HTTPS") {
+		t.Errorf("password join without HTTPS returned %v", err)
+	}
+	if passwordJoins != 0 {
+		t.Error("password sent without HTTPS")
+	}
+
+	node.RequireHTTPS = true
+	if _, err := node.StartConnection("203.0.113.2", testUsername, testPassword); err != nil {
+		t.Fatal(err)
+	}
+	if passwordJoins != 1 {
+		t.Errorf("%d password joins received, expected 1", passwordJoins)
+	}
+	if node.ChallengeJoined() {
+		t.Error("password join remembered as challenge-response join")
+	}
+	if routerB.Router.NodePermissions("a") == godddns.PermissionNone {
+		t.Error("node not registered by the password join")
+	}
+}
+
+func TestChallengeJoinNotDowngraded(t *testing.T) {
+	passwordJoins := 0
+	network, routerA, routerB := newJoinNetwork(t, true, &passwordJoins)
+	if err := network.Connect("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	//The password join is refused for nodes that supported the challenge-response join, even if set later
+	node, _ := routerA.Router.GetNodeByUUID("b")
+	node.PasswordJoin = true
+	node.RequireHTTPS = true
+	routerB.Router.Options.ScramCredentialFunction = nil
+	_, err := node.StartConnection("203.0.113.2", testUsername, testPassword)
+	if err == nil || !strings.Contains(err.Error(), "refusing to send the password") {
+		t.Errorf("join downgraded to the password join: %v", err)
+	}
+	if passwordJoins != 0 {
+		t.Error("password sent to a router that supported the challenge-response join before")
+	}
+}
+
+func TestRequireChallengeJoin(t *testing.T) {
+	passwordJoins := 0
+	network, routerA, routerB := newJoinNetwork(t, false, &passwordJoins)
+	routerA.Router.Options.RequireChallengeJoin = true
+	node := addJoinNode(t, routerA, routerB, true, true)
+	if _, err := node.StartConnection("203.0.113.2", testUsername, testPassword); err == nil {
+		t.Error("joined a router without the challenge-response join")
+	}
+	if passwordJoins != 0 {
+		t.Error("password sent although the challenge-response join is required")
+	}
+
+	//Password joins to a router requiring the challenge-response join are refused
+	routerC, err := network.AddNode("c", "203.0.113.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeA := routerC.Router.NewNode(godddns.NodeOptions{NodeID: "a", Port: routerA.Port, RESTInterface: "/godddns", PasswordJoin: true, RequireHTTPS: true})
+	routerC.Router.AddNode(nodeA)
+	if _, err := nodeA.StartConnection("203.0.113.1", testUsername, testPassword); err == nil {
+		t.Error("password join accepted by a router requiring the challenge-response join")
+	}
+	if routerA.Router.NodePermissions("c") != godddns.PermissionNone {
+		t.Error("node registered by a password join")
+	}
+}
@@ -0,0 +1,241 @@
+package godddns
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+)
+
+/*
+	Secrets.go
+
+	This script handle the secrets of the router (TOTP secrets and retry
+	credentials). Secrets are redacted before they are printed, and can be
+	encrypted with AES-GCM when the router is exported, so the config file
+	can be placed on a shared disk.
+
+	The key is either given directly or derived from a passphrase with
+	PBKDF2-HMAC-SHA256. Encrypted values are stored as enc:v1:<base64>
+*/
+
+const (
+	encryptedSecretPrefix      = "enc:v1:"
+	secretCipherAlgorithm      = "AES-256-GCM"
+	secretKDFNone              = "none"
+	secretKDFPBKDF2            = "PBKDF2-HMAC-SHA256"
+	secretKDFDefaultIterations = 600000
+	secretCipherCheckValue     = "go-DDDNS"
+	redactedSecret             = "[REDACTED]"
+)
+
+//SecretCipher encrypt the secrets of the router with a passphrase or a raw key
+type SecretCipher struct {
+	key        []byte //The raw key, nil if the key is derived from the passphrase
+	passphrase string //The passphrase to derive the key from
+}
+
+//The encryption parameters written into an exported config
+type secretEncryptionHeader struct {
+	Version    int
+	Cipher     string
+	KDF        string
+	Iterations int    `json:",omitempty"`
+	Salt       string `json:",omitempty"` //Base64 encoded salt of the key derivation
+	Check      string //An encrypted known value to detect a wrong passphrase or key
+}
+
+//NewPassphraseCipher create a cipher that derive its key from the given passphrase
+func NewPassphraseCipher(passphrase string) (*SecretCipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	return &SecretCipher{passphrase: passphrase}, nil
+}
+
+//NewKeyCipher create a cipher with a raw 32 bytes AES-256 key
+func NewKeyCipher(key []byte) (*SecretCipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes long")
+	}
+	keyCopy := make([]byte, len(key))
+	copy(keyCopy, key)
+	return &SecretCipher{key: keyCopy}, nil
+}
+
+/*
+	newSealer
+
+	Create a new header with random salt and return the AEAD to encrypt the
+	secrets of an export
+*/
+func (c *SecretCipher) newSealer() (*secretEncryptionHeader, cipher.AEAD, error) {
+	header := &secretEncryptionHeader{
+		Version: 1,
+		Cipher:  secretCipherAlgorithm,
+		KDF:     secretKDFNone,
+	}
+	key := c.key
+	if key == nil {
+		salt := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, nil, err
+		}
+		header.KDF = secretKDFPBKDF2
+		header.Iterations = secretKDFDefaultIterations
+		header.Salt = base64.StdEncoding.EncodeToString(salt)
+		key = pbkdf2SHA256([]byte(c.passphrase), salt, header.Iterations, 32)
+	}
+
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Check, err = encryptSecret(aead, secretCipherCheckValue, "check")
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, aead, nil
+}
+
+//newOpener return the AEAD to decrypt the secrets of an export with the given header
+func (c *SecretCipher) newOpener(header *secretEncryptionHeader) (cipher.AEAD, error) {
+	if header.Version != 1 || header.Cipher != secretCipherAlgorithm {
+		return nil, errors.New("unsupported secret encryption: " + header.Cipher)
+	}
+
+	key := c.key
+	switch header.KDF {
+	case secretKDFNone:
+		if key == nil {
+			return nil, errors.New("config is encrypted with a raw key but a passphrase is given")
+		}
+	case secretKDFPBKDF2:
+		if key == nil {
+			salt, err := base64.StdEncoding.DecodeString(header.Salt)
+			if err != nil {
+				return nil, errors.New("invalid key derivation salt")
+			}
+			if header.Iterations <= 0 {
+				return nil, errors.New("invalid key derivation iterations")
+			}
+			key = pbkdf2SHA256([]byte(c.passphrase), salt, header.Iterations, 32)
+		}
+	default:
+		return nil, errors.New("unsupported key derivation: " + header.KDF)
+	}
+
+	aead, err := newSecretAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	check, err := decryptSecret(aead, header.Check, "check")
+	if err != nil || check != secretCipherCheckValue {
+		return nil, errors.New("wrong passphrase or key")
+	}
+	return aead, nil
+}
+
+func newSecretAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/*
+	encryptSecret
+
+	Encrypt the secret and return it as enc:v1:<base64 of nonce and ciphertext>.
+	The context (e.g. the field name and node UUID) is authenticated so an
+	encrypted value cannot be moved to another field or node. Empty secrets are
+	kept empty
+*/
+func encryptSecret(aead cipher.AEAD, secret string, context string) (string, error) {
+	if secret == "" {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(context))
+	return encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+/*
+	decryptSecret
+
+	Decrypt the value created by encryptSecret. Plain values are only returned
+	as is if no AEAD is given, otherwise a plain value could replace an
+	encrypted one without being noticed
+*/
+func decryptSecret(aead cipher.AEAD, value string, context string) (string, error) {
+	if aead == nil {
+		if isEncryptedSecret(value) {
+			return "", errors.New("config contains encrypted secrets, a passphrase or key is required")
+		}
+		return value, nil
+	}
+	if value == "" {
+		return "", nil
+	}
+	if !isEncryptedSecret(value) {
+		return "", errors.New("secret of " + context + " is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedSecretPrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted secret")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", errors.New("unable to decrypt secret of " + context)
+	}
+	return string(plain), nil
+}
+
+func isEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+//redactSecret hide the secret for printing
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+//pbkdf2SHA256 derive a key from the password with PBKDF2 (RFC 8018) using HMAC-SHA256
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	derivedKey := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u = prf.Sum(u[:0])
+		t := make([]byte, hashLength)
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		derivedKey = append(derivedKey, t...)
+	}
+	return derivedKey[:keyLength]
+}
@@ -0,0 +1,147 @@
+package godddns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+//newSecretsRouter create a router with the secrets of two nodes
+func newSecretsRouter() *ServiceRouter {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "thisNode"})
+	for _, uuid := range []string{"node1", "node2"} {
+		node := router.NewNode(NodeOptions{NodeID: uuid, Port: 8080, RESTInterface: "/godddns"})
+		node.SendTotpSecret = "SEND" + strings.ToUpper(uuid) + "SECRET"
+		node.retryUsername = "user"
+		node.retryPassword = "password of " + uuid
+		router.AddNode(node)
+		router.TOTPMap = append(router.TOTPMap, &TOTPRecord{RemoteUUID: uuid, RecvTOTPSecret: "RECV" + strings.ToUpper(uuid) + "SECRET", Permissions: PermissionAll})
+	}
+	return router
+}
+
+//changeNodeSecret replace the send secret of the node at index in the exported JSON
+func changeNodeSecret(t *testing.T, js string, index int, change func(string) string) string {
+	t.Helper()
+	config := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(js), &config); err != nil {
+		t.Fatal(err)
+	}
+	node := config["NodeMap"].([]interface{})[index].(map[string]interface{})
+	node["SendTotpSecret"] = change(node["SendTotpSecret"].(string))
+	changed, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(changed)
+}
+
+func TestPBKDF2SHA256(t *testing.T) {
+	//Test vector of RFC 7914 section 11
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if key := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)); key != expected {
+		t.Errorf("derived key %s, expected %s", key, expected)
+	}
+}
+
+func TestPassphraseCipherRoundTrip(t *testing.T) {
+	secretCipher, err := NewPassphraseCipher("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := newSecretsRouter().ExportRouterToEncryptedJSON(secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"SENDNODE1SECRET", "RECVNODE2SECRET", "password of node1"} {
+		if strings.Contains(js, secret) {
+			t.Errorf("secret %s exported in plain text", secret)
+		}
+	}
+
+	router, err := NewRouterFromEncryptedJSON(js, secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := router.GetNodeByUUID("node2")
+	if node.SendTotpSecret != "SENDNODE2SECRET" || node.retryPassword != "password of node2" {
+		t.Errorf("node secrets restored as %s and %s", node.SendTotpSecret, node.retryPassword)
+	}
+	if router.getTotpSecret("node1") != "RECVNODE1SECRET" {
+		t.Errorf("TOTP record secret restored as %s", router.getTotpSecret("node1"))
+	}
+
+	wrongCipher, _ := NewPassphraseCipher("wrong passphrase")
+	if _, err := NewRouterFromEncryptedJSON(js, wrongCipher); err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("config decrypted with a wrong passphrase: %v", err)
+	}
+	if _, err := NewRouterFromJSON(js); err == nil {
+		t.Error("encrypted config loaded without passphrase")
+	}
+}
+
+func TestEncryptedConfigTampered(t *testing.T) {
+	secretCipher, _ := NewKeyCipher([]byte("0123456789abcdef0123456789abcdef"))
+	js, err := newSecretsRouter().ExportRouterToEncryptedJSON(secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedSecret := ""
+	changeNodeSecret(t, js, 1, func(secret string) string {
+		encryptedSecret = secret
+		return secret
+	})
+
+	tests := []struct {
+		name   string
+		change func(string) string
+	}{
+		{"tampered ciphertext", func(secret string) string {
+			middle := len(secret) / 2
+			replacement := "A"
+			if secret[middle] == 'A' {
+				replacement = "B"
+			}
+			return secret[:middle] + replacement + secret[middle+1:]
+		}},
+		{"truncated ciphertext", func(secret string) string { return encryptedSecretPrefix + "AAAA" }},
+		{"plain secret", func(secret string) string { return "KRSXG5CTMVRXEZLU" }},
+		{"secret of another node", func(secret string) string { return encryptedSecret }},
+	}
+	for _, test := range tests {
+		if _, err := NewRouterFromEncryptedJSON(changeNodeSecret(t, js, 0, test.change), secretCipher); err == nil {
+			t.Errorf("config with %s loaded", test.name)
+		}
+	}
+
+	//Secrets left empty stay empty
+	router, err := NewRouterFromEncryptedJSON(changeNodeSecret(t, js, 0, func(string) string { return "" }), secretCipher)
+	if err != nil {
+		t.Fatalf("config with an empty secret refused: %v", err)
+	}
+	if node, _ := router.GetNodeByUUID("node1"); node.SendTotpSecret != "" {
+		t.Errorf("empty secret restored as %s", node.SendTotpSecret)
+	}
+}
+
+func TestPlainConfigLoadedWithCipher(t *testing.T) {
+	js, err := newSecretsRouter().ExportRouterToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretCipher, _ := NewKeyCipher([]byte("0123456789abcdef0123456789abcdef"))
+	router, err := NewRouterFromEncryptedJSON(js, secretCipher)
+	if err != nil {
+		t.Fatalf("plain config refused: %v", err)
+	}
+	if node, _ := router.GetNodeByUUID("node1"); node.SendTotpSecret != "SENDNODE1SECRET" {
+		t.Errorf("plain secret restored as %s", node.SendTotpSecret)
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	if redactSecret("") != "" || redactSecret("SECRET") != redactedSecret {
+		t.Error("secret not redacted")
+	}
+}
@@ -1,11 +1,11 @@
 package godddns
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
-
-	"github.com/xlzd/gotp"
+	"strings"
 )
 
 /*
@@ -19,12 +19,16 @@ type Credential struct {
 	NodeUUID string //The remote node UUID
 	Username string //The username that the account is using
 	Password string //The password that the account is using
+
+	PublicKey []byte `json:",omitempty"` //The public key of the remote node
 }
 
 //Return from registrated node
 type TOTPPayload struct {
 	TOTPSecret   string
 	ReflectionIP string
+	PublicKey    []byte          `json:",omitempty"` //The public key of the registrated node
+	Parameters   *TOTPParameters `json:",omitempty"` //The parameters of the TOTP, not set if they are the defaults
 }
 
 /*
@@ -38,47 +42,146 @@ func (s *ServiceRouter) handleConnectionEstablishResponse(w http.ResponseWriter,
 	//Try to parse it into the required structure
 	err := json.NewDecoder(r.Body).Decode(&cred)
 	if err != nil {
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, RemoteAddr: r.RemoteAddr, Err: err})
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	if !s.checkNodeLockout(w, r, "connect", cred.NodeUUID) {
+		return
+	}
+
+	if !isValidPublicKey(cred.PublicKey) {
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, NodeUUID: cred.NodeUUID, RemoteAddr: r.RemoteAddr, Err: errors.New("invalid public key")})
+		http.Error(w, "invalid public key", http.StatusBadRequest)
+		return
+	}
+
 	//Validate the credential
-	if !s.Options.AuthFunction(cred.Username, cred.Password) {
+	if s.Options.RequireChallengeJoin {
+		err = errors.New("password join is disabled, use the challenge-response join")
+		s.logger().Warn("handshake rejected", logKeyRemote, cred.NodeUUID, logKeyOperation, "connect", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, NodeUUID: cred.NodeUUID, RemoteAddr: r.RemoteAddr, Err: err})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	authResult, err := s.authenticate(&AuthRequest{
+		Credential: cred,
+		RemoteAddr: r.RemoteAddr,
+		Request:    r,
+	})
+	if err != nil {
 		//Unauthorized
+		s.recordAuthFailure(r, "connect", cred.NodeUUID)
+		s.logger().Warn("handshake rejected", logKeyRemote, cred.NodeUUID, logKeyOperation, "connect", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "failure")
+		s.emitEvent(Event{Type: EventHandshakeRejected, NodeUUID: cred.NodeUUID, RemoteAddr: r.RemoteAddr, Err: err})
 		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Incorrect username or password"))
+		w.Write([]byte(err.Error()))
 		return
 	}
 
-	//Check if the node TOTP already exists
-	nodeTotpRecordPosition := s.totpMapExists(cred.NodeUUID)
-	if nodeTotpRecordPosition >= 0 {
-		//Node already registered. Remove the previous TOTP record
-		s.TOTPMap[nodeTotpRecordPosition] = s.TOTPMap[len(s.TOTPMap)-1]
-		s.TOTPMap = s.TOTPMap[:len(s.TOTPMap)-1]
-	}
+	s.recordAuthSuccess(r, cred.NodeUUID)
 
 	//Generate TOTP
-	totpSecret := gotp.RandomSecret(8)
-
-	//Write TOTP Secret to map
-	s.TOTPMap = append(s.TOTPMap, &TOTPRecord{
-		RemoteUUID:     cred.NodeUUID,
-		RecvTOTPSecret: totpSecret,
-	})
+	totpSecret, parameters, err := s.issueTOTPSecret(cred.NodeUUID, authResult.Permissions, cred.PublicKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	//Construct response
 	payload := TOTPPayload{
 		TOTPSecret:   totpSecret,
 		ReflectionIP: r.RemoteAddr,
+		PublicKey:    s.PublicKey(),
+		Parameters:   parameters.wireParameters(),
 	}
 
 	result, _ := json.Marshal(payload)
 
-	if s.Options.Verbal {
-		log.Println(cred.NodeUUID + " has established connection with this node(" + s.Options.DeviceUUID + ")")
-	}
+	s.logger().Info("handshake accepted", logKeyRemote, cred.NodeUUID, logKeyOperation, "connect", "permissions", authResult.Permissions.String())
 
 	//Return TOTP to request client
+	s.metrics.inc(metricHandshakes, "direction", "incoming", "result", "success")
 	w.Write(result)
+	s.emitEvent(Event{Type: EventHandshakeAccepted, NodeUUID: cred.NodeUUID, RemoteAddr: r.RemoteAddr})
+	s.scheduleSave()
+}
+
+/*
+	authenticate
+
+	Check the handshake request with the authenticator of this router. A nil
+	result from the authenticator grant all permissions
+*/
+func (s *ServiceRouter) authenticate(request *AuthRequest) (*AuthResult, error) {
+	if strings.TrimSpace(request.Credential.NodeUUID) == "" {
+		return nil, errors.New("node UUID is empty")
+	}
+	if request.Credential.NodeUUID == s.Options.DeviceUUID {
+		return nil, errors.New("node UUID is the same as this router")
+	}
+	if s.IsNodeRevoked(request.Credential.NodeUUID) {
+		return nil, errors.New("node is revoked")
+	}
+
+	authenticator := s.getAuthenticator()
+	if authenticator == nil {
+		return nil, errors.New("this router does not accept new nodes")
+	}
+
+	result, err := authenticator.Authenticate(request)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &AuthResult{Permissions: PermissionAll}
+	}
+	return result, nil
+}
+
+/*
+	issueTOTPSecret
+
+	Generate a new TOTP secret for the node and replace its previous TOTP record.
+	The public key sent by the node is kept with the record, a changed key is
+	accepted as the node has just been authenticated
+*/
+func (s *ServiceRouter) issueTOTPSecret(nodeUUID string, permissions Permission, publicKey []byte) (string, TOTPParameters, error) {
+	totpSecret, err := s.newTOTPSecret()
+	if err != nil {
+		return "", TOTPParameters{}, err
+	}
+	parameters := s.getTOTPOptions().parameters()
+
+	s.mux.Lock()
+	keyChanged := false
+	//Check if the node TOTP already exists
+	nodeTotpRecordPosition := s.totpMapExists(nodeUUID)
+	if nodeTotpRecordPosition >= 0 {
+		//Node already registered. Remove the previous TOTP record
+		previousKey := s.TOTPMap[nodeTotpRecordPosition].PublicKey
+		keyChanged = len(previousKey) > 0 && !bytes.Equal(previousKey, publicKey)
+		s.TOTPMap[nodeTotpRecordPosition] = s.TOTPMap[len(s.TOTPMap)-1]
+		s.TOTPMap = s.TOTPMap[:len(s.TOTPMap)-1]
+	}
+
+	//Write TOTP Secret to map
+	s.TOTPMap = append(s.TOTPMap, &TOTPRecord{
+		RemoteUUID:     nodeUUID,
+		RecvTOTPSecret: totpSecret,
+		Permissions:    permissions,
+		PublicKey:      publicKey,
+		Parameters:     parameters,
+	})
+	s.mux.Unlock()
+
+	if keyChanged {
+		s.logger().Warn("public key of node changed", logKeyRemote, nodeUUID, logKeyOperation, "connect", "fingerprint", PublicKeyFingerprint(publicKey))
+	}
+	return totpSecret, parameters, nil
 }
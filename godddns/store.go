@@ -0,0 +1,241 @@
+package godddns
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	Store.go
+
+	This script persist the router state to a storage backend. If a store is
+	set in the router options, the router saves itself after handshakes, node
+	add / remove and address changes. Saves are coalesced so a burst of
+	changes only write the state once
+
+	options := godddns.RouterOptions{
+		DeviceUUID:   "thisNode",
+		AuthFunction: ValidateCred,
+		Store:        godddns.NewFileStore("router.json"),
+	}
+	thisNode, err := godddns.LoadRouter(options)
+	if errors.Is(err, godddns.ErrStoreEmpty) {
+		thisNode = godddns.NewServiceRouter(options)
+	}
+*/
+
+//ErrStoreEmpty is returned by Store.Load if no router state has been saved
+var ErrStoreEmpty = errors.New("no router state in store")
+
+//Store is a storage backend of the router state
+type Store interface {
+	Load() ([]byte, error) //Load the saved state, return ErrStoreEmpty if nothing is saved
+	Save(data []byte) error
+}
+
+//The delay before the router state is saved if SaveDelay is not set
+const defaultSaveDelay = time.Second
+
+/*
+	FileStore
+
+	Save the router state to a file. The state is written to a temp file in
+	the same folder and renamed to the target path, so the file is never left
+	half written
+*/
+type FileStore struct {
+	Path string      //The path of the state file
+	Perm os.FileMode //The permission of the state file, default 0600
+}
+
+//NewFileStore create a store that save the router state to the given path
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		Path: path,
+		Perm: 0600,
+	}
+}
+
+func (f *FileStore) Load() ([]byte, error) {
+	content, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, ErrStoreEmpty
+	}
+	return content, err
+}
+
+func (f *FileStore) Save(data []byte) error {
+	perm := f.Perm
+	if perm == 0 {
+		perm = 0600
+	}
+	return writeFileAtomic(f.Path, data, perm)
+}
+
+//MemoryStore keep the router state in memory, e.g. for testing
+type MemoryStore struct {
+	data []byte
+	mux  sync.Mutex
+}
+
+//NewMemoryStore create an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (m *MemoryStore) Load() ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if m.data == nil {
+		return nil, ErrStoreEmpty
+	}
+	data := make([]byte, len(m.data))
+	copy(data, m.data)
+	return data, nil
+}
+
+func (m *MemoryStore) Save(data []byte) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.data = make([]byte, len(data))
+	copy(m.data, data)
+	return nil
+}
+
+/*
+	LoadRouter
+
+	Restore a router from the store in the options. The secrets are decrypted
+	with the cipher in the options if the state was saved with one. The options
+	that are not saved with the state (store, cipher, authentication, transport,
+	clock and logger) are taken from the given options, the others from the
+	saved state, so the same options can create the router on first startup
+*/
+func LoadRouter(options RouterOptions) (*ServiceRouter, error) {
+	if options.Store == nil {
+		return nil, errors.New("store is not set")
+	}
+	data, err := options.Store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	newRouter, err := NewRouterFromEncryptedJSON(string(data), options.SecretCipher)
+	if err != nil {
+		return nil, err
+	}
+	newRouter.Options.AuthFunction = options.AuthFunction
+	newRouter.Options.Authenticator = options.Authenticator
+	newRouter.Options.ScramCredentialFunction = options.ScramCredentialFunction
+	newRouter.Options.Transport = options.Transport
+	newRouter.Options.Clock = options.Clock
+	newRouter.Options.Logger = options.Logger
+	newRouter.Options.Store = options.Store
+	newRouter.Options.SecretCipher = options.SecretCipher
+	newRouter.checkStoreCipher()
+	return newRouter, nil
+}
+
+//Save write the router state to the store immediately. Secrets are encrypted if a cipher is set
+func (s *ServiceRouter) Save() error {
+	if s.Options == nil || s.Options.Store == nil {
+		return errors.New("store is not set")
+	}
+
+	s.saveMux.Lock()
+	defer s.saveMux.Unlock()
+	return s.save()
+}
+
+//save export the router and write it to the store, caller must hold the save lock
+func (s *ServiceRouter) save() error {
+	s.savePending = false
+	if s.saveQuit != nil {
+		//Cancel the scheduled save, the latest state is written now
+		close(s.saveQuit)
+		s.saveQuit = nil
+	}
+
+	js, err := s.exportRouter(s.Options.SecretCipher)
+	if err != nil {
+		return err
+	}
+	return s.Options.Store.Save([]byte(js))
+}
+
+//checkStoreCipher warn once that the retry credentials are not saved if the store is set without a cipher
+func (s *ServiceRouter) checkStoreCipher() {
+	if s.Options == nil || s.Options.Store == nil || s.Options.SecretCipher != nil {
+		return
+	}
+	s.logger().Warn("store is set without a cipher, the secrets are saved in plain text and the retry credentials are not saved", logKeyOperation, "save")
+}
+
+/*
+	scheduleSave
+
+	Save the router state after the save delay if a store is set. Changes
+	happened before the pending save is executed are written together.
+	Must not be called while holding the router lock
+*/
+func (s *ServiceRouter) scheduleSave() {
+	if s.Options == nil || s.Options.Store == nil {
+		return
+	}
+
+	s.saveMux.Lock()
+	defer s.saveMux.Unlock()
+	if s.savePending || s.saveStopped {
+		return
+	}
+	s.savePending = true
+
+	delay := s.Options.SaveDelay
+	if delay <= 0 {
+		delay = defaultSaveDelay
+	}
+	ticker := s.getClock().NewTicker(delay)
+	quit := make(chan bool)
+	s.saveQuit = quit
+	go func() {
+		defer ticker.Stop()
+		select {
+		case <-ticker.Chan():
+		case <-quit:
+			return
+		}
+
+		s.saveMux.Lock()
+		defer s.saveMux.Unlock()
+		if !s.savePending || s.saveStopped {
+			//Saved or stopped in between
+			return
+		}
+		if err := s.save(); err != nil {
+			s.logger().Error("unable to save router state", logKeyError, err)
+		}
+	}()
+}
+
+/*
+	stopSaving
+
+	Write the latest state to the store and stop saving further changes
+	automatically. Called when the router is closed, so the connections ended
+	by Close are not written to the store
+*/
+func (s *ServiceRouter) stopSaving() {
+	if s.Options == nil || s.Options.Store == nil {
+		return
+	}
+
+	s.saveMux.Lock()
+	defer s.saveMux.Unlock()
+	if err := s.save(); err != nil {
+		s.logger().Error("unable to save router state", logKeyError, err)
+	}
+	s.saveStopped = true
+}
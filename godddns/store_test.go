@@ -0,0 +1,228 @@
+package godddns_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+	"github.com/tobychui/go-DDDNS/simulator"
+)
+
+//notifyStore is a memory store that report every save on a channel
+type notifyStore struct {
+	*godddns.MemoryStore
+	saved chan []byte
+}
+
+func newNotifyStore() *notifyStore {
+	return &notifyStore{
+		MemoryStore: godddns.NewMemoryStore(),
+		saved:       make(chan []byte, 16),
+	}
+}
+
+func (s *notifyStore) Save(data []byte) error {
+	s.saved <- data
+	return s.MemoryStore.Save(data)
+}
+
+//warnLogger count the warnings written by the router
+type warnLogger struct {
+	warnings []string
+	mux      sync.Mutex
+}
+
+func (l *warnLogger) Debug(msg string, args ...interface{}) {}
+func (l *warnLogger) Info(msg string, args ...interface{})  {}
+func (l *warnLogger) Error(msg string, args ...interface{}) {}
+
+func (l *warnLogger) Warn(msg string, args ...interface{}) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.warnings = append(l.warnings, msg)
+}
+
+func (l *warnLogger) getWarnings() []string {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return append([]string{}, l.warnings...)
+}
+
+func TestScheduleSaveDebounce(t *testing.T) {
+	clock := simulator.NewClock(time.Unix(1700000000, 0))
+	store := newNotifyStore()
+	router := godddns.NewServiceRouter(godddns.RouterOptions{
+		DeviceUUID: "thisNode",
+		Store:      store,
+		Clock:      clock,
+		SaveDelay:  5 * time.Second,
+		Logger:     &warnLogger{},
+	})
+
+	//Changes within the save delay are written together once the delay is over
+	for _, uuid := range []string{"node1", "node2", "node3"} {
+		router.AddNode(router.NewNode(godddns.NodeOptions{NodeID: uuid, Port: 8080, RESTInterface: "/godddns"}))
+		clock.Advance(time.Second)
+	}
+	select {
+	case <-store.saved:
+		t.Fatal("router state saved before the save delay")
+	default:
+	}
+
+	clock.Advance(2 * time.Second)
+	select {
+	case data := <-store.saved:
+		if !strings.Contains(string(data), "node3") {
+			t.Error("latest change not in the saved state")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("router state not saved after the save delay")
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-store.saved:
+		t.Error("router state saved twice for one burst of changes")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//A save by hand cancel the pending save
+	router.AddNode(router.NewNode(godddns.NodeOptions{NodeID: "node4", Port: 8080, RESTInterface: "/godddns"}))
+	if err := router.Save(); err != nil {
+		t.Fatal(err)
+	}
+	<-store.saved
+	clock.Advance(time.Minute)
+	select {
+	case <-store.saved:
+		t.Error("cancelled save executed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStoreWithoutCipherWarnsOnce(t *testing.T) {
+	clock := simulator.NewClock(time.Unix(1700000000, 0))
+	logger := &warnLogger{}
+	store := newNotifyStore()
+	router := godddns.NewServiceRouter(godddns.RouterOptions{
+		DeviceUUID: "thisNode",
+		Store:      store,
+		Clock:      clock,
+		Logger:     logger,
+	})
+	if len(logger.getWarnings()) != 1 {
+		t.Fatalf("router created with warnings %q, expected one", logger.getWarnings())
+	}
+	for i := 0; i < 3; i++ {
+		router.AddNode(router.NewNode(godddns.NodeOptions{NodeID: "node" + string(rune('1'+i)), Port: 8080, RESTInterface: "/godddns"}))
+		if err := router.Save(); err != nil {
+			t.Fatal(err)
+		}
+		<-store.saved
+	}
+	if len(logger.getWarnings()) != 1 {
+		t.Errorf("saves warned %q", logger.getWarnings()[1:])
+	}
+
+	//No warning if the secrets are encrypted
+	secretCipher, _ := godddns.NewKeyCipher([]byte("0123456789abcdef0123456789abcdef"))
+	logger = &warnLogger{}
+	godddns.NewServiceRouter(godddns.RouterOptions{DeviceUUID: "thisNode", Store: store, SecretCipher: secretCipher, Logger: logger})
+	if len(logger.getWarnings()) != 0 {
+		t.Errorf("router with a cipher warned %q", logger.getWarnings())
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store := godddns.NewFileStore(filepath.Join(dir, "router.json"))
+	if _, err := store.Load(); !errors.Is(err, godddns.ErrStoreEmpty) {
+		t.Errorf("missing state file loaded with %v, expected ErrStoreEmpty", err)
+	}
+
+	for _, data := range []string{"first state", "second state"} {
+		if err := store.Save([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		content, err := store.Load()
+		if err != nil || string(content) != data {
+			t.Errorf("state loaded as %q, %v, expected %q", content, err, data)
+		}
+	}
+
+	//The state file is replaced by a rename, no temp file is left behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || files[0].Mode().Perm() != 0600 {
+		t.Errorf("%d files in the folder after saving, expected the state file with mode 0600", len(files))
+	}
+}
+
+func TestLoadRouterRoundTrip(t *testing.T) {
+	network := simulator.NewNetwork(simulator.Options{StartTime: time.Unix(1700000000, 0)})
+	store := godddns.NewMemoryStore()
+	secretCipher, _ := godddns.NewPassphraseCipher("correct horse battery staple")
+	var options godddns.RouterOptions
+	nodeA, err := network.AddNodeWithOptions("a", "203.0.113.1", func(o *godddns.RouterOptions) {
+		o.Store = store
+		o.SecretCipher = secretCipher
+		options = *o
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.AddNode("b", "203.0.113.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodeA.Router.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	//The runtime options are taken from the given options, the rest from the store
+	logger := &warnLogger{}
+	options.Logger = logger
+	options.SyncInterval = 0
+	restored, err := godddns.LoadRouter(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Options.Store != store || restored.Options.SecretCipher != secretCipher || restored.Options.Clock != network.Clock || restored.Options.Logger != logger || restored.Options.Transport == nil {
+		t.Error("runtime options not restored from the given options")
+	}
+	if restored.Options.AuthFunction == nil || restored.Options.ScramCredentialFunction == nil {
+		t.Error("authentication functions not restored from the given options")
+	}
+	if restored.Options.SyncInterval != 10 {
+		t.Errorf("sync interval %d, expected the saved interval", restored.Options.SyncInterval)
+	}
+	nodeB, err := restored.GetNodeByUUID("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nodeB.IpAddr.Equal(network.GetIP("b")) {
+		t.Errorf("address of b restored as %s", nodeB.IpAddr)
+	}
+
+	//The retry credentials are kept with a cipher, so the restored router can register again
+	js, err := restored.ExportRouterToEncryptedJSON(secretCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(js, `"RetryPassword": "enc:`) {
+		t.Error("retry credentials lost in the saved state")
+	}
+	if len(logger.getWarnings()) != 0 {
+		t.Errorf("restored router warned %q", logger.getWarnings())
+	}
+
+	if _, err := godddns.LoadRouter(godddns.RouterOptions{DeviceUUID: "a", Store: godddns.NewMemoryStore()}); !errors.Is(err, godddns.ErrStoreEmpty) {
+		t.Errorf("empty store loaded with %v, expected ErrStoreEmpty", err)
+	}
+}
@@ -1,21 +1,14 @@
 package godddns
 
 import (
-	"bytes"
+	"crypto/hmac"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"log"
 	"math/rand"
 	"net"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
-
-	"github.com/xlzd/gotp"
 )
 
 /*
@@ -26,62 +19,91 @@ import (
 */
 
 type SyncRequestPackage struct {
-	NodeUUID string
-	TOTP     string
-	LostUUID string
+	NodeUUID  string
+	TOTP      string
+	LostUUID  string
+	Nonce     string `json:",omitempty"` //Random value the reply is bound to, each nonce is accepted once
+	Timestamp int64  `json:",omitempty"` //The time the packet is sent
+	MAC       []byte `json:",omitempty"` //Keyed with the TOTP secret of the sending node
+	Signature []byte `json:",omitempty"` //Signed with the identity key of the sending node
+}
+
+//Reply to a sync request with nonce, authenticated by the replying router
+type SyncResponse struct {
+	IpAddr    string //The address of the lost node known by the replying router
+	MAC       []byte //Keyed with the TOTP secret the sync request is sent with
+	Signature []byte //Signed with the identity key of the replying router
+}
+
+//signedMessage return the message signed in the sync request sent to the router with given UUID
+func (p *SyncRequestPackage) signedMessage(routerUUID string) []byte {
+	return signedMessage("sync", p.NodeUUID, routerUUID, p.TOTP, p.LostUUID, p.Nonce, strconv.FormatInt(p.Timestamp, 10))
+}
+
+//signedMessage return the message signed in the reply of the router with given UUID to the sync request
+func (r *SyncResponse) signedMessage(routerUUID string, packet *SyncRequestPackage) []byte {
+	return signedMessage("sync-response", routerUUID, packet.NodeUUID, packet.Nonce, packet.LostUUID, r.IpAddr)
 }
 
 func (s *ServiceRouter) syncNodeAddress(node *Node) error {
 	//Get the nodes that is recently updated
 	latestUpdatedNodes := []*Node{}
-	timeBaseline := time.Now().Unix() - (heartBeatRetryCount-1)*s.Options.SyncInterval
-	for _, node := range s.NodeMap {
-		if node.lastOnline > timeBaseline {
+	timeBaseline := s.now().Unix() - (heartBeatRetryCount-1)*s.getSyncInterval()
+	for _, thisNode := range s.getNodes() {
+		if thisNode.GetLastOnline() > timeBaseline {
 			//This node is newly updated
-			latestUpdatedNodes = append(latestUpdatedNodes, node)
+			latestUpdatedNodes = append(latestUpdatedNodes, thisNode)
 		}
 	}
 
 	if len(latestUpdatedNodes) == 0 {
-		if s.Options.Verbal {
-			fmt.Println("[WARNING] Unable to reach any nodes. " + s.Options.DeviceUUID + " in orphan mode!!")
+		if s.setOrphanMode(true) {
+			s.metrics.inc(metricOrphanModeEntered)
+			s.logger().Warn("unable to reach any node, entering orphan mode", logKeyRemote, node.UUID, logKeyOperation, "sync")
+			s.emitEvent(Event{Type: EventOrphanModeEntered})
+		} else {
+			s.logger().Debug("still in orphan mode", logKeyRemote, node.UUID, logKeyOperation, "sync")
 		}
 
 		//Retry next time after longer period of time
+		node.mux.Lock()
 		node.retryCount = 0
+		node.mux.Unlock()
 		return errors.New("node in orphan mode")
 	}
 
 	//Randomly pick one from the node list
-	rand.Seed(time.Now().Unix()) // initialize global pseudo random generator
+	rand.Seed(s.now().Unix()) // initialize global pseudo random generator
 	askingNode := latestUpdatedNodes[rand.Intn(len(latestUpdatedNodes))]
 
-	if s.Options.Verbal {
-		fmt.Println("[WARNING] "+s.Options.DeviceUUID+" is asking for "+node.UUID+"'s IP from sync node: ", askingNode.UUID)
-	}
+	s.logger().Info("node lost, asking another node for its address", logKeyRemote, askingNode.UUID, logKeyOperation, "sync", "lost", node.UUID)
 	//Ask the asking node for the target node's ip address
+	s.metrics.inc(metricSyncIssued)
 	newNodeIp, err := s.resolveNodeIpFromAskingNode(node, askingNode)
 	if err != nil {
-		fmt.Println("[ERROR] Unable to perform sync from", s.Options.DeviceUUID, " to ", askingNode.UUID, err.Error())
+		s.metrics.inc(metricSyncFailed)
+		s.logger().Error("unable to perform sync", logKeyRemote, askingNode.UUID, logKeyOperation, "sync", "lost", node.UUID, logKeyError, err)
 		return err
 	}
 
-	if newNodeIp.String() == node.IpAddr.String() {
+	if newNodeIp.String() == node.GetIpAddr().String() {
 		//IP didnt change as seen from the 3rd node. Ask another random node in next cycle
-		if s.Options.Verbal {
-			if s.Options.Verbal {
-				fmt.Println("[Sync] IP Sync from " + askingNode.UUID + " is identical as the one stored in " + s.Options.DeviceUUID + ". Waiting for next iteration...")
-				//Try connect in the next iteration, sync again after 2 iterations
-				node.retryCount = heartBeatRetryCount - 1
-			}
-		}
+		s.logger().Debug("synced address is unchanged, waiting for next iteration", logKeyRemote, askingNode.UUID, logKeyOperation, "sync", "lost", node.UUID)
+		//Try connect in the next iteration, sync again after 2 iterations
+		node.mux.Lock()
+		node.retryCount = heartBeatRetryCount - 1
+		node.mux.Unlock()
 	} else {
-		if s.Options.Verbal {
-			fmt.Println("[Sync] IP Sync from "+askingNode.UUID+" shows "+node.UUID+" ip is: ", newNodeIp.String())
-		}
+		s.logger().Info("synced new address of lost node", logKeyRemote, askingNode.UUID, logKeyOperation, "sync", "lost", node.UUID, "ip", newNodeIp.String())
 		//IP addr different. Update it and reset retry count
+		node.mux.Lock()
+		previousIpAddr := node.IpAddr
 		node.IpAddr = newNodeIp
 		node.retryCount = 0
+		node.mux.Unlock()
+		s.metrics.inc(metricNodeIpChanges, "node", node.UUID)
+		s.emitEvent(Event{Type: EventNodeIpChanged, NodeUUID: node.UUID, IpAddr: newNodeIp, PreviousIpAddr: previousIpAddr})
+		s.scheduleSave()
 	}
 	return nil
 }
@@ -96,28 +118,60 @@ func (s *ServiceRouter) handleSyncRequestByLostNode(w http.ResponseWriter, r *ht
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !s.checkNodeLockout(w, r, "sync", payload.NodeUUID) {
+		return
+	}
 
 	//Validate the TOTP
-	targetTotpSecret := ""
-	for _, thisTOTPRecord := range s.TOTPMap {
-		if thisTOTPRecord.RemoteUUID == payload.NodeUUID {
-			targetTotpSecret = thisTOTPRecord.RecvTOTPSecret
-		}
-	}
+	targetTotpSecret := s.getTotpSecret(payload.NodeUUID)
 
 	if targetTotpSecret == "" {
 		//No record found, target UUID did not register on this node
+		s.recordAuthFailure(r, "sync", payload.NodeUUID)
+		s.metrics.inc(metricTOTPFailures, "operation", "sync")
 		http.Error(w, "node UUID not registered", http.StatusUnauthorized)
+		s.logger().Warn("sync request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "sync", logKeyEndpoint, r.RemoteAddr, logKeyError, "node TOTP not registered")
 		return
 	}
 
-	targetTotpResolver := gotp.NewDefaultTOTP(targetTotpSecret)
-	isValidTotp := targetTotpResolver.Verify(payload.TOTP, int(time.Now().Unix()))
+	//The previous secret is still accepted for a while after rotation
+	matchedTotpSecret := s.verifyNodeTOTP(payload.NodeUUID, payload.TOTP)
 
-	if !isValidTotp {
+	if matchedTotpSecret == "" {
 		//Response to invalid TOTP
+		s.recordAuthFailure(r, "sync", payload.NodeUUID)
+		s.metrics.inc(metricTOTPFailures, "operation", "sync")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte("400 - Invalid TOTP"))
+		s.logger().Warn("sync request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "sync", logKeyEndpoint, r.RemoteAddr, logKeyError, "invalid TOTP")
+		return
+	}
+
+	//Check the signature if the node has sent its public key
+	err = s.verifyNodeSignature(payload.NodeUUID, payload.signedMessage(s.Options.DeviceUUID), payload.Signature)
+	if err != nil {
+		s.recordNodeFailure(r, "sync", payload.NodeUUID)
+		s.metrics.inc(metricSignatureFailures, "operation", "sync")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		s.logger().Warn("sync request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "sync", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	//Make sure the packet is recent and not seen before
+	status, err := s.checkPacketFreshness(payload.NodeUUID, matchedTotpSecret, payload.signedMessage(s.Options.DeviceUUID), payload.Nonce, payload.Timestamp, payload.MAC, payload.TOTP, r.RemoteAddr)
+	if err != nil {
+		s.metrics.inc(metricReplayedPackets, "operation", "sync")
+		http.Error(w, err.Error(), status)
+		s.logger().Warn("sync request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "sync", logKeyEndpoint, r.RemoteAddr, logKeyError, err)
+		return
+	}
+
+	s.recordAuthSuccess(r, payload.NodeUUID)
+
+	//Check if the node is allowed to ask for the address of other nodes
+	if !s.getNodePermissions(payload.NodeUUID).Has(PermissionSync) {
+		http.Error(w, "sync not permitted", http.StatusForbidden)
+		s.logger().Warn("sync request rejected", logKeyRemote, payload.NodeUUID, logKeyOperation, "sync", logKeyEndpoint, r.RemoteAddr, logKeyError, "sync not permitted")
 		return
 	}
 
@@ -129,60 +183,101 @@ func (s *ServiceRouter) handleSyncRequestByLostNode(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if s.Options.Verbal {
-		log.Println("[Sync] " + s.Options.DeviceUUID + " responding to " + payload.NodeUUID + " request on IP address of node " + payload.LostUUID)
-	}
+	s.logger().Debug("answering sync request", logKeyRemote, payload.NodeUUID, logKeyOperation, "sync", "lost", payload.LostUUID)
 
 	//Reply the IP address of the requesting node from this node's perspective
-	w.Write([]byte(targetNode.IpAddr.String()))
+	s.metrics.inc(metricSyncServed)
+	if payload.Nonce == "" {
+		//Sent by older versions that do not verify the reply
+		w.Write([]byte(targetNode.GetIpAddr().String()))
+		return
+	}
+	response := SyncResponse{
+		IpAddr: targetNode.GetIpAddr().String(),
+	}
+	response.MAC = packetMAC(matchedTotpSecret, response.signedMessage(s.Options.DeviceUUID, &payload))
+	response.Signature = s.sign(response.signedMessage(s.Options.DeviceUUID, &payload))
+	result, _ := json.Marshal(response)
+	w.Write(result)
 }
 
-func (s *ServiceRouter) resolveNodeIpFromAskingNode(lostNode *Node, askingNode *Node) (net.IP, error) {
-	//Assemble the target node heartbeat endpoint
-	reqEndpoint := askingNode.IpAddr.String() + ":" + strconv.Itoa(askingNode.Port) + "/" + askingNode.RESTfulInterface + "?opr=s"
-	reqEndpoint = filepath.ToSlash(filepath.Clean(reqEndpoint))
+/*
+	parseSyncResponse
 
-	//Append protocol type
-	if askingNode.RequireHTTPS {
-		reqEndpoint = "https://" + reqEndpoint
-	} else {
-		reqEndpoint = "http://" + reqEndpoint
+	Return the address of the lost node in the reply of the asking node. The
+	reply must carry a MAC keyed with the TOTP secret the request is sent with
+	and bound to the nonce of the request, and be signed by the asking node if
+	its public key is known, so a forged address is not accepted. The plain
+	reply of older versions is only accepted from nodes that never sent a MAC
+*/
+func parseSyncResponse(askingNode *Node, packet *SyncRequestPackage, totpSecret string, body []byte) (string, error) {
+	response := SyncResponse{}
+	err := json.Unmarshal(body, &response)
+	if err != nil || len(response.MAC) == 0 {
+		if askingNode.requiresReplyMAC() {
+			return "", errors.New("sync response is not authenticated")
+		}
+		//Older versions reply the address in plain text
+		return strings.TrimSpace(string(body)), nil
+	}
+	if !hmac.Equal(response.MAC, packetMAC(totpSecret, response.signedMessage(askingNode.UUID, packet))) {
+		return "", errors.New("sync response is not authenticated")
+	}
+	if publicKey := askingNode.GetPublicKey(); len(publicKey) > 0 {
+		err = verifySignature(publicKey, response.signedMessage(askingNode.UUID, packet), response.Signature)
+		if err != nil {
+			return "", err
+		}
 	}
+	askingNode.setReplyMACRequired()
+	return strings.TrimSpace(response.IpAddr), nil
+}
+
+func (s *ServiceRouter) resolveNodeIpFromAskingNode(lostNode *Node, askingNode *Node) (net.IP, error) {
+	askingNode.mux.RLock()
+	askingNodeIpAddr := askingNode.IpAddr
+	sendTotpSecret := askingNode.SendTotpSecret
+	totpParameters := askingNode.totpParameters
+	askingNode.mux.RUnlock()
 
 	//Generate a TOTP for this node
-	totp := gotp.NewDefaultTOTP(askingNode.SendTotpSecret)
-	token := totp.Now()
+	token := s.generateTOTP(sendTotpSecret, totpParameters)
 
 	//POST the request asking for the target node
-	postBody, _ := json.Marshal(map[string]string{
-		"NodeUUID": s.Options.DeviceUUID,
-		"TOTP":     token,
-		"LostUUID": lostNode.UUID,
-	})
-	responseBody := bytes.NewBuffer(postBody)
-
-	//Create a POST request to the target node heartbeat endpoint
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
-	resp, err := client.Post(reqEndpoint, "application/json", responseBody)
+	nonce, err := newNonce()
 	if err != nil {
-		//Post failed, return the error
 		return nil, err
 	}
+	packet := SyncRequestPackage{
+		NodeUUID:  s.Options.DeviceUUID,
+		TOTP:      token,
+		LostUUID:  lostNode.UUID,
+		Nonce:     nonce,
+		Timestamp: s.now().Unix(),
+	}
+	packet.MAC = packetMAC(sendTotpSecret, packet.signedMessage(askingNode.UUID))
+	packet.Signature = s.sign(packet.signedMessage(askingNode.UUID))
+	postBody, _ := json.Marshal(packet)
 
-	body, err := ioutil.ReadAll(resp.Body)
+	//Send the sync request to the asking node
+	resp, err := s.getTransport().Sync(askingNode.getEndpoint(askingNodeIpAddr.String()), postBody)
 	if err != nil {
+		//Request failed, return the error
 		return nil, err
 	}
 
+	body := resp.Body
 	if resp.StatusCode != 200 {
 		//Something went wrong.
 		return nil, errors.New(string(body))
 	}
 
 	//The response is ip address of the target node. Update the node's IP
-	syncedIpString := strings.TrimSpace(string(body))
+	syncedIpString, err := parseSyncResponse(askingNode, &packet, sendTotpSecret, body)
+	if err != nil {
+		s.metrics.inc(metricSignatureFailures, "operation", "sync_response")
+		return nil, err
+	}
 	syncedIp := net.ParseIP(syncedIpString)
 	if syncedIp == nil {
 		return nil, errors.New("ip sync from nearby node is invalid")
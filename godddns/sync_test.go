@@ -0,0 +1,66 @@
+package godddns
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+//signSyncResponse return the reply of the router to the sync request, with its MAC and signature changed if given
+func signSyncResponse(t *testing.T, replier *ServiceRouter, packet *SyncRequestPackage, change func(*SyncResponse)) []byte {
+	t.Helper()
+	response := SyncResponse{IpAddr: "203.0.113.20"}
+	response.MAC = packetMAC(testReplySecret, response.signedMessage(replier.Options.DeviceUUID, packet))
+	response.Signature = replier.sign(response.signedMessage(replier.Options.DeviceUUID, packet))
+	if change != nil {
+		change(&response)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestParseSyncResponse(t *testing.T) {
+	packet := &SyncRequestPackage{NodeUUID: "thisNode", LostUUID: "node2", Nonce: "nonce"}
+	replier, node := newReplyNode(true)
+	forger := NewServiceRouter(RouterOptions{DeviceUUID: "node1"})
+
+	syncedIP, err := parseSyncResponse(node, packet, testReplySecret, signSyncResponse(t, replier, packet, nil))
+	if err != nil || syncedIP != "203.0.113.20" {
+		t.Errorf("authenticated reply parsed as %s, %v", syncedIP, err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(*SyncResponse)
+	}{
+		{"bad MAC", func(r *SyncResponse) { r.MAC = packetMAC("KRSXG5CTMVRXEZLU", r.signedMessage("node1", packet)) }},
+		{"changed address", func(r *SyncResponse) { r.IpAddr = "198.51.100.1" }},
+		{"forged signature", func(r *SyncResponse) { r.Signature = forger.sign(r.signedMessage("node1", packet)) }},
+	}
+	for _, test := range tests {
+		if _, err := parseSyncResponse(node, packet, testReplySecret, signSyncResponse(t, replier, packet, test.change)); err == nil {
+			t.Errorf("reply with %s accepted", test.name)
+		}
+	}
+	if _, err := parseSyncResponse(node, packet, testReplySecret, []byte("198.51.100.1")); err == nil {
+		t.Error("plain reply accepted from a node with a public key")
+	}
+}
+
+func TestParseLegacySyncResponse(t *testing.T) {
+	packet := &SyncRequestPackage{NodeUUID: "thisNode", LostUUID: "node2", Nonce: "nonce"}
+	replier, node := newReplyNode(false)
+	syncedIP, err := parseSyncResponse(node, packet, testReplySecret, []byte("203.0.113.20\n"))
+	if err != nil || syncedIP != "203.0.113.20" {
+		t.Errorf("plain reply of an older version parsed as %s, %v", syncedIP, err)
+	}
+
+	if _, err := parseSyncResponse(node, packet, testReplySecret, signSyncResponse(t, replier, packet, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSyncResponse(node, packet, testReplySecret, []byte("198.51.100.1")); err == nil {
+		t.Error("plain reply accepted after a reply with a MAC")
+	}
+}
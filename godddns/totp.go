@@ -0,0 +1,239 @@
+package godddns
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/xlzd/gotp"
+)
+
+/*
+	TOTP.go
+
+	Generate and verify the TOTP tokens carried by heartbeat and
+	sync packets using the time of the router's clock.
+
+	The parameters of the TOTP (digits, period and algorithm) are decided
+	by the router issuing the secret and sent to the node with the secret,
+	so routers with different options can still work together
+*/
+
+const (
+	defaultTOTPDigits       = 6
+	defaultTOTPPeriod       = 30
+	defaultTOTPAlgorithm    = "SHA1"
+	defaultTOTPSecretLength = 32    //160 bits, as recommended by RFC 4226
+	defaultRotationInterval = 86400 //Rotate the secrets once a day
+	defaultRotationOverlap  = 120   //Long enough for the heartbeats sent before the rotation to arrive
+)
+
+//TOTPOptions are the parameters of the TOTP secrets issued by this router and the rotation schedule
+type TOTPOptions struct {
+	Digits           int    //Number of digits of a token, 6 to 10, default 6
+	Period           int    //Seconds a token is valid, default 30
+	Algorithm        string //HMAC algorithm of the TOTP: SHA1, SHA256 or SHA512, default SHA1
+	SecretLength     int    //Number of base32 characters of an issued secret, a multiple of 8 and at least 16, default 32
+	RotationInterval int64  //Seconds before the secrets received from other nodes are rotated, default 1 day, negative to disable
+	RotationOverlap  int64  //Seconds the previous secret is still accepted after it is rotated, default 120
+}
+
+//TOTPParameters are the parameters to generate the tokens of an issued secret. Zero values mean the defaults
+type TOTPParameters struct {
+	Digits    int    `json:",omitempty"`
+	Period    int    `json:",omitempty"`
+	Algorithm string `json:",omitempty"`
+}
+
+//normalize return the parameters with the defaults filled in
+func (p TOTPParameters) normalize() TOTPParameters {
+	if p.Digits == 0 {
+		p.Digits = defaultTOTPDigits
+	}
+	if p.Period == 0 {
+		p.Period = defaultTOTPPeriod
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = defaultTOTPAlgorithm
+	}
+	p.Algorithm = strings.ToUpper(p.Algorithm)
+	return p
+}
+
+func (p TOTPParameters) String() string {
+	p = p.normalize()
+	return p.Algorithm + "/" + strconv.Itoa(p.Digits) + "/" + strconv.Itoa(p.Period)
+}
+
+//validate check if the parameters are supported
+func (p TOTPParameters) validate() error {
+	p = p.normalize()
+	if p.Digits < 6 || p.Digits > 10 {
+		return errors.New("TOTP digits must be between 6 and 10")
+	}
+	if p.Period <= 0 {
+		return errors.New("TOTP period must be positive")
+	}
+	if getTOTPHasher(p.Algorithm) == nil {
+		return errors.New("unsupported TOTP algorithm: " + p.Algorithm)
+	}
+	return nil
+}
+
+func getTOTPHasher(algorithm string) *gotp.Hasher {
+	switch strings.ToUpper(algorithm) {
+	case "SHA1":
+		return &gotp.Hasher{HashName: "sha1", Digest: sha1.New}
+	case "SHA256":
+		return &gotp.Hasher{HashName: "sha256", Digest: sha256.New}
+	case "SHA512":
+		return &gotp.Hasher{HashName: "sha512", Digest: sha512.New}
+	}
+	return nil
+}
+
+/*
+	wireParameters
+
+	Return the parameters to be sent with an issued secret, nil if they are
+	the defaults. Older versions can only use the defaults and do not know
+	the field, so it is left out whenever possible
+*/
+func (p TOTPParameters) wireParameters() *TOTPParameters {
+	p = p.normalize()
+	if p == (TOTPParameters{}).normalize() {
+		return nil
+	}
+	return &p
+}
+
+//isValidTOTPSecret check if the secret received from another node can be used to generate tokens, older versions issue 8 characters
+func isValidTOTPSecret(secret string) bool {
+	if secret == "" || len(secret)%8 != 0 {
+		return false
+	}
+	_, err := base32.StdEncoding.DecodeString(secret)
+	return err == nil
+}
+
+//validate check if the options are supported
+func (o *TOTPOptions) validate() error {
+	if o.SecretLength != 0 && (o.SecretLength < 16 || o.SecretLength%8 != 0) {
+		return errors.New("TOTP secret length must be a multiple of 8 and at least 16")
+	}
+	if o.RotationOverlap < 0 {
+		return errors.New("TOTP rotation overlap is negative")
+	}
+	return o.parameters().validate()
+}
+
+//parameters return the TOTP parameters of the secrets issued with these options
+func (o *TOTPOptions) parameters() TOTPParameters {
+	return TOTPParameters{
+		Digits:    o.Digits,
+		Period:    o.Period,
+		Algorithm: o.Algorithm,
+	}.normalize()
+}
+
+//getTOTPOptions return the TOTP options of this router
+func (s *ServiceRouter) getTOTPOptions() *TOTPOptions {
+	if s.Options == nil {
+		return &TOTPOptions{}
+	}
+	return &s.Options.TOTP
+}
+
+//getRotationInterval return the seconds between rotations of the received secrets, 0 if disabled
+func (s *ServiceRouter) getRotationInterval() int64 {
+	interval := s.getTOTPOptions().RotationInterval
+	if interval < 0 {
+		return 0
+	}
+	if interval == 0 {
+		return defaultRotationInterval
+	}
+	return interval
+}
+
+//getRotationOverlap return the seconds the previous secret is accepted after rotation
+func (s *ServiceRouter) getRotationOverlap() int64 {
+	overlap := s.getTOTPOptions().RotationOverlap
+	if overlap <= 0 {
+		return defaultRotationOverlap
+	}
+	return overlap
+}
+
+/*
+	newTOTPSecret
+
+	Generate a random base32 secret with the length set in the options. The
+	characters are picked with crypto/rand, 256 is a multiple of the 32
+	characters so every character is equally likely
+*/
+func (s *ServiceRouter) newTOTPSecret() (string, error) {
+	length := s.getTOTPOptions().SecretLength
+	if length <= 0 {
+		length = defaultTOTPSecretLength
+	}
+
+	const base32Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	randomBytes := make([]byte, length)
+	if _, err := io.ReadFull(rand.Reader, randomBytes); err != nil {
+		return "", err
+	}
+	secret := make([]byte, length)
+	for i, b := range randomBytes {
+		secret[i] = base32Alphabet[int(b)%len(base32Alphabet)]
+	}
+	return string(secret), nil
+}
+
+func newTOTP(secret string, parameters TOTPParameters) *gotp.TOTP {
+	parameters = parameters.normalize()
+	return gotp.NewTOTP(secret, parameters.Digits, parameters.Period, getTOTPHasher(parameters.Algorithm))
+}
+
+//generateTOTP generate the TOTP token of the given secret at current time
+func (s *ServiceRouter) generateTOTP(secret string, parameters TOTPParameters) string {
+	return newTOTP(secret, parameters).At(int(s.now().Unix()))
+}
+
+//verifyTOTP check if the token is valid for the given secret at current time
+func (s *ServiceRouter) verifyTOTP(secret string, parameters TOTPParameters, token string) bool {
+	return newTOTP(secret, parameters).Verify(token, int(s.now().Unix()))
+}
+
+/*
+	verifyNodeTOTP
+
+	Check the token sent by the node with given UUID. The previous secret of
+	the node is still accepted within the overlap window after rotation.
+	Return the secret that matches the token, empty string if none matches
+*/
+func (s *ServiceRouter) verifyNodeTOTP(nodeUUID string, token string) string {
+	s.mux.RLock()
+	position := s.totpMapExists(nodeUUID)
+	if position < 0 {
+		s.mux.RUnlock()
+		return ""
+	}
+	record := *s.TOTPMap[position]
+	s.mux.RUnlock()
+
+	if s.verifyTOTP(record.RecvTOTPSecret, record.Parameters, token) {
+		return record.RecvTOTPSecret
+	}
+	if record.PreviousTOTPSecret != "" && s.now().Unix() < record.PreviousSecretExpire &&
+		s.verifyTOTP(record.PreviousTOTPSecret, record.PreviousParameters, token) {
+		return record.PreviousTOTPSecret
+	}
+	return ""
+}
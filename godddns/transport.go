@@ -0,0 +1,212 @@
+package godddns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/*
+	Transport.go
+
+	This script define the transport layer that deliver the handshake,
+	heartbeat and sync packets to other nodes. The protocol logic (TOTP,
+	reflection and voting) stays in the router, the transport only moves
+	the encoded packets and the reply of the remote node.
+*/
+
+//Endpoint describe where a remote node can be reached
+type Endpoint struct {
+	NodeUUID         string //The UUID of the remote node
+	Host             string //The IP address (or hostname) of the remote node
+	Port             int    //The port for connection
+	RESTfulInterface string //The RESTFUL request interface
+	RequireHTTPS     bool   //The connection to the node must pass through HTTPS
+}
+
+//TransportResponse is the reply from the remote node
+type TransportResponse struct {
+	StatusCode int    //The status code of the reply, follows the HTTP status code definition
+	Body       []byte //The body of the reply
+}
+
+//Transport deliver the encoded protocol packets to the remote node
+type Transport interface {
+	//Connect send the handshake credential to the remote node (opr=c)
+	Connect(endpoint *Endpoint, payload []byte) (*TransportResponse, error)
+
+	//HeartBeat send the heartbeat packet to the remote node (opr=h)
+	HeartBeat(endpoint *Endpoint, payload []byte) (*TransportResponse, error)
+
+	//Sync ask the remote node for the address of a lost node (opr=s)
+	Sync(endpoint *Endpoint, payload []byte) (*TransportResponse, error)
+}
+
+//OperationTransport is implemented by transports that can deliver any operation type, e.g. the challenge-response join (opr=cs and opr=cf)
+type OperationTransport interface {
+	Send(endpoint *Endpoint, opr string, payload []byte) (*TransportResponse, error)
+}
+
+//URL return the request URL of the given operation type on this endpoint
+func (e *Endpoint) URL(opr string) string {
+	return buildNodeEndpoint(e.Host, e.Port, e.RESTfulInterface, e.RequireHTTPS, opr)
+}
+
+/*
+	HTTP Transport
+
+	The default transport of the service router. Packets are POST to the
+	RESTful interface of the remote node and handled by HandleConnections
+*/
+
+type HTTPTransport struct {
+	Client  *http.Client  //The client for sending requests, use http.DefaultClient if nil
+	Timeout time.Duration //Timeout for every request, default 5 seconds
+}
+
+var defaultTransport Transport = &HTTPTransport{}
+
+func (t *HTTPTransport) Connect(endpoint *Endpoint, payload []byte) (*TransportResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.getTimeout())
+	defer cancel()
+	return t.post(ctx, endpoint.URL("c"), payload)
+}
+
+func (t *HTTPTransport) HeartBeat(endpoint *Endpoint, payload []byte) (*TransportResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.getTimeout())
+	defer cancel()
+	return t.post(ctx, endpoint.URL("h"), payload)
+}
+
+func (t *HTTPTransport) Sync(endpoint *Endpoint, payload []byte) (*TransportResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.getTimeout())
+	defer cancel()
+	return t.post(ctx, endpoint.URL("s"), payload)
+}
+
+func (t *HTTPTransport) Send(endpoint *Endpoint, opr string, payload []byte) (*TransportResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.getTimeout())
+	defer cancel()
+	return t.post(ctx, endpoint.URL(opr), payload)
+}
+
+func (t *HTTPTransport) getTimeout() time.Duration {
+	if t.Timeout <= 0 {
+		return 5 * time.Second
+	}
+	return t.Timeout
+}
+
+func (t *HTTPTransport) post(ctx context.Context, reqEndpoint string, payload []byte) (*TransportResponse, error) {
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqEndpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransportResponse{
+		StatusCode: resp.StatusCode,
+		Body:       body,
+	}, nil
+}
+
+/*
+	HandlePacket
+
+	Handle a packet received by a non-HTTP transport (e.g. UDP or in-memory transport)
+	opr is the operation type (e.g. c, h or s) and remoteAddr is the source address of the
+	packet in ip:port format, which will be reflected to the sender
+*/
+func (s *ServiceRouter) HandlePacket(opr string, remoteAddr string, payload []byte) *TransportResponse {
+	r, err := http.NewRequest(http.MethodPost, "/?opr="+url.QueryEscape(opr), bytes.NewReader(payload))
+	if err != nil {
+		return &TransportResponse{
+			StatusCode: http.StatusBadRequest,
+			Body:       []byte(err.Error()),
+		}
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = remoteAddr
+
+	w := newPacketResponseWriter()
+	s.HandleConnections(w, r)
+	return &TransportResponse{
+		StatusCode: w.statusCode,
+		Body:       w.body.Bytes(),
+	}
+}
+
+//packetResponseWriter collect the reply of HandleConnections for HandlePacket
+type packetResponseWriter struct {
+	header     http.Header
+	body       *bytes.Buffer
+	statusCode int
+}
+
+func newPacketResponseWriter() *packetResponseWriter {
+	return &packetResponseWriter{
+		header:     http.Header{},
+		body:       bytes.NewBuffer([]byte{}),
+		statusCode: http.StatusOK,
+	}
+}
+
+func (w *packetResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *packetResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *packetResponseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+}
+
+//getTransport return the transport of this router, fallback to HTTP transport if not set
+func (s *ServiceRouter) getTransport() Transport {
+	if s.Options != nil && s.Options.Transport != nil {
+		return s.Options.Transport
+	}
+	return defaultTransport
+}
+
+//sendOperation deliver the packet of the given operation type, fail if the transport does not implement OperationTransport
+func (s *ServiceRouter) sendOperation(endpoint *Endpoint, opr string, payload []byte) (*TransportResponse, error) {
+	transport, ok := s.getTransport().(OperationTransport)
+	if !ok {
+		return nil, errors.New("transport does not support operation " + opr)
+	}
+	return transport.Send(endpoint, opr, payload)
+}
+
+//getEndpoint return the endpoint of this node at the given host
+func (n *Node) getEndpoint(host string) *Endpoint {
+	return &Endpoint{
+		NodeUUID:         n.UUID,
+		Host:             trimIpPort(host),
+		Port:             n.Port,
+		RESTfulInterface: n.RESTfulInterface,
+		RequireHTTPS:     n.RequireHTTPS,
+	}
+}
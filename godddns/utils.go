@@ -2,6 +2,8 @@ package godddns
 
 import (
 	"net"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -26,6 +28,18 @@ var privateIPNetworks = []net.IPNet{
 		IP:   net.ParseIP("127.0.0.0"),
 		Mask: net.CIDRMask(8, 32),
 	},
+	{
+		IP:   net.ParseIP("fc00::"), //IPv6 unique local address
+		Mask: net.CIDRMask(7, 128),
+	},
+	{
+		IP:   net.ParseIP("fe80::"), //IPv6 link local address
+		Mask: net.CIDRMask(10, 128),
+	},
+	{
+		IP:   net.ParseIP("::1"), //IPv6 loopback
+		Mask: net.CIDRMask(128, 128),
+	},
 }
 
 func isPrivateIpString(ipaddr string) bool {
@@ -49,21 +63,67 @@ func IsPrivateIP(ip net.IP) bool {
 
 /*
 	Trim the port number from returned net.IP
+
+	Accept both IPv4 (1.2.3.4:80) and IPv6 ([2001:db8::1]:80) host port pairs.
+	If the address can be parsed as an IP, the canonical form is returned
+	(e.g. IPv4-mapped IPv6 addresses are returned as IPv4)
 */
 
 func trimIpPort(ipWithPort string) string {
-	if strings.Contains(ipWithPort, ":") {
-		//from LAN or testing environment which contains the port after the reflected IP addr, trim that part
-		tmp := strings.Split(ipWithPort, ":")
-		result := tmp[0]
-		return result
+	ipWithPort = strings.TrimSpace(ipWithPort)
+	host, _, err := net.SplitHostPort(ipWithPort)
+	if err != nil {
+		//No port attached (e.g. 1.2.3.4, 2001:db8::1 or [2001:db8::1])
+		host = strings.TrimSuffix(strings.TrimPrefix(ipWithPort, "["), "]")
+	}
+
+	//Remove the IPv6 zone if any, it is only meaningful to the local host
+	if zoneIndex := strings.LastIndex(host, "%"); zoneIndex >= 0 {
+		host = host[:zoneIndex]
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	return ip.String()
+}
+
+//isIPv4 check if the given ip is an IPv4 address (including IPv4-mapped IPv6 addresses)
+func isIPv4(ip net.IP) bool {
+	return ip != nil && ip.To4() != nil
+}
+
+/*
+	Build the request endpoint of a remote node
+
+	IPv6 addresses are wrapped with square brackets so the port can be appended
+*/
+func buildNodeEndpoint(host string, port int, restInterface string, requireHTTPS bool, opr string) string {
+	host = trimIpPort(host)
+	reqEndpoint := net.JoinHostPort(host, strconv.Itoa(port)) + "/" + restInterface + "?opr=" + opr
+	reqEndpoint = filepath.ToSlash(filepath.Clean(reqEndpoint))
+
+	//Append protocol type
+	if requireHTTPS {
+		reqEndpoint = "https://" + reqEndpoint
 	} else {
-		return ipWithPort
+		reqEndpoint = "http://" + reqEndpoint
 	}
+	return reqEndpoint
+}
+
+//getSyncInterval return the heartbeat interval in seconds, default 10 seconds if not set
+func (s *ServiceRouter) getSyncInterval() int64 {
+	if s.Options.SyncInterval <= 0 {
+		return 10
+	}
+	return s.Options.SyncInterval
 }
 
 /*
 	Check if the given TOTP map exists in the router (aka already conenncted)
+	The caller must hold the router lock
 */
 func (s *ServiceRouter) totpMapExists(nodeUUID string) int {
 	for i := 0; i < len(s.TOTPMap); i++ {
@@ -75,8 +135,34 @@ func (s *ServiceRouter) totpMapExists(nodeUUID string) int {
 	return -1
 }
 
+//getTotpSecret return the TOTP secret assigned to the given remote node, return empty string if not found
+func (s *ServiceRouter) getTotpSecret(nodeUUID string) string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	targetTotpSecret := ""
+	for _, thisTOTPRecord := range s.TOTPMap {
+		if thisTOTPRecord.RemoteUUID == nodeUUID {
+			targetTotpSecret = thisTOTPRecord.RecvTOTPSecret
+		}
+	}
+	return targetTotpSecret
+}
+
+//nodeRegistered check if the node with given UUID is in the node map. The caller must hold the router lock
+func (s *ServiceRouter) nodeRegistered(nodeUUID string) bool {
+	nodeUUID = strings.TrimSpace(nodeUUID)
+	for _, node := range s.NodeMap {
+		if strings.TrimSpace(node.UUID) == nodeUUID {
+			return true
+		}
+	}
+	return false
+}
+
 //getNodebyUUID return the node that with the given uuid, return nil if not found
 func (s *ServiceRouter) getNodeByUUID(uuid string) *Node {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
 	for _, node := range s.NodeMap {
 		if node.UUID == uuid {
 			return node
@@ -85,3 +171,21 @@ func (s *ServiceRouter) getNodeByUUID(uuid string) *Node {
 
 	return nil
 }
+
+//getNodes return a copy of the node map that can be iterated without holding the router lock
+func (s *ServiceRouter) getNodes() []*Node {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	nodes := make([]*Node, len(s.NodeMap))
+	copy(nodes, s.NodeMap)
+	return nodes
+}
+
+//setOrphanMode update the orphan mode state of this router, return true if the state changed
+func (s *ServiceRouter) setOrphanMode(orphan bool) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	changed := s.orphanMode != orphan
+	s.orphanMode = orphan
+	return changed
+}
@@ -0,0 +1,108 @@
+package godddns
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTrimIpPort(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1.2.3.4:80", "1.2.3.4"},
+		{"1.2.3.4", "1.2.3.4"},
+		{" 1.2.3.4:80 ", "1.2.3.4"},
+		{"[2001:db8::1]:80", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"2001:0db8:0000::0001", "2001:db8::1"},
+		{"[fe80::1%eth0]:80", "fe80::1"},
+		{"fe80::1%eth0", "fe80::1"},
+		{"[::ffff:1.2.3.4]:80", "1.2.3.4"},
+		{"example.com:80", "example.com"},
+	}
+	for _, test := range tests {
+		if result := trimIpPort(test.input); result != test.expected {
+			t.Errorf("trimIpPort(%q) = %q, expected %q", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestBuildNodeEndpoint(t *testing.T) {
+	if endpoint := buildNodeEndpoint("2001:db8::1", 8080, "/godddns", false, "h"); endpoint != "http://[2001:db8::1]:8080/godddns?opr=h" {
+		t.Errorf("unexpected IPv6 endpoint %s", endpoint)
+	}
+	if endpoint := buildNodeEndpoint("1.2.3.4", 443, "/godddns", true, "c"); endpoint != "https://1.2.3.4:443/godddns?opr=c" {
+		t.Errorf("unexpected IPv4 endpoint %s", endpoint)
+	}
+}
+
+//newVotingRouter create a router with one node for each given reflection
+func newVotingRouter(reflections ...[2]string) *ServiceRouter {
+	router := NewServiceRouter(RouterOptions{DeviceUUID: "voter"})
+	for i, reflection := range reflections {
+		node := router.NewNode(NodeOptions{NodeID: "node" + string(rune('a'+i)), Port: 8080})
+		node.ReflectedIP = reflection[0]
+		node.ReflectedPrivateIP = reflection[1]
+		router.AddNode(node)
+	}
+	return router
+}
+
+func TestVoteRouterIPAddrByFamily(t *testing.T) {
+	router := newVotingRouter(
+		[2]string{"203.0.113.1", ""},
+		[2]string{"203.0.113.1", ""},
+		[2]string{"203.0.113.2", ""},
+		[2]string{"2001:db8::1", ""},
+		[2]string{"2001:db8::2", ""},
+		[2]string{"2001:db8::2", ""},
+	)
+	ipv4, ipv6 := router.VoteRouterIPAddrByFamily()
+	if !ipv4.Equal(net.ParseIP("203.0.113.1")) {
+		t.Errorf("voted IPv4 %s, expected 203.0.113.1", ipv4)
+	}
+	if !ipv6.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("voted IPv6 %s, expected 2001:db8::2", ipv6)
+	}
+
+	//IPv4 is preferred as the address of the router, even with fewer votes
+	public, _ := router.VoteRouterIPAddr()
+	if !public.Equal(net.ParseIP("203.0.113.1")) {
+		t.Errorf("voted public address %s, expected 203.0.113.1", public)
+	}
+}
+
+func TestVoteRouterIPAddrPrivateFallback(t *testing.T) {
+	//Nodes on the same LAN reflect private addresses only
+	router := newVotingRouter(
+		[2]string{"192.168.1.10", "192.168.1.10"},
+		[2]string{"fd00::10", "fd00::10"},
+	)
+	ipv4, ipv6 := router.VoteRouterIPAddrByFamily()
+	if !ipv4.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("voted IPv4 %s, expected 192.168.1.10", ipv4)
+	}
+	if !ipv6.Equal(net.ParseIP("fd00::10")) {
+		t.Errorf("voted IPv6 %s, expected fd00::10", ipv6)
+	}
+
+	//A family no node has reflected is not voted
+	router = newVotingRouter([2]string{"203.0.113.1", ""})
+	if _, ipv6 := router.VoteRouterIPAddrByFamily(); ipv6 != nil {
+		t.Errorf("voted IPv6 %s without reflection", ipv6)
+	}
+}
+
+func TestVoteTieIsDeterministic(t *testing.T) {
+	router := newVotingRouter(
+		[2]string{"203.0.113.2", ""},
+		[2]string{"203.0.113.1", ""},
+	)
+	for i := 0; i < 10; i++ {
+		if ipv4, _ := router.VoteRouterIPAddrByFamily(); !ipv4.Equal(net.ParseIP("203.0.113.1")) {
+			t.Fatalf("tie broken to %s, expected the smaller 203.0.113.1", ipv4)
+		}
+	}
+}
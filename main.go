@@ -43,6 +43,16 @@ func ValidateCred(username string, password string) bool {
 	}
 }
 
+//Demo verifier of the user account for the challenge-response join
+var demoCredential, _ = godddns.NewScramCredential("123456")
+
+func GetScramCredential(username string) *godddns.ScramCredential {
+	if username == "user" {
+		return demoCredential
+	}
+	return nil
+}
+
 func main() {
 	//Create three mux for the demo server handler
 	serverHandler := http.NewServeMux()
@@ -60,23 +70,26 @@ func main() {
 	*/
 	//Create the static router
 	staticRouter = godddns.NewServiceRouter(godddns.RouterOptions{
-		DeviceUUID:   "static",
-		AuthFunction: ValidateCred,
-		SyncInterval: syncInterval,
+		DeviceUUID:              "static",
+		AuthFunction:            ValidateCred,
+		ScramCredentialFunction: GetScramCredential,
+		SyncInterval:            syncInterval,
 	})
 
 	//Create the testing server router
 	serverRouter = godddns.NewServiceRouter(godddns.RouterOptions{
-		DeviceUUID:   "server",
-		AuthFunction: ValidateCred,
-		SyncInterval: syncInterval,
+		DeviceUUID:              "server",
+		AuthFunction:            ValidateCred,
+		ScramCredentialFunction: GetScramCredential,
+		SyncInterval:            syncInterval,
 	})
 
 	//Create the client router
 	clientRouter = godddns.NewServiceRouter(godddns.RouterOptions{
-		DeviceUUID:   "client",
-		AuthFunction: ValidateCred,
-		SyncInterval: syncInterval,
+		DeviceUUID:              "client",
+		AuthFunction:            ValidateCred,
+		ScramCredentialFunction: GetScramCredential,
+		SyncInterval:            syncInterval,
 	})
 
 	/*
@@ -185,68 +198,68 @@ func main() {
 
 	//Client to Server
 	if c2sNode != nil {
-		clientToServer, err := c2sNode.StartConnection("127.0.0.1", "user", "123456")
+		_, err := c2sNode.StartConnection("127.0.0.1", "user", "123456")
 		if err != nil {
-			log.Println("Unable to get TOTP from serverRouter", clientToServer)
+			log.Println("Unable to get TOTP from serverRouter")
 			log.Fatal(err)
 		}
-		log.Println("Client -> Server TOTP exchange done:", clientToServer)
+		log.Println("Client -> Server TOTP exchange done")
 	}
 
 	time.Sleep(300 * time.Millisecond)
 
 	//Client to static
 	if c2staticNode != nil {
-		totp, err := c2staticNode.StartConnection("127.0.0.1", "user", "123456")
+		_, err := c2staticNode.StartConnection("127.0.0.1", "user", "123456")
 		if err != nil {
-			log.Println("Unable to get TOTP from static server", totp)
+			log.Println("Unable to get TOTP from static server")
 			log.Fatal(err)
 		}
-		log.Println("Client -> Static TOTP exchange done:", totp)
+		log.Println("Client -> Static TOTP exchange done")
 	}
 	time.Sleep(300 * time.Millisecond)
 
 	//Server to Client
 	if s2cNode != nil {
-		serverToClient, err := s2cNode.StartConnection("127.0.0.1", "user", "123456")
+		_, err := s2cNode.StartConnection("127.0.0.1", "user", "123456")
 		if err != nil {
-			log.Println("Unable to get TOTP from clientRouter", serverToClient)
+			log.Println("Unable to get TOTP from clientRouter")
 			log.Fatal(err)
 		}
-		log.Println("Server -> Client TOTP exchange done:", serverToClient)
+		log.Println("Server -> Client TOTP exchange done")
 	}
 	time.Sleep(300 * time.Millisecond)
 
 	//Server to Static Server
 	if s2staticNode != nil {
-		totp, err := s2staticNode.StartConnection("127.0.0.1", "user", "123456")
+		_, err := s2staticNode.StartConnection("127.0.0.1", "user", "123456")
 		if err != nil {
-			log.Println("Unable to get TOTP from static", totp)
+			log.Println("Unable to get TOTP from static")
 			log.Fatal(err)
 		}
-		log.Println("Server -> Static TOTP exchange done:", totp)
+		log.Println("Server -> Static TOTP exchange done")
 	}
 	time.Sleep(300 * time.Millisecond)
 
 	//Static to Client
 	if static2cNode != nil {
-		totp, err := static2cNode.StartConnection("127.0.0.1", "user", "123456")
+		_, err := static2cNode.StartConnection("127.0.0.1", "user", "123456")
 		if err != nil {
-			log.Println("Unable to get TOTP from client", totp)
+			log.Println("Unable to get TOTP from client")
 			log.Fatal(err)
 		}
-		log.Println("Static -> Client TOTP exchange done:", totp)
+		log.Println("Static -> Client TOTP exchange done")
 	}
 	time.Sleep(300 * time.Millisecond)
 
 	//Static to Server
 	if static2sNode != nil {
-		totp, err := static2sNode.StartConnection("127.0.0.1", "user", "123456")
+		_, err := static2sNode.StartConnection("127.0.0.1", "user", "123456")
 		if err != nil {
-			log.Println("Unable to get TOTP from server", totp)
+			log.Println("Unable to get TOTP from server")
 			log.Fatal(err)
 		}
-		log.Println("Static -> Server TOTP exchange done:", totp)
+		log.Println("Static -> Server TOTP exchange done")
 	}
 	time.Sleep(300 * time.Millisecond)
 
@@ -271,11 +284,11 @@ func main() {
 	//Show the client and server IP address after 2 heart beat cycles
 	go func() {
 		time.Sleep(11 * time.Second)
-		fmt.Println("Client IP Address is: ", clientRouter.DeviceIpAddr.String())
+		fmt.Println("Client IP Address is: ", clientRouter.GetDeviceIpAddr().String())
 		fmt.Println("Client's nearby nodes are: ", clientRouter.GetNeighbourNodes())
-		fmt.Println("Server IP Address is: ", serverRouter.DeviceIpAddr.String())
+		fmt.Println("Server IP Address is: ", serverRouter.GetDeviceIpAddr().String())
 		fmt.Println("Server's nearby nodes are: ", serverRouter.GetNeighbourNodes())
-		fmt.Println("Static IP Address is: ", staticRouter.DeviceIpAddr.String())
+		fmt.Println("Static IP Address is: ", staticRouter.GetDeviceIpAddr().String())
 		fmt.Println("Static's nearby nodes are: ", staticRouter.GetNeighbourNodes())
 		//Disable the client http listener
 		enableClientHTTP = false
@@ -0,0 +1,116 @@
+package simulator
+
+import (
+	"sync"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+)
+
+/*
+	Clock.go
+
+	The fake clock of the simulated network. Time only moves forward
+	when the simulation advances it, so a scenario of many heartbeat
+	cycles can be executed in milliseconds.
+
+	Clock implements godddns.Clock and is shared by all simulated routers,
+	so TOTP and last online bookkeeping follow the simulated time. Tickers
+	created from this clock fire when the clock is advanced past their
+	next tick, which allow StartHeartBeat to be used with the fake clock
+*/
+
+type Clock struct {
+	now     time.Time
+	tickers []*fakeTicker
+	mux     sync.RWMutex
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	interval time.Duration
+	next     time.Time
+	stopped  bool
+	clock    *Clock
+}
+
+//NewClock create a fake clock starting at the given time
+func NewClock(start time.Time) *Clock {
+	return &Clock{
+		now:     start,
+		tickers: []*fakeTicker{},
+	}
+}
+
+//Now return the current time of the fake clock
+func (c *Clock) Now() time.Time {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.now
+}
+
+//NewTicker create a ticker that fire every d of simulated time
+func (c *Clock) NewTicker(d time.Duration) godddns.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	ticker := &fakeTicker{
+		c:        make(chan time.Time, 1),
+		interval: d,
+		next:     c.now.Add(d),
+		clock:    c,
+	}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+//Set move the clock to the given time. The clock never moves backward
+func (c *Clock) Set(t time.Time) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !t.After(c.now) {
+		return
+	}
+	c.now = t
+
+	//Fire all the tickers that are due. Like time.Ticker, ticks are dropped if the receiver is slow
+	for _, ticker := range c.tickers {
+		for !ticker.next.After(t) {
+			select {
+			case ticker.c <- ticker.next:
+			default:
+			}
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+	}
+}
+
+//Advance move the clock forward by the given duration
+func (c *Clock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+func (t *fakeTicker) Chan() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mux.Lock()
+	defer t.clock.mux.Unlock()
+	if t.stopped {
+		return
+	}
+	t.stopped = true
+
+	//Remove this ticker from the clock
+	remainingTickers := []*fakeTicker{}
+	for _, ticker := range t.clock.tickers {
+		if ticker != t {
+			remainingTickers = append(remainingTickers, ticker)
+		}
+	}
+	t.clock.tickers = remainingTickers
+}
@@ -0,0 +1,441 @@
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+)
+
+/*
+	go-DDDNS Cluster Simulator
+
+	This package spins up multiple service routers on a virtual network
+	so the heartbeat and sync recovery paths can be tested without real
+	sockets or waiting for real heartbeat intervals.
+
+	A typical scenario looks like this
+
+	network := simulator.NewNetwork(simulator.Options{Seed: 1})
+	network.AddNode("a", "203.0.113.1")
+	network.AddNode("b", "203.0.113.2")
+	network.AddNode("c", "203.0.113.3")
+	network.ConnectAll()
+
+	network.SetIP("a", "203.0.113.101")
+	network.RunCycles(5)
+	err := network.CheckConvergence()
+*/
+
+//Options of the simulated network
+type Options struct {
+	SyncInterval int64     //Heartbeat interval of the simulated routers in seconds, default 10
+	Seed         int64     //Seed for the packet dropping random generator
+	StartTime    time.Time //The start time of the fake clock, default to current time
+	Username     string    //Username for handshake between simulated routers, default "user"
+	Password     string    //Password for handshake between simulated routers, default "password"
+}
+
+//SimNode is a service router attached to the simulated network
+type SimNode struct {
+	UUID   string                 //The UUID of the simulated router
+	Port   int                    //The port this router listen to on the virtual network
+	Router *godddns.ServiceRouter //The service router under simulation
+
+	ip       net.IP    //The source address of this node as seen by the network
+	online   bool      //If this node can send and receive packets
+	nextBeat time.Time //The next time this node execute a heartbeat cycle
+}
+
+//Stats is the packet statistic of the simulated network
+type Stats struct {
+	Delivered int64 //Number of packets delivered to the target router
+	Dropped   int64 //Number of packets dropped randomly
+	Failed    int64 //Number of packets failed due to offline, unreachable or partitioned nodes
+}
+
+type Network struct {
+	Clock *Clock //The fake clock of this network
+
+	options       Options
+	credential    *godddns.ScramCredential //The verifier of the handshake password
+	nodes         map[string]*SimNode
+	order         []string //The UUID of nodes in the order they are added
+	partitions    map[string]bool
+	dropRate      float64
+	rand          *rand.Rand
+	ephemeralPort int
+	stats         Stats
+	mux           sync.Mutex
+}
+
+//NewNetwork create a new simulated network
+func NewNetwork(options Options) *Network {
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = 10
+	}
+	if options.StartTime.IsZero() {
+		options.StartTime = time.Now()
+	}
+	if options.Username == "" {
+		options.Username = "user"
+	}
+	if options.Password == "" {
+		options.Password = "password"
+	}
+
+	//Handshakes between simulated routers use the challenge-response join
+	credential, _ := godddns.NewScramCredential(options.Password)
+
+	return &Network{
+		Clock:         NewClock(options.StartTime),
+		options:       options,
+		credential:    credential,
+		nodes:         map[string]*SimNode{},
+		order:         []string{},
+		partitions:    map[string]bool{},
+		dropRate:      0,
+		rand:          rand.New(rand.NewSource(options.Seed)),
+		ephemeralPort: 49152,
+	}
+}
+
+//AddNode create a new service router with given UUID and source address on the network
+func (n *Network) AddNode(uuid string, ipAddr string) (*SimNode, error) {
+	return n.AddNodeWithOptions(uuid, ipAddr, nil)
+}
+
+/*
+	AddNodeWithOptions
+
+	Create a new service router like AddNode, with its options changed by the
+	configure function before the router is created. The network sets the UUID,
+	credentials, sync interval, clock and transport, which can be overridden
+	to simulate routers with different settings
+*/
+func (n *Network) AddNodeWithOptions(uuid string, ipAddr string, configure func(options *godddns.RouterOptions)) (*SimNode, error) {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return nil, errors.New("invalid ip address: " + ipAddr)
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if _, ok := n.nodes[uuid]; ok {
+		return nil, errors.New("node already exists: " + uuid)
+	}
+
+	options := godddns.RouterOptions{
+		DeviceUUID:              uuid,
+		AuthFunction:            n.validateCred,
+		ScramCredentialFunction: n.scramCredential,
+		SyncInterval:            n.options.SyncInterval,
+		Clock:                   n.Clock,
+		Transport: &networkTransport{
+			network:  n,
+			fromUUID: uuid,
+		},
+	}
+	if configure != nil {
+		configure(&options)
+	}
+	router := godddns.NewServiceRouter(options)
+
+	thisNode := &SimNode{
+		UUID:     uuid,
+		Port:     8000 + len(n.order),
+		Router:   router,
+		ip:       ip,
+		online:   true,
+		nextBeat: n.Clock.Now(),
+	}
+	n.nodes[uuid] = thisNode
+	n.order = append(n.order, uuid)
+	return thisNode, nil
+}
+
+//GetNode return the simulated node with given UUID
+func (n *Network) GetNode(uuid string) (*SimNode, error) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	thisNode, ok := n.nodes[uuid]
+	if !ok {
+		return nil, errors.New("node not found: " + uuid)
+	}
+	return thisNode, nil
+}
+
+//Connect register the "to" node on the "from" router and perform the handshake
+func (n *Network) Connect(fromUUID string, toUUID string) error {
+	from, err := n.GetNode(fromUUID)
+	if err != nil {
+		return err
+	}
+	to, err := n.GetNode(toUUID)
+	if err != nil {
+		return err
+	}
+
+	remoteNode, err := from.Router.GetNodeByUUID(toUUID)
+	if err != nil {
+		remoteNode = from.Router.NewNode(godddns.NodeOptions{
+			NodeID:        toUUID,
+			Port:          to.Port,
+			RESTInterface: "/godddns",
+			RequireHTTPS:  false,
+		})
+		err = from.Router.AddNode(remoteNode)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = remoteNode.StartConnection(n.GetIP(toUUID).String(), n.options.Username, n.options.Password)
+	if err != nil {
+		return fmt.Errorf("unable to connect %s to %s: %w", fromUUID, toUUID, err)
+	}
+	return nil
+}
+
+//ConnectAll connect every pair of nodes on the network (full mesh)
+func (n *Network) ConnectAll() error {
+	for _, from := range n.getOrder() {
+		for _, to := range n.getOrder() {
+			if from == to {
+				continue
+			}
+			err := n.Connect(from, to)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//SetIP change the source address of the node, e.g. to simulate a DHCP lease change
+func (n *Network) SetIP(uuid string, ipAddr string) error {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return errors.New("invalid ip address: " + ipAddr)
+	}
+
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	thisNode, ok := n.nodes[uuid]
+	if !ok {
+		return errors.New("node not found: " + uuid)
+	}
+	thisNode.ip = ip
+	return nil
+}
+
+//GetIP return the current source address of the node, nil if not found
+func (n *Network) GetIP(uuid string) net.IP {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	thisNode, ok := n.nodes[uuid]
+	if !ok {
+		return nil
+	}
+	return thisNode.ip
+}
+
+//SetOnline bring the node up or down. An offline node cannot send nor receive packets
+func (n *Network) SetOnline(uuid string, online bool) error {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	thisNode, ok := n.nodes[uuid]
+	if !ok {
+		return errors.New("node not found: " + uuid)
+	}
+	thisNode.online = online
+	return nil
+}
+
+//Partition block all packets between the two nodes in both directions
+func (n *Network) Partition(uuidA string, uuidB string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.partitions[newLinkKey(uuidA, uuidB)] = true
+}
+
+//Heal restore the link between the two nodes
+func (n *Network) Heal(uuidA string, uuidB string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	delete(n.partitions, newLinkKey(uuidA, uuidB))
+}
+
+//HealAll restore all partitioned links
+func (n *Network) HealAll() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.partitions = map[string]bool{}
+}
+
+//SetDropRate set the probability (0 - 1) that a packet is dropped by the network
+func (n *Network) SetDropRate(rate float64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.dropRate = rate
+}
+
+//Stats return the packet statistic of the network
+func (n *Network) Stats() Stats {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.stats
+}
+
+/*
+	Advance
+
+	Move the fake clock forward by the given duration and execute the heartbeat
+	cycles of every online router that are scheduled within that period.
+	Cycles are executed one at a time in the order of their scheduled time,
+	nodes scheduled at the same time run in the order they are added
+*/
+func (n *Network) Advance(d time.Duration) {
+	deadline := n.Clock.Now().Add(d)
+	interval := time.Duration(n.options.SyncInterval) * time.Second
+	for {
+		nextNode := n.nextScheduledNode(deadline)
+		if nextNode == nil {
+			break
+		}
+
+		n.Clock.Set(nextNode.nextBeat)
+		n.mux.Lock()
+		online := nextNode.online
+		nextNode.nextBeat = nextNode.nextBeat.Add(interval)
+		n.mux.Unlock()
+
+		if online {
+			nextNode.Router.ExecuteHeartBeatCycle()
+		}
+	}
+	n.Clock.Set(deadline)
+}
+
+//RunCycles advance the network by the given number of heartbeat intervals
+func (n *Network) RunCycles(cycles int) {
+	n.Advance(time.Duration(int64(cycles)*n.options.SyncInterval) * time.Second)
+}
+
+/*
+	CheckConvergence
+
+	Check if every online router knows the current address of every online
+	node it registered, and if every online router has voted its own address
+	correctly. Return an error describing all the mismatches if not converged
+*/
+func (n *Network) CheckConvergence() error {
+	mismatches := []string{}
+	for _, uuid := range n.getOrder() {
+		thisNode, _ := n.GetNode(uuid)
+		if !n.isOnline(uuid) {
+			continue
+		}
+
+		for _, remoteUUID := range thisNode.Router.GetNeighbourNodes() {
+			if !n.isOnline(remoteUUID) {
+				continue
+			}
+			expectedIP := n.GetIP(remoteUUID)
+			knownIP := thisNode.Router.GetNodeIP(remoteUUID)
+			if !expectedIP.Equal(knownIP) {
+				mismatches = append(mismatches, fmt.Sprintf("%s sees %s at %s, expected %s", uuid, remoteUUID, knownIP, expectedIP))
+			}
+		}
+
+		if len(thisNode.Router.GetNeighbourNodes()) > 0 {
+			expectedIP := n.GetIP(uuid)
+			votedIP := thisNode.Router.GetDeviceIpAddr()
+			if !expectedIP.Equal(votedIP) {
+				mismatches = append(mismatches, fmt.Sprintf("%s voted itself at %s, expected %s", uuid, votedIP, expectedIP))
+			}
+		}
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return errors.New("network not converged: " + strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+//RunUntilConverged run heartbeat cycles until the network converged or the max number of cycles is reached.
+//Return the number of cycles executed
+func (n *Network) RunUntilConverged(maxCycles int) (int, error) {
+	var err error
+	for i := 0; i < maxCycles; i++ {
+		n.RunCycles(1)
+		err = n.CheckConvergence()
+		if err == nil {
+			return i + 1, nil
+		}
+	}
+	return maxCycles, err
+}
+
+/*
+	Internal functions
+*/
+
+func (n *Network) validateCred(username string, password string) bool {
+	return username == n.options.Username && password == n.options.Password
+}
+
+func (n *Network) scramCredential(username string) *godddns.ScramCredential {
+	if username != n.options.Username {
+		return nil
+	}
+	return n.credential
+}
+
+func (n *Network) getOrder() []string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	order := make([]string, len(n.order))
+	copy(order, n.order)
+	return order
+}
+
+func (n *Network) isOnline(uuid string) bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	thisNode, ok := n.nodes[uuid]
+	return ok && thisNode.online
+}
+
+//nextScheduledNode return the node with the earliest heartbeat cycle before the deadline, nil if none
+func (n *Network) nextScheduledNode(deadline time.Time) *SimNode {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	var nextNode *SimNode
+	for _, uuid := range n.order {
+		thisNode := n.nodes[uuid]
+		if thisNode.nextBeat.After(deadline) {
+			continue
+		}
+		if nextNode == nil || thisNode.nextBeat.Before(nextNode.nextBeat) {
+			nextNode = thisNode
+		}
+	}
+	return nextNode
+}
+
+//newLinkKey return the key of the link between two nodes regardless of direction
+func newLinkKey(uuidA string, uuidB string) string {
+	if uuidA > uuidB {
+		uuidA, uuidB = uuidB, uuidA
+	}
+	return uuidA + "\x00" + uuidB
+}
@@ -0,0 +1,197 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+)
+
+//newTestNetwork create a full mesh of routers with the given UUIDs on 203.0.113.0/24
+func newTestNetwork(t *testing.T, uuids ...string) *Network {
+	t.Helper()
+	network := NewNetwork(Options{
+		StartTime:    time.Unix(1700000000, 0),
+		SyncInterval: 10,
+		Seed:         1,
+	})
+	for i, uuid := range uuids {
+		_, err := network.AddNode(uuid, "203.0.113."+string(rune('1'+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestConvergence(t *testing.T) {
+	network := newTestNetwork(t, "a", "b", "c", "d")
+	cycles, err := network.RunUntilConverged(5)
+	if err != nil {
+		t.Fatalf("not converged after %d cycles: %v", cycles, err)
+	}
+	if stats := network.Stats(); stats.Dropped != 0 || stats.Failed != 0 {
+		t.Errorf("unexpected lost packets on a healthy network: %+v", stats)
+	}
+}
+
+func TestIPChange(t *testing.T) {
+	network := newTestNetwork(t, "a", "b", "c")
+	if _, err := network.RunUntilConverged(5); err != nil {
+		t.Fatal(err)
+	}
+
+	network.SetIP("a", "203.0.113.101")
+	cycles, err := network.RunUntilConverged(10)
+	if err != nil {
+		t.Fatalf("not converged after %d cycles: %v", cycles, err)
+	}
+	for _, uuid := range []string{"b", "c"} {
+		thisNode, _ := network.GetNode(uuid)
+		if ip := thisNode.Router.GetNodeIP("a"); ip.String() != "203.0.113.101" {
+			t.Errorf("%s sees a at %s, expected 203.0.113.101", uuid, ip)
+		}
+	}
+	nodeA, _ := network.GetNode("a")
+	if ip := nodeA.Router.GetDeviceIpAddr(); ip.String() != "203.0.113.101" {
+		t.Errorf("a voted itself at %s, expected 203.0.113.101", ip)
+	}
+}
+
+func TestOfflineNodeRecovers(t *testing.T) {
+	network := newTestNetwork(t, "a", "b", "c")
+	if _, err := network.RunUntilConverged(5); err != nil {
+		t.Fatal(err)
+	}
+
+	//c misses the address change of a and has to find a through the others
+	network.SetOnline("c", false)
+	network.SetIP("a", "203.0.113.101")
+	if _, err := network.RunUntilConverged(10); err != nil {
+		t.Fatal(err)
+	}
+	network.SetOnline("c", true)
+	cycles, err := network.RunUntilConverged(20)
+	if err != nil {
+		t.Fatalf("not converged after %d cycles: %v", cycles, err)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	network := newTestNetwork(t, "a", "b", "c")
+	if _, err := network.RunUntilConverged(5); err != nil {
+		t.Fatal(err)
+	}
+
+	//b cannot reach a directly, so it learns the new address of a from c
+	network.Partition("a", "b")
+	network.SetIP("a", "203.0.113.101")
+	network.RunCycles(10)
+	nodeB, _ := network.GetNode("b")
+	if ip := nodeB.Router.GetNodeIP("a"); ip.String() != "203.0.113.101" {
+		t.Errorf("b sees a at %s through the partition, expected 203.0.113.101", ip)
+	}
+	if network.Stats().Failed == 0 {
+		t.Error("no packet failed on the partitioned link")
+	}
+
+	network.HealAll()
+	cycles, err := network.RunUntilConverged(20)
+	if err != nil {
+		t.Fatalf("not converged after %d cycles: %v", cycles, err)
+	}
+}
+
+func TestPacketDrop(t *testing.T) {
+	network := newTestNetwork(t, "a", "b", "c", "d")
+	if _, err := network.RunUntilConverged(5); err != nil {
+		t.Fatal(err)
+	}
+
+	network.SetDropRate(0.3)
+	network.SetIP("b", "203.0.113.102")
+	network.RunCycles(20)
+	if network.Stats().Dropped == 0 {
+		t.Fatal("no packet dropped at 30% drop rate")
+	}
+
+	network.SetDropRate(0)
+	cycles, err := network.RunUntilConverged(20)
+	if err != nil {
+		t.Fatalf("not converged after %d cycles: %v", cycles, err)
+	}
+}
+
+func TestPartitionedNodeIsolated(t *testing.T) {
+	network := newTestNetwork(t, "a", "b", "c")
+	if _, err := network.RunUntilConverged(5); err != nil {
+		t.Fatal(err)
+	}
+
+	//A node cut off from everyone keeps its last known view until the links heal
+	network.Partition("a", "b")
+	network.Partition("a", "c")
+	network.SetIP("a", "203.0.113.101")
+	network.RunCycles(10)
+	nodeB, _ := network.GetNode("b")
+	if ip := nodeB.Router.GetNodeIP("a"); ip.String() != "203.0.113.1" {
+		t.Errorf("b sees the isolated a at %s, expected the last known 203.0.113.1", ip)
+	}
+
+	network.HealAll()
+	cycles, err := network.RunUntilConverged(30)
+	if err != nil {
+		t.Fatalf("not converged after %d cycles: %v", cycles, err)
+	}
+}
+
+func TestAddNodeWithOptions(t *testing.T) {
+	network := newTestNetwork(t, "a", "b")
+	thisNode, err := network.AddNodeWithOptions("c", "203.0.113.3", func(options *godddns.RouterOptions) {
+		options.RequireChallengeJoin = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !thisNode.Router.Options.RequireChallengeJoin || thisNode.Router.Options.Clock != network.Clock {
+		t.Error("router options not changed or network defaults lost")
+	}
+	if err := network.ConnectAll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := network.RunUntilConverged(5); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClockTicker(t *testing.T) {
+	clock := NewClock(time.Unix(1700000000, 0))
+	ticker := clock.NewTicker(10 * time.Second)
+	clock.Advance(5 * time.Second)
+	select {
+	case <-ticker.Chan():
+		t.Fatal("ticker fired before its interval")
+	default:
+	}
+
+	clock.Advance(5 * time.Second)
+	select {
+	case tick := <-ticker.Chan():
+		if tick.Unix() != 1700000010 {
+			t.Errorf("tick at %d, expected 1700000010", tick.Unix())
+		}
+	default:
+		t.Fatal("ticker not fired after its interval")
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.Chan():
+		t.Error("stopped ticker fired")
+	default:
+	}
+}
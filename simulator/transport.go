@@ -0,0 +1,97 @@
+package simulator
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	godddns "github.com/tobychui/go-DDDNS/godddns"
+)
+
+/*
+	Transport.go
+
+	The transport of the simulated routers. Packets are delivered directly
+	to the HandlePacket function of the router that currently owns the
+	destination address, as long as the link between the two nodes is
+	not partitioned and the packet is not dropped
+*/
+
+var (
+	ErrNodeOffline     = errors.New("simulated node is offline")
+	ErrHostUnreachable = errors.New("no simulated node is listening on the given address")
+	ErrLinkPartition   = errors.New("link between the simulated nodes is partitioned")
+	ErrPacketDropped   = errors.New("packet dropped by the simulated network")
+)
+
+type networkTransport struct {
+	network  *Network
+	fromUUID string
+}
+
+func (t *networkTransport) Connect(endpoint *godddns.Endpoint, payload []byte) (*godddns.TransportResponse, error) {
+	return t.network.deliver(t.fromUUID, endpoint, "c", payload)
+}
+
+func (t *networkTransport) HeartBeat(endpoint *godddns.Endpoint, payload []byte) (*godddns.TransportResponse, error) {
+	return t.network.deliver(t.fromUUID, endpoint, "h", payload)
+}
+
+func (t *networkTransport) Sync(endpoint *godddns.Endpoint, payload []byte) (*godddns.TransportResponse, error) {
+	return t.network.deliver(t.fromUUID, endpoint, "s", payload)
+}
+
+func (t *networkTransport) Send(endpoint *godddns.Endpoint, opr string, payload []byte) (*godddns.TransportResponse, error) {
+	return t.network.deliver(t.fromUUID, endpoint, opr, payload)
+}
+
+//deliver route the packet from the source node to the node listening on the endpoint
+func (n *Network) deliver(fromUUID string, endpoint *godddns.Endpoint, opr string, payload []byte) (*godddns.TransportResponse, error) {
+	n.mux.Lock()
+	source, ok := n.nodes[fromUUID]
+	if !ok || !source.online {
+		n.stats.Failed++
+		n.mux.Unlock()
+		return nil, ErrNodeOffline
+	}
+
+	//Find the node that owns the destination address
+	var target *SimNode
+	for _, uuid := range n.order {
+		thisNode := n.nodes[uuid]
+		if thisNode.online && thisNode.Port == endpoint.Port && thisNode.ip.String() == endpoint.Host {
+			target = thisNode
+			break
+		}
+	}
+
+	if target == nil {
+		n.stats.Failed++
+		n.mux.Unlock()
+		return nil, ErrHostUnreachable
+	}
+
+	if n.partitions[newLinkKey(source.UUID, target.UUID)] {
+		n.stats.Failed++
+		n.mux.Unlock()
+		return nil, ErrLinkPartition
+	}
+
+	if n.dropRate > 0 && n.rand.Float64() < n.dropRate {
+		n.stats.Dropped++
+		n.mux.Unlock()
+		return nil, ErrPacketDropped
+	}
+
+	//Every packet leaves the source from a new ephemeral port
+	n.ephemeralPort++
+	if n.ephemeralPort > 65535 {
+		n.ephemeralPort = 49152
+	}
+	remoteAddr := net.JoinHostPort(source.ip.String(), strconv.Itoa(n.ephemeralPort))
+	targetRouter := target.Router
+	n.stats.Delivered++
+	n.mux.Unlock()
+
+	return targetRouter.HandlePacket(opr, remoteAddr, payload), nil
+}